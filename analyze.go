@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// analyzeCommand runs the exposure and, if demographics are given,
+// contribution analyses of total final demand for several years through
+// Analyzer, writing a table of each with a row per year.
+func analyzeCommand(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	var yearList stringList
+	fs.Var(&yearList, "year", "analysis year; may be repeated (default the configured year)")
+	demKeys := fs.String("demographics", "", "comma-separated demograph keys or groups whose contributions to analyze; CES income deciles are only available for 2014-2015")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	concurrency := fs.Int("concurrency", 1, "number of years to analyze at once")
+	dir := fs.String("o", ".", "output directory")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s analyze [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	years := []Year{defaultYear()}
+	if len(yearList) > 0 {
+		years = years[:0]
+		for _, v := range yearList {
+			var y Year
+			if err := y.Set(v); err != nil {
+				return err
+			}
+			years = append(years, y)
+		}
+	}
+	var dems []*eieiorpc.Demograph
+	if *demKeys != "" {
+		for _, key := range strings.Split(*demKeys, ",") {
+			d, err := parseDemographs(strings.TrimSpace(key))
+			if err != nil {
+				return err
+			}
+			dems = append(dems, d...)
+		}
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return errors.Wrap(err, "creating output directory")
+	}
+	a := NewAnalyzer(s, WithYears(years...), WithAQM(*aqm), WithConcurrency(*concurrency),
+		WithProgress(func(p Progress) {
+			done := Year(p.Year).String()
+			if p.Demographic != "" {
+				done += " " + p.Demographic
+			}
+			log.Printf("%s: finished %s (%.0f%%)", p.Stage, done, p.Percent)
+		}))
+	ctx := context.Background()
+
+	exposure, err := a.ExposureResults(ctx)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, r := range exposure {
+		for _, pop := range r.Populations() {
+			rows = append(rows, []string{Year(r.Year).String(), pop, labels.get(pop), formatFloat(r.Exposure[pop]), formatFloat(suppression.count(r.People[pop]))})
+		}
+	}
+	path := filepath.Join(*dir, "exposure_by_year.csv")
+	if err := writeCSV(path, []string{"Year", "Population", "Label", "Exposure", "People"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(path, "exposure_by_year.csv"); err != nil {
+		return err
+	}
+	log.Printf("Wrote exposure for %d years to %s", len(years), path)
+
+	if len(dems) == 0 {
+		return nil
+	}
+	contribution, err := a.Contribution(ctx, dems)
+	if err != nil {
+		return err
+	}
+	rows = rows[:0]
+	for _, y := range years {
+		for i, dem := range dems {
+			rows = append(rows, []string{y.String(), demographKey(dem), labels.demograph(dem), formatFloat(contribution[int32(y)][i])})
+		}
+	}
+	path = filepath.Join(*dir, "contribution_by_year.csv")
+	if err := writeCSV(path, []string{"Year", "Demographic", "Label", "Emissions"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(path, "contribution_by_year.csv"); err != nil {
+		return err
+	}
+	log.Printf("Wrote the contributions of %d demographics for %d years to %s", len(dems), len(years), path)
+	return nil
+}
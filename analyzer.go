@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+)
+
+// Analyzer runs exposure and contribution analyses over one or more years.
+// It is the entry point intended for use by other programs, so its
+// settings are given as options to NewAnalyzer rather than as positional
+// parameters, which allows settings to be added without breaking callers.
+type Analyzer struct {
+	s           *eieio.Server
+	years       []int32
+	aqm         string
+	cache       bool
+	concurrency int
+	progress    func(Progress)
+
+	mx      sync.Mutex
+	results map[string]interface{}
+}
+
+// AnalyzerOption configures an Analyzer.
+type AnalyzerOption func(*Analyzer)
+
+// WithYears sets the years to analyze. The default is defaultYear.
+func WithYears(years ...Year) AnalyzerOption {
+	return func(a *Analyzer) {
+		a.years = make([]int32, len(years))
+		for i, y := range years {
+			a.years[i] = int32(y)
+		}
+	}
+}
+
+// WithAQM sets the air quality model. The default is "isrm".
+func WithAQM(aqm string) AnalyzerOption {
+	return func(a *Analyzer) { a.aqm = aqm }
+}
+
+// WithCache sets whether results are kept in memory so that repeated
+// analyses are not recalculated. The default is false.
+func WithCache(cache bool) AnalyzerOption {
+	return func(a *Analyzer) { a.cache = cache }
+}
+
+// WithConcurrency sets the number of years to analyze at once. The default
+// is 1.
+func WithConcurrency(n int) AnalyzerOption {
+	return func(a *Analyzer) { a.concurrency = n }
+}
+
+// WithProgress sets a function to be called with progress events during
+// analyses, e.g. to update a progress bar. Calls are never concurrent, but
+// f should return quickly. To receive events on a channel, use
+// WithProgress(func(p Progress) { ch <- p }).
+func WithProgress(f func(Progress)) AnalyzerOption {
+	return func(a *Analyzer) {
+		var mx sync.Mutex
+		a.progress = func(p Progress) {
+			mx.Lock()
+			f(p)
+			mx.Unlock()
+		}
+	}
+}
+
+// NewAnalyzer returns an Analyzer that uses s, configured by opts.
+func NewAnalyzer(s *eieio.Server, opts ...AnalyzerOption) *Analyzer {
+	a := &Analyzer{
+		s:           s,
+		years:       []int32{int32(defaultYear())},
+		aqm:         "isrm",
+		concurrency: 1,
+		results:     make(map[string]interface{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.concurrency < 1 {
+		a.concurrency = 1
+	}
+	return a
+}
+
+// forEachYear calls f for each of the analyzer's years, running up to
+// a.concurrency calls at once, and returns the first error. Progress in
+// stage is reported as each year finishes.
+func (a *Analyzer) forEachYear(ctx context.Context, stage string, f func(ctx context.Context, year int32) error) error {
+	for _, year := range a.years {
+		if err := Year(year).validate(ctx, a.s); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if a.progress != nil {
+		ctx = withProgress(ctx, a.progress)
+	}
+	var done int
+	var doneMx sync.Mutex
+	sem := make(chan struct{}, a.concurrency)
+	errs := make(chan error, len(a.years))
+	var wg sync.WaitGroup
+	for _, year := range a.years {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(year int32) {
+			defer func() { <-sem; wg.Done() }()
+			if err := f(ctx, year); err != nil {
+				errs <- errors.Wrapf(err, "year %d", year)
+				cancel()
+				return
+			}
+			doneMx.Lock()
+			done++
+			percent := 100 * float64(done) / float64(len(a.years))
+			doneMx.Unlock()
+			reportProgress(ctx, Progress{Stage: stage, Year: year, Percent: percent})
+		}(year)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// cached returns the result stored under key if caching is enabled,
+// otherwise calculating it with f.
+func (a *Analyzer) cached(key string, f func() (interface{}, error)) (interface{}, error) {
+	if a.cache {
+		a.mx.Lock()
+		r, ok := a.results[key]
+		a.mx.Unlock()
+		if ok {
+			return r, nil
+		}
+	}
+	r, err := f()
+	if err != nil {
+		return nil, err
+	}
+	if a.cache {
+		a.mx.Lock()
+		a.results[key] = r
+		a.mx.Unlock()
+	}
+	return r, nil
+}
+
+// Exposure returns population-weighted PM2.5 exposure (people·μg/m³) by
+// census population caused by total final demand, by year.
+func (a *Analyzer) Exposure(ctx context.Context) (map[int32]map[string]float64, error) {
+	result := make(map[int32]map[string]float64)
+	var mx sync.Mutex
+	err := a.forEachYear(ctx, "exposure", func(ctx context.Context, year int32) error {
+		r, err := a.cached(fmt.Sprintf("exposure/%s/%d", a.aqm, year), func() (interface{}, error) {
+			done := timeRPC(ctx, "FinalDemand")
+			demand, err := a.s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+				FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+				Year:            year,
+				Location:        LOC,
+			})
+			done(&err)
+			if err != nil {
+				return nil, errors.Wrap(err, "error getting final demand")
+			}
+			exposure, err := getExposureByPopulation(ctx, a.s, year, LOC, a.aqm, demand, nil)
+			if err != nil {
+				return nil, err
+			}
+			return *exposure, nil
+		})
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		result[year] = r.(map[string]float64)
+		mx.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Contribution returns the population-adjusted PM2.5 emissions (kg/year)
+// attributable to each of dems, in order, by year.
+func (a *Analyzer) Contribution(ctx context.Context, dems []*eieiorpc.Demograph) (map[int32][]float64, error) {
+	keys := make([]string, len(dems))
+	for i, dem := range dems {
+		keys[i] = demographKey(dem)
+	}
+	result := make(map[int32][]float64)
+	var mx sync.Mutex
+	err := a.forEachYear(ctx, "contribution", func(ctx context.Context, year int32) error {
+		key := fmt.Sprintf("contribution/%s/%d/%s", a.aqm, year, strings.Join(keys, ","))
+		r, err := a.cached(key, func() (interface{}, error) {
+			return getContributionByDemograph(ctx, a.s, dems, year, LOC, a.aqm, nil)
+		})
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		result[year] = r.([]float64)
+		mx.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ExposureResults is Exposure with a result for each of the analyzer's
+// years, in order, with the count of each population.
+func (a *Analyzer) ExposureResults(ctx context.Context) ([]*ExposureResult, error) {
+	byYear, err := a.Exposure(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := getGridID(a.s, a.aqm)
+	if err != nil {
+		return nil, err
+	}
+	people, err := populationCounts(ctx, a.s, a.aqm, id.Cells)
+	if err != nil {
+		return nil, errors.Wrap(err, "error counting populations")
+	}
+	results := make([]*ExposureResult, 0, len(byYear))
+	for _, year := range a.years {
+		results = append(results, &ExposureResult{Year: year, AQM: a.aqm, Exposure: byYear[year], People: people})
+	}
+	return results, nil
+}
+
+// ContributionMatrices returns the population-adjusted PM2.5 emissions
+// (kg/year) attributable to each of dems by SCC, for each of the
+// analyzer's years in order. The totals of each demographic are those of Contribution.
+func (a *Analyzer) ContributionMatrices(ctx context.Context, dems []*eieiorpc.Demograph) ([]*ContributionMatrix, error) {
+	keys := make([]string, len(dems))
+	for i, dem := range dems {
+		keys[i] = demographKey(dem)
+	}
+	result := make(map[int32]*ContributionMatrix)
+	var mx sync.Mutex
+	err := a.forEachYear(ctx, "contribution", func(ctx context.Context, year int32) error {
+		key := fmt.Sprintf("contributionMatrix/%s/%d/%s", a.aqm, year, strings.Join(keys, ","))
+		r, err := a.cached(key, func() (interface{}, error) {
+			return contributionMatrix(ctx, a.s, dems, year, LOC, a.aqm, nil)
+		})
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		result[year] = r.(*ContributionMatrix)
+		mx.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	matrices := make([]*ContributionMatrix, len(a.years))
+	for i, year := range a.years {
+		matrices[i] = result[year]
+	}
+	return matrices, nil
+}
+
+// Progress is an event reporting progress through an analysis.
+type Progress struct {
+	// Stage is the part of the analysis in progress, e.g. "exposure",
+	// "contribution" or "emissions by demographic".
+	Stage string
+
+	// Year and Demographic (a demograph key) are those just finished, if
+	// applicable to the stage.
+	Year        int32
+	Demographic string
+
+	// Percent is the percentage of the stage that is complete.
+	Percent float64
+}
+
+type progressKey struct{}
+
+// withProgress returns a context in which progress events are passed to f.
+func withProgress(ctx context.Context, f func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+// reportProgress passes p to the progress function in ctx, if any.
+func reportProgress(ctx context.Context, p Progress) {
+	status.recordProgress(p)
+	if f, ok := ctx.Value(progressKey{}).(func(Progress)); ok {
+		f(p)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API key roles. Viewers may only read (GET and HEAD), analysts may also
+// submit jobs, and admins may also see the usage of every key at
+// /admin/usage.
+const (
+	roleViewer  = "viewer"
+	roleAnalyst = "analyst"
+	roleAdmin   = "admin"
+)
+
+// apiKeyConfig is an API key of the server commands, in the
+// [Sandbox.APIKeys] table of the config, keyed by the name of its holder.
+type apiKeyConfig struct {
+	// Key is the secret, sent as "Authorization: Bearer KEY" or in the
+	// X-API-Key header. It may reference environment variables, e.g.
+	// "${ALICE_API_KEY}".
+	Key string
+
+	// Role is viewer, analyst or admin; see roleViewer. Defaults to
+	// analyst.
+	Role string
+
+	// RequestsPerMinute limits the key's requests, or 0 for no limit.
+	RequestsPerMinute int
+
+	// ComputeMinutesPerDay limits the time spent answering the key's
+	// requests and running its jobs each day (UTC), or 0 for no limit.
+	ComputeMinutesPerDay float64
+}
+
+// apiKey is an API key and its usage since the server started.
+type apiKey struct {
+	name string
+	cfg  apiKeyConfig
+
+	mx          sync.Mutex
+	requests    int
+	rateLimited int
+	windowStart time.Time // start of the current rate limit minute
+	window      int       // requests in the current minute
+	compute     time.Duration
+	day         string // the UTC day of today
+	today       time.Duration
+	lastUsed    time.Time
+}
+
+// apiKeyUsage is the usage of an API key, as listed at /admin/usage.
+type apiKeyUsage struct {
+	Name                 string
+	Role                 string
+	Requests             int
+	RateLimited          int
+	ComputeMinutes       float64
+	ComputeMinutesToday  float64
+	ComputeMinutesPerDay float64    `json:",omitempty"`
+	RequestsPerMinute    int        `json:",omitempty"`
+	LastUsed             *time.Time `json:",omitempty"`
+}
+
+// apiKeys authenticates the requests to a server by API key, enforcing
+// roles, rate limits and compute quotas, and tracks each key's usage.
+type apiKeys struct {
+	byHash map[[sha256.Size]byte]*apiKey
+	keys   []*apiKey
+}
+
+// newAPIKeys returns the keys configured in cfg, or nil if there are none.
+func newAPIKeys(cfg map[string]apiKeyConfig) (*apiKeys, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	a := &apiKeys{byHash: make(map[[sha256.Size]byte]*apiKey)}
+	for _, name := range names {
+		c := cfg[name]
+		c.Key = os.ExpandEnv(c.Key)
+		if c.Key == "" {
+			return nil, errorf(kindConfig, "API key %s has no Key", name)
+		}
+		switch c.Role {
+		case "":
+			c.Role = roleAnalyst
+		case roleViewer, roleAnalyst, roleAdmin:
+		default:
+			return nil, errorf(kindConfig, "API key %s has invalid Role %q; must be %s, %s or %s", name, c.Role, roleViewer, roleAnalyst, roleAdmin)
+		}
+		if c.RequestsPerMinute < 0 || c.ComputeMinutesPerDay < 0 {
+			return nil, errorf(kindConfig, "API key %s has a negative limit", name)
+		}
+		h := sha256.Sum256([]byte(c.Key))
+		if _, ok := a.byHash[h]; ok {
+			return nil, errorf(kindConfig, "API key %s has the same Key as another", name)
+		}
+		k := &apiKey{name: name, cfg: c}
+		a.byHash[h] = k
+		a.keys = append(a.keys, k)
+	}
+	return a, nil
+}
+
+// loadAPIKeys returns the API keys in the config, or nil if there are none.
+func loadAPIKeys() (*apiKeys, error) {
+	cfg, _, err := readConfig()
+	if err != nil {
+		return nil, withKind(kindConfig, err)
+	}
+	return newAPIKeys(cfg.Sandbox.APIKeys)
+}
+
+// requestKey returns the API key sent with r.
+func requestKey(r *http.Request) string {
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(v, "Bearer "))
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// wrap returns h, only serving requests with a key of a that is allowed
+// them and recording the time spent answering them. It also serves the
+// usage of each key to admins at /admin/usage.
+func (a *apiKeys) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k, ok := a.byHash[sha256.Sum256([]byte(requestKey(r)))]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if wait := k.allow(time.Now()); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+			http.Error(w, fmt.Sprintf("rate limit of %d requests per minute exceeded", k.cfg.RequestsPerMinute), http.StatusTooManyRequests)
+			return
+		}
+		switch {
+		case r.URL.Path == "/admin/usage":
+			if k.cfg.Role != roleAdmin {
+				http.Error(w, "usage is only available to admin keys", http.StatusForbidden)
+				return
+			}
+			writeJSON(w, http.StatusOK, a.usage(time.Now()))
+			return
+		case k.cfg.Role == roleViewer && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			http.Error(w, "viewer keys may only read", http.StatusForbidden)
+			return
+		}
+		// Polling for and downloading the results of jobs is allowed
+		// over quota, so that the work already charged isn't lost.
+		pollingJobs := strings.HasPrefix(r.URL.Path, "/jobs") && r.Method != http.MethodPost
+		if used, over := k.overQuota(time.Now()); over && !pollingJobs {
+			http.Error(w, fmt.Sprintf("daily compute quota of %g minutes is used up (%.3g minutes today); try again tomorrow (UTC)", k.cfg.ComputeMinutesPerDay, used), http.StatusTooManyRequests)
+			return
+		}
+		start := time.Now()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+		k.charge(start, time.Now())
+	})
+}
+
+// allow records a request with k at now, returning how long to wait
+// before retrying if it exceeds k's rate limit.
+func (k *apiKey) allow(now time.Time) time.Duration {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.requests++
+	k.lastUsed = now
+	if k.cfg.RequestsPerMinute == 0 {
+		return 0
+	}
+	if now.Sub(k.windowStart) >= time.Minute {
+		k.windowStart, k.window = now, 0
+	}
+	if k.window >= k.cfg.RequestsPerMinute {
+		k.rateLimited++
+		return k.windowStart.Add(time.Minute).Sub(now)
+	}
+	k.window++
+	return 0
+}
+
+// overQuota returns the compute minutes k has used on the day of now and
+// whether they reach its quota.
+func (k *apiKey) overQuota(now time.Time) (float64, bool) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.rollDay(now)
+	used := k.today.Minutes()
+	return used, k.cfg.ComputeMinutesPerDay > 0 && used >= k.cfg.ComputeMinutesPerDay
+}
+
+// charge adds the compute time from start to end to k's usage, counting
+// it towards the quota of the day it ends. k.mx must not be held.
+func (k *apiKey) charge(start, end time.Time) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.rollDay(end)
+	k.compute += end.Sub(start)
+	k.today += end.Sub(start)
+}
+
+// rollDay resets the compute time of the day if now is on a later day.
+// k.mx must be held.
+func (k *apiKey) rollDay(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); day != k.day {
+		k.day, k.today = day, 0
+	}
+}
+
+// usage returns the usage of each key at now, by name.
+func (a *apiKeys) usage(now time.Time) []apiKeyUsage {
+	var u []apiKeyUsage
+	for _, k := range a.keys {
+		k.mx.Lock()
+		k.rollDay(now)
+		ku := apiKeyUsage{Name: k.name, Role: k.cfg.Role, Requests: k.requests, RateLimited: k.rateLimited,
+			ComputeMinutes: k.compute.Minutes(), ComputeMinutesToday: k.today.Minutes(),
+			ComputeMinutesPerDay: k.cfg.ComputeMinutesPerDay, RequestsPerMinute: k.cfg.RequestsPerMinute}
+		if !k.lastUsed.IsZero() {
+			t := k.lastUsed
+			ku.LastUsed = &t
+		}
+		k.mx.Unlock()
+		u = append(u, ku)
+	}
+	return u
+}
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey returns the API key of a request's context ctx, such as
+// to charge it for the jobs the request starts, or nil if the server
+// doesn't use API keys.
+func requestAPIKey(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
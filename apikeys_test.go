@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAPIKeyAllow checks that a key's rate limit allows RequestsPerMinute
+// requests in each minute from the first, and says how long to wait for
+// the next minute when it is exceeded.
+func TestAPIKeyAllow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	k := &apiKey{cfg: apiKeyConfig{RequestsPerMinute: 2}}
+	for _, test := range []struct {
+		at   time.Duration // since start
+		wait time.Duration
+	}{
+		{0, 0},
+		{10 * time.Second, 0},
+		{20 * time.Second, 40 * time.Second},
+		{59 * time.Second, time.Second},
+		{time.Minute, 0}, // a new minute
+		{time.Minute + time.Second, 0},
+		{time.Minute + 2*time.Second, 58 * time.Second},
+		{5 * time.Minute, 0},
+	} {
+		if wait := k.allow(start.Add(test.at)); wait != test.wait {
+			t.Errorf("at %s: got wait %s, want %s", test.at, wait, test.wait)
+		}
+	}
+	if k.requests != 8 || k.rateLimited != 3 {
+		t.Errorf("got %d requests and %d rate limited, want 8 and 3", k.requests, k.rateLimited)
+	}
+
+	unlimited := &apiKey{}
+	for i := 0; i < 1000; i++ {
+		if wait := unlimited.allow(start); wait != 0 {
+			t.Fatalf("without a limit: request %d got wait %s", i, wait)
+		}
+	}
+}
+
+func TestAPIKeyOverQuota(t *testing.T) {
+	day := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	k := &apiKey{cfg: apiKeyConfig{ComputeMinutesPerDay: 10}}
+	k.charge(day, day.Add(6*time.Minute))
+	if used, over := k.overQuota(day); used != 6 || over {
+		t.Errorf("after 6 minutes: got %g, %v, want 6 minutes under quota", used, over)
+	}
+	k.charge(day, day.Add(4*time.Minute))
+	if used, over := k.overQuota(day); used != 10 || !over {
+		t.Errorf("after 10 minutes: got %g, %v, want 10 minutes over quota", used, over)
+	}
+	// The quota is reset on the next UTC day, but not the total.
+	if used, over := k.overQuota(day.Add(2 * time.Hour)); used != 0 || over {
+		t.Errorf("the next day: got %g, %v, want 0 minutes under quota", used, over)
+	}
+	if k.compute != 10*time.Minute {
+		t.Errorf("got total compute %s, want 10m", k.compute)
+	}
+}
+
+func TestNewAPIKeys(t *testing.T) {
+	if keys, err := newAPIKeys(nil); keys != nil || err != nil {
+		t.Errorf("no keys: got %v, %v, want nil", keys, err)
+	}
+	for name, cfg := range map[string]map[string]apiKeyConfig{
+		"no key":        {"alice": {}},
+		"invalid role":  {"alice": {Key: "a", Role: "owner"}},
+		"negative rate": {"alice": {Key: "a", RequestsPerMinute: -1}},
+		"same key":      {"alice": {Key: "a"}, "bob": {Key: "a"}},
+	} {
+		if _, err := newAPIKeys(cfg); kindOf(err) != kindConfig {
+			t.Errorf("%s: got error %v, want a config error", name, err)
+		}
+	}
+	keys, err := newAPIKeys(map[string]apiKeyConfig{"alice": {Key: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role := keys.keys[0].cfg.Role; role != roleAnalyst {
+		t.Errorf("got default role %q, want %q", role, roleAnalyst)
+	}
+}
+
+// TestAPIKeysWrap checks the responses to requests without a key, over a
+// key's limits and beyond its role.
+func TestAPIKeysWrap(t *testing.T) {
+	keys, err := newAPIKeys(map[string]apiKeyConfig{
+		"viewer":  {Key: "v", Role: roleViewer},
+		"analyst": {Key: "a", RequestsPerMinute: 1},
+		"admin":   {Key: "x", Role: roleAdmin, ComputeMinutesPerDay: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := keys.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestAPIKey(r.Context()) == nil {
+			t.Error("the request's key isn't in its context")
+		}
+	}))
+	keys.byHash[sha256.Sum256([]byte("x"))].charge(time.Now().Add(-time.Minute), time.Now())
+	for _, test := range []struct {
+		method, path, key string
+		want              int
+	}{
+		{http.MethodGet, "/", "", http.StatusUnauthorized},
+		{http.MethodGet, "/", "unknown", http.StatusUnauthorized},
+		{http.MethodGet, "/", "v", http.StatusOK},
+		{http.MethodPost, "/jobs", "v", http.StatusForbidden},
+		{http.MethodGet, "/admin/usage", "v", http.StatusForbidden},
+		{http.MethodPost, "/jobs", "a", http.StatusOK},
+		{http.MethodGet, "/", "a", http.StatusTooManyRequests}, // over the rate limit
+		{http.MethodGet, "/admin/usage", "x", http.StatusOK},
+		{http.MethodGet, "/", "x", http.StatusTooManyRequests}, // over quota
+		{http.MethodGet, "/jobs/1", "x", http.StatusOK},        // polling jobs over quota
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.key != "" {
+			r.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s with key %q: got %d, want %d", test.method, test.path, test.key, w.Code, test.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", "v")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("with X-API-Key: got %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"gonum.org/v1/gonum/mat"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// arrowStreamType is the media type of an Arrow IPC stream.
+const arrowStreamType = "application/vnd.apache.arrow.stream"
+
+// arrowMatrices serves grid×SCC matrices as Arrow IPC streams. Matrices
+// are named "emissions/<Emission>" (kg/year) or
+// "concentrations/<Pollutant>" (μg/m³), e.g. "emissions/PM25". Each
+// matrix is a single record batch with a row for each grid cell (or each
+// subdomain cell, if a subdomain is configured) and a float64 column for
+// each SCC, or consecutive batches of rows if it doesn't otherwise fit
+// within -max-memory. They are served over HTTP and, by flightService,
+// over Arrow Flight.
+type arrowMatrices struct {
+	pool  *serverPool
+	cache *responseCache
+	year  int32
+	aqm   string
+}
+
+// names returns the names of all available matrices.
+func (a *arrowMatrices) names() []string {
+	var n []string
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		n = append(n, "emissions/"+eieiorpc.Emission(val).String())
+	}
+	for val := 0; val < len(eieiorpc.Pollutant_name); val++ {
+		n = append(n, "concentrations/"+eieiorpc.Pollutant(val).String())
+	}
+	return n
+}
+
+// matrix calculates the named matrix, caused by total final demand.
+func (a *arrowMatrices) matrix(ctx context.Context, s *eieio.Server, name string) (*mat.Dense, error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid matrix %q", name)
+	}
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            a.year,
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting final demand")
+	}
+	var full *mat.Dense
+	switch parts[0] {
+	case "emissions":
+		pol, ok := eieiorpc.Emission_value[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("invalid emission %q", parts[1])
+		}
+		if full, err = emissionsMatrix(ctx, s, &eieiorpc.EmissionsMatrixInput{
+			Demand:   demand,
+			Emission: eieiorpc.Emission(pol),
+			Year:     a.year,
+			Location: LOC,
+			AQM:      a.aqm,
+		}); err != nil {
+			return nil, err
+		}
+		if err := filterSCCColumns(s, full); err != nil {
+			return nil, err
+		}
+	case "concentrations":
+		pol, ok := eieiorpc.Pollutant_value[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("invalid pollutant %q", parts[1])
+		}
+		if full, err = concentrationMatrix(ctx, s, &eieiorpc.ConcentrationMatrixInput{
+			Demand:    demand,
+			Pollutant: eieiorpc.Pollutant(pol),
+			Year:      a.year,
+			Location:  LOC,
+			AQM:       a.aqm,
+		}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid matrix %q", name)
+	}
+	d, err := getSubdomain(s, a.aqm)
+	if err != nil || d == nil {
+		return full, err
+	}
+	_, cols := full.Dims()
+	if err := reserveMemory("the subdomain cells of matrix "+name, matrixBytes(len(d.Cells), cols)); err != nil {
+		return nil, err
+	}
+	sub := mat.NewDense(len(d.Cells), cols, nil)
+	for i, c := range d.Cells {
+		sub.SetRow(i, full.RawRowView(c))
+	}
+	return sub, nil
+}
+
+// schema returns the schema of the record batches of a matrix, with a
+// column for each SCC.
+func (a *arrowMatrices) schema(s *eieio.Server) *arrow.Schema {
+	fields := make([]arrow.Field, len(s.SCCs))
+	for i, scc := range s.SCCs {
+		fields[i] = arrow.Field{Name: string(scc), Type: arrow.PrimitiveTypes.Float64}
+	}
+	return arrow.NewSchema(fields, nil)
+}
+
+// record converts m to an Arrow record batch with the given schema.
+// Column buffers are built directly from the column data without copying
+// through an Arrow builder.
+func (a *arrowMatrices) record(schema *arrow.Schema, m mat.Matrix) array.Record {
+	rows, cols := m.Dims()
+	arrays := make([]array.Interface, cols)
+	for j := 0; j < cols; j++ {
+		col := mat.Col(nil, j, m)
+		buf := memory.NewBufferBytes(arrow.Float64Traits.CastToBytes(col))
+		data := array.NewData(arrow.PrimitiveTypes.Float64, rows, []*memory.Buffer{nil, buf}, nil, 0, 0)
+		arrays[j] = array.NewFloat64Data(data)
+		data.Release()
+	}
+	return array.NewRecord(schema, arrays, int64(rows))
+}
+
+// writeStream writes m to w as an Arrow IPC stream: a single record batch
+// if a copy of m fits within maxMemory along with the stream, and
+// otherwise batches of as many rows as fit.
+func (a *arrowMatrices) writeStream(w io.Writer, s *eieio.Server, m *mat.Dense) error {
+	rows, cols := m.Dims()
+	batch := rows
+	if !fitsMemory(3 * matrixBytes(rows, cols)) {
+		// The stream and, for each batch, its columns and their encoding.
+		free := memoryAvailable() - matrixBytes(rows, cols)
+		batch = int(free / (2 * matrixBytes(1, cols)))
+		if batch < 1 {
+			return reserveMemory(fmt.Sprintf("streaming a %d×%d matrix", rows, cols), matrixBytes(rows+2, cols))
+		}
+		log.Printf("Arrow: writing %d×%d matrix in batches of %d rows to stay within -max-memory %s", rows, cols, batch, &maxMemory)
+	}
+	schema := a.schema(s)
+	aw := ipc.NewWriter(w, ipc.WithSchema(schema))
+	for start := 0; start < rows; start += batch {
+		end := start + batch
+		if end > rows {
+			end = rows
+		}
+		rec := a.record(schema, m.Slice(start, end, 0, cols))
+		err := aw.Write(rec)
+		rec.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// cacheKey returns the key of the named matrix in the response cache.
+func (a *arrowMatrices) cacheKey(name string) string {
+	key := fmt.Sprintf("%s?year=%d&aqm=%s", name, a.year, a.aqm)
+	if f := sccFilterSetting(); f != "none" {
+		key += "&scc=" + f
+	}
+	return key
+}
+
+// stream returns the Arrow IPC stream of the named matrix, calculating it
+// if it isn't cached.
+func (a *arrowMatrices) stream(ctx context.Context, name string) *cachedResponse {
+	return a.cache.get(a.cacheKey(name), func() ([]byte, error) {
+		log.Printf("Arrow: calculating %s", name)
+		var buf bytes.Buffer
+		err := a.pool.do(ctx, func(ctx context.Context, s *eieio.Server) error {
+			m, err := a.matrix(ctx, s, name)
+			if err != nil {
+				return err
+			}
+			return a.writeStream(&buf, s, m)
+		})
+		return buf.Bytes(), err
+	})
+}
+
+// ServeHTTP serves the list of matrices at / and each matrix at /<name>.
+func (a *arrowMatrices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.names())
+		return
+	}
+	name = path.Clean(name)
+	ctx, span := startSpan(r.Context(), "arrow", attribute.String("matrix", name))
+	defer span.End()
+	resp := a.stream(ctx, name)
+	if resp.err == errServerBusy {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, resp.err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if resp.err != nil {
+		span.RecordError(resp.err)
+		http.Error(w, resp.err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Arrow: sending %s", name)
+	a.cache.serve(w, r, resp, arrowStreamType)
+}
+
+// arrowCommand serves the grid×SCC matrices as Arrow IPC streams over
+// HTTP and over Arrow Flight; see arrowMatrices.
+func arrowCommand(args []string) error {
+	fs := flag.NewFlagSet("arrow", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8815", "address to serve HTTP on")
+	flightAddr := fs.String("flight-addr", "localhost:8816", "address to serve Arrow Flight on (empty to not serve Flight)")
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	parallelism := fs.Int("parallelism", 1, "number of matrices to calculate at once")
+	queue := fs.Int("queue", 16, "number of requests that can wait for a calculation before the server responds 503")
+	cacheMB := fs.Int("cache", 1024, "megabytes of responses to keep in memory for repeated requests")
+	maxAge := fs.Duration("max-age", time.Hour, "how long clients may reuse a response without revalidating it")
+	watch := fs.Duration("watch", 5*time.Second, "how often to check the config for changed [Sandbox.Server] settings (0 to not check)")
+	drain := fs.Duration("drain", 30*time.Second, "on SIGTERM, how long to wait for requests in progress to finish")
+	cacheDir := fs.String("cache-dir", "", "directory to save cached responses to on shutdown and load them from on startup")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s arrow [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	s, sandbox, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	flags := serverSettings{parallelism: *parallelism, queue: *queue, cacheMB: *cacheMB, maxAge: *maxAge}
+	st, err := sandbox.Server.resolve(fs, flags)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving Arrow streams on http://%s/", *addr)
+	pool := newServerPool(s, st.parallelism, st.queue)
+	cache := newResponseCache(st.cacheMB<<20, st.maxAge)
+	if *cacheDir != "" {
+		n, err := cache.load(*cacheDir)
+		if err != nil {
+			return errors.Wrapf(err, "loading cached responses from %s", *cacheDir)
+		}
+		log.Printf("Loaded %d cached responses from %s", n, *cacheDir)
+	}
+	watchConfig(*watch, func(cfg *config) {
+		next, err := cfg.Sandbox.Server.resolve(fs, flags)
+		if err != nil {
+			log.Printf("Ignoring changed server settings: %v", err)
+			return
+		}
+		if next == st {
+			return
+		}
+		st = next
+		pool.resize(st.parallelism, st.queue)
+		cache.setLimits(st.cacheMB<<20, st.maxAge)
+		log.Printf("Applied server settings: parallelism %d, queue %d, cache %d MB, max-age %s", st.parallelism, st.queue, st.cacheMB, st.maxAge)
+	})
+	h := &arrowMatrices{pool: pool, cache: cache, year: int32(*year), aqm: *aqm}
+	var fsrv flight.Server
+	if *flightAddr != "" {
+		keys, err := loadAPIKeys()
+		if err != nil {
+			return err
+		}
+		if fsrv, err = startFlight(*flightAddr, h, keys); err != nil {
+			return err
+		}
+		log.Printf("Serving Arrow Flight on grpc://%s", fsrv.Addr())
+	}
+	return serveUntilSignal(*addr, h, *drain, func() error {
+		if fsrv != nil {
+			stopFlight(fsrv, *drain)
+		}
+		if *cacheDir == "" {
+			return nil
+		}
+		n, err := cache.save(*cacheDir)
+		if err != nil {
+			return errors.Wrapf(err, "saving cached responses to %s", *cacheDir)
+		}
+		log.Printf("Saved %d cached responses to %s", n, *cacheDir)
+		return nil
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// Areas of grid cells by NAAQS attainment status.
+const (
+	areaAttainment    = "Attainment"
+	areaNonattainment = "Nonattainment"
+)
+
+// nonattainmentConfig is the Nonattainment setting in the [Sandbox] config
+// table: the polygons of the NAAQS nonattainment areas, such as those of
+// the EPA Green Book for the 2012 annual PM2.5 standard.
+var nonattainmentConfig regionConfig
+
+// attainmentHeader is the header of exposure_by_attainment.csv.
+var attainmentHeader = []string{"Population", "Label", "Area", "Cells", "People", "Exposure", "MeanConcentration"}
+
+// attainmentMasks returns, by area, whether each cell of the aqm grid is in
+// it. Cells whose centroids are within the nonattainment polygons are in
+// nonattainment, and all others in attainment.
+func attainmentMasks(s *eieio.Server, aqm string) (map[string][]bool, error) {
+	nonattainment, err := regionMask(s, nonattainmentConfig, aqm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading nonattainment areas")
+	}
+	attainment := make([]bool, len(nonattainment))
+	var n int
+	for i, in := range nonattainment {
+		attainment[i] = !in
+		if in {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, errorf(kindConfig, "no %s grid cells are within the nonattainment areas of %s", aqm, nonattainmentConfig.File)
+	}
+	return map[string][]bool{areaAttainment: attainment, areaNonattainment: nonattainment}, nil
+}
+
+// attainmentRows returns a row of attainmentHeader for each census
+// population and area: the population's exposure to the total PM2.5
+// concentrations caused by demand in the cells of the area, their number
+// and the number of people in them, and the population-weighted mean
+// concentration. Areas are restricted to the subdomain, if any.
+func attainmentRows(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, year int32, aqm string) ([][]string, error) {
+	ctx, span := startSpan(ctx, "attainmentRows")
+	defer span.End()
+	masks, err := attainmentMasks(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	conc, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(masks[areaAttainment]) != len(conc.Data) {
+		return nil, checkGrid(s, aqm, len(conc.Data), "concentrations")
+	}
+	var rows [][]string
+	for _, area := range []string{areaAttainment, areaNonattainment} {
+		exposure, people, cells, err := maskedExposure(ctx, s, aqm, conc.Data, masks[area])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s areas", strings.ToLower(area))
+		}
+		for _, pop := range sortedKeys(exposure) {
+			e, n := exposure[pop], suppression.count(people[pop])
+			rows = append(rows, []string{pop, labels.get(pop), area, strconv.Itoa(cells),
+				formatFloat(n), formatFloat(e), formatFloat(e / n)})
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// backgroundConfig specifies a background (e.g. natural) PM2.5
+// concentration that is subtracted from modeled concentrations before
+// exposure and health impacts are calculated, so that only concentrations
+// above it are counted.
+type backgroundConfig struct {
+	// Concentration is the background concentration (μg/m³) in grid cells
+	// without one in File.
+	Concentration float64
+
+	// File, if set, is the path to a CSV file with columns
+	// Cell,Concentration giving the background concentration in grid cells
+	// of the air quality model, by index.
+	File string
+}
+
+func (b backgroundConfig) empty() bool {
+	return b.Concentration == 0 && b.File == ""
+}
+
+// String describes b, for recording in results.
+func (b backgroundConfig) String() string {
+	if b.empty() {
+		return "none"
+	}
+	s := strconv.FormatFloat(b.Concentration, 'g', -1, 64)
+	if b.File != "" && b.Concentration != 0 {
+		return filepath.Base(b.File) + ", elsewhere " + s
+	} else if b.File != "" {
+		return filepath.Base(b.File)
+	}
+	return s
+}
+
+var (
+	// backgroundSetting is the Background setting in the [Sandbox] config
+	// table, used when ctx doesn't have one.
+	backgroundSetting backgroundConfig
+
+	backgroundFilesMx sync.Mutex
+	backgroundFiles   = make(map[string]map[int]float64)
+)
+
+// grid returns the background concentration in each of nCells grid cells,
+// or nil if b is empty. Files are cached by path.
+func (b backgroundConfig) grid(nCells int) ([]float64, error) {
+	if b.empty() {
+		return nil, nil
+	}
+	if b.Concentration < 0 {
+		return nil, errorf(kindConfig, "background concentration must not be negative, got %g", b.Concentration)
+	}
+	grid := make([]float64, nCells)
+	for i := range grid {
+		grid[i] = b.Concentration
+	}
+	if b.File == "" {
+		return grid, nil
+	}
+	path := os.ExpandEnv(b.File)
+	backgroundFilesMx.Lock()
+	cells, ok := backgroundFiles[path]
+	if !ok {
+		var err error
+		if cells, err = readBackgroundFile(path); err != nil {
+			backgroundFilesMx.Unlock()
+			return nil, withKind(kindConfig, fmt.Errorf("reading background concentrations: %v", err))
+		}
+		backgroundFiles[path] = cells
+	}
+	backgroundFilesMx.Unlock()
+	for cell, c := range cells {
+		if cell >= nCells {
+			return nil, errorf(kindNumeric, "background concentration for grid cell %d, but the grid has %d cells", cell, nCells)
+		}
+		grid[cell] = c
+	}
+	return grid, nil
+}
+
+// readBackgroundFile reads a CSV file with columns Cell,Concentration.
+func readBackgroundFile(path string) (map[int]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	cells := make(map[int]float64)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		cell, err := strconv.Atoi(strings.TrimSpace(rec[0]))
+		if err != nil || cell < 0 {
+			return nil, fmt.Errorf("invalid grid cell %q", rec[0])
+		}
+		c, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil || c < 0 {
+			return nil, fmt.Errorf("invalid concentration %q in cell %d", rec[1], cell)
+		}
+		cells[cell] = c
+	}
+	return cells, nil
+}
+
+type backgroundKey struct{}
+
+// withBackground returns a context in which b is subtracted from
+// concentrations.
+func withBackground(ctx context.Context, b backgroundConfig) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, b)
+}
+
+// backgroundFor returns the background concentration of ctx.
+func backgroundFor(ctx context.Context) backgroundConfig {
+	if b, ok := ctx.Value(backgroundKey{}).(backgroundConfig); ok {
+		return b
+	}
+	return backgroundSetting
+}
+
+// backgroundWeights returns the factor multiplying the health impacts (or
+// any other quantity linear in concentration) in each grid cell caused by
+// demand, to count only the PM2.5 concentration above the background of
+// ctx. It returns nil if there is no background.
+func backgroundWeights(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, year int32, aqm string) ([]float64, error) {
+	if backgroundFor(ctx).empty() {
+		return nil, nil
+	}
+	total, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	bg, err := backgroundFor(ctx).grid(len(total.Data))
+	if err != nil {
+		return nil, err
+	}
+	return linearExposure.cellWeights(total.Data, bg), nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchManifest lists the scenarios to be run by the batch command.
+type batchManifest struct {
+	// OutputDir is the directory where each scenario's output directory
+	// and the combined index.csv are written.
+	OutputDir string
+
+	// Parallel is the number of scenarios to run at once. Defaults to 1.
+	Parallel int
+
+	// Notify specifies where to send a summary when the batch finishes.
+	Notify notifyConfig
+
+	Scenario []scenario
+}
+
+// loadBatchManifest reads a TOML batch manifest from path.
+func loadBatchManifest(path string) (*batchManifest, error) {
+	var m batchManifest
+	if _, err := toml.DecodeFile(path, &m); err != nil {
+		return nil, err
+	}
+	m.OutputDir = os.ExpandEnv(m.OutputDir)
+	if m.OutputDir == "" {
+		return nil, fmt.Errorf("batch manifest must specify OutputDir")
+	}
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// check fills in the defaults of m and its scenarios and checks them.
+func (m *batchManifest) check() error {
+	if m.Parallel < 1 {
+		m.Parallel = 1
+	}
+	names := make(map[string]bool)
+	for i := range m.Scenario {
+		sc := &m.Scenario[i]
+		if sc.Name == "" {
+			return fmt.Errorf("scenario %d has no Name", i)
+		}
+		if names[sc.Name] {
+			return fmt.Errorf("duplicate scenario name %q", sc.Name)
+		}
+		names[sc.Name] = true
+		built, err := scenarioFrom(*sc).build("")
+		if err != nil {
+			return err
+		}
+		*sc = built
+	}
+	return nil
+}
+
+// batchCommand runs every scenario in a batch manifest, writing each to
+// its own directory and a combined index of the runs.
+func batchCommand(args []string) error {
+	if len(args) > 0 && args[0] == "k8s-manifest" {
+		return jobSpecCommand(args[1:])
+	}
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	parallel := fs.Int("parallel", 0, "number of scenarios to run at once (overrides the manifest)")
+	retryFailed := fs.Bool("retry-failed", false, "re-run scenarios that failed in a previous run")
+	incremental := fs.Bool("incremental", false, "reuse the results of unchanged demographics when re-running scenarios whose settings changed")
+	profile := fs.String("profile", "", "run the named analysis profile from the config instead of a manifest")
+	output := fs.String("output", "", "directory to write the scenarios to (overrides the manifest or profile)")
+	var sh shard
+	fs.Var(&sh, "shard", "run only shard i/N of the scenarios (every Nth, starting with the ith), writing to a subdirectory of the output directory, for combining with merge")
+	var retry, only stringList
+	fs.Var(&retry, "retry", "re-run the named scenario regardless of its previous state (repeatable)")
+	fs.Var(&only, "scenario", "run only the named scenario of the manifest (repeatable)")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s batch [-parallel N] [-max-memory size] [-include-scc patterns] [-exclude-scc patterns] [-retry-failed] [-incremental] [-shard i/N] [-retry name]... [-scenario name]... [-output dir] manifest.toml\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s batch [flags] -profile name\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s batch k8s-manifest [flags] manifest.toml\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var m *batchManifest
+	source := fs.Arg(0)
+	if *profile != "" {
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return errorf(kindUsage, "batch takes either a manifest file or -profile, not both")
+		}
+		var err error
+		if m, err = profileManifest(*profile); err != nil {
+			return err
+		}
+		source = "profile " + *profile
+	} else {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return errorf(kindUsage, "batch requires exactly one manifest file")
+		}
+		var err error
+		if m, err = loadBatchManifest(fs.Arg(0)); err != nil {
+			return withKind(kindConfig, errors.Wrap(err, "error loading batch manifest"))
+		}
+	}
+	if *output != "" {
+		m.OutputDir = *output
+	}
+	if len(only) > 0 {
+		var scenarios []scenario
+		for _, sc := range m.Scenario {
+			if only.contains(sc.Name) {
+				scenarios = append(scenarios, sc)
+			}
+		}
+		if len(scenarios) != len(only) {
+			return errorf(kindUsage, "-scenario: the manifest has %d of the %d named scenarios", len(scenarios), len(only))
+		}
+		m.Scenario = scenarios
+	}
+	if *parallel > 0 {
+		m.Parallel = *parallel
+	}
+	if sh.Count > 0 {
+		m.Scenario = sh.scenarios(m.Scenario)
+		m.OutputDir = filepath.Join(m.OutputDir, sh.dir())
+		log.Printf("Shard %s: running %d scenarios", sh.String(), len(m.Scenario))
+	}
+
+	if err := os.MkdirAll(m.OutputDir, 0755); err != nil {
+		return err
+	}
+	started := time.Now()
+	jobs, err := openJobStore(filepath.Join(m.OutputDir, "jobs.db"))
+	if err != nil {
+		return errors.Wrap(err, "error opening batch job store")
+	}
+	defer jobs.Close()
+
+	// Scenarios that were running when a previous batch was interrupted
+	// are re-run along with pending ones, as are finished scenarios whose
+	// settings changed since they finished, so that editing a scenario in
+	// the manifest isn't skipped as already done. With -incremental, the
+	// results of their unchanged demographics are reused.
+	var toRun []scenario
+	for _, sc := range m.Scenario {
+		st, err := jobs.get(sc.Name)
+		if err != nil {
+			return err
+		}
+		spec, err := scenarioSpec(sc)
+		if err != nil {
+			return err
+		}
+		switch {
+		case retry.contains(sc.Name),
+			st.Status == jobPending || st.Status == jobRunning,
+			st.Status == jobFailed && *retryFailed:
+			toRun = append(toRun, sc)
+		case st.Status == jobDone && st.Spec != spec:
+			log.Printf("Re-running changed scenario %s", sc.Name)
+			toRun = append(toRun, sc)
+		default:
+			log.Printf("Skipping scenario %s (%s)", sc.Name, st.Status)
+		}
+	}
+
+	results := make(map[string]*scenarioResult)
+	var totalPopColumn string
+	var resultsMx sync.Mutex
+	if len(toRun) > 0 {
+		s, _, err := getEIOServer()
+		if err != nil {
+			return errors.Wrap(err, "error creating EIO server")
+		}
+		// Results by demographic are always stored, so that a later
+		// -incremental run can reuse them.
+		dc, err := openDemographicCache(filepath.Join(m.OutputDir, "demographics.db"), *incremental)
+		if err != nil {
+			return errors.Wrap(err, "error opening demographic cache")
+		}
+		defer dc.Close()
+		ctx := withDemographicCache(context.Background(), dc)
+		totalPopColumn = s.CSTConfig.CensusTotalPopColumn
+
+		status.expect("scenario", len(toRun))
+		sem := make(chan struct{}, m.Parallel)
+		var wg sync.WaitGroup
+		for _, sc := range toRun {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(sc scenario) {
+				defer func() { <-sem; wg.Done() }()
+				if err := jobs.set(sc.Name, jobRunning, nil); err != nil {
+					log.Printf("Scenario %s: error recording state: %v", sc.Name, err)
+					return
+				}
+				dir := filepath.Join(m.OutputDir, sc.Name)
+				log.Printf("Running scenario %s", sc.Name)
+				err := os.MkdirAll(dir, 0755)
+				if err == nil {
+					var r *scenarioResult
+					ctx, span := startSpan(ctx, "scenario", attribute.String("name", sc.Name), attribute.Int64("year", int64(sc.Year)))
+					r, err = runScenario(ctx, s, sc, dir)
+					endSpan(span, err)
+					resultsMx.Lock()
+					results[sc.Name] = r
+					resultsMx.Unlock()
+				}
+				status := jobDone
+				if err != nil {
+					status = jobFailed
+					log.Printf("Scenario %s failed: %v", sc.Name, err)
+				} else {
+					log.Printf("Finished scenario %s", sc.Name)
+				}
+				if err := jobs.set(sc.Name, status, err); err != nil {
+					log.Printf("Scenario %s: error recording state: %v", sc.Name, err)
+				}
+				if status == jobDone {
+					spec, _ := scenarioSpec(sc)
+					if err := jobs.setSpec(sc.Name, spec); err != nil {
+						log.Printf("Scenario %s: error recording state: %v", sc.Name, err)
+					}
+				}
+			}(sc)
+		}
+		wg.Wait()
+	}
+
+	summary := &batchSummary{Manifest: source, OutputDir: m.OutputDir, Started: started}
+	if abs, err := filepath.Abs(m.OutputDir); err == nil {
+		summary.OutputDir = abs
+	}
+	var rows [][]string
+	failedCodes := make(map[int]bool)
+	for _, sc := range m.Scenario {
+		st, err := jobs.get(sc.Name)
+		if err != nil {
+			return err
+		}
+		if st.Status == jobDone {
+			summary.Done++
+		} else {
+			summary.Failed++
+			failedCodes[st.ExitCode] = true
+		}
+		ss := scenarioSummary{
+			Name:      sc.Name,
+			Status:    st.Status,
+			Error:     st.Error,
+			ExitCode:  st.ExitCode,
+			OutputDir: filepath.Join(summary.OutputDir, sc.Name),
+			Metrics:   summaryMetrics(results[sc.Name], totalPopColumn),
+		}
+		if r := results[sc.Name]; r != nil {
+			ss.Disparities = summaryDisparities(r, totalPopColumn)
+			ss.TopSectors = r.TopSectors
+		}
+		summary.Scenarios = append(summary.Scenarios, ss)
+		rows = append(rows, []string{sc.Name, strconv.Itoa(int(sc.Year)), sc.AQM, sc.HR, sc.Name, string(st.Status), strconv.Itoa(st.Attempts), st.Error, strconv.Itoa(st.ExitCode)})
+	}
+	err = writeCSV(filepath.Join(m.OutputDir, "index.csv"), []string{"Name", "Year", "AQM", "HR", "Directory", "Status", "Attempts", "Error", "ExitCode"}, rows)
+	if err != nil {
+		return errors.Wrap(err, "error writing batch index")
+	}
+	if err := writeDataDictionaries(m.OutputDir); err != nil {
+		return err
+	}
+	if err := writeRunManifest(m.OutputDir, source); err != nil {
+		return err
+	}
+
+	summary.Finished = time.Now()
+	if err := notify(m.Notify, summary); err != nil {
+		log.Printf("Error sending batch notification: %v", err)
+	}
+	if summary.Failed > 0 {
+		err := fmt.Errorf("%d of %d scenarios did not complete", summary.Failed, len(m.Scenario))
+		// Exit with the status of the failed scenarios if they all
+		// failed the same way.
+		if len(failedCodes) == 1 {
+			for code := range failedCodes {
+				return withKind(exitKind(code), err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// scenarioSpec identifies the settings of sc and the SCC filter, to tell
+// whether they have changed since it was last run.
+func scenarioSpec(sc scenario) (string, error) {
+	if f := sccFilterSetting(); f != "none" {
+		return fingerprint([]interface{}{sc, f})
+	}
+	return fingerprint(sc)
+}
+
+// stringList is a flag.Value collecting repeated string flags.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (l stringList) contains(v string) bool {
+	for _, s := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
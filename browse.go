@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// browseView is one of the tables that can be shown by the browse command.
+type browseView struct {
+	name   string
+	header []string
+	rows   [][]string
+}
+
+// browseModel is the bubbletea model of the browse command. It shows one
+// table at a time, which can be scrolled; the sector table can also be
+// sorted by emissions and filtered by pollutant.
+type browseModel struct {
+	dir    string
+	views  []browseView
+	view   int
+	offset int
+	height int
+
+	// sectors holds all rows of sectors.csv: SCC, Emission, Emissions.
+	sectors    [][]string
+	pollutants []string
+	pollutant  int
+	ascending  bool
+}
+
+// browseCommand opens an interactive viewer of the tables written by a
+// completed scenario run.
+func browseCommand(args []string) error {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s browse scenario_output_dir\n", os.Args[0])
+		return errorf(kindUsage, "browse requires exactly one output directory")
+	}
+	m, err := loadBrowseModel(args[0])
+	if err != nil {
+		return err
+	}
+	return tea.NewProgram(m).Start()
+}
+
+// loadBrowseModel reads the result tables in dir.
+func loadBrowseModel(dir string) (*browseModel, error) {
+	m := &browseModel{dir: dir, height: 20}
+	for _, t := range []struct{ name, file string }{
+		{"Exposure", "exposure.csv"},
+		{"Contribution", "contribution.csv"},
+		{"Deaths", "health.csv"},
+		{"Damages", "damages.csv"},
+	} {
+		header, rows, err := readCSV(filepath.Join(dir, t.file))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		m.views = append(m.views, browseView{name: t.name, header: header, rows: rows})
+	}
+
+	_, sectors, err := readCSV(filepath.Join(dir, "sectors.csv"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && len(sectors) > 0 {
+		m.sectors = sectors
+		seen := make(map[string]bool)
+		for _, r := range sectors {
+			if !seen[r[1]] {
+				seen[r[1]] = true
+				m.pollutants = append(m.pollutants, r[1])
+			}
+		}
+		m.views = append(m.views, browseView{name: "Sectors", header: []string{"SCC", "Emission", "Emissions"}})
+		m.updateSectors()
+	}
+	if len(m.views) == 0 {
+		return nil, fmt.Errorf("no result tables found in %s", dir)
+	}
+	return m, nil
+}
+
+// updateSectors refreshes the sector view for the current pollutant and
+// sort order.
+func (m *browseModel) updateSectors() {
+	var rows [][]string
+	for _, r := range m.sectors {
+		if r[1] == m.pollutants[m.pollutant] {
+			rows = append(rows, r)
+		}
+	}
+	value := func(r []string) float64 {
+		v, _ := strconv.ParseFloat(r[2], 64)
+		return v
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if m.ascending {
+			return value(rows[i]) < value(rows[j])
+		}
+		return value(rows[i]) > value(rows[j])
+	})
+	m.views[len(m.views)-1].rows = rows
+	m.offset = 0
+}
+
+func (m *browseModel) sectorView() bool {
+	return m.sectors != nil && m.view == len(m.views)-1
+}
+
+func (m *browseModel) Init() tea.Cmd { return nil }
+
+func (m *browseModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.height = msg.Height - 6
+		if m.height < 1 {
+			m.height = 1
+		}
+	case tea.KeyMsg:
+		rows := len(m.views[m.view].rows)
+		switch msg.String() {
+		case "q", "ctrl+c", "esc":
+			return m, tea.Quit
+		case "tab", "right", "l":
+			m.view = (m.view + 1) % len(m.views)
+			m.offset = 0
+		case "shift+tab", "left", "h":
+			m.view = (m.view + len(m.views) - 1) % len(m.views)
+			m.offset = 0
+		case "down", "j":
+			m.offset++
+		case "up", "k":
+			m.offset--
+		case "pgdown", " ":
+			m.offset += m.height
+		case "pgup":
+			m.offset -= m.height
+		case "s":
+			if m.sectorView() {
+				m.ascending = !m.ascending
+				m.updateSectors()
+			}
+		case "p":
+			if m.sectorView() {
+				m.pollutant = (m.pollutant + 1) % len(m.pollutants)
+				m.updateSectors()
+			}
+		}
+		if m.offset > rows-m.height {
+			m.offset = rows - m.height
+		}
+		if m.offset < 0 {
+			m.offset = 0
+		}
+	}
+	return m, nil
+}
+
+func (m *browseModel) View() string {
+	var b strings.Builder
+	for i, v := range m.views {
+		if i == m.view {
+			fmt.Fprintf(&b, "[%s] ", v.name)
+		} else {
+			fmt.Fprintf(&b, " %s  ", v.name)
+		}
+	}
+	b.WriteString("\n\n")
+
+	v := m.views[m.view]
+	widths := make([]int, len(v.header))
+	for i, h := range v.header {
+		widths[i] = len(h)
+	}
+	for _, r := range v.rows {
+		for i, c := range r {
+			if i < len(widths) && len(c) > widths[i] {
+				widths[i] = len(c)
+			}
+		}
+	}
+	writeRow := func(r []string) {
+		for i, c := range r {
+			if i < len(widths) {
+				fmt.Fprintf(&b, "%-*s  ", widths[i], c)
+			}
+		}
+		b.WriteString("\n")
+	}
+	writeRow(v.header)
+	end := m.offset + m.height
+	if end > len(v.rows) {
+		end = len(v.rows)
+	}
+	for _, r := range v.rows[m.offset:end] {
+		writeRow(r)
+	}
+
+	fmt.Fprintf(&b, "\n%s: rows %d-%d of %d", m.dir, m.offset+1, end, len(v.rows))
+	b.WriteString(" | tab: next table, ↑/↓ pgup/pgdn: scroll")
+	if m.sectorView() {
+		order := "descending"
+		if m.ascending {
+			order = "ascending"
+		}
+		fmt.Fprintf(&b, ", p: pollutant (%s), s: sort (%s)", m.pollutants[m.pollutant], order)
+	}
+	b.WriteString(", q: quit\n")
+	return b.String()
+}
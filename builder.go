@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Metric is an optional result of a scenario, named as the batch manifest
+// setting that enables it.
+type Metric string
+
+// Optional scenario results; see the scenario settings of the same name.
+const (
+	MetricSpeciation             Metric = "Speciation"
+	MetricExposureDistribution   Metric = "ExposureDistribution"
+	MetricConcentrationIndex     Metric = "ConcentrationIndex"
+	MetricCategoryTree           Metric = "CategoryTree"
+	MetricSupplyChain            Metric = "SupplyChain"
+	MetricPollutantContribution  Metric = "PollutantContribution"
+	MetricContributionByLocation Metric = "ContributionByLocation"
+	MetricNAICSContribution      Metric = "NAICSContribution"
+	MetricConsumptionShares      Metric = "ConsumptionShares"
+	MetricExposureEfficiency     Metric = "ExposureEfficiency"
+	MetricSectors                Metric = "Sectors"
+	MetricInventory              Metric = "Inventory"
+	MetricWorkbook               Metric = "Workbook"
+)
+
+// sccScaling is an emission factor override added by ScaleSCC or
+// SCCEmissions.
+type sccScaling struct {
+	scc, pollutant, kind string
+	value                float64
+}
+
+// ScenarioBuilder composes a scenario in code, as a batch manifest's
+// [[Scenario]] table would, for programs that generate many scenarios.
+// Its methods return the builder so that calls can be chained; the first
+// invalid setting is reported by Run or WriteManifest. The scenarios it
+// builds are the ones batch runs, so a builder can either run its scenario
+// directly or write a manifest for the batch command.
+type ScenarioBuilder struct {
+	sc       scenario
+	scalings []sccScaling
+	err      error
+}
+
+// NewScenario returns a builder of a scenario named name, which names its
+// output directory, of total final demand in defaultYear.
+func NewScenario(name string) *ScenarioBuilder {
+	b := &ScenarioBuilder{sc: scenario{Name: name}}
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		b.fail(fmt.Errorf("invalid scenario name %q", name))
+	}
+	return b
+}
+
+// scenarioFrom returns a builder of sc, a scenario of a batch manifest or
+// posted to serve-map, whose settings are checked as if they had been made
+// with the builder's methods.
+func scenarioFrom(sc scenario) *ScenarioBuilder {
+	b := NewScenario(sc.Name)
+	b.sc = sc
+	year := Year(sc.Year)
+	if year == 0 {
+		year = defaultYear()
+	}
+	b.Year(year)
+	b.ImportSubstitution(sc.ImportSubstitution)
+	for commodity, factor := range sc.DemandScale {
+		b.ScaleDemand(commodity, factor)
+	}
+	b.sc.Demographics = nil
+	b.Demographics(sc.Demographics...)
+	return b
+}
+
+// fail records err, if it is the first error.
+func (b *ScenarioBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = errors.Wrapf(err, "scenario %s", b.sc.Name)
+	}
+}
+
+// Year sets the base year of the analysis.
+func (b *ScenarioBuilder) Year(y Year) *ScenarioBuilder {
+	if _, err := parseYear(int(y)); err != nil {
+		b.fail(err)
+	}
+	b.sc.Year = int32(y)
+	return b
+}
+
+// FinalDemand sets the type of final demand analyzed, e.g.
+// "PersonalConsumption".
+func (b *ScenarioBuilder) FinalDemand(finalDemandType string) *ScenarioBuilder {
+	b.sc.FinalDemandType = finalDemandType
+	return b
+}
+
+// DemandFile replaces the model's final demand with that in the CSV file
+// at path, rescaled as given by rescale ("none", "total" or "unedited").
+func (b *ScenarioBuilder) DemandFile(path, rescale string) *ScenarioBuilder {
+	b.sc.DemandFile, b.sc.DemandRescale = path, rescale
+	return b
+}
+
+// ScaleDemand multiplies the final demand for commodity, or for every
+// commodity not otherwise scaled if commodity is "*", by factor.
+func (b *ScenarioBuilder) ScaleDemand(commodity string, factor float64) *ScenarioBuilder {
+	if factor < 0 {
+		b.fail(fmt.Errorf("negative demand scale %g for %s", factor, commodity))
+	}
+	if b.sc.DemandScale == nil {
+		b.sc.DemandScale = make(map[string]float64)
+	}
+	b.sc.DemandScale[commodity] = factor
+	return b
+}
+
+// ImportSubstitution sets how changes in demand are split between domestic
+// production and imports: "fixed", "domestic" or "import".
+func (b *ScenarioBuilder) ImportSubstitution(mode string) *ScenarioBuilder {
+	if err := checkImportSubstitution(mode); err != nil {
+		b.fail(err)
+	}
+	b.sc.ImportSubstitution = mode
+	return b
+}
+
+// ScaleSCC multiplies the emission factors of pollutant (an NEI pollutant,
+// or "*" for all) from scc (or SCC prefix ending in "*") by factor.
+func (b *ScenarioBuilder) ScaleSCC(scc, pollutant string, factor float64) *ScenarioBuilder {
+	return b.addScaling(sccScaling{scc: scc, pollutant: pollutant, kind: "multiplier", value: factor})
+}
+
+// SCCEmissions scales the emission factors of pollutant from scc (or SCC
+// prefix ending in "*") so that its emissions from the year's total
+// domestic production are kg per year.
+func (b *ScenarioBuilder) SCCEmissions(scc, pollutant string, kg float64) *ScenarioBuilder {
+	return b.addScaling(sccScaling{scc: scc, pollutant: pollutant, kind: "emissions", value: kg})
+}
+
+func (b *ScenarioBuilder) addScaling(s sccScaling) *ScenarioBuilder {
+	switch {
+	case strings.TrimLeft(s.scc, "0") == "":
+		b.fail(fmt.Errorf("SCC scaling must specify an SCC, or \"*\""))
+	case s.value < 0:
+		b.fail(fmt.Errorf("negative SCC scaling %g for %s", s.value, s.scc))
+	case s.pollutant == "*" && s.kind == "emissions":
+		b.fail(fmt.Errorf("SCC emissions for %s must specify a pollutant", s.scc))
+	}
+	if _, ok := neiPollutants[strings.ToUpper(s.pollutant)]; !ok && s.pollutant != "*" {
+		b.fail(fmt.Errorf("invalid pollutant %q", s.pollutant))
+	}
+	b.scalings = append(b.scalings, s)
+	return b
+}
+
+// Demographics adds demographics whose contribution to emissions and
+// health impacts is calculated, by key (e.g. "decile:LowestTen") or group
+// ("decile" or "ethnicity").
+func (b *ScenarioBuilder) Demographics(keys ...string) *ScenarioBuilder {
+	for _, key := range keys {
+		if _, err := parseDemographs(key); err != nil {
+			b.fail(err)
+		}
+	}
+	b.sc.Demographics = append(b.sc.Demographics, keys...)
+	return b
+}
+
+// Metrics adds optional results to calculate.
+func (b *ScenarioBuilder) Metrics(metrics ...Metric) *ScenarioBuilder {
+	v := reflect.ValueOf(&b.sc).Elem()
+	for _, m := range metrics {
+		f := v.FieldByName(string(m))
+		if !f.IsValid() || f.Kind() != reflect.Bool {
+			b.fail(fmt.Errorf("invalid metric %q", m))
+			continue
+		}
+		f.SetBool(true)
+	}
+	return b
+}
+
+// Health calculates deaths with the hazard ratio function hr and, if vsl
+// isn't zero, their value for a value of a statistical life of vsl dollars
+// in defaultYear.
+func (b *ScenarioBuilder) Health(hr string, vsl float64) *ScenarioBuilder {
+	b.sc.HR = hr
+	b.sc.Valuation.VSL = vsl
+	return b
+}
+
+// AQM sets the air quality model.
+func (b *ScenarioBuilder) AQM(aqm string) *ScenarioBuilder {
+	b.sc.AQM = aqm
+	return b
+}
+
+// build returns the scenario, writing the emission factor overrides of
+// its SCC scalings, if any, to a file in dir.
+func (b *ScenarioBuilder) build(dir string) (scenario, error) {
+	if b.err != nil {
+		return scenario{}, withKind(kindConfig, b.err)
+	}
+	sc := b.sc
+	if len(b.scalings) > 0 {
+		var rows [][]string
+		for _, s := range b.scalings {
+			rows = append(rows, []string{s.scc, s.pollutant, s.kind, strconv.FormatFloat(s.value, 'g', -1, 64)})
+		}
+		sc.EmissionFactors.File = filepath.Join(dir, sc.Name+"_emission_factors.csv")
+		if err := writeCSV(sc.EmissionFactors.File, []string{"SCC", "Pollutant", "Type", "Value"}, rows); err != nil {
+			return scenario{}, err
+		}
+	}
+	sc.setDefaults()
+	return sc, nil
+}
+
+// Run runs the scenario with s, writing its results to dir.
+func (b *ScenarioBuilder) Run(ctx context.Context, s *eieio.Server, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	sc, err := b.build(dir)
+	if err != nil {
+		return err
+	}
+	if err := Year(sc.Year).validate(ctx, s); err != nil {
+		return err
+	}
+	_, err = runScenario(ctx, s, sc, dir)
+	return err
+}
+
+// WriteManifest writes a batch manifest to path that runs the scenarios of
+// builders with their results in outputDir, for the batch command. SCC
+// scalings are written to files beside the manifest.
+func WriteManifest(path, outputDir string, builders ...*ScenarioBuilder) error {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	m := batchManifest{OutputDir: outputDir}
+	for _, b := range builders {
+		sc, err := b.build(dir)
+		if err != nil {
+			return err
+		}
+		m.Scenario = append(m.Scenario, sc)
+	}
+	if err := m.check(); err != nil {
+		return withKind(kindConfig, err)
+	}
+	tables := make([]map[string]interface{}, len(m.Scenario))
+	for i, sc := range m.Scenario {
+		tables[i] = nonZeroFields(reflect.ValueOf(sc))
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = toml.NewEncoder(f).Encode(map[string]interface{}{"OutputDir": outputDir, "Scenario": tables})
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return errors.Wrap(err, "writing batch manifest")
+}
+
+// nonZeroFields returns the fields of the struct v that aren't zero, by
+// name, so that a manifest only lists the settings that were made.
+func nonZeroFields(v reflect.Value) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).PkgPath != "" {
+			continue // unexported
+		}
+		if f := v.Field(i); !reflect.DeepEqual(f.Interface(), reflect.Zero(f.Type()).Interface()) {
+			if f.Kind() == reflect.Struct {
+				fields[v.Type().Field(i).Name] = nonZeroFields(f)
+			} else {
+				fields[v.Type().Field(i).Name] = f.Interface()
+			}
+		}
+	}
+	return fields
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useDefaultYears makes the configured years defaultYears, unless they
+// were already read from a config.
+func useDefaultYears() {
+	configuredYearsOnce.Do(func() { configuredYearsList = defaultYears })
+}
+
+func TestScenarioFrom(t *testing.T) {
+	useDefaultYears()
+	sc, err := scenarioFrom(scenario{Name: "base", Demographics: []string{"decile", "ethnicity:Black"},
+		DemandScale: map[string]float64{"*": 0.5}}).build("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Year(sc.Year) != defaultYear() || sc.AQM != "isrm" || sc.ImportSubstitution != substituteFixed || sc.FinalDemandType == "" {
+		t.Errorf("defaults not set: %+v", sc)
+	}
+	if len(sc.Demographics) != 2 || sc.DemandScale["*"] != 0.5 {
+		t.Errorf("settings not kept: %+v", sc)
+	}
+}
+
+func TestScenarioFromInvalid(t *testing.T) {
+	useDefaultYears()
+	for _, sc := range []scenario{
+		{Name: "a/b"},
+		{Name: "base", Year: 1990},
+		{Name: "base", Demographics: []string{"decile:Top"}},
+		{Name: "base", DemandScale: map[string]float64{"*": -1}},
+		{Name: "base", ImportSubstitution: "tariff"},
+	} {
+		if _, err := scenarioFrom(sc).build(""); kindOf(err) != kindConfig {
+			t.Errorf("%+v: got error %v, want a config error", sc, err)
+		}
+	}
+}
+
+// TestWriteManifest checks that a manifest written from builders is read
+// back by batch as the scenarios they built.
+func TestWriteManifest(t *testing.T) {
+	useDefaultYears()
+	dir, err := ioutil.TempDir("", "builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "batch.toml")
+	err = WriteManifest(path, filepath.Join(dir, "out"),
+		NewScenario("base").Demographics("decile"),
+		NewScenario("cleaner").Metrics(MetricSpeciation).ScaleSCC("2*", "NOX", 0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadBatchManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Scenario) != 2 {
+		t.Fatalf("got %d scenarios, want 2", len(m.Scenario))
+	}
+	if base := m.Scenario[0]; base.Name != "base" || len(base.Demographics) != 1 || Year(base.Year) != defaultYear() {
+		t.Errorf("base: got %+v", base)
+	}
+	cleaner := m.Scenario[1]
+	if !cleaner.Speciation || cleaner.EmissionFactors.File == "" {
+		t.Fatalf("cleaner: got %+v", cleaner)
+	}
+	b, err := ioutil.ReadFile(cleaner.EmissionFactors.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "2*,NOX,multiplier,0.5") {
+		t.Errorf("emission factors: got %q", b)
+	}
+
+	// A manifest with an invalid scenario isn't written.
+	if err := WriteManifest(path, dir, NewScenario("bad").Demographics("decile:Top")); kindOf(err) != kindConfig {
+		t.Errorf("invalid scenario: got error %v, want a config error", err)
+	}
+}
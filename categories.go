@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"github.com/tealeg/xlsx"
+	"gonum.org/v1/gonum/floats"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cesDataDir is the CESDataDir config setting, with environment variables
+// expanded.
+var cesDataDir string
+
+// categoryNode is a CES consumption category, such as Housing → Utilities,
+// fuels, and public services → Electricity. The leaves of a category tree
+// are the IO commodities purchased in each category.
+type categoryNode struct {
+	Name string
+
+	// Exposure is population-weighted exposure caused by the category,
+	// by census population.
+	Exposure map[string]float64
+
+	Children []*categoryNode `json:",omitempty"`
+
+	indent      int     // indentation of the category in the CES table
+	expenditure float64 // aggregate CES expenditure, for splitting commodities between categories
+	commodity   bool
+}
+
+// categoryTreeSep separates the names of a category and its ancestors in
+// category IDs.
+const categoryTreeSep = " > "
+
+// unclassifiedCategory holds the commodities not mapped to any CES
+// category, such as those only bought by businesses and government.
+const unclassifiedCategory = "Unclassified"
+
+// xlsxIndents returns the indentation of the first cell of each row of the
+// first sheet of an Excel file, indexed by row number starting at 1. The
+// xlsx package doesn't read indentation, which CES tables use to show the
+// category hierarchy.
+func xlsxIndents(path string) (map[int]int, error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	decode := func(name string, v interface{}) error {
+		for _, f := range z.File {
+			if f.Name == name {
+				r, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				return xml.Unmarshal(b, v)
+			}
+		}
+		return fmt.Errorf("%s: missing %s", path, name)
+	}
+	var styles struct {
+		Xfs []struct {
+			Alignment struct {
+				Indent int `xml:"indent,attr"`
+			} `xml:"alignment"`
+		} `xml:"cellXfs>xf"`
+	}
+	if err := decode("xl/styles.xml", &styles); err != nil {
+		return nil, err
+	}
+	var sheet struct {
+		Rows []struct {
+			R     int `xml:"r,attr"`
+			Cells []struct {
+				R string `xml:"r,attr"`
+				S int    `xml:"s,attr"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := decode("xl/worksheets/sheet1.xml", &sheet); err != nil {
+		return nil, err
+	}
+	indents := make(map[int]int)
+	for _, row := range sheet.Rows {
+		for _, c := range row.Cells {
+			if c.R == "A"+strconv.Itoa(row.R) && c.S < len(styles.Xfs) {
+				indents[row.R] = styles.Xfs[c.S].Alignment.Indent
+			}
+		}
+	}
+	return indents, nil
+}
+
+// readCESCategories returns the tree of expenditure categories in the CES
+// table for year (the nearest year with data if there is none), along
+// with the nodes for each category name; some names, such as
+// "Maintenance and repairs", occur more than once.
+func readCESCategories(s *eieio.Server, year int32) (*categoryNode, map[string][]*categoryNode, error) {
+	y := int(year)
+	if y < s.CES.StartYear {
+		y = s.CES.StartYear
+	} else if y > s.CES.EndYear {
+		y = s.CES.EndYear
+	}
+	if y != int(year) {
+		log.Printf("No CES table for %d; using the %d consumption categories", year, y)
+	}
+	path := filepath.Join(cesDataDir, fmt.Sprintf("hispanic%d.xlsx", y))
+	f, err := xlsx.OpenFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	indents, err := xlsxIndents(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Expenditures may be flagged as, e.g., "a/" for too small to display.
+	flags := strings.NewReplacer("a/", "", "b/", "", "c/", "", ",", "", " ", "")
+
+	root := &categoryNode{Name: "All"}
+	byName := make(map[string][]*categoryNode)
+	stack := []*categoryNode{root}
+	started := false
+	for i, row := range f.Sheets[0].Rows {
+		if len(row.Cells) == 0 {
+			continue
+		}
+		name := strings.TrimSpace(row.Cells[0].Value)
+		indent := indents[i+1]
+		if !started {
+			// The categories follow the total, "Annual aggregate expenditures".
+			started = indent == 0 && strings.HasSuffix(strings.ToLower(name), "expenditures")
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		if indent == 0 {
+			break // the end of the expenditure categories
+		}
+		n := &categoryNode{Name: name, indent: indent}
+		if len(row.Cells) > 1 {
+			n.expenditure, _ = strconv.ParseFloat(flags.Replace(row.Cells[1].Value), 64)
+		}
+		for len(stack) > 1 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, n)
+		stack = append(stack, n)
+		byName[name] = append(byName[name], n)
+	}
+	if len(root.Children) == 0 {
+		return nil, nil, fmt.Errorf("no expenditure categories found in %s", path)
+	}
+	return root, byName, nil
+}
+
+// readCESCrosswalk returns the CES categories of each IO commodity.
+func readCESCrosswalk() (map[string][]string, error) {
+	f, err := xlsx.OpenFile(filepath.Join(cesDataDir, "IO-CEcrosswalk.xlsx"))
+	if err != nil {
+		return nil, err
+	}
+	crosswalk := make(map[string][]string)
+	for _, sheet := range f.Sheets {
+		for i, row := range sheet.Rows {
+			if i == 0 || len(row.Cells) == 0 {
+				continue // column headers
+			}
+			commodity := row.Cells[0].Value
+			for _, c := range row.Cells[1:] {
+				if v := strings.TrimSpace(c.Value); v != "" {
+					crosswalk[commodity] = append(crosswalk[commodity], v)
+				}
+			}
+		}
+	}
+	return crosswalk, nil
+}
+
+// getExposureByCommodity returns the population-weighted exposure to PM2.5
+// of each census population caused by the demand for each commodity,
+// indexed by population and then commodity. Commodities with no demand
+// cause no exposure and are not calculated.
+func getExposureByCommodity(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector) (map[string][]float64, error) {
+	ctx, span := startSpan(ctx, "getExposureByCommodity")
+	defer span.End()
+	d, err := getSubdomain(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	// With a nonlinear exposure function or a background concentration,
+	// the concentration caused by each commodity is weighted by those of the
+	// total concentration.
+	var cellWeights []float64
+	if exposureWeighted(ctx) {
+		total, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+			Demand:    demand,
+			Pollutant: eieiorpc.Pollutant_TotalPM25,
+			Year:      year,
+			Location:  LOC,
+			AQM:       aqm,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if cellWeights, err = exposureWeights(ctx, total.Data); err != nil {
+			return nil, err
+		}
+	}
+	var pops map[string][]float64
+	byPop := make(map[string][]float64)
+	unit := make([]float64, len(demand.Data))
+	for j, v := range demand.Data {
+		if v == 0 {
+			continue
+		}
+		unit[j] = v
+		vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+			Demand:    &eieiorpc.Vector{Data: unit},
+			Pollutant: eieiorpc.Pollutant_TotalPM25,
+			Year:      year,
+			Location:  LOC,
+			AQM:       aqm,
+		})
+		unit[j] = 0
+		if err != nil {
+			return nil, err
+		}
+		conc, err := scaleByCell(vec.Data, cellWeights)
+		if err != nil {
+			return nil, err
+		}
+		if pops == nil {
+			var popNames []string
+			popNames, pops, err = getPopulationGrids(ctx, s, aqm, len(conc))
+			if err != nil {
+				return nil, err
+			}
+			for _, pop := range popNames {
+				if pops[pop], err = d.restrict(pops[pop]); err != nil {
+					return nil, err
+				}
+				byPop[pop] = make([]float64, len(demand.Data))
+			}
+		}
+		if conc, err = d.restrict(conc); err != nil {
+			return nil, err
+		}
+		for pop, grid := range pops {
+			byPop[pop][j] = floats.Dot(grid, conc)
+		}
+	}
+	return byPop, nil
+}
+
+// getCategoryTree attributes the exposure of each census population caused
+// by demand to the CES consumption categories of the purchased
+// commodities. A commodity in several categories is split between them in
+// proportion to their aggregate expenditure. Categories without any
+// commodities are omitted.
+func getCategoryTree(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector) (*categoryNode, error) {
+	ctx, span := startSpan(ctx, "getCategoryTree")
+	defer span.End()
+	root, byName, err := readCESCategories(s, year)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading CES categories")
+	}
+	crosswalk, err := readCESCrosswalk()
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading CES crosswalk")
+	}
+	exposure, err := getExposureByCommodity(ctx, s, year, aqm, demand)
+	if err != nil {
+		return nil, err
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	unclassified := &categoryNode{Name: unclassifiedCategory}
+	for j, commodity := range commodities.List {
+		if demand.Data[j] == 0 {
+			continue
+		}
+		var nodes []*categoryNode
+		var total float64
+		for _, c := range crosswalk[commodity] {
+			for _, n := range byName[c] {
+				nodes = append(nodes, n)
+				total += n.expenditure
+			}
+		}
+		if len(nodes) == 0 {
+			nodes, total = []*categoryNode{unclassified}, 0
+		}
+		for _, n := range nodes {
+			share := 1 / float64(len(nodes))
+			if total != 0 {
+				share = n.expenditure / total
+			}
+			leaf := &categoryNode{Name: commodity, Exposure: make(map[string]float64), commodity: true}
+			for pop, e := range exposure {
+				leaf.Exposure[pop] = e[j] * share
+			}
+			n.Children = append(n.Children, leaf)
+		}
+	}
+	if len(unclassified.Children) > 0 {
+		root.Children = append(root.Children, unclassified)
+	}
+	root.sum()
+	return root, nil
+}
+
+// sum sets the exposure of n and its descendant categories to the sum of
+// that of their children, removing categories without commodities. It
+// returns whether n has any commodities.
+func (n *categoryNode) sum() bool {
+	if n.commodity {
+		return true
+	}
+	n.Exposure = make(map[string]float64)
+	children := n.Children[:0]
+	for _, c := range n.Children {
+		if !c.sum() {
+			continue
+		}
+		children = append(children, c)
+		for pop, e := range c.Exposure {
+			n.Exposure[pop] += e
+		}
+	}
+	n.Children = children
+	return len(children) > 0
+}
+
+// treemapRows returns a row for each population and node of the tree
+// rooted at n, with the columns in treemapHeader. IDs are the names of a
+// node and its ancestors joined by categoryTreeSep, so the rows can be
+// passed directly to treemap plots, such as Plotly's with
+// branchvalues="total".
+func (n *categoryNode) treemapRows(pops []string) [][]string {
+	var rows [][]string
+	var walk func(n *categoryNode, id, parent string, depth int)
+	walk = func(n *categoryNode, id, parent string, depth int) {
+		kind := "Category"
+		if n.commodity {
+			kind = "Commodity"
+		}
+		for _, pop := range pops {
+			rows = append(rows, []string{pop, labels.get(pop), id, parent, n.Name, kind, strconv.Itoa(depth), formatFloat(n.Exposure[pop])})
+		}
+		for _, c := range n.Children {
+			walk(c, id+categoryTreeSep+c.Name, id, depth+1)
+		}
+	}
+	walk(n, n.Name, "", 0)
+	return rows
+}
+
+var treemapHeader = []string{"Population", "Label", "ID", "Parent", "Name", "Kind", "Depth", "Exposure"}
+
+// writeCategoryTree writes the exposure of each census population caused
+// by demand, attributed to CES consumption categories, as a nested JSON
+// tree to jsonPath and as treemap rows to csvPath.
+func writeCategoryTree(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector, jsonPath, csvPath string) error {
+	tree, err := getCategoryTree(ctx, s, year, aqm, demand)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(jsonPath)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(tree); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	pops := make([]string, 0, len(tree.Exposure))
+	for pop := range tree.Exposure {
+		pops = append(pops, pop)
+	}
+	sort.Strings(pops)
+	return writeCSV(csvPath, treemapHeader, tree.treemapRows(pops))
+}
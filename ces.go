@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"log"
+	"math"
+	"sort"
+	"sync"
+)
+
+// cesPolicy specifies what to do when CES data is unavailable for a
+// demographic and year, e.g. income deciles outside of 2014-2015.
+type cesPolicy string
+
+const (
+	// cesFailFast returns an error, stopping the analysis.
+	cesFailFast cesPolicy = "fail"
+
+	// cesSkip logs a warning and uses NaN for the demographic, so its
+	// results are NaN.
+	cesSkip cesPolicy = "skip"
+
+	// cesNearestYear uses the data for the nearest year that is available.
+	cesNearestYear cesPolicy = "nearest"
+)
+
+// missingCES is the policy for missing CES data, set from the
+// MissingCES setting in the [Sandbox] config table.
+var missingCES = cesFailFast
+
+// setMissingCES sets missingCES from a config value, which defaults to
+// cesFailFast if empty.
+func setMissingCES(v string) error {
+	switch p := cesPolicy(v); p {
+	case "":
+		missingCES = cesFailFast
+	case cesFailFast, cesSkip, cesNearestYear:
+		missingCES = p
+	default:
+		return errorf(kindConfig, "invalid MissingCES policy %q; must be fail, skip or nearest", v)
+	}
+	return nil
+}
+
+// cesLog records where missing CES data was skipped or replaced, so that
+// it can be reported in output metadata.
+type cesLog struct {
+	mx    sync.Mutex
+	notes map[string]bool
+}
+
+type cesLogKey struct{}
+
+// withCESLog returns a context that records missing CES data in a new
+// cesLog, along with the log.
+func withCESLog(ctx context.Context) (context.Context, *cesLog) {
+	l := &cesLog{notes: make(map[string]bool)}
+	return context.WithValue(ctx, cesLogKey{}, l), l
+}
+
+// recordCES logs a note about missing CES data and adds it to the
+// cesLog in ctx, if any.
+func recordCES(ctx context.Context, format string, args ...interface{}) {
+	note := fmt.Sprintf(format, args...)
+	log.Printf("Warning: %s", note)
+	if l, ok := ctx.Value(cesLogKey{}).(*cesLog); ok {
+		l.mx.Lock()
+		l.notes[note] = true
+		l.mx.Unlock()
+	}
+}
+
+// addCESNotes adds notes that have already been logged to the cesLog in
+// ctx, if any.
+func addCESNotes(ctx context.Context, notes []string) {
+	if l, ok := ctx.Value(cesLogKey{}).(*cesLog); ok {
+		l.mx.Lock()
+		for _, note := range notes {
+			l.notes[note] = true
+		}
+		l.mx.Unlock()
+	}
+}
+
+// Notes returns the recorded notes in sorted order.
+func (l *cesLog) Notes() []string {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	notes := make([]string, 0, len(l.notes))
+	for n := range l.notes {
+		notes = append(notes, n)
+	}
+	sort.Strings(notes)
+	return notes
+}
+
+// missingCESError classifies err, from a CES request, as kindDataMissing
+// rather than kindRPC: the CES data for the request doesn't exist.
+func missingCESError(err error) error {
+	return &kindError{kind: kindDataMissing, err: err}
+}
+
+// cesYearsByDistance returns the model years other than year, nearest first.
+func cesYearsByDistance(ctx context.Context, s *eieio.Server, year int32) ([]int32, error) {
+	years, err := s.Years(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var others []int32
+	for _, y := range years.Years {
+		if y != year {
+			others = append(others, y)
+		}
+	}
+	dist := func(y int32) int32 {
+		if y > year {
+			return y - year
+		}
+		return year - y
+	}
+	sort.SliceStable(others, func(i, j int) bool { return dist(others[i]) < dist(others[j]) })
+	return others, nil
+}
+
+// demographicConsumption returns the CES-based consumption of dem in year,
+// applying missingCES if it is unavailable, weighted by cesWeights.
+func demographicConsumption(ctx context.Context, s *eieio.Server, dem *eieiorpc.Demograph, year int32) (*eieiorpc.Vector, error) {
+	done := timeRPC(ctx, "DemographicConsumption")
+	consumption, err := s.CES.DemographicConsumption(ctx, &eieiorpc.DemographicConsumptionInput{
+		Year:      year,
+		Demograph: dem,
+	})
+	done(&err)
+	if err == nil {
+		if err := checkFinite(ctx, fmt.Sprintf("DemographicConsumption of %s in %d", demographKey(dem), year), consumption.Data, commodityLabel(ctx, s)); err != nil {
+			return nil, err
+		}
+		return weightConsumption(consumption, dem, year), nil
+	} else if missingCES == cesFailFast {
+		return nil, missingCESError(err)
+	}
+	switch missingCES {
+	case cesSkip:
+		commodities, cErr := s.Commodities(ctx, nil)
+		if cErr != nil {
+			return nil, cErr
+		}
+		recordCES(ctx, "no CES consumption for %s in %d; results are NaN (%v)", demographKey(dem), year, err)
+		nan := make([]float64, len(commodities.List))
+		for i := range nan {
+			nan[i] = math.NaN()
+		}
+		return &eieiorpc.Vector{Data: nan}, nil
+	default:
+		years, yErr := cesYearsByDistance(ctx, s, year)
+		if yErr != nil {
+			return nil, yErr
+		}
+		for _, y := range years {
+			done := timeRPC(ctx, "DemographicConsumption")
+			c, yErr := s.CES.DemographicConsumption(ctx, &eieiorpc.DemographicConsumptionInput{
+				Year:      y,
+				Demograph: dem,
+			})
+			done(&yErr)
+			if yErr == nil {
+				recordCES(ctx, "no CES consumption for %s in %d; used %d", demographKey(dem), year, y)
+				if err := checkFinite(ctx, fmt.Sprintf("DemographicConsumption of %s in %d", demographKey(dem), y), c.Data, commodityLabel(ctx, s)); err != nil {
+					return nil, err
+				}
+				return weightConsumption(c, dem, y), nil
+			}
+		}
+		return nil, missingCESError(err)
+	}
+}
+
+// totalPopulationCount returns the CES population count of dem in year,
+// applying missingCES if it is unavailable, weighted by cesWeights. With
+// cesSkip, the count is returned as 0.
+func totalPopulationCount(ctx context.Context, s *eieio.Server, dem *eieiorpc.Demograph, year int32) (int, error) {
+	done := timeRPC(ctx, "TotalPopulationCount")
+	count, err := s.CES.TotalPopulationCount(dem, int(year))
+	done(&err)
+	if err == nil {
+		return weightCount(count, dem, year), nil
+	} else if missingCES == cesFailFast {
+		return 0, missingCESError(err)
+	}
+	switch missingCES {
+	case cesSkip:
+		recordCES(ctx, "no CES population count for %s in %d; results are NaN (%v)", demographKey(dem), year, err)
+		return 0, nil
+	default:
+		years, yErr := cesYearsByDistance(ctx, s, year)
+		if yErr != nil {
+			return 0, yErr
+		}
+		for _, y := range years {
+			if c, yErr := s.CES.TotalPopulationCount(dem, int(y)); yErr == nil {
+				recordCES(ctx, "no CES population count for %s in %d; used %d", demographKey(dem), year, y)
+				return weightCount(c, dem, y), nil
+			}
+		}
+		return 0, missingCESError(err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cesWeightConfig specifies corrections of the CES population counts and
+// consumption of demographics for the survey's sampling design, from the
+// CES sample weights.
+type cesWeightConfig struct {
+	// File is the path to a CSV file with columns
+	// Demographic,Year,PopulationWeight,ConsumptionWeight. Demographic is
+	// as in a batch scenario (e.g. "decile:LowestTen", or "ethnicity" for
+	// every ethnicity) and Year is a year or "*" for every year. The
+	// weights are the ratios of the survey-weighted estimates of the
+	// demographic's population and consumption to the raw (unweighted)
+	// ones that the CES tables give, and multiply TotalPopulationCount and
+	// DemographicConsumption. Demographics and years not listed are
+	// unweighted.
+	File string
+}
+
+// String describes c, for recording in results.
+func (c cesWeightConfig) String() string {
+	if c.File == "" {
+		return "none"
+	}
+	return filepath.Base(c.File)
+}
+
+// cesWeight is a row of a CES weight file.
+type cesWeight struct {
+	population, consumption float64
+}
+
+// cesWeights are the weights read from the CESWeights file, by
+// demographKey and year, with year 0 for every year.
+var cesWeights map[string]map[int32]cesWeight
+
+// cesWeightSetting is the CESWeights setting in the [Sandbox] config table.
+var cesWeightSetting cesWeightConfig
+
+// readCESWeights reads a CES weight file.
+func readCESWeights(path string) (map[string]map[int32]cesWeight, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 4
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	weights := make(map[string]map[int32]cesWeight)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range rec {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+		dems, err := parseDemographs(rec[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v in CES weight %v", err, rec)
+		}
+		var year int32
+		if rec[1] != "*" {
+			y, err := strconv.ParseInt(rec[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid year %q in CES weight %v", rec[1], rec)
+			}
+			year = int32(y)
+		}
+		var w cesWeight
+		for i, v := range []*float64{&w.population, &w.consumption} {
+			if *v, err = strconv.ParseFloat(rec[2+i], 64); err != nil || *v <= 0 {
+				return nil, fmt.Errorf("invalid weight %q in CES weight %v; weights must be positive", rec[2+i], rec)
+			}
+		}
+		for _, dem := range dems {
+			key := demographKey(dem)
+			if weights[key] == nil {
+				weights[key] = make(map[int32]cesWeight)
+			}
+			weights[key][year] = w
+		}
+	}
+	return weights, nil
+}
+
+// setCESWeights sets cesWeights from c.
+func setCESWeights(c cesWeightConfig) error {
+	cesWeightSetting = c
+	cesWeights = nil
+	if c.File == "" {
+		return nil
+	}
+	w, err := readCESWeights(c.File)
+	if err != nil {
+		err = errors.Wrap(err, "error reading CESWeights file")
+		if errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return withKind(kindConfig, err)
+	}
+	cesWeights = w
+	return nil
+}
+
+// cesWeightFor returns the weight of dem's CES data for year, which
+// defaults to 1.
+func cesWeightFor(dem *eieiorpc.Demograph, year int32) cesWeight {
+	byYear := cesWeights[demographKey(dem)]
+	if w, ok := byYear[year]; ok {
+		return w
+	}
+	if w, ok := byYear[0]; ok {
+		return w
+	}
+	return cesWeight{population: 1, consumption: 1}
+}
+
+// weightConsumption returns consumption, the CES consumption of dem in
+// year, multiplied by its consumption weight.
+func weightConsumption(consumption *eieiorpc.Vector, dem *eieiorpc.Demograph, year int32) *eieiorpc.Vector {
+	w := cesWeightFor(dem, year).consumption
+	if w == 1 {
+		return consumption
+	}
+	data := make([]float64, len(consumption.Data))
+	for i, v := range consumption.Data {
+		data[i] = v * w
+	}
+	return &eieiorpc.Vector{Data: data}
+}
+
+// weightCount returns count, the CES population count of dem in year,
+// multiplied by its population weight.
+func weightCount(count int, dem *eieiorpc.Demograph, year int32) int {
+	return int(math.Round(float64(count) * cesWeightFor(dem, year).population))
+}
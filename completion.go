@@ -0,0 +1,331 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// commandAliases maps short names to the commands in commands.
+var commandAliases = map[string]string{
+	"eq":   "equalize",
+	"ext":  "externality",
+	"inv":  "inventory-report",
+	"opt":  "optimize",
+	"pre":  "precompute",
+	"stab": "stability",
+}
+
+// resolveCommand returns the command name that name is an alias of, or name.
+func resolveCommand(name string) string {
+	if cmd, ok := commandAliases[name]; ok {
+		return cmd
+	}
+	return name
+}
+
+// completeCommand is the hidden command called by the completion scripts,
+// which is not listed among the completions.
+const completeCommand = "__complete"
+
+// The completion commands refer to commands, so they are added to it here
+// rather than in its declaration, which would be an initialization cycle.
+func init() {
+	commands["completion"] = completionCommand
+	commands[completeCommand] = func(args []string) error {
+		for _, c := range completions(args) {
+			fmt.Println(c)
+		}
+		return nil
+	}
+}
+
+// subcommands are the values of the first argument of commands that take
+// one before their flags.
+var subcommands = map[string][]string{
+	"data":   {"status"},
+	"demand": {"export", "import"},
+	"export": {"snapshot", "matrix", "grid", "populations", "crosswalk"},
+}
+
+// positionals are the values of the positional arguments of commands whose
+// arguments aren't files.
+var positionals = map[string][]string{
+	"completion": {"bash", "fish", "zsh"},
+}
+
+var (
+	// collectFlags, if set, is passed the flag set of a command instead of
+	// the command running; see parseFlags.
+	collectFlags      func(*flag.FlagSet)
+	errFlagsCollected = fmt.Errorf("flags collected")
+)
+
+// commandFlags returns the flags of the named command (with sub as its
+// subcommand, if it has any), or nil if it has none. The command function
+// is called, but returns from parseFlags before doing anything.
+func commandFlags(name, sub string) *flag.FlagSet {
+	cmd, ok := commands[name]
+	if !ok || name == completeCommand {
+		return nil
+	}
+	var fs *flag.FlagSet
+	collectFlags = func(f *flag.FlagSet) { fs = f }
+	defer func() { collectFlags = nil }()
+	var args []string
+	if sub != "" {
+		args = []string{sub}
+	}
+	if err := cmd(args); err != errFlagsCollected {
+		return nil
+	}
+	return fs
+}
+
+// completions returns the completions of the last of words, the arguments
+// typed so far, which may be empty. Flags can be completed with their
+// values as -flag=value or in the next argument. No completions means
+// that the argument is a file.
+func completions(words []string) []string {
+	if len(words) == 0 {
+		return nil
+	}
+	cur, prev := words[len(words)-1], words[:len(words)-1]
+	if len(prev) == 0 {
+		var names []string
+		for name := range commands {
+			if name != completeCommand {
+				names = append(names, name)
+			}
+		}
+		return matching(names, cur)
+	}
+	name, args := resolveCommand(prev[0]), prev[1:]
+	var sub string
+	if subs, ok := subcommands[name]; ok {
+		if len(args) == 0 {
+			return matching(subs, cur)
+		}
+		sub, args = args[0], args[1:]
+	}
+	fs := commandFlags(name, sub)
+	if fs == nil {
+		return matching(positionals[name], cur)
+	}
+	if len(args) > 0 {
+		last := args[len(args)-1]
+		if strings.HasPrefix(last, "-") && !strings.Contains(last, "=") {
+			if f := fs.Lookup(strings.TrimLeft(last, "-")); f != nil && !isBoolFlag(f) {
+				return flagValues(name, f.Name, cur)
+			}
+		}
+	}
+	if !strings.HasPrefix(cur, "-") {
+		return matching(positionals[name], cur)
+	}
+	if i := strings.Index(cur, "="); i >= 0 {
+		var out []string
+		for _, v := range flagValues(name, strings.TrimLeft(cur[:i], "-"), cur[i+1:]) {
+			out = append(out, cur[:i+1]+v)
+		}
+		return out
+	}
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "-"+f.Name) })
+	return matching(names, cur)
+}
+
+// isBoolFlag returns whether f is a boolean flag, which takes no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// matching returns the sorted values starting with prefix.
+func matching(values []string, prefix string) []string {
+	var out []string
+	for _, v := range values {
+		if strings.HasPrefix(v, prefix) {
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// matchingLast returns the completions of the last item of cur, a
+// comma-separated list.
+func matchingLast(values []string, cur string) []string {
+	i := strings.LastIndex(cur, ",") + 1
+	var out []string
+	for _, v := range matching(values, cur[i:]) {
+		out = append(out, cur[:i]+v)
+	}
+	return out
+}
+
+// flagValues returns the completions of cur as the value of the named flag
+// of cmd, or nil for flags whose values are files or can't be listed.
+func flagValues(cmd, name, cur string) []string {
+	switch name {
+	case "year", "from", "to":
+		years, err := configuredYears()
+		if err != nil {
+			years = defaultYears
+		}
+		names := make([]string, len(years))
+		for i, y := range years {
+			names[i] = y.String()
+		}
+		return matching(names, cur)
+	case "demographic":
+		return matching(demographNames(), cur)
+	case "demographics":
+		return matchingLast(demographNames(), cur)
+	case "populations":
+		var names []string
+		if cfg, _, err := readConfig(); err == nil {
+			names = append(cfg.SpatialEIO.CSTConfig.CensusPopColumns, cfg.SpatialEIO.CSTConfig.CensusIncomeDecileNames...)
+			for name := range cfg.Sandbox.Populations {
+				names = append(names, name)
+			}
+		}
+		return matchingLast(names, cur)
+	case "hr":
+		if cfg, _, err := readConfig(); err == nil {
+			registerHRIntervals(cfg.Sandbox.HRIntervals)
+		}
+		names := make([]string, len(hazardRatios))
+		for i, hr := range hazardRatios {
+			names[i] = hr.Name()
+		}
+		return matching(names, cur)
+	case "aqm":
+		names := []string{"isrm"}
+		if cfg, _, err := readConfig(); err == nil && len(cfg.SpatialEIO.CSTConfig.SRFiles) > 0 {
+			names = names[:0]
+			for aqm := range cfg.SpatialEIO.CSTConfig.SRFiles {
+				names = append(names, aqm)
+			}
+		}
+		return matching(names, cur)
+	case "emission":
+		var names []string
+		for n := range eieiorpc.Emission_value {
+			names = append(names, n)
+		}
+		return matching(names, cur)
+	case "rescale":
+		return matching([]string{rescaleNone, rescaleTotal, rescaleUnedited}, cur)
+	case "type":
+		var names []string
+		for n := range eieiorpc.FinalDemandType_value {
+			names = append(names, n)
+		}
+		return matching(names, cur)
+	case "exposure-function":
+		return matching(exposureFunctionNames(), cur)
+	case "only":
+		var names []string
+		if datasets, err := loadDatasets(datasetsFile()); err == nil {
+			for _, d := range datasets {
+				names = append(names, d.Name)
+			}
+		}
+		return matching(names, cur)
+	case "metric":
+		switch cmd {
+		case "export":
+			return matching([]string{"emissions", "deaths"}, cur)
+		case "optimize":
+			return matching([]string{disparityRange, disparityMax}, cur)
+		}
+	}
+	return nil
+}
+
+// demographNames returns the demograph keys and groups accepted by
+// parseDemographs.
+func demographNames() []string {
+	names := []string{"decile", "ethnicity"}
+	for _, dem := range append(decileDemographs(), ethnicityDemographs()...) {
+		names = append(names, demographKey(dem))
+	}
+	return names
+}
+
+// completionScripts are the shell completion scripts by shell, in which
+// PROG is replaced by the name of the program and FUNC by a shell function
+// name derived from it. Each calls the program's __complete command with
+// the words on the command line and falls back to file names when it
+// prints nothing.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for PROG
+FUNC() {
+	local line=${COMP_LINE:0:COMP_POINT}
+	local -a words
+	read -ra words <<<"$line"
+	[[ $line == *[[:space:]] ]] && words+=("")
+	local cur=${words[${#words[@]}-1]}
+	# Bash splits words at COMP_WORDBREAKS characters such as = and :,
+	# so only replace the part of cur after the last of them.
+	local prefix=${cur%"${COMP_WORDS[COMP_CWORD]}"}
+	local IFS=$'\n'
+	COMPREPLY=($(PROG __complete "${words[@]:1}" 2>/dev/null))
+	COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+}
+complete -o default -F FUNC PROG
+`,
+	"zsh": `#compdef PROG
+FUNC() {
+	local -a out
+	out=(${(f)"$(PROG __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#out} == 0 )); then
+		_files
+	else
+		compadd -Q -- "${out[@]}"
+	fi
+}
+compdef FUNC PROG
+`,
+	"fish": `# fish completion for PROG
+function FUNC
+	set -l out (PROG __complete (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)
+	if test (count $out) -eq 0
+		__fish_complete_path (commandline -ct)
+	else
+		printf '%s\n' $out
+	end
+end
+complete -c PROG -f -a '(FUNC)'
+`,
+}
+
+// completionCommand prints a completion script for bash, zsh or fish.
+func completionCommand(args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	prog := fs.String("name", filepath.Base(os.Args[0]), "name of the installed program to complete")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s completion [-name program] bash|zsh|fish\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "completion requires exactly one shell")
+	}
+	script, ok := completionScripts[fs.Arg(0)]
+	if !ok {
+		return errorf(kindUsage, "invalid shell %q; valid shells are bash, zsh and fish", fs.Arg(0))
+	}
+	fn := "_" + regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(*prog, "_") + "_complete"
+	fmt.Print(strings.NewReplacer("PROG", *prog, "FUNC", fn).Replace(script))
+	return nil
+}
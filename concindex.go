@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"example.com/m/v2/exposuremath"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+// concentrationIndexHeader is the header of concentration_index.csv.
+var concentrationIndexHeader = []string{"Year", "Pollutant", "ConcentrationIndex", "StdErr", "Cells"}
+
+// concentrationIndexRows returns a row of concentrationIndexHeader for
+// each pollutant, from the concentrations caused by demand and the income
+// decile populations of each grid cell.
+func concentrationIndexRows(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector) ([][]string, error) {
+	ctx, span := startSpan(ctx, "concentrationIndexRows")
+	defer span.End()
+	deciles := s.CSTConfig.CensusIncomeDecileNames
+	if len(deciles) < 2 {
+		return nil, errorf(kindConfig, "the concentration index requires income decile populations; set CensusIncomeDecileNames in the config")
+	}
+	var rows [][]string
+	for val := 0; val < len(eieiorpc.Pollutant_name); val++ {
+		pol := eieiorpc.Pollutant(val)
+		vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+			Demand:    demand,
+			Pollutant: pol,
+			Year:      year,
+			Location:  LOC,
+			AQM:       aqm,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating %s concentrations", pol)
+		}
+		g, err := getExposureGrids(ctx, s, aqm, vec.Data, nil)
+		if err != nil {
+			return nil, err
+		}
+		var away float64
+		if len(timeActivity.HomeFraction) > 0 {
+			if err := timeActivity.checkPopulations(g.popNames); err != nil {
+				return nil, err
+			}
+			away = awayConcentration(g.conc, g.receptors, g.popNames, g.pops, s.CSTConfig.CensusTotalPopColumn)
+		}
+		exposures := make([][]float64, len(deciles))
+		pops := make([][]float64, len(deciles))
+		for k, d := range deciles {
+			pop, ok := g.pops[d]
+			if !ok {
+				return nil, errorf(kindDataMissing, "missing population for income decile %s", d)
+			}
+			exposures[k] = make([]float64, len(g.conc))
+			pops[k] = make([]float64, len(g.conc))
+			for i, c := range g.conc {
+				if g.receptors != nil && !g.receptors[i] {
+					continue
+				}
+				pops[k][i] = pop[i]
+				exposures[k][i] = timeActivity.adjust(d, c*pop[i], pop[i], away)
+			}
+		}
+		ci, se, n, err := exposuremath.JackknifeConcentrationIndex(exposures, pops)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []string{strconv.Itoa(int(year)), pol.String(), formatFloat(ci), formatFloat(se), strconv.Itoa(n)})
+	}
+	return rows, nil
+}
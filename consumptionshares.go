@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/floats"
+)
+
+// endUseGroup is an aggregated sector of the commodities consumed, such
+// as food, as defined by the IOAggregatorFile in the config.
+type endUseGroup struct {
+	Name, Abbrev string
+
+	// Mask is 1 for the commodities in the group and 0 otherwise.
+	Mask []float64
+}
+
+// getEndUseGroups returns the end-use groups of s. Each commodity is in
+// exactly one group.
+func getEndUseGroups(ctx context.Context, s *eieio.Server) ([]endUseGroup, error) {
+	names, err := s.EndUseGroupNames(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	abbrevs, err := s.EndUseGroupAbbrevs(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(abbrevs.List) == 0 {
+		return nil, errorf(kindConfig, "consumption shares require end-use groups; set IOAggregatorFile in the config")
+	}
+	groups := make([]endUseGroup, len(abbrevs.List))
+	for i, abbrev := range abbrevs.List {
+		m, err := s.EndUseMask(ctx, &eieiorpc.StringInput{String_: abbrev})
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = endUseGroup{Name: names.List[i], Abbrev: abbrev, Mask: m.Data}
+	}
+	return groups, nil
+}
+
+// consumptionSharesHeader is the header of consumption_shares.csv.
+var consumptionSharesHeader = []string{"Demographic", "Label", "Sector", "Abbrev", "Consumption", "Share", "Emissions", "EmissionsPerDollar", "Exposure"}
+
+// writeConsumptionShares writes the consumption of each demographic by
+// end-use group to path, with the group's share of the demographic's
+// total consumption and the PM2.5 emissions and exposure it causes, so
+// that the composition of consumption can be read alongside its emission
+// intensity. It requires one emissions and one concentration calculation
+// per demographic and group.
+func writeConsumptionShares(ctx context.Context, s *eieio.Server, sc *scenario, dems []*eieiorpc.Demograph, multipliers []float64, path string) error {
+	ctx, span := startSpan(ctx, "writeConsumptionShares")
+	defer span.End()
+	groups, err := getEndUseGroups(ctx, s)
+	if err != nil {
+		return err
+	}
+	totalPop, err := cubeTotalPopulation(ctx, s, sc.AQM)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, dem := range dems {
+		demand, err := getDemographicDemand(ctx, s, dem, sc.Year, multipliers)
+		if err != nil {
+			return err
+		}
+		pop, err := groupExposureWeights(ctx, s, sc, demand, totalPop)
+		if err != nil {
+			return err
+		}
+		var total float64
+		for _, v := range demand.Data {
+			total += v
+		}
+		for _, g := range groups {
+			masked := make([]float64, len(demand.Data))
+			var dollars float64
+			for i, v := range demand.Data {
+				masked[i] = v * g.Mask[i]
+				dollars += masked[i]
+			}
+			// Emissions are not population-adjusted, as the consumption
+			// isn't.
+			var kg, exposure float64
+			if dollars != 0 {
+				emis, err := getEmissionsBySCC(ctx, &eieiorpc.Vector{Data: masked}, s, eieiorpc.Emission_PM25, sc.Year, LOC, sc.AQM)
+				if err != nil {
+					return errors.Wrapf(err, "end-use group %s", g.Abbrev)
+				}
+				for _, v := range emis.RawVector().Data {
+					kg += v
+				}
+				conc, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+					Demand:    &eieiorpc.Vector{Data: masked},
+					Pollutant: eieiorpc.Pollutant_TotalPM25,
+					Year:      sc.Year,
+					Location:  LOC,
+					AQM:       sc.AQM,
+				})
+				if err != nil {
+					return errors.Wrapf(err, "end-use group %s", g.Abbrev)
+				}
+				if err := checkGrid(s, sc.AQM, len(conc.Data), "PM2.5 concentrations"); err != nil {
+					return err
+				}
+				exposure = floats.Dot(conc.Data, pop)
+			}
+			var share, perDollar float64
+			if total != 0 {
+				share = dollars / total
+			}
+			if dollars != 0 {
+				perDollar = kg / dollars
+			}
+			rows = append(rows, []string{demographKey(dem), labels.demograph(dem), g.Name, g.Abbrev,
+				formatFloat(dollars), formatFloat(share), formatFloat(kg), formatFloat(perDollar), formatFloat(exposure)})
+		}
+	}
+	return writeCSV(path, consumptionSharesHeader, rows)
+}
+
+// groupExposureWeights returns the total population of each grid cell,
+// weighted with a nonlinear exposure function or a background
+// concentration by the total PM2.5 concentration that demand causes, so
+// that the exposures caused by the end-use groups of demand sum to the
+// exposure it causes.
+func groupExposureWeights(ctx context.Context, s *eieio.Server, sc *scenario, demand *eieiorpc.Vector, totalPop []float64) ([]float64, error) {
+	if !exposureWeighted(ctx) {
+		return totalPop, nil
+	}
+	total, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      sc.Year,
+		Location:  LOC,
+		AQM:       sc.AQM,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "calculating total PM2.5 concentrations")
+	}
+	weights, err := exposureWeights(ctx, total.Data)
+	if err != nil {
+		return nil, err
+	}
+	return scaleByCell(totalPop, weights)
+}
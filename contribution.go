@@ -10,89 +10,221 @@ import (
 	"github.com/pkg/errors"
 	"gonum.org/v1/gonum/mat"
 	"log"
+	"math"
 )
 
-// Given an EIEIO server, get the consumption for the specified demographic and year
-// organized by SCC
-func getConsumptionBySCC(ctx context.Context, s *eieio.Server, dem *eieiorpc.Demograph, year int32) (*mat.VecDense, error) {
-	totalConsRPC, err := s.CES.DemographicConsumption(ctx, &eieiorpc.DemographicConsumptionInput{
-		Year:      year,
-		Demograph: dem,
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "error calculating demographic consumption")
-	}
+// Units used for contribution calculations:
+//   - Demand (final demand and demographic consumption) is in dollars per
+//     year, by IO commodity. BEA tables are in millions of dollars and are
+//     converted to dollars by EIEIO.
+//   - Emissions are primary PM2.5 emissions in kg per year, by SCC, as
+//     caused by the given demand through the EIO (Leontief) model.
+// Emissions attributable to a demographic are therefore computed by passing
+// the demographic's own dollar demand through the EIO model, rather than by
+// scaling national emissions.
 
-	consumptionBySCC := make([]float64, len(s.SCCs))
-	for industryIdx, consumption := range totalConsRPC.Data {
-		SCCs := s.IndustryToSCCMap[industryIdx]
-		for _, sccIdx := range SCCs {
-			consumptionBySCC[sccIdx] += consumption
+// Given an EIEIO server, get the final demand in dollars for the specified
+// demographic and year, by IO commodity. CES consumption shares are
+// converted to dollars by applying them to national personal consumption
+// and private residential expenditures; see ces.CES.DemographicConsumption.
+// If multipliers is non-nil, each commodity's demand is scaled by the
+// corresponding multiplier. Missing CES data is handled according to
+// missingCES.
+func getDemographicDemand(ctx context.Context, s *eieio.Server, dem *eieiorpc.Demograph, year int32, multipliers []float64) (*eieiorpc.Vector, error) {
+	ctx, span := startSpan(ctx, "getDemographicDemand")
+	defer span.End()
+	data, err := cachedDemographic(ctx, "demand", dem, []interface{}{year, hashFloats(multipliers)}, func(ctx context.Context) ([]float64, error) {
+		demand, err := demographicConsumption(ctx, s, dem, year)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating demographic consumption")
+		}
+		if err := scaleDemand(demand, multipliers); err != nil {
+			return nil, err
 		}
+		return demand.Data, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return mat.NewVecDense(len(consumptionBySCC), consumptionBySCC), nil
+	return &eieiorpc.Vector{Data: data}, nil
 }
 
-// Get emissions by SCC for the specified year and location
-func getEmissionsBySCC(ctx context.Context, demand *eieiorpc.Vector, s *eieio.Server, year int32, loc eieiorpc.Location) (*mat.VecDense, error) {
-	emisRPC, err := s.EmissionsMatrix(ctx, &eieiorpc.EmissionsMatrixInput{
-		Demand:               demand,
-		Year:                 year,
-		Location:             loc,
-		AQM:                  "isrm",
+// Get emissions of pol in kg/year by SCC caused by demand (in dollars) for
+// the specified year, location, and air quality model
+func getEmissionsBySCC(ctx context.Context, demand *eieiorpc.Vector, s *eieio.Server, pol eieiorpc.Emission, year int32, loc eieiorpc.Location, aqm string) (*mat.VecDense, error) {
+	ctx, span := startSpan(ctx, "getEmissionsBySCC")
+	defer span.End()
+	emis, err := emissionsMatrix(ctx, s, &eieiorpc.EmissionsMatrixInput{
+		Demand:   demand,
+		Emission: pol,
+		Year:     year,
+		Location: loc,
+		AQM:      aqm,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting emissions matrix")
 	}
-	emis := rpc2mat(emisRPC)
-
-	if _, c := emis.Dims(); c != len(s.SCCs) {
-		return nil, fmt.Errorf("expected emissions to have #SCC %d columns, got %d", len(s.SCCs), c)
+	m, err := emissionFactorMultipliers(ctx, s, pol, year, aqm)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := countedSCCs(s, m)
+	if err != nil {
+		return nil, err
 	}
 
-	emisSCC := make([]float64, len(s.SCCs))
-	for sectorIdx := range s.SCCs {
-		emissionsForSector := emis.ColView(sectorIdx)
-		var totalEmissions float64 = 0
-		for i := 0; i < emissionsForSector.Len(); i++ {
-			totalEmissions += emissionsForSector.AtVec(i)
+	emisSCC := sumSCCColumns(emis, cols, m)
+	if allFinite(demand.Data) {
+		if err := checkFinite(ctx, fmt.Sprintf("%s emissions by SCC", pol), emisSCC, sccLabel(s)); err != nil {
+			return nil, err
 		}
-		emisSCC[sectorIdx] = totalEmissions
 	}
 
 	return mat.NewVecDense(len(emisSCC), emisSCC), nil
 }
 
-// Return a matrix of emissions by demographic and sector
-// along with the rows/columns for that matrix
-func demAndEmissions(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, dems []*eieiorpc.Demograph, year int32, loc eieiorpc.Location) (*mat.Dense, []slca.SCC, error) {
-	emis, err := getEmissionsBySCC(ctx, demand, s, year, loc)
+// sumSCCColumns returns the sum over grid cells of the columns cols of the
+// grid×SCC matrix emis, each scaled by its multiplier in m if m is non-nil.
+// Only those columns are summed, a row of grid cells at a time; the others
+// are zero.
+func sumSCCColumns(emis *mat.Dense, cols []int, m []float64) []float64 {
+	r, c := emis.Dims()
+	sums := make([]float64, c)
+	for i := 0; i < r; i++ {
+		row := emis.RawRowView(i)
+		for _, j := range cols {
+			sums[j] += row[j]
+		}
+	}
+	if m != nil {
+		for _, j := range cols {
+			sums[j] *= m[j]
+		}
+	}
+	return sums
+}
+
+// countedSCCs returns the indices of the SCCs of s whose emissions are
+// counted: those included by the SCC filter whose emission factor
+// multiplier, if m is non-nil, isn't zero.
+func countedSCCs(s *eieio.Server, m []float64) ([]int, error) {
+	mask, err := sccFilterMask(s)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error getting emissions by SCC")
+		return nil, err
 	}
+	cols := make([]int, 0, len(s.SCCs))
+	for j := range s.SCCs {
+		if (mask == nil || mask[j] != 0) && (m == nil || m[j] != 0) {
+			cols = append(cols, j)
+		}
+	}
+	return cols, nil
+}
+
+// Return a matrix of emissions (kg/year) by demographic and sector caused
+// by each demographic's consumption, along with the columns for that matrix.
+// multipliers optionally scales each commodity's demand; see getDemographicDemand.
+func demAndEmissions(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, year int32, loc eieiorpc.Location, aqm string, multipliers []float64) (*mat.Dense, []slca.SCC, error) {
+	m, err := demAndEmissionsOf(ctx, s, dems, eieiorpc.Emission_PM25, year, loc, aqm, multipliers)
+	return m, s.SCCs, err
+}
 
+// demAndEmissionsOf is demAndEmissions for emissions of pol.
+func demAndEmissionsOf(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, pol eieiorpc.Emission, year int32, loc eieiorpc.Location, aqm string, multipliers []float64) (*mat.Dense, error) {
+	rows, err := demEmissionRows(ctx, s, dems, pol, year, loc, aqm, multipliers)
+	if err != nil {
+		return nil, err
+	}
 	demAndSec := mat.NewDense(len(dems), len(s.SCCs), nil)
+	for demIdx, row := range rows {
+		demAndSec.SetRow(demIdx, row)
+	}
+	return demAndSec, nil
+}
+
+// demEmissionRows returns the emissions of pol (kg/year) caused by each of
+// dems by SCC, indexed as s.SCCs.
+func demEmissionRows(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, pol eieiorpc.Emission, year int32, loc eieiorpc.Location, aqm string, multipliers []float64) ([][]float64, error) {
+	ctx, span := startSpan(ctx, "demAndEmissions")
+	defer span.End()
+	rows := make([][]float64, len(dems))
 	for demIdx := range dems {
-		consumption, err := getConsumptionBySCC(ctx, s, dems[demIdx], year)
+		emis, err := cachedDemographic(ctx, "emissions", dems[demIdx], []interface{}{pol, year, loc, aqm, hashFloats(multipliers)}, func(ctx context.Context) ([]float64, error) {
+			demand, err := getDemographicDemand(ctx, s, dems[demIdx], year, multipliers)
+			if err != nil {
+				return nil, errors.Wrap(err, "error getting consumption")
+			}
+			emis, err := getEmissionsBySCC(ctx, demand, s, pol, year, loc, aqm)
+			if err != nil {
+				return nil, errors.Wrap(err, "error getting emissions by SCC")
+			}
+			return emis.RawVector().Data, nil
+		})
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "error getting consumption")
+			return nil, err
 		}
-
-		var manualDot float64 = 0
-		for sectorIdx := 0; sectorIdx < consumption.Len(); sectorIdx++ {
-			emisForDemAndSCC := consumption.At(sectorIdx, 0) * emis.At(sectorIdx, 0)
-			manualDot += emisForDemAndSCC
-			demAndSec.Set(demIdx, sectorIdx, emisForDemAndSCC)
+		if len(emis) != len(s.SCCs) {
+			return nil, errorf(kindNumeric, "expected emissions for %d SCCs, got %d", len(s.SCCs), len(emis))
 		}
+		rows[demIdx] = emis
+		reportProgress(ctx, Progress{
+			Stage:       "emissions by demographic",
+			Year:        year,
+			Demographic: demographKey(dems[demIdx]),
+			Percent:     100 * float64(demIdx+1) / float64(len(dems)),
+		})
 	}
-
-	return demAndSec, s.SCCs, nil
+	return rows, nil
 }
 
+// demEmissions holds the emissions (kg/year) caused by each demographic's
+// consumption by SCC, for each emitted pollutant and, optionally, for
+// domestic and imported production separately.
+type demEmissions struct {
+	Emissions []eieiorpc.Emission
+	Locations []eieiorpc.Location
+
+	// Values holds a demographic×SCC matrix for each location and
+	// emission, indexed [location][emission].
+	Values [][]*mat.Dense
+}
 
+// demAndEmissionsByPollutant returns the emissions caused by each of dems
+// for every emitted pollutant, unlike demAndEmissions, which returns only
+// PM2.5. If byLocation is true, emissions from domestic and imported
+// production are returned separately; otherwise only those of LOC are.
+// If popAdjust is true, the emissions are population-adjusted as in
+// getContributionByDemograph.
+func demAndEmissionsByPollutant(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, year int32, aqm string, multipliers []float64, byLocation, popAdjust bool) (*demEmissions, error) {
+	ctx, span := startSpan(ctx, "demAndEmissionsByPollutant")
+	defer span.End()
+	e := &demEmissions{Locations: []eieiorpc.Location{LOC}}
+	if byLocation {
+		e.Locations = []eieiorpc.Location{eieiorpc.Location_Domestic, eieiorpc.Location_Imported}
+	}
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		e.Emissions = append(e.Emissions, eieiorpc.Emission(val))
+	}
+	e.Values = make([][]*mat.Dense, len(e.Locations))
+	for i, loc := range e.Locations {
+		e.Values[i] = make([]*mat.Dense, len(e.Emissions))
+		for j, pol := range e.Emissions {
+			m, err := demAndEmissionsOf(ctx, s, dems, pol, year, loc, aqm, multipliers)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s %s emissions", loc, pol)
+			}
+			if popAdjust {
+				if err := populationAdjust(ctx, s, m, dems, year); err != nil {
+					return nil, err
+				}
+			}
+			e.Values[i][j] = m
+		}
+	}
+	return e, nil
+}
 
-func contributionSideTest(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location, demand *eieiorpc.Vector) error {
+func contributionSideTest(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location) error {
 	/*
 	var eths []eieiorpc.Demograph
 	for val := 0; val < len(eieiorpc.Ethnicity_value); val++ {
@@ -103,58 +235,103 @@ func contributionSideTest(ctx context.Context, s *eieio.Server, year int32, loc
 	}
 	dems := eths*/
 
-	var deciles []*eieiorpc.Demograph
-	for val := 0; val < len(eieiorpc.Decile_value); val++ {
-		dec := eieiorpc.Decile(val)
-		if dec != eieiorpc.Decile_Decile_All {
-			deciles = append(deciles, ces.DecileToDemograph(dec))
-		}
-	}
-	dems := deciles
+	dems := decileDemographs()
 
-	emisByDemAndSCC, _, err := demAndEmissions(ctx, s, demand, dems, year, loc)
+	contributions, err := getContributionByDemograph(ctx, s, dems, year, loc, "isrm", nil)
 	if err != nil {
 		return err
 	}
 
-	err = populationAdjust(s, emisByDemAndSCC, dems)
+	for demIdx, demTotalEmissions := range contributions {
+		log.Printf("Demographic: %s\tTotal emissions (pop-adjusted): %.2f", labels.demograph(dems[demIdx]), demTotalEmissions)
+	}
+
+	return nil
+}
+
+// Get the total population-adjusted emissions (kg/year) attributable to each
+// demographic's consumption, in the order of dems
+func getContributionByDemograph(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, year int32, loc eieiorpc.Location, aqm string, multipliers []float64) ([]float64, error) {
+	ctx, span := startSpan(ctx, "getContributionByDemograph")
+	defer span.End()
+	m, err := contributionMatrix(ctx, s, dems, year, loc, aqm, multipliers)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return m.Totals(), nil
+}
 
-	for demIdx := range dems {
-		var demTotalEmissions float64 = 0
-		for _, emisForSCCForDem := range emisByDemAndSCC.RawRowView(demIdx) {
-			demTotalEmissions += emisForSCCForDem
+// Return a demograph for each income decile, excluding Decile_All
+func decileDemographs() []*eieiorpc.Demograph {
+	var deciles []*eieiorpc.Demograph
+	for val := 0; val < len(eieiorpc.Decile_value); val++ {
+		dec := eieiorpc.Decile(val)
+		if dec != eieiorpc.Decile_Decile_All {
+			deciles = append(deciles, ces.DecileToDemograph(dec))
 		}
-		log.Printf("Index: %d\tTotal emissions (pop-adjusted): %.2f", demIdx, demTotalEmissions)
 	}
+	return deciles
+}
 
-	return nil
+// Return a demograph for each ethnicity, excluding Ethnicity_All
+func ethnicityDemographs() []*eieiorpc.Demograph {
+	var eths []*eieiorpc.Demograph
+	for val := 0; val < len(eieiorpc.Ethnicity_value); val++ {
+		eth := eieiorpc.Ethnicity(val)
+		if eth != eieiorpc.Ethnicity_Ethnicity_All {
+			eths = append(eths, ces.EthnicityToDemograph(eth))
+		}
+	}
+	return eths
 }
 
-func populationAdjust(s *eieio.Server, emisByDemAndSCC *mat.Dense, dems []*eieiorpc.Demograph) error {
-	// multiplying result values by the ratio of the total population count
-	// to the population count of the group in question
-	totalPop := 0
+// populationAdjust multiplies each row of emisByDemAndSCC by the ratio of
+// the total population count of dems to that of the row's demographic in
+// year, using the counts of another year as MissingCES allows.
+func populationAdjust(ctx context.Context, s *eieio.Server, emisByDemAndSCC *mat.Dense, dems []*eieiorpc.Demograph, year int32) error {
 	popCounts := make([]int, len(dems))
+	keys := make([]string, len(dems))
 	for demIdx, dem := range dems {
-		demCount, err := s.CES.TotalPopulationCount(dem, 2015) // N: hardcoded year
+		demCount, err := totalPopulationCount(ctx, s, dem, year)
 		if err != nil {
 			return err
 		}
-		totalPop += demCount
-		popCounts[demIdx] = demCount
+		popCounts[demIdx], keys[demIdx] = demCount, demographKey(dem)
 	}
+	return scaleToPopulation(ctx, emisByDemAndSCC, keys, popCounts)
+}
 
+// scaleToPopulation multiplies each row of emisByDemAndSCC by the ratio of
+// the total of popCounts to the row's count, that of the demographic keys
+// names. Rows whose count is zero, skipped for missing CES data, become
+// NaN.
+func scaleToPopulation(ctx context.Context, emisByDemAndSCC *mat.Dense, keys []string, popCounts []int) error {
+	totalPop := 0
+	for _, n := range popCounts {
+		totalPop += n
+	}
 	numRows, numCols := emisByDemAndSCC.Dims()
-	if numRows != len(dems) {
-		return fmt.Errorf("Expected emissions to have length of dem, %d != %d", numRows, len(dems))
+	if numRows != len(popCounts) {
+		return errorf(kindNumeric, "Expected emissions to have length of dem, %d != %d", numRows, len(popCounts))
 	}
-	for demIdx := range dems {
-		adjustRatio := float64(totalPop)/float64(popCounts[demIdx])
+	for demIdx := range popCounts {
+		adjustRatio := float64(totalPop) / float64(popCounts[demIdx])
+		if popCounts[demIdx] == 0 {
+			// Skipped because of missing CES data.
+			adjustRatio = math.NaN()
+		}
+		row := emisByDemAndSCC.RawRowView(demIdx)
+		// A skipped demographic's emissions are already NaN, so only
+		// those made non-finite here, as by a group with no people, are
+		// checked.
+		checked := allFinite(row)
 		for j := 0; j < numCols; j++ {
-			emisByDemAndSCC.Set(demIdx, j, emisByDemAndSCC.At(demIdx, j) * adjustRatio)
+			row[j] *= adjustRatio
+		}
+		if checked {
+			if err := checkFinite(ctx, fmt.Sprintf("population adjustment of %s (group count %d of %d)", keys[demIdx], popCounts[demIdx], totalPop), row, indexLabel("column")); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+// bounded maps the arbitrary values generated by testing/quick, which
+// overflow when summed, into ±1e6.
+func bounded(v float64) float64 {
+	return math.Mod(v, 1e6)
+}
+
+func TestScaleToPopulation(t *testing.T) {
+	nan := math.NaN()
+	for _, test := range []struct {
+		name   string
+		emis   []float64 // 2 demographics by 2 SCCs
+		counts []int
+		want   []float64
+	}{
+		{
+			name:   "scaled to the total",
+			emis:   []float64{1, 2, 4, 0},
+			counts: []int{1, 3},
+			want:   []float64{4, 8, 16.0 / 3, 0},
+		},
+		{
+			// A demographic skipped for missing CES data has NaN
+			// emissions and no count; it stays NaN without an error.
+			name:   "skipped demographic",
+			emis:   []float64{1, 2, nan, nan},
+			counts: []int{2, 0},
+			want:   []float64{1, 2, nan, nan},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			emis := mat.NewDense(2, 2, test.emis)
+			if err := scaleToPopulation(context.Background(), emis, []string{"a", "b"}, test.counts); err != nil {
+				t.Fatal(err)
+			}
+			for i, v := range emis.RawMatrix().Data {
+				if w := test.want[i]; !(math.Abs(v-w) < 1e-12 || math.IsNaN(v) && math.IsNaN(w)) {
+					t.Errorf("got %v, want %v", emis.RawMatrix().Data, test.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestScaleToPopulationZeroCount(t *testing.T) {
+	// A group with no people but finite emissions can't be scaled.
+	emis := mat.NewDense(2, 2, []float64{1, 2, 0, 3})
+	err := scaleToPopulation(context.Background(), emis, []string{"a", "b"}, []int{2, 0})
+	if kindOf(err) != kindNumeric {
+		t.Fatalf("got error %v, want a numeric error", err)
+	}
+
+	defer setNonFinitePolicy(nonFinitePolicy)
+	if err := setNonFinitePolicy(nonFiniteZero); err != nil {
+		t.Fatal(err)
+	}
+	emis = mat.NewDense(2, 2, []float64{1, 2, 0, 3})
+	if err := scaleToPopulation(context.Background(), emis, []string{"a", "b"}, []int{2, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if row := emis.RawRowView(1); row[0] != 0 || row[1] != 0 {
+		t.Errorf("with NonFinite = zero, got %v, want zeros", row)
+	}
+}
+
+func TestScaleToPopulationRows(t *testing.T) {
+	emis := mat.NewDense(2, 2, nil)
+	if err := scaleToPopulation(context.Background(), emis, []string{"a"}, []int{1}); kindOf(err) != kindNumeric {
+		t.Errorf("got error %v, want a numeric error", err)
+	}
+}
+
+// TestScaleToPopulationQuick checks that scaling a row back by its share
+// of the population gives the original emissions.
+func TestScaleToPopulationQuick(t *testing.T) {
+	f := func(values [4]float64, c0, c1 uint16) bool {
+		for i := range values {
+			values[i] = bounded(values[i])
+		}
+		counts := []int{int(c0) + 1, int(c1) + 1}
+		total := float64(counts[0] + counts[1])
+		emis := mat.NewDense(2, 2, append([]float64(nil), values[:]...))
+		if err := scaleToPopulation(context.Background(), emis, []string{"a", "b"}, counts); err != nil {
+			return false
+		}
+		for i, v := range emis.RawMatrix().Data {
+			back := v * float64(counts[i/2]) / total
+			if math.Abs(back-values[i]) > 1e-9*math.Max(1, math.Abs(values[i])) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestSumSCCColumnsQuick checks the sums of counted columns against a
+// direct calculation, and that uncounted columns are zero.
+func TestSumSCCColumnsQuick(t *testing.T) {
+	f := func(values [12]float64, counted [4]bool, multipliers [4]float64, scaled bool) bool {
+		for i := range values {
+			values[i] = bounded(values[i])
+		}
+		for j := range multipliers {
+			multipliers[j] = bounded(multipliers[j])
+		}
+		emis := mat.NewDense(3, 4, append([]float64(nil), values[:]...))
+		var cols []int
+		for j, ok := range counted {
+			if ok {
+				cols = append(cols, j)
+			}
+		}
+		var m []float64
+		if scaled {
+			m = multipliers[:]
+		}
+		sums := sumSCCColumns(emis, cols, m)
+		for j := 0; j < 4; j++ {
+			var want float64
+			if counted[j] {
+				want = values[j] + values[4+j] + values[8+j]
+				if scaled {
+					want *= multipliers[j]
+				}
+			}
+			if math.Abs(sums[j]-want) > 1e-9*math.Max(1, math.Abs(want)) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSumSCCColumnsNaN(t *testing.T) {
+	nan := math.NaN()
+	emis := mat.NewDense(2, 3, []float64{
+		1, nan, 2,
+		1, 1, nan,
+	})
+	// A NaN makes the sum of its SCC NaN if the SCC is counted, and is
+	// ignored otherwise.
+	sums := sumSCCColumns(emis, []int{0, 1}, nil)
+	if sums[0] != 2 || !math.IsNaN(sums[1]) || sums[2] != 0 {
+		t.Errorf("got %v, want [2 NaN 0]", sums)
+	}
+}
+
+// TestContributionPipelineQuick feeds matrices of random shapes, with
+// random zero columns and demographics without people, through SCC
+// aggregation, population adjustment, pruning and normalization, checking
+// that the shapes agree at each stage and that NaN only reaches the
+// shares of the demographics without people.
+func TestContributionPipelineQuick(t *testing.T) {
+	f := func(seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		dems, sccs, cells := 1+rng.Intn(5), 1+rng.Intn(6), 1+rng.Intn(4)
+		var cols []int
+		for j := 0; j < sccs; j++ {
+			if rng.Intn(3) > 0 {
+				cols = append(cols, j)
+			}
+		}
+		counts := make([]int, dems)
+		keys := make([]string, dems)
+		data := make([]float64, 0, dems*sccs)
+		for i := range counts {
+			emis := mat.NewDense(cells, sccs, nil)
+			for c := 0; c < cells; c++ {
+				for j := 0; j < sccs; j++ {
+					if rng.Intn(4) > 0 {
+						emis.Set(c, j, rng.Float64()*1e3)
+					}
+				}
+			}
+			sums := sumSCCColumns(emis, cols, nil)
+			if len(sums) != sccs {
+				return false
+			}
+			if counts[i] = rng.Intn(4) * rng.Intn(1000); counts[i] == 0 {
+				// Skipped for missing CES data.
+				for j := range sums {
+					sums[j] = math.NaN()
+				}
+			}
+			keys[i] = string(rune('a' + i))
+			data = append(data, sums...)
+		}
+		byDem := mat.NewDense(dems, sccs, data)
+		if err := scaleToPopulation(context.Background(), byDem, keys, counts); err != nil {
+			return false
+		}
+		rows := make([][]float64, dems)
+		for i := range rows {
+			rows[i] = byDem.RawRowView(i)
+		}
+		pruned, kept := pruneZeroColumns(rows, sccs)
+		if r, c := pruned.Dims(); r != dems || c != len(kept) || c == 0 {
+			return false
+		}
+		m := &ContributionMatrix{SCCs: make([]slca.SCC, len(kept)), Emissions: pruned}
+		for _, mode := range []NormalizeMode{NormalizeDemographic, NormalizeSector, NormalizeTotal} {
+			n, err := m.Normalize(mode)
+			if err != nil {
+				return false
+			}
+			if r, c := n.Emissions.Dims(); r != dems || c != len(kept) {
+				return false
+			}
+			if mode != NormalizeDemographic {
+				continue
+			}
+			for i, count := range counts {
+				for _, v := range n.Emissions.RawRowView(i) {
+					if math.IsNaN(v) != (count == 0) || v < 0 || v > 1 {
+						return false
+					}
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// controlConfig specifies an emission control scenario, such as an EPA
+// regulatory analysis scenario, that scales emissions by SCC, state and
+// year.
+type controlConfig struct {
+	// File is the path to a CSV file with columns
+	// SCC,State,Pollutant,Year,Factor. Factor multiplies the emissions of
+	// the SCC in the state (0.6 for a 40% reduction) from Year on, until
+	// a later entry for the same SCC, State and Pollutant. SCC may be a
+	// code, a prefix ending in "*" or "*" for all SCCs; State and
+	// Pollutant (an NEI pollutant code or Emission name) may be "*". Where
+	// several entries apply, the one with the longest SCC match wins, then
+	// one with a specific state, then one with a specific pollutant.
+	// Leading zeros of SCCs are ignored, so 8-digit point source codes
+	// match their 10-digit forms.
+	File string
+
+	// States are the state polygons, named by States.Field as in the State
+	// column of File. Required if File has entries for specific states.
+	States regionConfig
+
+	// Year is the year the controls are evaluated for, e.g. 2030. Defaults
+	// to the scenario year.
+	Year int32
+}
+
+// control is an entry in a control scenario file.
+type control struct {
+	scc, state string
+	pol        eieiorpc.Emission
+	anyPol     bool
+	year       int32
+	factor     float64
+}
+
+// matches returns the specificity with which c applies to emissions of pol
+// from scc in state, or -1 if it does not apply.
+func (c control) matches(scc, state string, pol eieiorpc.Emission) int {
+	scc = strings.TrimLeft(scc, "0")
+	if !c.anyPol && c.pol != pol {
+		return -1
+	}
+	if c.state != "*" && c.state != state {
+		return -1
+	}
+	var n int
+	switch {
+	case c.scc == "*":
+	case strings.HasSuffix(c.scc, "*"):
+		prefix := strings.TrimSuffix(c.scc, "*")
+		if !strings.HasPrefix(scc, prefix) {
+			return -1
+		}
+		n = 2 * len(prefix)
+	case c.scc == scc:
+		n = 2*len(scc) + 1 // an exact code beats a prefix of the same length
+	default:
+		return -1
+	}
+	n *= 4
+	if c.state != "*" {
+		n += 2
+	}
+	if !c.anyPol {
+		n++
+	}
+	return n
+}
+
+// readControls reads the entries of a control scenario file that are in
+// effect in year: for each SCC, State and Pollutant, the one with the
+// latest Year not after year.
+func readControls(path string, year int32) ([]control, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 5
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	type key struct{ scc, state, pol string }
+	inEffect := make(map[key]control)
+	var order []key
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range rec {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+		c := control{scc: strings.TrimLeft(rec[0], "0"), state: rec[1]}
+		if c.scc == "" || c.state == "" {
+			return nil, fmt.Errorf("control %v must specify an SCC and a State, or \"*\"", rec)
+		}
+		if rec[2] == "*" {
+			c.anyPol = true
+		} else {
+			var ok bool
+			if c.pol, ok = neiPollutants[strings.ToUpper(rec[2])]; !ok {
+				return nil, fmt.Errorf("invalid pollutant %q in control %v", rec[2], rec)
+			}
+		}
+		y, err := strconv.Atoi(rec[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid year %q in control %v", rec[3], rec)
+		}
+		c.year = int32(y)
+		if c.factor, err = strconv.ParseFloat(rec[4], 64); err != nil || c.factor < 0 {
+			return nil, fmt.Errorf("invalid factor %q in control %v", rec[4], rec)
+		}
+		if c.year > year {
+			continue
+		}
+		k := key{c.scc, c.state, strings.ToUpper(rec[2])}
+		prev, ok := inEffect[k]
+		if !ok {
+			order = append(order, k)
+		}
+		if !ok || c.year >= prev.year {
+			inEffect[k] = c
+		}
+	}
+	controls := make([]control, len(order))
+	for i, k := range order {
+		controls[i] = inEffect[k]
+	}
+	return controls, nil
+}
+
+// controlFactor returns the factor of the most specific of controls that
+// applies to emissions of pol from scc in state, or 1 if none does.
+func controlFactor(controls []control, scc, state string, pol eieiorpc.Emission) float64 {
+	factor, best := 1.0, -1
+	for _, c := range controls {
+		if n := c.matches(scc, state, pol); n > best {
+			factor, best = c.factor, n
+		}
+	}
+	return factor
+}
+
+// speciesEmissions maps each PM2.5 species to the emission it forms from.
+var speciesEmissions = map[eieiorpc.Pollutant]eieiorpc.Emission{
+	eieiorpc.Pollutant_PrimaryPM25: eieiorpc.Emission_PM25,
+	eieiorpc.Pollutant_PNH4:        eieiorpc.Emission_NH3,
+	eieiorpc.Pollutant_PNO3:        eieiorpc.Emission_NOx,
+	eieiorpc.Pollutant_PSO4:        eieiorpc.Emission_SOx,
+	eieiorpc.Pollutant_SOA:         eieiorpc.Emission_VOC,
+}
+
+// controlledEmissions holds the emissions (kg/year) by pollutant and SCC,
+// indexed as s.SCCs, caused by a demand with and without a control
+// scenario.
+type controlledEmissions struct {
+	Baseline, Controlled map[eieiorpc.Emission][]float64
+}
+
+// ratio returns the ratio of controlled to baseline emissions of pol from
+// the SCC with index j, or 1 if there are no baseline emissions.
+func (ce *controlledEmissions) ratio(pol eieiorpc.Emission, j int) float64 {
+	if b := ce.Baseline[pol][j]; b != 0 {
+		return ce.Controlled[pol][j] / b
+	}
+	return 1
+}
+
+// getControlledEmissions applies the control scenario cfg to the emissions
+// caused by demand, using the state of each aqm grid cell for controls on
+// specific states.
+func getControlledEmissions(ctx context.Context, s *eieio.Server, cfg controlConfig, year int32, aqm string, demand *eieiorpc.Vector) (*controlledEmissions, error) {
+	ctx, span := startSpan(ctx, "getControlledEmissions")
+	defer span.End()
+	controlYear := cfg.Year
+	if controlYear == 0 {
+		controlYear = year
+	}
+	controls, err := readControls(os.ExpandEnv(cfg.File), controlYear)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading control scenario")
+	}
+	var states []string
+	var cellStates []int
+	if cfg.States.File != "" {
+		cfg.States.File = os.ExpandEnv(cfg.States.File)
+		if states, cellStates, err = regionIndex(s, cfg.States, aqm); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, c := range controls {
+			if c.state != "*" {
+				return nil, fmt.Errorf("control scenario has entries for state %q but no States are configured", c.state)
+			}
+		}
+	}
+
+	ce := &controlledEmissions{
+		Baseline:   make(map[eieiorpc.Emission][]float64),
+		Controlled: make(map[eieiorpc.Emission][]float64),
+	}
+	for _, pol := range speciesEmissions {
+		emis, err := emissionsMatrix(ctx, s, &eieiorpc.EmissionsMatrixInput{
+			Demand:   demand,
+			Emission: pol,
+			Year:     year,
+			Location: LOC,
+			AQM:      aqm,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting %v emissions matrix", pol)
+		}
+		nCells, nSCCs := emis.Dims()
+		if err := filterSCCColumns(s, emis); err != nil {
+			return nil, err
+		}
+		if cellStates != nil && len(cellStates) != nCells {
+			return nil, errorf(kindNumeric, "expected %d grid cells in states, got %d", nCells, len(cellStates))
+		}
+		ef, err := emissionFactorMultipliers(ctx, s, pol, year, aqm)
+		if err != nil {
+			return nil, err
+		}
+		baseline, controlled := make([]float64, nSCCs), make([]float64, nSCCs)
+		for j, scc := range s.SCCs {
+			// The factor in each state, with the last entry for cells
+			// outside every state.
+			factors := make([]float64, len(states)+1)
+			for k := range factors {
+				var state string
+				if k < len(states) {
+					state = states[k]
+				}
+				factors[k] = controlFactor(controls, string(scc), state, pol)
+			}
+			for i := 0; i < nCells; i++ {
+				e := emis.At(i, j)
+				if e == 0 {
+					continue
+				}
+				state := len(states)
+				if cellStates != nil && cellStates[i] >= 0 {
+					state = cellStates[i]
+				}
+				baseline[j] += e
+				controlled[j] += e * factors[state]
+			}
+			if ef != nil {
+				baseline[j] *= ef[j]
+				controlled[j] *= ef[j]
+			}
+		}
+		ce.Baseline[pol], ce.Controlled[pol] = baseline, controlled
+	}
+	return ce, nil
+}
+
+// controlledConcentrations returns the baseline and controlled total PM2.5
+// concentrations in each grid cell caused by demand. The concentrations
+// of each species from each SCC, which account for plume rise, are scaled
+// by the ratio of the SCC's controlled to baseline emissions of the
+// species' precursor. Where a control applies to some states but not
+// others, this keeps the SCC's concentrations in the same places.
+func controlledConcentrations(ctx context.Context, s *eieio.Server, ce *controlledEmissions, year int32, aqm string, demand *eieiorpc.Vector) (baseline, controlled []float64, err error) {
+	for species, pol := range speciesEmissions {
+		ef, err := emissionFactorMultipliers(ctx, s, pol, year, aqm)
+		if err != nil {
+			return nil, nil, err
+		}
+		conc, err := concentrationMatrix(ctx, s, &eieiorpc.ConcentrationMatrixInput{
+			Demand:    demand,
+			Pollutant: species,
+			Year:      year,
+			Location:  LOC,
+			AQM:       aqm,
+		})
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "calculating %s concentrations", species)
+		}
+		nCells, nSCCs := conc.Dims()
+		if nSCCs != len(s.SCCs) {
+			return nil, nil, errorf(kindNumeric, "expected concentrations to have #SCC %d columns, got %d", len(s.SCCs), nSCCs)
+		}
+		if baseline == nil {
+			baseline, controlled = make([]float64, nCells), make([]float64, nCells)
+		}
+		for j := 0; j < nSCCs; j++ {
+			r := ce.ratio(pol, j)
+			f := 1.0
+			if ef != nil {
+				f = ef[j]
+			}
+			for i := 0; i < nCells; i++ {
+				c := conc.At(i, j) * f
+				baseline[i] += c
+				controlled[i] += c * r
+			}
+		}
+	}
+	return baseline, controlled, nil
+}
+
+var controlsHeader = []string{"Population", "Label", "BaselineExposure", "ControlledExposure", "Change"}
+
+// writeControls writes the PM2.5 exposure of each census population caused
+// by demand with and without the control scenario cfg to path, and the
+// emissions by SCC to sectorsPath.
+func writeControls(ctx context.Context, s *eieio.Server, cfg controlConfig, year int32, aqm string, demand *eieiorpc.Vector, path, sectorsPath string) error {
+	ctx, span := startSpan(ctx, "writeControls")
+	defer span.End()
+	ce, err := getControlledEmissions(ctx, s, cfg, year, aqm, demand)
+	if err != nil {
+		return err
+	}
+	baseline, controlled, err := controlledConcentrations(ctx, s, ce, year, aqm, demand)
+	if err != nil {
+		return err
+	}
+	var exposure [2]map[string]float64
+	for i, conc := range [][]float64{baseline, controlled} {
+		e, err := populationExposure(ctx, s, aqm, conc, nil)
+		if err != nil {
+			return err
+		}
+		exposure[i] = *e
+	}
+	var rows [][]string
+	for _, pop := range sortedKeys(exposure[0]) {
+		b, c := exposure[0][pop], exposure[1][pop]
+		rows = append(rows, []string{pop, labels.get(pop), formatFloat(b), formatFloat(c), formatFloat(c - b)})
+	}
+	if err := writeCSV(path, controlsHeader, rows); err != nil {
+		return err
+	}
+
+	rows = rows[:0]
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		pol := eieiorpc.Emission(val)
+		for j, b := range ce.Baseline[pol] {
+			if b != 0 {
+				rows = append(rows, []string{string(s.SCCs[j]), pol.String(), formatFloat(b), formatFloat(ce.Controlled[pol][j])})
+			}
+		}
+	}
+	return writeCSV(sectorsPath, []string{"SCC", "Emission", "BaselineEmissions", "ControlledEmissions"}, rows)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/pkg/errors"
+	"github.com/tealeg/xlsx"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// useDetailFile is the UseDetail config setting, the BEA detailed use
+// table, with environment variables expanded. Its "NAICS codes" sheet
+// relates the IO industries to NAICS codes.
+var useDetailFile string
+
+// unclassifiedNAICS is the NAICS code reported for industries with none,
+// such as government.
+const unclassifiedNAICS = "Unclassified"
+
+// beaIndustry is a detailed BEA industry and the 2007 NAICS codes it
+// comprises.
+type beaIndustry struct {
+	Code  string
+	NAICS []string
+}
+
+// naicsLink is the share of an SCC's emissions attributed to a NAICS code
+// through one of the SCC's IO industries.
+type naicsLink struct {
+	Industry, BEACode, NAICS string
+	Share                    float64
+}
+
+// naicsCrosswalk maps each SCC, by index, to NAICS codes through the IO
+// industries it is mapped to in the SCC map. Neither mapping is weighted,
+// so an SCC's emissions are split equally among its industries and each
+// industry's equally among its NAICS codes.
+type naicsCrosswalk [][]naicsLink
+
+// readBEAIndustries returns the detailed industries in the "NAICS codes"
+// sheet of the BEA use table at path, by lower-case title and by code.
+func readBEAIndustries(path string) (map[string]beaIndustry, error) {
+	f, err := xlsx.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sheet, ok := f.Sheet["NAICS codes"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no NAICS codes sheet", path)
+	}
+	industries := make(map[string]beaIndustry)
+	for _, row := range sheet.Rows {
+		// Detailed industries have their code in the third column, their
+		// title in the fourth and their NAICS codes in the sixth; sectors
+		// and summary industries are in the columns before.
+		if len(row.Cells) < 6 {
+			continue
+		}
+		code, title := strings.TrimSpace(row.Cells[2].Value), strings.TrimSpace(row.Cells[3].Value)
+		if code == "" || title == "" {
+			continue
+		}
+		naics, err := expandNAICS(row.Cells[5].Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "industry %s", code)
+		}
+		ind := beaIndustry{Code: code, NAICS: naics}
+		industries[strings.ToLower(title)] = ind
+		industries[code] = ind
+	}
+	if len(industries) == 0 {
+		return nil, fmt.Errorf("no industries found in the NAICS codes sheet of %s", path)
+	}
+	return industries, nil
+}
+
+// expandNAICS returns the NAICS codes in a list such as "11113-6, 11119",
+// where "11113-6" is the range 11113 to 11116. "n/a" is no codes.
+func expandNAICS(list string) ([]string, error) {
+	var codes []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.EqualFold(item, "n/a") {
+			continue
+		}
+		parts := strings.Split(item, "-")
+		if len(parts) == 1 {
+			if _, err := strconv.Atoi(item); err != nil {
+				return nil, fmt.Errorf("invalid NAICS code %q", item)
+			}
+			codes = append(codes, item)
+			continue
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid NAICS code range %q", item)
+		}
+		first, last := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(last) == 0 || len(last) > len(first) {
+			return nil, fmt.Errorf("invalid NAICS code range %q", item)
+		}
+		// The end of a range replaces the last digits of its start.
+		prefix := first[:len(first)-len(last)]
+		lo, err1 := strconv.Atoi(first[len(prefix):])
+		hi, err2 := strconv.Atoi(last)
+		if _, err3 := strconv.Atoi(first); err1 != nil || err2 != nil || err3 != nil || hi < lo {
+			return nil, fmt.Errorf("invalid NAICS code range %q", item)
+		}
+		for n := lo; n <= hi; n++ {
+			codes = append(codes, fmt.Sprintf("%s%0*d", prefix, len(last), n))
+		}
+	}
+	return codes, nil
+}
+
+// newNAICSCrosswalk returns the crosswalk from the SCCs of s to NAICS codes.
+func newNAICSCrosswalk(ctx context.Context, s *eieio.Server) (naicsCrosswalk, error) {
+	if useDetailFile == "" {
+		return nil, errorf(kindConfig, "the NAICS crosswalk requires the UseDetail config setting")
+	}
+	bea, err := readBEAIndustries(useDetailFile)
+	if err != nil {
+		return nil, withKind(kindDataMissing, errors.Wrap(err, "error reading NAICS codes"))
+	}
+	industries, err := s.Industries(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	cw := make(naicsCrosswalk, len(s.SCCs))
+	for i, inds := range s.SCCMap {
+		for _, ind := range inds {
+			// Industries are named by title, or by code if aggregated
+			// differently; those not in the table are unclassified.
+			name := industries.List[ind]
+			b, ok := bea[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				b = bea[strings.TrimSpace(name)]
+			}
+			naics := b.NAICS
+			if len(naics) == 0 {
+				naics = []string{unclassifiedNAICS}
+			}
+			for _, code := range naics {
+				cw[i] = append(cw[i], naicsLink{Industry: name, BEACode: b.Code, NAICS: code,
+					Share: 1 / float64(len(inds)*len(naics))})
+			}
+		}
+	}
+	return cw, nil
+}
+
+// aggregate returns the sum of values by SCC for each NAICS code, where
+// cols are the indices of the SCCs of values in the model's SCCs.
+func (cw naicsCrosswalk) aggregate(values []float64, cols []int) map[string]float64 {
+	byNAICS := make(map[string]float64)
+	for k, v := range values {
+		if v == 0 {
+			continue
+		}
+		for _, l := range cw[cols[k]] {
+			byNAICS[l.NAICS] += v * l.Share
+		}
+	}
+	return byNAICS
+}
+
+// writeNAICSCrosswalk writes the crosswalk from the SCCs of s to NAICS
+// codes to path, returning the number of SCCs with at least one code.
+func writeNAICSCrosswalk(ctx context.Context, s *eieio.Server, path string) (int, error) {
+	cw, err := newNAICSCrosswalk(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+	var rows [][]string
+	var n int
+	for i, links := range cw {
+		for _, l := range links {
+			rows = append(rows, []string{string(s.SCCs[i]), l.Industry, l.BEACode, l.NAICS, formatFloat(l.Share)})
+		}
+		if len(links) > 0 {
+			n++
+		}
+	}
+	return n, writeCSV(path, []string{"SCC", "Industry", "BEACode", "NAICS", "Share"}, rows)
+}
+
+// writeNAICSContribution writes each demographic's population-adjusted
+// PM2.5 emissions by NAICS code in m to path.
+func writeNAICSContribution(ctx context.Context, s *eieio.Server, m *ContributionMatrix, path string) error {
+	cw, err := newNAICSCrosswalk(ctx, s)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for d, dem := range m.Demographics {
+		byNAICS := cw.aggregate(m.Emissions.RawRowView(d), m.Columns)
+		codes := make([]string, 0, len(byNAICS))
+		for code := range byNAICS {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			rows = append(rows, []string{demographKey(dem), labels.demograph(dem), code, formatFloat(byNAICS[code])})
+		}
+	}
+	return writeCSV(path, []string{"Demographic", "Label", "NAICS", "Emissions"}, rows)
+}
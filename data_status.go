@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// dataInput is a file or directory that the config or dataset manifest
+// refers to.
+type dataInput struct {
+	Name    string // setting, e.g. "SpatialEIO.SRFiles.isrm", or "dataset NAME"
+	Path    string // with environment variables expanded
+	Unset   []string
+	Vintage string
+	SHA256  string
+
+	// Optional inputs, such as downloads that the config may not use,
+	// are only invalid if they are present with the wrong checksum.
+	Optional bool
+}
+
+// configInputs returns the settings in cfg that hold absolute paths
+// (after expanding environment variables), which are taken to be inputs,
+// except for caches and outputs.
+func configInputs(cfg *config) []dataInput {
+	var inputs []dataInput
+	var walk func(v reflect.Value, path []string)
+	walk = func(v reflect.Value, path []string) {
+		if len(path) > 0 {
+			name := path[len(path)-1]
+			if strings.Contains(name, "Cache") || strings.HasPrefix(name, "Output") || name == "TraceFile" {
+				return
+			}
+		}
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			if !v.IsNil() {
+				walk(v.Elem(), path)
+			}
+		case reflect.Struct:
+			t := v.Type()
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if f.PkgPath != "" { // unexported
+					continue
+				}
+				fPath := append(path[:len(path):len(path)], f.Name)
+				if f.Anonymous {
+					fPath = path // TOML keys of embedded structs are promoted
+				}
+				walk(v.Field(i), fPath)
+			}
+		case reflect.Map:
+			for _, k := range v.MapKeys() {
+				walk(v.MapIndex(k), append(path[:len(path):len(path)], fmt.Sprint(k.Interface())))
+			}
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i), append(path[:len(path):len(path)], fmt.Sprint(i)))
+			}
+		case reflect.String:
+			in := dataInput{Name: strings.Join(path, ".")}
+			in.Path = os.Expand(v.String(), func(name string) string {
+				val, ok := os.LookupEnv(name)
+				if !ok {
+					in.Unset = append(in.Unset, name)
+				}
+				return val
+			})
+			if filepath.IsAbs(in.Path) {
+				inputs = append(inputs, in)
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), nil)
+	return inputs
+}
+
+var yearKeyRE = regexp.MustCompile(`^(19|20)\d\d$`)
+
+// dataSize returns the total size of the file or directory at path.
+func dataSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// formatSize formats a number of bytes in human-readable units.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// within returns whether path is dir or inside it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// dataStatus describes whether in exists and is valid, returning whether
+// it is usable. Checksums are only verified if verify is set.
+func dataStatus(in dataInput, verify bool) (status string, size int64, ok bool) {
+	if len(in.Unset) > 0 {
+		return fmt.Sprintf("missing ($%s not set)", strings.Join(in.Unset, ", $")), 0, false
+	}
+	if _, err := os.Stat(in.Path); os.IsNotExist(err) {
+		return "missing", 0, false
+	} else if err != nil {
+		return err.Error(), 0, false
+	}
+	size, err := dataSize(in.Path)
+	if err != nil {
+		return err.Error(), size, false
+	}
+	switch {
+	case in.SHA256 == "":
+		return "present", size, true
+	case !verify:
+		return "present (not verified)", size, true
+	}
+	sum, err := fileSHA256(in.Path)
+	if err != nil {
+		return err.Error(), size, false
+	}
+	if !strings.EqualFold(sum, in.SHA256) {
+		return "checksum mismatch", size, false
+	}
+	return "verified", size, true
+}
+
+// dataCommand runs data subcommands: "status" lists the input data the
+// config and the dataset manifest refer to, whether each exists, its size,
+// checksum validity and vintage, to find missing inputs before they cause
+// errors deep in creating the EIEIO server.
+func dataCommand(args []string) error {
+	if len(args) == 0 || args[0] != "status" {
+		fmt.Fprintf(os.Stderr, "usage: %s data status [flags]\n", os.Args[0])
+		return errorf(kindUsage, "data requires a subcommand, status")
+	}
+	fs := flag.NewFlagSet("data "+args[0], flag.ExitOnError)
+	manifest := fs.String("manifest", datasetsFile(), "dataset manifest")
+	verify := fs.Bool("verify", true, "verify the checksums of downloaded datasets, which reads them in full")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	cfg, _, err := readConfig()
+	if err != nil {
+		return withKind(kindConfig, errors.Wrap(err, "error reading config"))
+	}
+	var datasets []dataset
+	if _, err := os.Stat(*manifest); err == nil {
+		if datasets, err = loadDatasets(*manifest); err != nil {
+			return withKind(kindConfig, errors.Wrap(err, "error loading dataset manifest"))
+		}
+	}
+
+	// Downloads come first, followed by the config settings, with the
+	// vintage of the dataset they were extracted from.
+	var inputs []dataInput
+	for _, d := range datasets {
+		inputs = append(inputs, dataInput{Name: "dataset " + d.Name, Path: d.File, Vintage: d.Vintage, SHA256: d.SHA256, Optional: true})
+		for _, name := range d.provided() {
+			inputs = append(inputs, dataInput{Name: "dataset " + d.Name + " " + name, Path: d.providedPath(name), Vintage: d.Vintage, Optional: true})
+		}
+	}
+	settings := configInputs(cfg)
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	for _, in := range settings {
+		for _, d := range datasets {
+			if d.Extract != "" && within(in.Path, d.Extract) {
+				in.Vintage = d.Name + " " + d.Vintage
+			}
+		}
+		// Settings such as CensusFile are keyed by year.
+		if key := in.Name[strings.LastIndex(in.Name, ".")+1:]; in.Vintage == "" && yearKeyRE.MatchString(key) {
+			in.Vintage = key
+		}
+		inputs = append(inputs, in)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Input\tStatus\tSize\tVintage\tPath\n")
+	var total int64
+	var bad int
+	for _, in := range inputs {
+		status, size, ok := dataStatus(in, *verify)
+		if in.Optional && status == "missing" {
+			status, ok = "not downloaded", true
+		}
+		if !ok {
+			bad++
+		}
+		total += size
+		sizeStr := ""
+		if size > 0 {
+			sizeStr = formatSize(size)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", in.Name, status, sizeStr, in.Vintage, in.Path)
+	}
+	fmt.Fprintf(w, "\nTotal:\t%d inputs, %d missing or invalid\t%s\n", len(inputs), bad, formatSize(total))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if bad > 0 {
+		return errorf(kindDataMissing, "%d of %d inputs are missing or invalid; run fetch-data or fix the config", bad, len(inputs))
+	}
+	return nil
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// dataDictionaryFile is the name of the data dictionary written to each
+// directory of output files, describing the files in it.
+const dataDictionaryFile = "data_dictionary.json"
+
+// column describes a column of an output table.
+type column struct {
+	Name string
+
+	// Type is string, integer, number or boolean.
+	Type string
+
+	Units       string `json:",omitempty"`
+	Description string
+
+	// Provenance is the calculation and inputs the values come from. It
+	// defaults to that of the file for columns of values rather than
+	// names.
+	Provenance string `json:",omitempty"`
+}
+
+// outputFile describes an output file.
+type outputFile struct {
+	File        string
+	Format      string
+	Description string
+	Provenance  string
+	Columns     []column `json:",omitempty"`
+}
+
+// dataDictionary is the contents of a data dictionary file.
+type dataDictionary struct {
+	Files []outputFile
+}
+
+// Columns that appear in many tables.
+var (
+	populationColumn  = column{Name: "Population", Type: "string", Description: "census population (a column of the census data) or population defined in [Sandbox.Populations]"}
+	labelColumn       = column{Name: "Label", Type: "string", Description: "human-readable name of the population or demographic, from [Sandbox.Labels]"}
+	demographicColumn = column{Name: "Demographic", Type: "string", Description: "CES demographic, as a demograph key such as decile:LowestTen"}
+	sccColumn         = column{Name: "SCC", Type: "string", Description: "source classification code of the emitting sector"}
+	emissionColumn    = column{Name: "Emission", Type: "string", Description: "emitted pollutant: PM25, NH3, NOx, SOx or VOC"}
+	exposureColumn    = column{Name: "Exposure", Type: "number", Units: "people·μg/m³", Description: "PM2.5 concentration summed over the population's members (population-weighted exposure); transformed by the exposure function first, if one is set"}
+	naicsColumn       = column{Name: "NAICS", Type: "string", Description: "2007 NAICS code, of 2 to 6 digits, or Unclassified for industries with none, such as government"}
+	yearColumn        = column{Name: "Year", Type: "integer", Description: "analysis year"}
+)
+
+// Sources of common results, for their provenance.
+const (
+	exposureSource     = "EIEIO PM2.5 concentrations caused by the scenario's final demand, weighted by the census population counts of each grid cell, with the scenario's exposure function, background, time-activity weighting, SCC filter and small-cell suppression"
+	emissionsSource    = "EIEIO emissions by SCC caused by the final demand, through the EIO (Leontief) model and the NEI emission factors, with emission factor overrides and the SCC filter"
+	contributionSource = "EIEIO emissions caused by each demographic's consumption (CES consumption shares applied to national personal consumption), adjusted by population"
+	healthSource       = "EIEIO health impacts: the hazard ratio function (the scenario's HR) applied to the PM2.5 concentrations caused by the final demand and the baseline mortality rates and populations of each grid cell"
+)
+
+// outputFiles describes the output files of the sandbox, by default file
+// name. Tables list every column they may have; columns only written with
+// some settings are omitted from the dictionaries of files without them.
+var outputFiles = []outputFile{
+	// Batch output directory.
+	{File: "index.csv", Format: "csv", Description: "status of each scenario of a batch", Provenance: "batch job store (jobs.db)", Columns: []column{
+		{Name: "Name", Type: "string", Description: "scenario name"},
+		yearColumn,
+		{Name: "AQM", Type: "string", Description: "air quality model"},
+		{Name: "HR", Type: "string", Description: "hazard ratio function, if health impacts were calculated"},
+		{Name: "Directory", Type: "string", Description: "directory of the scenario's results, relative to the batch output directory"},
+		{Name: "Status", Type: "string", Description: "pending, running, done or failed"},
+		{Name: "Attempts", Type: "integer", Description: "number of times the scenario was run"},
+		{Name: "Error", Type: "string", Description: "error of the last failed attempt"},
+		{Name: "ExitCode", Type: "integer", Description: "exit status the error would give (see the README)"},
+	}},
+	{File: "trends.csv", Format: "csv", Description: "linear trend of each population's exposure across the batch's years", Provenance: "exposure.csv of each completed scenario", Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "FirstYear", Type: "integer", Description: "first year with results"},
+		{Name: "LastYear", Type: "integer", Description: "last year with results"},
+		{Name: "Slope", Type: "number", Units: "people·μg/m³ per year", Description: "least-squares slope of exposure against year"},
+		{Name: "PercentChange", Type: "number", Units: "%", Description: "change in exposure from the first to the last year"},
+		{Name: "MaxDisparityYear", Type: "integer", Description: "year the population's mean exposure (exposure per person) differed most, relatively, from that of the total population"},
+	}},
+	{File: "decomposition.csv", Format: "csv", Description: "change in the exposure caused by each demographic's consumption between consecutive years of the batch, split into volume, mix and intensity effects", Provenance: "additive LMDI-I decomposition of consumption_shares.csv of each completed scenario, in the constant dollars of consumption.csv", Columns: []column{
+		demographicColumn, labelColumn,
+		{Name: "FromYear", Type: "integer", Description: "earlier year"},
+		{Name: "ToYear", Type: "integer", Description: "later year"},
+		{Name: "FromExposure", Type: "number", Units: "people·μg/m³", Description: "exposure of the total population caused by the demographic's consumption in FromYear"},
+		{Name: "ToExposure", Type: "number", Units: "people·μg/m³", Description: "exposure caused in ToYear"},
+		{Name: "Change", Type: "number", Units: "people·μg/m³", Description: "ToExposure minus FromExposure; the sum of the effects"},
+		{Name: "Volume", Type: "number", Units: "people·μg/m³", Description: "effect of the change in total consumption, in constant dollars"},
+		{Name: "Mix", Type: "number", Units: "people·μg/m³", Description: "effect of the change in the shares of the end-use groups in consumption"},
+		{Name: "Intensity", Type: "number", Units: "people·μg/m³", Description: "effect of the change in the exposure per constant dollar of each end-use group"},
+	}},
+	{File: runManifestFile, Format: "json", Description: "size and SHA-256 checksum of every output file, for `verify`", Provenance: "output files of the batch or merge"},
+
+	// Scenario directories.
+	{File: "exposure.csv", Format: "csv", Description: "population-weighted PM2.5 exposure of each population", Provenance: exposureSource, Columns: []column{
+		populationColumn, labelColumn, exposureColumn,
+		{Name: "People", Type: "number", Units: "people", Description: "population count, within the subdomain if one is configured; exposure divided by it is the mean concentration the population is exposed to"},
+	}},
+	{File: "composite_exposure.csv", Format: "csv", Description: "population-weighted exposure to the composite of PM2.5 species weighted by the scenario's ExposureWeights, or those of the config", Provenance: exposureSource, Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "CompositeExposure", Type: "number", Units: "people·μg/m³", Description: "weighted species concentrations summed over the population's members"},
+	}},
+	{File: "speciation.csv", Format: "csv", Description: "population-weighted exposure of each population split into PM2.5 components", Provenance: exposureSource, Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "Primary", Type: "number", Units: "people·μg/m³", Description: "exposure to primary PM2.5"},
+		{Name: "Sulfate", Type: "number", Units: "people·μg/m³", Description: "exposure to particulate sulfate"},
+		{Name: "Nitrate", Type: "number", Units: "people·μg/m³", Description: "exposure to particulate nitrate and ammonium"},
+		{Name: "SOA", Type: "number", Units: "people·μg/m³", Description: "exposure to secondary organic aerosol"},
+	}},
+	{File: "exposure_by_attainment.csv", Format: "csv", Description: "population-weighted PM2.5 exposure of each population, separately in the grid cells within the NAAQS nonattainment areas of [Sandbox.Nonattainment] and in the rest of the domain", Provenance: exposureSource, Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "Area", Type: "string", Description: "Attainment or Nonattainment: the grid cells whose centroids are outside or within the nonattainment areas"},
+		{Name: "Cells", Type: "integer", Description: "number of grid cells in the area"},
+		{Name: "People", Type: "number", Units: "people", Description: "population count in the area"},
+		exposureColumn,
+		{Name: "MeanConcentration", Type: "number", Units: "μg/m³", Description: "exposure divided by the people in the area"},
+	}},
+	{File: "receptor_exposure.csv", Format: "csv", Description: "population-weighted PM2.5 exposure of each population in the grid cells within the receptor region of [Sandbox.ReceptorRegion]", Provenance: exposureSource, Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "Cells", Type: "integer", Description: "number of grid cells whose centroids are within the region"},
+		{Name: "People", Type: "number", Units: "people", Description: "population count in the region"},
+		exposureColumn,
+		{Name: "MeanConcentration", Type: "number", Units: "μg/m³", Description: "exposure divided by the people in the region"},
+	}},
+	{File: "exposure_by_emitter_region.csv", Format: "csv", Description: "population-weighted PM2.5 exposure of each population caused by the emissions in each region of [Sandbox.EmitterRegions]", Provenance: "EIEIO emissions caused by the scenario's final demand in each grid cell, grouped by the region containing the cell and carried to receptors by the InMAP SR matrix, with all emissions treated as ground-level, then weighted as for exposure.csv", Columns: []column{
+		{Name: "Region", Type: "string", Description: "the value of the region's Field, or Other for emissions outside every region"},
+		populationColumn, labelColumn, exposureColumn,
+	}},
+	{File: "inventory_exposure.csv", Format: "csv", Description: "population-weighted PM2.5 exposure of each population caused by the emissions of the inventory in [Sandbox.Inventory], beside that caused by the scenario's EIO-derived emissions", Provenance: "inventory emissions regridded to the AQM grid and carried to receptors by the InMAP SR matrix, with all emissions treated as ground-level, then weighted as for exposure.csv", Columns: []column{
+		populationColumn, labelColumn, exposureColumn,
+		{Name: "EIOExposure", Type: "number", Units: "people·μg/m³", Description: "the population's exposure caused by the scenario's final demand, as in exposure.csv"},
+	}},
+	{File: "exposure_distribution.csv", Format: "csv", Description: "distribution of the individual exposure of each population's members, taken as the concentration in the grid cell where each lives", Provenance: exposureSource, Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "People", Type: "number", Units: "people", Description: "population count"},
+		{Name: "Mean", Type: "number", Units: "μg/m³", Description: "mean exposure"},
+		{Name: "StdDev", Type: "number", Units: "μg/m³", Description: "standard deviation of exposure"},
+		{Name: "P10", Type: "number", Units: "μg/m³", Description: "10th percentile of exposure"},
+		{Name: "P25", Type: "number", Units: "μg/m³", Description: "25th percentile of exposure"},
+		{Name: "P50", Type: "number", Units: "μg/m³", Description: "median exposure"},
+		{Name: "P75", Type: "number", Units: "μg/m³", Description: "75th percentile of exposure"},
+		{Name: "P90", Type: "number", Units: "μg/m³", Description: "90th percentile of exposure"},
+		{Name: "P90P10Ratio", Type: "number", Description: "ratio of the 90th to the 10th percentile"},
+	}},
+	{File: "concentration_index.csv", Format: "csv", Description: "concentration index of exposure along the income gradient", Provenance: "concentrations caused by the final demand and the population of each income decile in each grid cell", Columns: []column{
+		yearColumn,
+		{Name: "Pollutant", Type: "string", Description: "PM2.5 species or TotalPM25"},
+		{Name: "ConcentrationIndex", Type: "number", Description: "twice the covariance of exposure and fractional income rank, divided by mean exposure; from -1 to 1, negative when exposure is concentrated among lower incomes"},
+		{Name: "StdErr", Type: "number", Description: "jackknife standard error, leaving out each populated grid cell in turn"},
+		{Name: "Cells", Type: "integer", Description: "number of populated grid cells"},
+	}},
+	{File: "exposure_by_period.csv", Format: "csv", Description: "population-weighted exposure during each month or season", Provenance: exposureSource + ", with emissions scaled by the monthly emission profiles of [Sandbox.Temporal]", Columns: []column{
+		{Name: "Period", Type: "string", Description: "month or season"},
+		populationColumn, labelColumn,
+		{Name: "Exposure", Type: "number", Units: "people·μg/m³", Description: "exposure at the period's average emission rate"},
+		{Name: "RatioToAnnual", Type: "number", Description: "ratio of the period's exposure to the annual exposure"},
+	}},
+	{File: "projection.csv", Format: "csv", Description: "exposure under census and projected populations", Provenance: exposureSource + ", and the projected populations of the scenario's [Scenario.Population]", Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "CensusCount", Type: "number", Units: "people", Description: "census population count"},
+		{Name: "ProjectedCount", Type: "number", Units: "people", Description: "projected population count"},
+		{Name: "CensusExposure", Type: "number", Units: "people·μg/m³", Description: "exposure of the census population"},
+		{Name: "ProjectedExposure", Type: "number", Units: "people·μg/m³", Description: "exposure of the projected population"},
+		{Name: "CensusMean", Type: "number", Units: "μg/m³", Description: "census exposure divided by count"},
+		{Name: "ProjectedMean", Type: "number", Units: "μg/m³", Description: "projected exposure divided by count"},
+		{Name: "CensusMeanRatioToTotal", Type: "number", Description: "census mean relative to that of the total population"},
+		{Name: "ProjectedMeanRatioToTotal", Type: "number", Description: "projected mean relative to that of the total population"},
+	}},
+	{File: "categories.csv", Format: "csv", Description: "exposure caused by each consumption category and commodity, as treemap rows", Provenance: exposureSource + ", for the final demand of each commodity grouped by [Sandbox.Categories]", Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "ID", Type: "string", Description: "path of the node from the root, separated by " + categoryTreeSep},
+		{Name: "Parent", Type: "string", Description: "ID of the parent node, empty for the root"},
+		{Name: "Name", Type: "string", Description: "category or commodity name"},
+		{Name: "Kind", Type: "string", Description: "Category or Commodity"},
+		{Name: "Depth", Type: "integer", Description: "depth of the node, 0 for the root"},
+		exposureColumn,
+	}},
+	{File: "categories.json", Format: "json", Description: "tree of consumption categories and commodities with the exposure of each population caused by each", Provenance: exposureSource + ", for the final demand of each commodity grouped by [Sandbox.Categories]"},
+	{File: "controls.csv", Format: "csv", Description: "exposure before and after the scenario's emission controls", Provenance: exposureSource + ", with the control factors of [Scenario.Controls] applied to emissions by SCC and state", Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "BaselineExposure", Type: "number", Units: "people·μg/m³", Description: "exposure without controls"},
+		{Name: "ControlledExposure", Type: "number", Units: "people·μg/m³", Description: "exposure with controls"},
+		{Name: "Change", Type: "number", Units: "people·μg/m³", Description: "controlled minus baseline exposure"},
+	}},
+	{File: "controls_sectors.csv", Format: "csv", Description: "emissions of each SCC before and after the scenario's emission controls", Provenance: emissionsSource + ", with the control factors of [Scenario.Controls]", Columns: []column{
+		sccColumn, emissionColumn,
+		{Name: "BaselineEmissions", Type: "number", Units: "kg/year", Description: "emissions without controls"},
+		{Name: "ControlledEmissions", Type: "number", Units: "kg/year", Description: "emissions with controls"},
+	}},
+	{File: "employment.csv", Format: "csv", Description: "emissions and exposure per job of each sector", Provenance: "the scenario's EmploymentFile and the emissions and exposure caused by each sector's final demand", Columns: []column{
+		{Name: "Sector", Type: "string", Description: "EIO commodity"},
+		{Name: "FinalDemand", Type: "number", Units: "dollars/year", Description: "final demand of the sector"},
+		{Name: "Jobs", Type: "number", Units: "jobs", Description: "employment in the sector"},
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "PM2.5 emissions caused by the sector's final demand"},
+		{Name: "Exposure", Type: "number", Units: "people·μg/m³", Description: "exposure caused by the sector's final demand"},
+		{Name: "EmissionsPerJob", Type: "number", Units: "kg/year per job", Description: "emissions divided by jobs"},
+		{Name: "ExposurePerJob", Type: "number", Units: "people·μg/m³ per job", Description: "exposure divided by jobs"},
+		{Name: "ExposurePerDollar", Type: "number", Units: "people·μg/m³ per dollar/year", Description: "exposure divided by final demand"},
+	}},
+	{File: "exposure_efficiency.csv", Format: "csv", Description: "exposure caused per dollar of final demand, and per job, of each sector, ranked from the most exposure per dollar", Provenance: "the exposure caused by each sector's final demand, and the scenario's EmploymentFile, if any", Columns: []column{
+		{Name: "Rank", Type: "integer", Description: "rank by ExposurePerDollar, 1 for the most"},
+		{Name: "Sector", Type: "string", Description: "EIO commodity"},
+		{Name: "FinalDemand", Type: "number", Units: "dollars/year", Description: "final demand of the sector"},
+		{Name: "Exposure", Type: "number", Units: "people·μg/m³", Description: "exposure of the total population caused by the sector's final demand"},
+		{Name: "ExposurePerDollar", Type: "number", Units: "people·μg/m³ per dollar/year", Description: "exposure divided by final demand"},
+		{Name: "Jobs", Type: "number", Units: "jobs", Description: "employment in the sector, or NaN without an EmploymentFile"},
+		{Name: "ExposurePerJob", Type: "number", Units: "people·μg/m³ per job", Description: "exposure divided by jobs"},
+		{Name: "RankPerJob", Type: "integer", Description: "rank by ExposurePerJob, 1 for the most; empty for sectors without employment"},
+	}},
+	{File: "contribution.csv", Format: "csv", Description: "PM2.5 emissions caused by each demographic's consumption", Provenance: contributionSource, Columns: []column{
+		demographicColumn, labelColumn,
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "population-adjusted PM2.5 emissions"},
+	}},
+	{File: "demographics.csv", Format: "csv", Description: "exposure and contribution of each CES demographic, joined with the census populations that match it", Provenance: exposureSource + "; " + contributionSource, Columns: []column{
+		demographicColumn, labelColumn,
+		{Name: "PopulationLayers", Type: "string", Description: "census populations matching the demographic, joined by +"},
+		{Name: "Match", Type: "string", Description: "how the census populations match the demographic: exact, combined or none"},
+		{Name: "Exposure", Type: "number", Units: "people·μg/m³", Description: "exposure of the matching census populations"},
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "population-adjusted PM2.5 emissions caused by the demographic's consumption"},
+	}},
+	{File: "consumption.csv", Format: "csv", Description: "total consumption of each CES demographic in nominal and constant dollars, and the emissions it causes per dollar, for comparing years", Provenance: "EIEIO demographic final demand from CES consumption shares, deflated with the [Sandbox.Deflator] price index (recorded in metadata.csv)", Columns: []column{
+		demographicColumn, labelColumn, yearColumn,
+		{Name: "Consumption", Type: "number", Units: "dollars/year", Description: "final demand of the demographic, in dollars of the year"},
+		{Name: "RealConsumption", Type: "number", Units: "constant dollars/year", Description: "final demand in dollars of the deflator's base year"},
+		{Name: "EmissionsPerDollar", Type: "number", Units: "kg per constant dollar", Description: "PM2.5 emissions caused by the demographic's consumption (not population-adjusted) divided by RealConsumption", Provenance: emissionsSource},
+	}},
+	{File: "consumption_shares.csv", Format: "csv", Description: "consumption of each CES demographic by end-use group, with the group's share of its total consumption and the emission intensity of the group", Provenance: "EIEIO demographic final demand from CES consumption shares, summed over the commodities of each end-use group of the IOAggregatorFile", Columns: []column{
+		demographicColumn, labelColumn,
+		{Name: "Sector", Type: "string", Description: "name of the end-use group"},
+		{Name: "Abbrev", Type: "string", Description: "abbreviation of the end-use group"},
+		{Name: "Consumption", Type: "number", Units: "dollars/year", Description: "final demand of the demographic for the group's commodities"},
+		{Name: "Share", Type: "number", Description: "fraction of the demographic's total consumption"},
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "PM2.5 emissions caused by the consumption (not population-adjusted)", Provenance: emissionsSource},
+		{Name: "EmissionsPerDollar", Type: "number", Units: "kg per dollar", Description: "Emissions divided by Consumption, or 0 for no consumption"},
+		{Name: "Exposure", Type: "number", Units: "people·μg/m³", Description: "exposure of the total population caused by the consumption, weighted as the demographic's total so that the groups sum to it", Provenance: exposureSource},
+	}},
+	{File: "supply_chain.csv", Format: "csv", Description: "each demographic's PM2.5 emissions split into those of the sectors it buys from and those further up the supply chain", Provenance: "Leontief decomposition of the emissions caused by each demographic's consumption (not population-adjusted)", Columns: []column{
+		demographicColumn, labelColumn,
+		{Name: "Direct", Type: "number", Units: "kg/year", Description: "emissions of the sectors bought from directly"},
+		{Name: "SupplyChain", Type: "number", Units: "kg/year", Description: "emissions further up the supply chain"},
+		{Name: "SupplyChainShare", Type: "number", Description: "supply-chain fraction of the total"},
+	}},
+	{File: "contribution_by_pollutant.csv", Format: "csv", Description: "each demographic's emissions of every emitted pollutant by SCC", Provenance: contributionSource, Columns: []column{
+		demographicColumn, labelColumn,
+		{Name: "Location", Type: "string", Description: "Domestic, or Imported for emissions abroad caused by imports with ContributionByLocation"},
+		emissionColumn, sccColumn,
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "population-adjusted emissions"},
+	}},
+	{File: "contribution_by_naics.csv", Format: "csv", Description: "each demographic's PM2.5 emissions by NAICS code, for reporting contributions by industry", Provenance: contributionSource + ", summed by NAICS code through the crosswalk of naics_crosswalk.csv", Columns: []column{
+		demographicColumn, labelColumn, naicsColumn,
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "population-adjusted PM2.5 emissions"},
+	}},
+	{File: "provenance.json", Format: "json", Description: "the inputs contributing most to each exposure and contribution value: SCCs, clusters of grid cells and PM2.5 components, with their shares", Provenance: exposureSource + "; " + contributionSource},
+	{File: "health.csv", Format: "csv", Description: "deaths of each population attributable to the PM2.5 caused by the final demand", Provenance: healthSource, Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "Deaths", Type: "number", Units: "deaths/year", Description: "attributable deaths"},
+		{Name: "DeathsLow", Type: "number", Units: "deaths/year", Description: "lower bound of the hazard ratio's confidence interval", Provenance: healthSource + ", at the bounds of [Sandbox.HRIntervals]"},
+		{Name: "DeathsHigh", Type: "number", Units: "deaths/year", Description: "upper bound of the hazard ratio's confidence interval", Provenance: healthSource + ", at the bounds of [Sandbox.HRIntervals]"},
+	}},
+	{File: "health_by_age.csv", Format: "csv", Description: "deaths, years of life lost and DALYs of each population by age group", Provenance: healthSource + ", with the baseline incidence and life expectancy of each age group from [Sandbox.AgeMortality]", Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "AgeGroup", Type: "string", Description: "age group"},
+		{Name: "Deaths", Type: "number", Units: "deaths/year", Description: "attributable deaths"},
+		{Name: "YLL", Type: "number", Units: "years/year", Description: "years of life lost, discounted and age weighted as configured"},
+		{Name: "DALY", Type: "number", Units: "years/year", Description: "disability-adjusted life years: YLL plus years lived with disability"},
+	}},
+	{File: "health_by_sector.csv", Format: "csv", Description: "deaths, years of life lost and DALYs of each population by emitting SCC", Provenance: healthSource + ", with the baseline incidence and life expectancy of each age group from [Sandbox.AgeMortality]", Columns: []column{
+		populationColumn, labelColumn, sccColumn,
+		{Name: "Deaths", Type: "number", Units: "deaths/year", Description: "attributable deaths"},
+		{Name: "YLL", Type: "number", Units: "years/year", Description: "years of life lost"},
+		{Name: "DALY", Type: "number", Units: "years/year", Description: "disability-adjusted life years"},
+	}},
+	{File: "deaths_by_demographic_sector.csv", Format: "csv", Description: "deaths of the total population attributable to each demographic's consumption, by emitting SCC", Provenance: healthSource + ", for each demographic's consumption (not population-adjusted)", Columns: []column{
+		demographicColumn, labelColumn, sccColumn,
+		{Name: "Deaths", Type: "number", Units: "deaths/year", Description: "attributable deaths"},
+	}},
+	{File: "damages.csv", Format: "csv", Description: "deaths and their monetized damages by population from total PM2.5, as in health.csv, and from each PM2.5 species; as hazard ratios are nonlinear, the species are a breakdown that needn't sum to the total", Provenance: healthSource + ", valued with the scenario's [Scenario.Valuation]", Columns: []column{
+		populationColumn, labelColumn,
+		{Name: "Pollutant", Type: "string", Description: "TotalPM25 or a PM2.5 species"},
+		{Name: "Year", Type: "integer", Description: "year the dollars are expressed in"},
+		{Name: "Deaths", Type: "number", Units: "deaths/year", Description: "attributable deaths"},
+		{Name: "DeathsLow", Type: "number", Units: "deaths/year", Description: "lower bound of the hazard ratio's confidence interval"},
+		{Name: "DeathsHigh", Type: "number", Units: "deaths/year", Description: "upper bound of the hazard ratio's confidence interval"},
+		{Name: "Damages", Type: "number", Units: "dollars/year", Description: "deaths valued at the value of a statistical life"},
+		{Name: "DamagesLow", Type: "number", Units: "dollars/year", Description: "damages at the lower bound"},
+		{Name: "DamagesHigh", Type: "number", Units: "dollars/year", Description: "damages at the upper bound"},
+	}},
+	{File: "damages_by_sector.csv", Format: "csv", Description: "deaths of the total population and their damages by emitting SCC", Provenance: healthSource + ", valued with the scenario's [Scenario.Valuation]", Columns: []column{
+		sccColumn,
+		{Name: "Year", Type: "integer", Description: "year the dollars are expressed in"},
+		{Name: "Deaths", Type: "number", Units: "deaths/year", Description: "attributable deaths"},
+		{Name: "Damages", Type: "number", Units: "dollars/year", Description: "deaths valued at the value of a statistical life"},
+	}},
+	{File: "damages_by_demographic.csv", Format: "csv", Description: "deaths of the total population attributable to each demographic's consumption and their damages", Provenance: healthSource + ", for each demographic's consumption, valued with the scenario's [Scenario.Valuation]", Columns: []column{
+		demographicColumn, labelColumn,
+		{Name: "Year", Type: "integer", Description: "year the dollars are expressed in"},
+		{Name: "Deaths", Type: "number", Units: "deaths/year", Description: "attributable deaths"},
+		{Name: "DeathsLow", Type: "number", Units: "deaths/year", Description: "lower bound of the hazard ratio's confidence interval"},
+		{Name: "DeathsHigh", Type: "number", Units: "deaths/year", Description: "upper bound of the hazard ratio's confidence interval"},
+		{Name: "Damages", Type: "number", Units: "dollars/year", Description: "deaths valued at the value of a statistical life"},
+		{Name: "DamagesLow", Type: "number", Units: "dollars/year", Description: "damages at the lower bound"},
+		{Name: "DamagesHigh", Type: "number", Units: "dollars/year", Description: "damages at the upper bound"},
+	}},
+	{File: "sectors.csv", Format: "csv", Description: "emissions of each pollutant by SCC caused by the final demand, omitting zeros", Provenance: emissionsSource, Columns: []column{
+		sccColumn, emissionColumn,
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "emissions"},
+	}},
+	{File: "metadata.csv", Format: "csv", Description: "settings the scenario was calculated with", Provenance: "the scenario and config settings", Columns: []column{
+		{Name: "Field", Type: "string", Description: "setting name; Population, CESNote, NonFiniteNote and similar fields may repeat"},
+		{Name: "Value", Type: "string", Description: "setting value"},
+	}},
+	{File: "results.xlsx", Format: "xlsx", Description: "workbook with a sheet for each of the scenario's main results", Provenance: "the scenario's result tables"},
+
+	// Command outputs.
+	{File: "equal_exposure.csv", Format: "csv", Description: "reductions in SCC emissions that equalize exposure across groups", Provenance: "written by the equalize command from the emissions and exposure caused by total final demand", Columns: sectorReductionColumns},
+	{File: "optimal_reductions.csv", Format: "csv", Description: "reductions in SCC emissions that minimize the disparity in exposure within the emissions budget", Provenance: "written by the optimize command from the emissions and exposure caused by total final demand", Columns: sectorReductionColumns},
+	{File: "externality.csv", Format: "csv", Description: "health damages caused per dollar of final demand of each commodity", Provenance: "written by the externality command from the EIEIO health impacts of a dollar of final demand of each commodity, valued at the value of a statistical life", Columns: []column{
+		{Name: "Commodity", Type: "string", Description: "EIO commodity"},
+		{Name: "FinalDemand", Type: "number", Units: "dollars/year", Description: "final demand of the commodity"},
+		{Name: "Damages", Type: "number", Units: "dollars/year", Description: "health damages caused by the final demand"},
+		{Name: "DamagesPerDollar", Type: "number", Units: "dollars per dollar", Description: "damages per dollar of final demand"},
+	}},
+	{File: "stability.csv", Format: "csv", Description: "stability across years of each sector's share of each demographic's emissions", Provenance: "written by the stability command from " + contributionSource, Columns: []column{
+		demographicColumn, labelColumn, sccColumn,
+		{Name: "MeanShare", Type: "number", Description: "mean share of the demographic's PM2.5 emissions"},
+		{Name: "StdDev", Type: "number", Description: "standard deviation of the share"},
+		{Name: "CV", Type: "number", Description: "coefficient of variation of the share"},
+		{Name: "Stability", Type: "string", Description: "stable, or volatile if CV is above the -cv threshold"},
+	}},
+	{File: "exposure_by_year.csv", Format: "csv", Description: "population-weighted PM2.5 exposure of each population caused by total final demand in each year", Provenance: "written by the analyze command from the EIEIO PM2.5 concentrations caused by total final demand, weighted by the census population counts of each grid cell", Columns: []column{
+		yearColumn, populationColumn, labelColumn, exposureColumn,
+		{Name: "People", Type: "number", Units: "people", Description: "population count, within the subdomain if one is configured"},
+	}},
+	{File: "contribution_by_year.csv", Format: "csv", Description: "PM2.5 emissions caused by each demographic's consumption in each year", Provenance: "written by the analyze command from " + contributionSource, Columns: []column{
+		yearColumn, demographicColumn, labelColumn,
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "population-adjusted PM2.5 emissions"},
+	}},
+	{File: "paths.csv", Format: "csv", Description: "the supply-chain paths responsible for the most of a demographic's emissions", Provenance: "written by the paths command from the Leontief structural path decomposition of the demographic's consumption", Columns: []column{
+		{Name: "Rank", Type: "integer", Description: "rank by emissions, from 1"},
+		{Name: "Depth", Type: "integer", Description: "number of upstream steps"},
+		{Name: "Path", Type: "string", Description: "commodities from household purchase to emitter, separated by >"},
+		{Name: "Emissions", Type: "number", Units: "kg/year", Description: "emissions of the last sector of the path caused by the demographic's purchases along it"},
+	}},
+	{File: "monitor_comparison.csv", Format: "csv", Description: "modeled and observed concentrations at air quality monitors", Provenance: "written by the monitor-report command from EPA AQS observations and the concentrations caused by final demand", Columns: []column{
+		{Name: "Site", Type: "string", Description: "AQS site ID"},
+		{Name: "Lon", Type: "number", Units: "degrees", Description: "monitor longitude"},
+		{Name: "Lat", Type: "number", Units: "degrees", Description: "monitor latitude"},
+		{Name: "GridCell", Type: "integer", Description: "model grid cell containing the monitor"},
+		{Name: "Observed", Type: "number", Units: "μg/m³", Description: "observed annual mean concentration"},
+		{Name: "Modeled", Type: "number", Units: "μg/m³", Description: "modeled concentration in the grid cell"},
+		{Name: "Bias", Type: "number", Units: "μg/m³", Description: "modeled minus observed"},
+	}},
+	{File: "emission_totals.csv", Format: "csv", Description: "modeled national emission totals compared with published ones", Provenance: "written by the totals-report command from " + emissionsSource + " for total final demand, and the published totals file", Columns: []column{
+		yearColumn, emissionColumn,
+		{Name: "Model", Type: "number", Units: "kg/year", Description: "modeled national emissions"},
+		{Name: "National", Type: "number", Units: "kg/year", Description: "published national emissions"},
+		{Name: "Ratio", Type: "number", Description: "modeled divided by published emissions"},
+		{Name: "Flagged", Type: "boolean", Description: "whether the ratio differs from 1 by more than the threshold"},
+		{Name: "Note", Type: "string", Description: "possible cause of a flagged ratio, such as a unit error"},
+	}},
+	{File: "emissions_comparison.csv", Format: "csv", Description: "EIO-derived emissions by SCC compared with the emissions inventory", Provenance: "written by the inventory-report command from " + emissionsSource + " for total final demand, and the inventory of [Sandbox.Inventory]", Columns: []column{
+		sccColumn, emissionColumn,
+		{Name: "EIO", Type: "number", Units: "kg/year", Description: "EIO-derived emissions"},
+		{Name: "Inventory", Type: "number", Units: "kg/year", Description: "inventory emissions"},
+		{Name: "Difference", Type: "number", Units: "kg/year", Description: "EIO minus inventory emissions"},
+		{Name: "RelativeDifference", Type: "number", Description: "difference divided by the larger of the two, from -1 to 1"},
+		{Name: "Flagged", Type: "boolean", Description: "whether the relative difference is above the threshold for emissions above the minimum"},
+	}},
+	{File: "demand.csv", Format: "csv", Description: "final demand by commodity, in the format read by a scenario's DemandFile", Provenance: "written by the demand export command from the EIEIO final demand", Columns: []column{
+		{Name: "Commodity", Type: "string", Description: "EIO commodity"},
+		{Name: "Dollars", Type: "number", Units: "dollars/year", Description: "final demand"},
+	}},
+	{File: "grid.csv", Format: "csv", Description: "geometry of the grid cells that gridded results are indexed by", Provenance: "written by the export grid command from the air quality model's grid", Columns: []column{
+		{Name: "Cell", Type: "integer", Description: "index of the cell in gridded results"},
+		{Name: "GridCell", Type: "integer", Description: "index of the cell in the model grid"},
+		{Name: "Lon", Type: "number", Units: "degrees", Description: "longitude of the cell centroid"},
+		{Name: "Lat", Type: "number", Units: "degrees", Description: "latitude of the cell centroid"},
+		{Name: "X", Type: "number", Units: "grid spatial reference units", Description: "x coordinate of the cell centroid"},
+		{Name: "Y", Type: "number", Units: "grid spatial reference units", Description: "y coordinate of the cell centroid"},
+		{Name: "Area", Type: "number", Units: "grid spatial reference units squared", Description: "cell area"},
+		{Name: "MinX", Type: "number", Units: "grid spatial reference units", Description: "west edge of the cell's bounding box"},
+		{Name: "MinY", Type: "number", Units: "grid spatial reference units", Description: "south edge of the cell's bounding box"},
+		{Name: "MaxX", Type: "number", Units: "grid spatial reference units", Description: "east edge of the cell's bounding box"},
+		{Name: "MaxY", Type: "number", Units: "grid spatial reference units", Description: "north edge of the cell's bounding box"},
+	}},
+	{File: "naics_crosswalk.csv", Format: "csv", Description: "crosswalk from SCCs to 2007 NAICS codes through the IO industries of the SCC map", Provenance: "written by the export crosswalk command from the SCC map and the NAICS codes sheet of the BEA detailed use table (UseDetail)", Columns: []column{
+		sccColumn,
+		{Name: "Industry", Type: "string", Description: "IO industry the SCC is mapped to"},
+		{Name: "BEACode", Type: "string", Description: "BEA detailed industry code, empty if the industry isn't in the NAICS codes sheet"},
+		naicsColumn,
+		{Name: "Share", Type: "number", Description: "fraction of the SCC's emissions attributed to the NAICS code: split equally among the SCC's industries and then among each industry's codes"},
+	}},
+	{File: "snapshot.npz", Format: "npz", Description: "derived arrays (demand, consumption, emissions, concentrations, populations) as a NumPy archive, with their labels and units in metadata.json", Provenance: "written by the export snapshot command"},
+	{File: "dem_scc.json", Format: "json", Description: "population-adjusted demographic×SCC PM2.5 emissions matrix with its labels and units, omitting SCCs without emissions", Provenance: "written by the export matrix command from " + contributionSource},
+	{File: "dem_scc_deaths.json", Format: "json", Description: "demographic×SCC matrix of the deaths of the total population attributable to each demographic's consumption", Provenance: "written by the export matrix command from " + healthSource},
+	{File: "populations.geojson", Format: "geojson", Description: "census population counts of each grid cell", Provenance: "written by the export populations command from the census data"},
+}
+
+// sectorReductionColumns are the columns of the tables of emission
+// reductions by SCC written by equalize and optimize.
+var sectorReductionColumns = []column{
+	sccColumn,
+	{Name: "Emissions", Type: "number", Units: "kg/year", Description: "PM2.5 emissions before reduction"},
+	{Name: "Reduction", Type: "number", Units: "kg/year", Description: "emissions removed"},
+	{Name: "ReductionFraction", Type: "number", Description: "fraction of the SCC's emissions removed"},
+}
+
+// outputFileNamed returns the description of the output file with the
+// default name name.
+func outputFileNamed(name string) (outputFile, bool) {
+	for _, f := range outputFiles {
+		if f.File == name {
+			return f, true
+		}
+	}
+	return outputFile{}, false
+}
+
+// describeFile returns the description of the file at path, which is the
+// output file with the default name name, listing the columns of its
+// header if it is a table.
+func describeFile(path, name string) (outputFile, error) {
+	f, ok := outputFileNamed(name)
+	if !ok {
+		return outputFile{}, errorf(kindOther, "no description of output file %s", name)
+	}
+	f.File = filepath.Base(path)
+	if f.Format != "csv" {
+		return f, nil
+	}
+	header, _, err := readCSV(path)
+	if err != nil {
+		return outputFile{}, err
+	}
+	known := f.Columns
+	f.Columns = make([]column, len(header))
+	for i, h := range header {
+		c := column{Name: h, Type: "string"}
+		for _, k := range known {
+			if k.Name == h {
+				c = k
+				break
+			}
+		}
+		if c.Provenance == "" && c.Type != "string" {
+			c.Provenance = f.Provenance
+		}
+		f.Columns[i] = c
+	}
+	return f, nil
+}
+
+// addToDataDictionary adds files to the data dictionary of dir, replacing
+// the existing descriptions of files with the same names.
+func addToDataDictionary(dir string, files []outputFile) error {
+	path := filepath.Join(dir, dataDictionaryFile)
+	var d dataDictionary
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(b, &d); err != nil {
+			return errors.Wrapf(err, "reading %s", path)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	byName := make(map[string]outputFile)
+	for _, f := range d.Files {
+		byName[f.File] = f
+	}
+	for _, f := range files {
+		byName[f.File] = f
+	}
+	d.Files = d.Files[:0]
+	for _, f := range byName {
+		d.Files = append(d.Files, f)
+	}
+	sort.Slice(d.Files, func(i, j int) bool { return d.Files[i].File < d.Files[j].File })
+	if b, err = json.MarshalIndent(d, "", "  "); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// describeOutput adds the file at path, the output file with the default
+// name name, to the data dictionary of its directory.
+func describeOutput(path, name string) error {
+	f, err := describeFile(path, name)
+	if err != nil {
+		return errors.Wrap(err, "writing data dictionary")
+	}
+	return errors.Wrap(addToDataDictionary(filepath.Dir(path), []outputFile{f}), "writing data dictionary")
+}
+
+// writeDataDictionaries writes a data dictionary to root and each of its
+// subdirectories describing the output files in it.
+func writeDataDictionaries(root string) error {
+	byDir := make(map[string][]outputFile)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if _, ok := outputFileNamed(info.Name()); !ok {
+			return nil
+		}
+		f, err := describeFile(path, info.Name())
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(path)
+		byDir[dir] = append(byDir[dir], f)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "writing data dictionaries")
+	}
+	for dir, files := range byDir {
+		if err := addToDataDictionary(dir, files); err != nil {
+			return errors.Wrap(err, "writing data dictionaries")
+		}
+	}
+	return nil
+}
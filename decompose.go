@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// groupConsumption is a demographic's consumption of an end-use group and
+// the exposure it causes.
+type groupConsumption struct {
+	// Dollars is the consumption in constant dollars.
+	Dollars float64
+
+	// Exposure is the exposure of the total population caused by the
+	// consumption (people·μg/m³).
+	Exposure float64
+}
+
+// yearShares is the consumption of each demographic by end-use group in
+// one year, from the consumption_shares.csv of a batch scenario.
+type yearShares struct {
+	Year int
+
+	// Deflator is the price index of the constant dollars.
+	Deflator string
+
+	// Groups are by demographic and then by end-use group abbreviation.
+	Groups map[string]map[string]groupConsumption
+	Labels map[string]string
+}
+
+// loadBatchShares reads the consumption shares of each completed scenario
+// of a batch output directory, in constant dollars. If names is non-empty,
+// only the named scenarios are read.
+func loadBatchShares(dir string, names []string) ([]yearShares, error) {
+	scenarios, err := completedYears(dir, names)
+	if err != nil {
+		return nil, err
+	}
+	var years []yearShares
+	for _, sc := range scenarios {
+		ys, err := readYearShares(sc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "scenario %s", sc.Name)
+		}
+		if len(years) > 0 && ys.Deflator != years[0].Deflator {
+			return nil, fmt.Errorf("scenario %s is in %s, but the first is in %s; rerun the batch with one deflator", sc.Name, ys.Deflator, years[0].Deflator)
+		}
+		years = append(years, ys)
+	}
+	return years, nil
+}
+
+// readYearShares reads the consumption shares of a completed scenario,
+// converting them to constant dollars with the deflator recorded in its
+// consumption.csv and metadata.csv.
+func readYearShares(sc batchYear) (yearShares, error) {
+	ys := yearShares{Year: sc.Year, Groups: make(map[string]map[string]groupConsumption), Labels: make(map[string]string)}
+	header, rows, err := readCSV(filepath.Join(sc.Dir, "consumption_shares.csv"))
+	if err != nil {
+		return ys, withKind(kindDataMissing, errors.Wrap(err, "decomposition requires ConsumptionShares = true"))
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[h] = i
+	}
+	if _, ok := col["Exposure"]; !ok {
+		return ys, errorf(kindDataMissing, "consumption_shares.csv has no Exposure column; rerun the scenario")
+	}
+	factors, err := realDollarFactors(sc.Dir)
+	if err != nil {
+		return ys, err
+	}
+	for _, r := range rows {
+		dem, group := r[col["Demographic"]], r[col["Abbrev"]]
+		f, ok := factors[dem]
+		if !ok {
+			return ys, fmt.Errorf("consumption.csv has no constant dollars for %s", dem)
+		}
+		dollars, err1 := strconv.ParseFloat(r[col["Consumption"]], 64)
+		exposure, err2 := strconv.ParseFloat(r[col["Exposure"]], 64)
+		if err1 != nil || err2 != nil {
+			return ys, fmt.Errorf("invalid consumption shares for %s and %s", dem, group)
+		}
+		if ys.Groups[dem] == nil {
+			ys.Groups[dem] = make(map[string]groupConsumption)
+		}
+		ys.Groups[dem][group] = groupConsumption{Dollars: dollars * f, Exposure: exposure}
+		ys.Labels[dem] = r[col["Label"]]
+	}
+	_, meta, err := readCSV(filepath.Join(sc.Dir, "metadata.csv"))
+	if err != nil {
+		return ys, err
+	}
+	for _, r := range meta {
+		if r[0] == "Deflator" {
+			ys.Deflator = r[1]
+		}
+	}
+	return ys, nil
+}
+
+// realDollarFactors returns what the consumption of each demographic in
+// the consumption.csv of dir is multiplied by to express it in constant
+// dollars.
+func realDollarFactors(dir string) (map[string]float64, error) {
+	header, rows, err := readCSV(filepath.Join(dir, "consumption.csv"))
+	if err != nil {
+		return nil, err
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[h] = i
+	}
+	factors := make(map[string]float64)
+	for _, r := range rows {
+		nominal, err1 := strconv.ParseFloat(r[col["Consumption"]], 64)
+		constant, err2 := strconv.ParseFloat(r[col["RealConsumption"]], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid consumption for %s", r[col["Demographic"]])
+		}
+		if nominal != 0 {
+			factors[r[col["Demographic"]]] = constant / nominal
+		}
+	}
+	return factors, nil
+}
+
+// decomposition is the change in the exposure caused by a demographic's
+// consumption between two years, split into the effects of the volume of
+// its consumption, the mix of end-use groups it consumes and the exposure
+// intensity of each group. The effects sum to the change.
+type decomposition struct {
+	From, To               float64
+	Volume, Mix, Intensity float64
+}
+
+// lmdiSmall replaces the zero shares and intensities of groups that are
+// only consumed, or only cause exposure, in one of the years, as
+// recommended by Ang and Liu (2007) for LMDI.
+const lmdiSmall = 1e-20
+
+// logMean returns the logarithmic mean of the positive a and b.
+func logMean(a, b float64) float64 {
+	if a == b {
+		return a
+	}
+	return (a - b) / (math.Log(a) - math.Log(b))
+}
+
+// decompose returns the additive LMDI-I decomposition (Ang, 2005) of the
+// change in exposure from the consumption from in one year to that to in a
+// later year, both by end-use group. The exposure of each group is the
+// total consumption, times the group's share of it, times the exposure
+// per constant dollar of the group. A group consumed in only one year is
+// given the intensity of the other, so that its appearance is a mix
+// effect.
+func decompose(from, to map[string]groupConsumption) (decomposition, error) {
+	var d decomposition
+	var v0, v1 float64
+	for _, g := range from {
+		v0 += g.Dollars
+		d.From += g.Exposure
+	}
+	for _, g := range to {
+		v1 += g.Dollars
+		d.To += g.Exposure
+	}
+	if !(v0 > 0 && v1 > 0) {
+		return d, errorf(kindNumeric, "decomposition requires positive consumption, got %g and %g", v0, v1)
+	}
+	var groups []string
+	for g := range from {
+		groups = append(groups, g)
+	}
+	for g := range to {
+		if _, ok := from[g]; !ok {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		g0, g1 := from[g], to[g]
+		if g0.Dollars < 0 || g1.Dollars < 0 || g0.Exposure < 0 || g1.Exposure < 0 {
+			return d, errorf(kindNumeric, "decomposition requires non-negative consumption and exposure, but end-use group %s has negative values", g)
+		}
+		if g0.Exposure == 0 && g1.Exposure == 0 {
+			continue
+		}
+		s0, s1 := g0.Dollars/v0, g1.Dollars/v1
+		var i0, i1 float64
+		if g0.Dollars > 0 {
+			i0 = g0.Exposure / g0.Dollars
+		}
+		if g1.Dollars > 0 {
+			i1 = g1.Exposure / g1.Dollars
+		}
+		if g0.Dollars == 0 {
+			s0, i0 = lmdiSmall, i1
+		}
+		if g1.Dollars == 0 {
+			s1, i1 = lmdiSmall, i0
+		}
+		i0, i1 = math.Max(i0, lmdiSmall), math.Max(i1, lmdiSmall)
+		w := logMean(v1*s1*i1, v0*s0*i0)
+		d.Volume += w * math.Log(v1/v0)
+		d.Mix += w * math.Log(s1/s0)
+		d.Intensity += w * math.Log(i1/i0)
+	}
+	return d, nil
+}
+
+// decompositionHeader is the header of decomposition.csv.
+var decompositionHeader = []string{"Demographic", "Label", "FromYear", "ToYear", "FromExposure", "ToExposure", "Change", "Volume", "Mix", "Intensity"}
+
+// writeDecomposition writes decomposition.csv to a batch output directory,
+// decomposing the change in the exposure caused by each demographic between
+// each pair of consecutive years.
+func writeDecomposition(dir string, names []string) error {
+	years, err := loadBatchShares(dir, names)
+	if err != nil {
+		return err
+	}
+	if len(years) < 2 {
+		return errorf(kindDataMissing, "decomposition requires completed scenarios with ConsumptionShares for at least 2 years, got %d", len(years))
+	}
+	var rows [][]string
+	for k := 1; k < len(years); k++ {
+		y0, y1 := years[k-1], years[k]
+		dems := make([]string, 0, len(y1.Groups))
+		for dem := range y1.Groups {
+			if _, ok := y0.Groups[dem]; ok {
+				dems = append(dems, dem)
+			}
+		}
+		sort.Strings(dems)
+		for _, dem := range dems {
+			d, err := decompose(y0.Groups[dem], y1.Groups[dem])
+			if err != nil {
+				return errors.Wrapf(err, "%s from %d to %d", dem, y0.Year, y1.Year)
+			}
+			rows = append(rows, []string{dem, y1.Labels[dem], strconv.Itoa(y0.Year), strconv.Itoa(y1.Year),
+				formatFloat(d.From), formatFloat(d.To), formatFloat(d.To - d.From),
+				formatFloat(d.Volume), formatFloat(d.Mix), formatFloat(d.Intensity)})
+		}
+	}
+	path := filepath.Join(dir, "decomposition.csv")
+	if err := writeCSV(path, decompositionHeader, rows); err != nil {
+		return err
+	}
+	return describeOutput(path, "decomposition.csv")
+}
+
+// decomposeCommand decomposes the changes in the exposure caused by each
+// demographic across the years of a completed batch.
+func decomposeCommand(args []string) error {
+	fs := flag.NewFlagSet("decompose", flag.ExitOnError)
+	var names stringList
+	fs.Var(&names, "scenario", "include only the named scenario (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s decompose [-scenario name]... batch_output_dir\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "decompose requires exactly one batch output directory")
+	}
+	if err := writeDecomposition(fs.Arg(0), names); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", filepath.Join(fs.Arg(0), "decomposition.csv"))
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecompose(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		from, to map[string]groupConsumption
+
+		// want, if set, are the expected effects.
+		want *decomposition
+	}{
+		{
+			name: "volume",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 20, Exposure: 10}},
+			want: &decomposition{From: 5, To: 10, Volume: 5},
+		},
+		{
+			name: "intensity",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 10}},
+			want: &decomposition{From: 5, To: 10, Intensity: 5},
+		},
+		{
+			name: "mix",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 5, Exposure: 5}, "TRAN": {Dollars: 5, Exposure: 10}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 2, Exposure: 2}, "TRAN": {Dollars: 8, Exposure: 16}},
+			want: &decomposition{From: 15, To: 18, Mix: 3},
+		},
+		{
+			name: "all effects",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 5, Exposure: 5}, "TRAN": {Dollars: 5, Exposure: 10}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 9, Exposure: 4}, "TRAN": {Dollars: 3, Exposure: 12}},
+		},
+		{
+			name: "group only in the first year",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}, "TRAN": {Dollars: 10, Exposure: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 20, Exposure: 10}},
+		},
+		{
+			name: "group only in the second year",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}, "TRAN": {Dollars: 4, Exposure: 8}},
+		},
+		{
+			name: "zero-exposure group",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}, "EDUC": {Dollars: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 12, Exposure: 4}, "EDUC": {Dollars: 8}},
+		},
+		{
+			name: "group that starts causing exposure",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}, "EDUC": {Dollars: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}, "EDUC": {Dollars: 5, Exposure: 3}},
+		},
+		{
+			name: "no change",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}},
+			want: &decomposition{From: 5, To: 5},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := decompose(test.from, test.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tol := 1e-9 * math.Max(1, math.Max(math.Abs(d.From), math.Abs(d.To)))
+			if sum := d.Volume + d.Mix + d.Intensity; math.Abs(sum-(d.To-d.From)) > tol {
+				t.Errorf("effects %+v sum to %g, want the change %g", d, sum, d.To-d.From)
+			}
+			if w := test.want; w != nil {
+				if d.From != w.From || d.To != w.To || math.Abs(d.Volume-w.Volume) > tol ||
+					math.Abs(d.Mix-w.Mix) > tol || math.Abs(d.Intensity-w.Intensity) > tol {
+					t.Errorf("got %+v, want %+v", d, *w)
+				}
+			}
+		})
+	}
+}
+
+func TestDecomposeInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		from, to map[string]groupConsumption
+	}{
+		{
+			name: "no consumption",
+			from: map[string]groupConsumption{"FOOD": {Exposure: 5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}},
+		},
+		{
+			name: "negative exposure",
+			from: map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: -5}},
+			to:   map[string]groupConsumption{"FOOD": {Dollars: 10, Exposure: 5}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decompose(test.from, test.to); kindOf(err) != kindNumeric {
+				t.Errorf("got error %v, want a numeric error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// deflatorConfig specifies the price index used to express the dollars of
+// each year in the constant dollars of one year, so that consumption can be
+// compared across years.
+type deflatorConfig struct {
+	// File, if set, is the path to a CSV file with columns Year,Index
+	// giving an annual price index, such as the PCE price index of BEA
+	// NIPA table 1.1.4, that replaces the built-in CPI-U.
+	File string
+
+	// BaseYear is the year whose dollars results are expressed in.
+	// Defaults to defaultYear.
+	BaseYear int32
+}
+
+// cpiU is the annual average Consumer Price Index for All Urban Consumers
+// (CPI-U), U.S. city average, all items, 1982-84=100, from the Bureau of
+// Labor Statistics (series CUUR0000SA0).
+var cpiU = map[int32]float64{
+	2000: 172.2,
+	2001: 177.1,
+	2002: 179.9,
+	2003: 184.0,
+	2004: 188.9,
+	2005: 195.3,
+	2006: 201.6,
+	2007: 207.342,
+	2008: 215.303,
+	2009: 214.537,
+	2010: 218.056,
+	2011: 224.939,
+	2012: 229.594,
+	2013: 232.957,
+	2014: 236.736,
+	2015: 237.017,
+	2016: 240.007,
+	2017: 245.120,
+	2018: 251.107,
+	2019: 255.657,
+}
+
+// priceIndex is an annual price index and the year of the constant
+// dollars it converts to.
+type priceIndex struct {
+	name   string
+	base   int32
+	values map[int32]float64
+}
+
+// deflator is the price index of the Deflator setting in the [Sandbox]
+// config table.
+var deflator = priceIndex{name: "CPI-U", values: cpiU}
+
+// setDeflator sets deflator from c, reading its index file, if any.
+func setDeflator(c deflatorConfig) error {
+	p := priceIndex{name: "CPI-U", base: c.BaseYear, values: cpiU}
+	if c.File != "" {
+		values, err := readPriceIndex(c.File)
+		if err != nil {
+			err = errors.Wrap(err, "error reading Deflator file")
+			if errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return withKind(kindConfig, err)
+		}
+		p = priceIndex{name: filepath.Base(c.File), base: c.BaseYear, values: values}
+	}
+	if _, ok := p.values[p.baseYear()]; !ok {
+		return errorf(kindConfig, "Deflator has no %s index for its base year %d", p.name, p.baseYear())
+	}
+	deflator = p
+	return nil
+}
+
+// readPriceIndex reads a price index file.
+func readPriceIndex(path string) (map[int32]float64, error) {
+	_, rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[int32]float64)
+	for _, r := range rows {
+		if len(r) != 2 {
+			return nil, fmt.Errorf("price index row %v must have columns Year,Index", r)
+		}
+		year, err := strconv.Atoi(strings.TrimSpace(r[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid year in price index row %v", r)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(r[1]), 64)
+		if err != nil || !(v > 0) {
+			return nil, fmt.Errorf("invalid index in price index row %v; must be positive", r)
+		}
+		if _, ok := values[int32(year)]; ok {
+			return nil, fmt.Errorf("year %d is listed more than once", year)
+		}
+		values[int32(year)] = v
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s has no years", path)
+	}
+	return values, nil
+}
+
+// baseYear returns the year of the constant dollars of p.
+func (p priceIndex) baseYear() int32 {
+	if p.base == 0 {
+		return int32(defaultYear())
+	}
+	return p.base
+}
+
+// factor returns what dollars of year are multiplied by to express them
+// in constant dollars of the base year.
+func (p priceIndex) factor(year int32) (float64, error) {
+	v, ok := p.values[year]
+	if !ok {
+		return 0, errorf(kindConfig, "no %s price index for %d; set a Deflator File that covers it", p.name, year)
+	}
+	return p.values[p.baseYear()] / v, nil
+}
+
+// String describes p, for recording in results.
+func (p priceIndex) String() string {
+	return fmt.Sprintf("%s, %d dollars", p.name, p.baseYear())
+}
+
+// consumptionHeader is the header of consumption.csv.
+var consumptionHeader = []string{"Demographic", "Label", "Year", "Consumption", "RealConsumption", "EmissionsPerDollar"}
+
+// consumptionRows returns the total consumption of each demographic in
+// sc's year, in nominal and constant dollars, and the PM2.5 emissions it
+// causes per constant dollar, for comparing demographics across years.
+func consumptionRows(ctx context.Context, s *eieio.Server, sc *scenario, dems []*eieiorpc.Demograph, multipliers []float64) ([][]string, error) {
+	f, err := deflator.factor(sc.Year)
+	if err != nil {
+		return nil, err
+	}
+	// Emissions are not population-adjusted, as the consumption isn't.
+	emis, _, err := demAndEmissions(ctx, s, dems, sc.Year, LOC, sc.AQM, multipliers)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for i, dem := range dems {
+		demand, err := getDemographicDemand(ctx, s, dem, sc.Year, multipliers)
+		if err != nil {
+			return nil, err
+		}
+		var nominal, kg float64
+		for _, v := range demand.Data {
+			nominal += v
+		}
+		for _, v := range emis.RawRowView(i) {
+			kg += v
+		}
+		constant := nominal * f
+		rows = append(rows, []string{demographKey(dem), labels.demograph(dem), strconv.Itoa(int(sc.Year)),
+			formatFloat(nominal), formatFloat(constant), formatFloat(kg / constant)})
+	}
+	return rows, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// allCommodities is the Commodity value in a state shares file that
+// applies to every commodity without a more specific entry.
+const allCommodities = "*"
+
+// demandStates and demandStateSharesFile are the DemandStates and
+// DemandStateSharesFile settings in the [Sandbox] config, set by
+// getEIOServer.
+var (
+	demandStates          []string
+	demandStateSharesFile string
+)
+
+// stateDemand returns demand restricted to the portion consumed in
+// demandStates, or demand itself if none are set.
+func stateDemand(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector) (*eieiorpc.Vector, error) {
+	if len(demandStates) == 0 {
+		return demand, nil
+	}
+	restricted, err := restrictDemandToStates(ctx, s, demand, demandStates, demandStateSharesFile)
+	if err != nil {
+		return nil, withKind(kindConfig, errors.Wrap(err, "error restricting final demand to states"))
+	}
+	return restricted, nil
+}
+
+// demandStatesSetting describes demandStates, for metadata.csv.
+func demandStatesSetting() string {
+	if len(demandStates) == 0 {
+		return "national"
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(demandStates, ", "), demandStateSharesFile)
+}
+
+// stateDemandShares holds each state's share of national final demand,
+// by state and then by commodity.
+type stateDemandShares map[string]map[string]float64
+
+// loadStateDemandShares reads a CSV file with header State,Commodity,Share.
+func loadStateDemandShares(path string) (stateDemandShares, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	if _, err := r.Read(); err != nil { // header
+		return nil, errors.Wrap(err, "reading state shares header")
+	}
+	shares := make(stateDemandShares)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		state := strings.ToUpper(strings.TrimSpace(rec[0]))
+		share, err := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid share for state %s: %v", state, err)
+		}
+		if share < 0 || share > 1 {
+			return nil, fmt.Errorf("share for state %s must be between 0 and 1, got %g", state, share)
+		}
+		if shares[state] == nil {
+			shares[state] = make(map[string]float64)
+		}
+		shares[state][strings.TrimSpace(rec[1])] = share
+	}
+	return shares, nil
+}
+
+// share returns the fraction of national demand for commodity that is
+// consumed in state.
+func (s stateDemandShares) share(state, commodity string) (float64, error) {
+	byCommodity, ok := s[state]
+	if !ok {
+		return 0, fmt.Errorf("no demand shares for state %s", state)
+	}
+	if v, ok := byCommodity[commodity]; ok {
+		return v, nil
+	}
+	if v, ok := byCommodity[allCommodities]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("no demand share for state %s and commodity %s", state, commodity)
+}
+
+// restrictDemandToStates returns the portion of the national demand vector
+// consumed by final users in states. The SpatialEIO model has no notion of
+// where final demand occurs, so this apportions national demand using the
+// shares in sharesFile; emissions are still located by the model's spatial
+// surrogates.
+func restrictDemandToStates(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, states []string, sharesFile string) (*eieiorpc.Vector, error) {
+	if sharesFile == "" {
+		return nil, fmt.Errorf("a state shares file is required to restrict demand to states")
+	}
+	shares, err := loadStateDemandShares(sharesFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading state demand shares")
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(commodities.List) != len(demand.Data) {
+		return nil, errorf(kindNumeric, "expected demand to have #commodities %d rows, got %d", len(commodities.List), len(demand.Data))
+	}
+
+	restricted := make([]float64, len(demand.Data))
+	for i, commodity := range commodities.List {
+		if demand.Data[i] == 0 {
+			continue
+		}
+		var total float64
+		for _, state := range states {
+			v, err := shares.share(strings.ToUpper(state), commodity)
+			if err != nil {
+				return nil, err
+			}
+			total += v
+		}
+		if total > 1 {
+			return nil, fmt.Errorf("state shares for commodity %s sum to %g > 1", commodity, total)
+		}
+		restricted[i] = demand.Data[i] * total
+	}
+	return &eieiorpc.Vector{Data: restricted}, nil
+}
+
+// demandMultipliers converts a map of commodity names to demand multipliers
+// into a per-commodity vector. The key "*" applies to all commodities
+// without a specific entry. It returns nil if scale is empty.
+func demandMultipliers(ctx context.Context, s *eieio.Server, scale map[string]float64) ([]float64, error) {
+	if len(scale) == 0 {
+		return nil, nil
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	multipliers := make([]float64, len(commodities.List))
+	for i, commodity := range commodities.List {
+		known[commodity] = true
+		multipliers[i] = 1
+		if f, ok := scale[commodity]; ok {
+			multipliers[i] = f
+		} else if f, ok := scale[allCommodities]; ok {
+			multipliers[i] = f
+		}
+	}
+	for commodity := range scale {
+		if commodity != allCommodities && !known[commodity] {
+			return nil, fmt.Errorf("invalid commodity %q in demand scale", commodity)
+		}
+	}
+	return multipliers, nil
+}
+
+// scaleDemand multiplies demand in place by multipliers, if non-nil.
+func scaleDemand(demand *eieiorpc.Vector, multipliers []float64) error {
+	if multipliers == nil {
+		return nil
+	}
+	if len(multipliers) != len(demand.Data) {
+		return errorf(kindNumeric, "expected demand to have #multipliers %d rows, got %d", len(multipliers), len(demand.Data))
+	}
+	for i, m := range multipliers {
+		demand.Data[i] *= m
+	}
+	return nil
+}
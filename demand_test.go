@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadStateDemandShares(t *testing.T) {
+	dir, err := ioutil.TempDir("", "demand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(contents string) string {
+		path := filepath.Join(dir, "shares.csv")
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	shares, err := loadStateDemandShares(write("State,Commodity,Share\nca, Cheese ,0.1\nCA,*,0.12\nNV,*,0.01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		state, commodity string
+		want             float64
+	}{
+		{"CA", "Cheese", 0.1},
+		{"CA", "Wine", 0.12},
+		{"NV", "Cheese", 0.01},
+	} {
+		if v, err := shares.share(test.state, test.commodity); err != nil || v != test.want {
+			t.Errorf("%s %s: got %g, %v, want %g", test.state, test.commodity, v, err, test.want)
+		}
+	}
+	if _, err := shares.share("OR", "Cheese"); err == nil {
+		t.Error("OR: got no error for a state without shares")
+	}
+
+	for name, contents := range map[string]string{
+		"out of range": "State,Commodity,Share\nCA,*,1.5\n",
+		"negative":     "State,Commodity,Share\nCA,*,-0.1\n",
+		"not a number": "State,Commodity,Share\nCA,*,most\n",
+		"short row":    "State,Commodity,Share\nCA,0.1\n",
+		"empty":        "",
+	} {
+		if _, err := loadStateDemandShares(write(contents)); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
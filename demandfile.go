@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// demandFileHeader is the header of the final demand files written by
+// `demand export` and read as a scenario's DemandFile.
+var demandFileHeader = []string{"Commodity", "Dollars"}
+
+// Ways of rescaling a demand file to preserve the model's total final
+// demand; see scenario.DemandRescale.
+const (
+	rescaleNone     = "none"
+	rescaleTotal    = "total"
+	rescaleUnedited = "unedited"
+)
+
+// modelDemand returns the model's final demand of type fdt, such as
+// "AllDemand", in year, along with the commodity names.
+func modelDemand(ctx context.Context, s *eieio.Server, fdt string, year int32) (*eieiorpc.Vector, []string, error) {
+	t, ok := eieiorpc.FinalDemandType_value[fdt]
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid final demand type %q", fdt)
+	}
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType(t),
+		Year:            year,
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting final demand")
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(commodities.List) != len(demand.Data) {
+		return nil, nil, errorf(kindNumeric, "expected final demand for %d commodities, got %d", len(commodities.List), len(demand.Data))
+	}
+	return demand, commodities.List, nil
+}
+
+// readDemandFile reads a final demand file, returning dollars by
+// commodity.
+func readDemandFile(path string) (map[string]float64, error) {
+	header, rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 2 || header[0] != demandFileHeader[0] || header[1] != demandFileHeader[1] {
+		return nil, errorf(kindConfig, "%s: expected header %s", path, strings.Join(demandFileHeader, ","))
+	}
+	dollars := make(map[string]float64, len(rows))
+	for i, r := range rows {
+		commodity := strings.TrimSpace(r[0])
+		if _, ok := dollars[commodity]; ok {
+			return nil, errorf(kindConfig, "%s line %d: duplicate commodity %q", path, i+2, commodity)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(r[1]), 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, errorf(kindConfig, "%s line %d: invalid demand %q for %s", path, i+2, r[1], commodity)
+		}
+		dollars[commodity] = v
+	}
+	return dollars, nil
+}
+
+// applyDemandFile replaces the demand for each commodity in demand with
+// that in dollars, rescaled according to rescale to preserve the total of
+// demand. Commodities not in dollars keep their demand. It returns the
+// number of commodities whose demand was changed.
+func applyDemandFile(demand *eieiorpc.Vector, commodities []string, dollars map[string]float64, rescale string) (int, error) {
+	index := make(map[string]int, len(commodities))
+	for i, c := range commodities {
+		index[c] = i
+	}
+	for c := range dollars {
+		if _, ok := index[c]; !ok {
+			return 0, errorf(kindConfig, "invalid commodity %q in demand file", c)
+		}
+	}
+
+	var modelTotal, editedTotal, uneditedTotal float64
+	edited := make([]bool, len(demand.Data))
+	var nEdited int
+	for i, c := range commodities {
+		modelTotal += demand.Data[i]
+		if v, ok := dollars[c]; ok && v != demand.Data[i] {
+			demand.Data[i] = v
+			edited[i] = true
+			nEdited++
+			editedTotal += v
+		} else {
+			uneditedTotal += demand.Data[i]
+		}
+	}
+
+	switch rescale {
+	case "", rescaleNone:
+	case rescaleTotal:
+		total := editedTotal + uneditedTotal
+		if total == 0 {
+			return 0, errorf(kindConfig, "can't rescale a demand file with no demand")
+		}
+		for i := range demand.Data {
+			demand.Data[i] *= modelTotal / total
+		}
+	case rescaleUnedited:
+		if editedTotal > modelTotal {
+			return 0, errorf(kindConfig, "the edited commodities' demand of $%g exceeds the model's total demand of $%g, so the others can't be rescaled to preserve it", editedTotal, modelTotal)
+		}
+		if uneditedTotal == 0 {
+			if editedTotal != modelTotal {
+				return 0, errorf(kindConfig, "no unedited commodities have demand to rescale")
+			}
+			break
+		}
+		f := (modelTotal - editedTotal) / uneditedTotal
+		for i := range demand.Data {
+			if !edited[i] {
+				demand.Data[i] *= f
+			}
+		}
+	default:
+		return 0, errorf(kindConfig, "invalid demand rescaling %q; valid options are %s, %s and %s", rescale, rescaleNone, rescaleTotal, rescaleUnedited)
+	}
+	return nEdited, nil
+}
+
+// writeDemandFile writes demand by commodity to path as a final demand file.
+func writeDemandFile(path string, demand *eieiorpc.Vector, commodities []string) error {
+	rows := make([][]string, len(commodities))
+	for i, c := range commodities {
+		rows[i] = []string{c, formatFloat(demand.Data[i])}
+	}
+	return writeCSV(path, demandFileHeader, rows)
+}
+
+// vectorSum returns the sum of the values of v.
+func vectorSum(v *eieiorpc.Vector) float64 {
+	var sum float64
+	for _, x := range v.Data {
+		sum += x
+	}
+	return sum
+}
+
+// demandCommand writes the model's final demand to an editable CSV file
+// (export), or checks an edited file against it and writes it with the
+// chosen rescaling applied (import), for use as a scenario's DemandFile.
+func demandCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintf(os.Stderr, "usage: %s demand export|import [flags]\n", os.Args[0])
+		return errorf(kindUsage, "demand requires a subcommand, export or import")
+	}
+	fs := flag.NewFlagSet("demand "+args[0], flag.ExitOnError)
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	fdt := fs.String("type", eieiorpc.FinalDemandType_AllDemand.String(), "final demand type")
+	rescale := fs.String("rescale", rescaleNone, "how to preserve the model's total demand: none, total or unedited (import only)")
+	out := fs.String("o", "", "output file (default demand.csv for export; none for import)")
+	fs.Usage = func() {
+		if args[0] == "import" {
+			fmt.Fprintf(fs.Output(), "usage: %s demand import [flags] file.csv\n", os.Args[0])
+		} else {
+			fmt.Fprintf(fs.Output(), "usage: %s demand export [flags]\n", os.Args[0])
+		}
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if args[0] == "import" && fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "demand import requires exactly one demand file")
+	}
+	switch *rescale {
+	case rescaleNone, rescaleTotal, rescaleUnedited:
+	default:
+		return errorf(kindUsage, "-rescale must be %s, %s or %s", rescaleNone, rescaleTotal, rescaleUnedited)
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	ctx := context.Background()
+	demand, commodities, err := modelDemand(ctx, s, *fdt, int32(*year))
+	if err != nil {
+		return err
+	}
+	if args[0] == "export" {
+		if *out == "" {
+			*out = "demand.csv"
+		}
+		if err := writeDemandFile(*out, demand, commodities); err != nil {
+			return err
+		}
+		if err := describeOutput(*out, "demand.csv"); err != nil {
+			return err
+		}
+		log.Printf("Wrote %s final demand for %d commodities ($%.4g) in %d to %s", *fdt, len(commodities), vectorSum(demand), *year, *out)
+		return nil
+	}
+
+	dollars, err := readDemandFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	modelTotal := vectorSum(demand)
+	n, err := applyDemandFile(demand, commodities, dollars, *rescale)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s changes the demand for %d of %d commodities; total final demand is $%.4g (model: $%.4g)", fs.Arg(0), n, len(commodities), vectorSum(demand), modelTotal)
+	if *out != "" {
+		if err := writeDemandFile(*out, demand, commodities); err != nil {
+			return err
+		}
+		if err := describeOutput(*out, "demand.csv"); err != nil {
+			return err
+		}
+		log.Printf("Wrote rescaled demand to %s", *out)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"go.etcd.io/bbolt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// demographicCache stores the results calculated for each demographic,
+// such as its consumption and the emissions and deaths it causes, so that
+// adding a demographic to a scenario that has already been run only
+// calculates results for the new one. Results are keyed by the settings
+// they depend on, including the config, so changed settings are
+// recalculated rather than reused.
+type demographicCache struct {
+	db *bbolt.DB
+
+	// reuse specifies whether stored results are used. If not, results
+	// are only stored.
+	reuse bool
+}
+
+var demographicsBucket = []byte("demographics")
+
+// demographicEntry is a stored result, along with any notes about missing
+// CES data recorded while calculating it, which are recorded again when it
+// is reused.
+type demographicEntry struct {
+	Values   []byte // float64s, little endian, so that NaNs are kept
+	CESNotes []string
+}
+
+// openDemographicCache opens or creates the demographic cache at path.
+func openDemographicCache(path string, reuse bool) (*demographicCache, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(demographicsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &demographicCache{db: db, reuse: reuse}, nil
+}
+
+func (c *demographicCache) Close() error { return c.db.Close() }
+
+func (c *demographicCache) get(key string) (*demographicEntry, error) {
+	var e *demographicEntry
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(demographicsBucket).Get([]byte(key))
+		if b == nil {
+			return nil
+		}
+		e = new(demographicEntry)
+		return json.Unmarshal(b, e)
+	})
+	return e, err
+}
+
+func (c *demographicCache) put(key string, e *demographicEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(demographicsBucket).Put([]byte(key), b)
+	})
+}
+
+type demographicCacheKey struct{}
+
+// withDemographicCache returns a context in which per-demographic results
+// are stored in, and if c.reuse is set reused from, c.
+func withDemographicCache(ctx context.Context, c *demographicCache) context.Context {
+	return context.WithValue(ctx, demographicCacheKey{}, c)
+}
+
+// configFingerprint identifies the config the EIEIO server was created
+// with, for keying cached results; it is set by getEIOServer.
+var configFingerprint string
+
+// configSpec returns a fingerprint of the config file, with environment
+// variables expanded, and of the environment variables in envVars that
+// override its settings. Changes to the contents of input files named in
+// the config are not detected.
+func configSpec(envVars []string) (string, error) {
+	var b []byte
+	if CONFIG != "" {
+		var err error
+		if b, err = ioutil.ReadFile(CONFIG); err != nil {
+			return "", err
+		}
+	}
+	parts := []string{os.ExpandEnv(string(b))}
+	for _, v := range envVars {
+		parts = append(parts, v+"="+os.Getenv(v))
+	}
+	return fingerprint(parts)
+}
+
+// fingerprint returns a short hex hash of the JSON encoding of v.
+func fingerprint(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])[:16], nil
+}
+
+// hashFloats returns a short hex hash of vs, or "" if vs is nil.
+func hashFloats(vs []float64) string {
+	if vs == nil {
+		return ""
+	}
+	h := sha256.New()
+	var b [8]byte
+	for _, v := range vs {
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		h.Write(b[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// cachedDemographic returns the result named kind for dem, calculated by
+// f with the settings params, using the demographic cache in ctx if there
+// is one.
+func cachedDemographic(ctx context.Context, kind string, dem *eieiorpc.Demograph, params []interface{}, f func(ctx context.Context) ([]float64, error)) ([]float64, error) {
+	c, ok := ctx.Value(demographicCacheKey{}).(*demographicCache)
+	if !ok {
+		return f(ctx)
+	}
+	parts := []string{kind, demographKey(dem), configFingerprint, emissionFactorsFor(ctx).File}
+	if f := sccFilterSetting(); f != "none" {
+		parts = append(parts, f)
+	}
+	for _, p := range params {
+		parts = append(parts, fmt.Sprint(p))
+	}
+	key := strings.Join(parts, "|")
+	if c.reuse {
+		e, err := c.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil && len(e.Values)%8 == 0 {
+			for _, note := range e.CESNotes {
+				recordCES(ctx, "%s", note)
+			}
+			vs := make([]float64, len(e.Values)/8)
+			for i := range vs {
+				vs[i] = math.Float64frombits(binary.LittleEndian.Uint64(e.Values[8*i:]))
+			}
+			return vs, nil
+		}
+	}
+
+	// Notes about missing CES data are recorded in a log of their own, to
+	// be stored with the result, and then added to that of ctx.
+	fCtx, notes := withCESLog(ctx)
+	vs, err := f(fCtx)
+	if err != nil {
+		return nil, err
+	}
+	e := &demographicEntry{Values: make([]byte, 8*len(vs)), CESNotes: notes.Notes()}
+	for i, v := range vs {
+		binary.LittleEndian.PutUint64(e.Values[8*i:], math.Float64bits(v))
+	}
+	addCESNotes(ctx, e.CESNotes)
+	if err := c.put(key, e); err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// efficiencyHeader is the header of exposure_efficiency.csv.
+var efficiencyHeader = []string{"Rank", "Sector", "FinalDemand", "Exposure", "ExposurePerDollar", "Jobs", "ExposurePerJob", "RankPerJob"}
+
+// efficiencyRows returns a row of efficiencyHeader for each sector with
+// positive final demand in impacts, ranked from the most total population
+// exposure per dollar of final demand to the least, so that the sectors
+// with the worst tradeoffs between exposure and economic value come first.
+// If jobs is not nil, sectors are also ranked by exposure per job in
+// RankPerJob; sectors without employment are NaN and unranked.
+func efficiencyRows(impacts map[int]sectorImpact, jobs map[int]float64) [][]string {
+	var sectors []int
+	for j, im := range impacts {
+		if im.Demand > 0 {
+			sectors = append(sectors, j)
+		}
+	}
+	perDollar := func(j int) float64 { return impacts[j].Exposure / impacts[j].Demand }
+	perJob := func(j int) float64 {
+		if n := jobs[j]; n > 0 {
+			return impacts[j].Exposure / n
+		}
+		return math.NaN()
+	}
+	byJob := append([]int{}, sectors...)
+	sort.Slice(byJob, func(a, b int) bool {
+		pa, pb := perJob(byJob[a]), perJob(byJob[b])
+		if math.IsNaN(pa) || math.IsNaN(pb) {
+			return !math.IsNaN(pa) && math.IsNaN(pb)
+		}
+		return pa > pb || (pa == pb && byJob[a] < byJob[b])
+	})
+	jobRank := make(map[int]int)
+	for r, j := range byJob {
+		if !math.IsNaN(perJob(j)) {
+			jobRank[j] = r + 1
+		}
+	}
+	sort.Slice(sectors, func(a, b int) bool {
+		pa, pb := perDollar(sectors[a]), perDollar(sectors[b])
+		return pa > pb || (pa == pb && sectors[a] < sectors[b])
+	})
+	rows := make([][]string, len(sectors))
+	for r, j := range sectors {
+		im := impacts[j]
+		n, ok := jobs[j]
+		if !ok {
+			n = math.NaN()
+		}
+		var rank string
+		if rr, ok := jobRank[j]; ok {
+			rank = strconv.Itoa(rr)
+		}
+		rows[r] = []string{strconv.Itoa(r + 1), im.Sector, formatFloat(im.Demand), formatFloat(im.Exposure),
+			formatFloat(perDollar(j)), formatFloat(n), formatFloat(perJob(j)), rank}
+	}
+	return rows
+}
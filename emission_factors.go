@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// emissionFactorConfig specifies overrides of the emission factors of
+// SCCs, to test corrections or alternative emission factor datasets
+// without rebuilding the EIEIO data.
+type emissionFactorConfig struct {
+	// File is the path to a CSV file with columns SCC,Pollutant,Type,Value.
+	// SCC and Pollutant are as in a control scenario file (see
+	// controlConfig). If Type is "multiplier", Value multiplies the
+	// emission factors. If Type is "emissions", the emission factors are
+	// scaled so that the SCC's emissions of the pollutant (a specific one)
+	// from the year's total domestic production, as in the NEI, are Value
+	// kg/year; with an SCC prefix, the total of the matching SCCs is.
+	// Where several entries apply, the most specific wins.
+	File string
+}
+
+// String describes c, for recording in results.
+func (c emissionFactorConfig) String() string {
+	if c.File == "" {
+		return "none"
+	}
+	return filepath.Base(c.File)
+}
+
+// emissionFactorEntry is an entry in an emission factor override file.
+type emissionFactorEntry struct {
+	control
+	absolute bool
+}
+
+// readEmissionFactors reads an emission factor override file.
+func readEmissionFactors(path string) ([]emissionFactorEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 4
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	var entries []emissionFactorEntry
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range rec {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+		e := emissionFactorEntry{control: control{scc: strings.TrimLeft(rec[0], "0"), state: "*"}}
+		if e.scc == "" {
+			return nil, fmt.Errorf("emission factor override %v must specify an SCC, or \"*\"", rec)
+		}
+		if rec[1] == "*" {
+			e.anyPol = true
+		} else {
+			var ok bool
+			if e.pol, ok = neiPollutants[strings.ToUpper(rec[1])]; !ok {
+				return nil, fmt.Errorf("invalid pollutant %q in emission factor override %v", rec[1], rec)
+			}
+		}
+		switch strings.ToLower(rec[2]) {
+		case "multiplier":
+		case "emissions":
+			e.absolute = true
+			if e.anyPol {
+				return nil, fmt.Errorf("emission factor override %v of type emissions must specify a pollutant", rec)
+			}
+		default:
+			return nil, fmt.Errorf("invalid type %q in emission factor override %v; valid types are multiplier and emissions", rec[2], rec)
+		}
+		if e.factor, err = strconv.ParseFloat(rec[3], 64); err != nil || e.factor < 0 {
+			return nil, fmt.Errorf("invalid value %q in emission factor override %v", rec[3], rec)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+var (
+	// emissionFactorSetting is the EmissionFactors setting in the
+	// [Sandbox] config table, used when ctx doesn't have one.
+	emissionFactorSetting emissionFactorConfig
+
+	emissionFactorsMx sync.Mutex
+	emissionFactors   = make(map[string][]float64)
+)
+
+type emissionFactorKey struct{}
+
+// withEmissionFactors returns a context in which emission factors are
+// overridden as specified by c.
+func withEmissionFactors(ctx context.Context, c emissionFactorConfig) context.Context {
+	return context.WithValue(ctx, emissionFactorKey{}, c)
+}
+
+// emissionFactorsFor returns the emission factor overrides of ctx.
+func emissionFactorsFor(ctx context.Context) emissionFactorConfig {
+	if c, ok := ctx.Value(emissionFactorKey{}).(emissionFactorConfig); ok {
+		return c
+	}
+	return emissionFactorSetting
+}
+
+// emissionFactorMultipliers returns the factor multiplying the emissions
+// of pol from each SCC, indexed as s.SCCs, under the emission factor
+// overrides of ctx, or nil if there are none. Multipliers are cached by
+// file, pollutant, year and air quality model.
+func emissionFactorMultipliers(ctx context.Context, s *eieio.Server, pol eieiorpc.Emission, year int32, aqm string) ([]float64, error) {
+	cfg := emissionFactorsFor(ctx)
+	if cfg.File == "" {
+		return nil, nil
+	}
+	path := os.ExpandEnv(cfg.File)
+	key := fmt.Sprintf("%s|%v|%d|%s", path, pol, year, aqm)
+	emissionFactorsMx.Lock()
+	m, ok := emissionFactors[key]
+	emissionFactorsMx.Unlock()
+	if ok {
+		return m, nil
+	}
+
+	entries, err := readEmissionFactors(path)
+	if err != nil {
+		return nil, withKind(kindConfig, errors.Wrap(err, "reading emission factor overrides"))
+	}
+	controls := make([]control, len(entries))
+	for i, e := range entries {
+		controls[i] = e.control
+	}
+	m = make([]float64, len(s.SCCs))
+	var absolute bool
+	for j, scc := range s.SCCs {
+		m[j] = controlFactor(controls, string(scc), "", pol)
+		absolute = absolute || entryFor(entries, string(scc), pol).absolute
+	}
+	if absolute {
+		if err := absoluteMultipliers(ctx, s, entries, m, pol, year, aqm); err != nil {
+			return nil, err
+		}
+	}
+	emissionFactorsMx.Lock()
+	emissionFactors[key] = m
+	emissionFactorsMx.Unlock()
+	return m, nil
+}
+
+// entryFor returns the most specific of entries that applies to
+// emissions of pol from scc, or an empty entry if none does.
+func entryFor(entries []emissionFactorEntry, scc string, pol eieiorpc.Emission) emissionFactorEntry {
+	var e emissionFactorEntry
+	best := -1
+	for _, c := range entries {
+		if n := c.matches(scc, "", pol); n > best {
+			e, best = c, n
+		}
+	}
+	return e
+}
+
+// absoluteMultipliers replaces the values in m of the SCCs whose emissions
+// of pol are overridden with an absolute value with the multiplier that
+// gives that value, by comparing it with the emissions of those SCCs
+// caused by the year's total domestic final demand.
+func absoluteMultipliers(ctx context.Context, s *eieio.Server, entries []emissionFactorEntry, m []float64, pol eieiorpc.Emission, year int32, aqm string) error {
+	demand, _, err := modelDemand(ctx, s, eieiorpc.FinalDemandType_AllDemand.String(), year)
+	if err != nil {
+		return err
+	}
+	emis, err := emissionsMatrix(ctx, s, &eieiorpc.EmissionsMatrixInput{
+		Demand:   demand,
+		Emission: pol,
+		Year:     year,
+		Location: LOC,
+		AQM:      aqm,
+	})
+	if err != nil {
+		return errors.Wrap(err, "error getting emissions matrix")
+	}
+
+	// Total the model emissions of the SCCs matched by each entry.
+	totals := make(map[emissionFactorEntry]float64)
+	matched := make([]*emissionFactorEntry, len(s.SCCs))
+	for j, scc := range s.SCCs {
+		e := entryFor(entries, string(scc), pol)
+		if !e.absolute {
+			continue
+		}
+		matched[j] = &e
+		col := emis.ColView(j)
+		for i := 0; i < col.Len(); i++ {
+			totals[e] += col.AtVec(i)
+		}
+	}
+	for j, e := range matched {
+		if e == nil {
+			continue
+		}
+		total := totals[*e]
+		if total == 0 {
+			return errorf(kindConfig, "emission factor override for SCC %s: the model has no %v emissions to scale to %g kg/year", e.scc, pol, e.factor)
+		}
+		m[j] = e.factor / total
+	}
+	return nil
+}
+
+// getConcentrations returns the concentrations in each grid cell of the
+// pollutant in input, using the emission factor overrides and temporal
+// period of ctx, if any. With either, the concentrations of each PM2.5
+// species from each SCC are scaled by the multiplier of the emissions of
+// its precursor.
+func getConcentrations(ctx context.Context, s *eieio.Server, input *eieiorpc.ConcentrationInput) (*eieiorpc.Vector, error) {
+	conc, err := concentrations(ctx, s, input)
+	if err != nil || !allFinite(input.Demand.Data) {
+		return conc, err
+	}
+	if err := checkFinite(ctx, fmt.Sprintf("%s concentrations", input.Pollutant), conc.Data, indexLabel("cell")); err != nil {
+		return nil, err
+	}
+	return conc, nil
+}
+
+// concentrations is getConcentrations without the check for non-finite
+// values.
+func concentrations(ctx context.Context, s *eieio.Server, input *eieiorpc.ConcentrationInput) (*eieiorpc.Vector, error) {
+	if emissionFactorsFor(ctx).File == "" && periodFor(ctx) == nil {
+		emitters, err := emitterMask(s, input.Emitters)
+		if err != nil {
+			return nil, err
+		}
+		done := timeRPC(ctx, "Concentrations")
+		vec, err := s.SpatialEIO.Concentrations(ctx, &eieiorpc.ConcentrationInput{
+			Demand:    input.Demand,
+			Emitters:  emitters,
+			Pollutant: input.Pollutant,
+			Year:      input.Year,
+			Location:  input.Location,
+			AQM:       input.AQM,
+		})
+		done(&err)
+		return vec, err
+	}
+	// Each species' matrix is summed and released before the next is
+	// calculated, so that only one is held at a time.
+	var total []float64
+	for _, sp := range pollutantSpecies(input.Pollutant) {
+		conc, err := speciesConcentrationMatrix(ctx, s, input, sp)
+		if err != nil {
+			return nil, err
+		}
+		nCells, _ := conc.Dims()
+		if total == nil {
+			total = make([]float64, nCells)
+		}
+		for i := range total {
+			for _, c := range conc.RawRowView(i) {
+				total[i] += c
+			}
+		}
+	}
+	return &eieiorpc.Vector{Data: total}, nil
+}
+
+// pollutantSpecies returns the PM2.5 species that make up pol: all of
+// them for total PM2.5, and otherwise pol itself.
+func pollutantSpecies(pol eieiorpc.Pollutant) []eieiorpc.Pollutant {
+	if pol == eieiorpc.Pollutant_TotalPM25 {
+		return []eieiorpc.Pollutant{eieiorpc.Pollutant_PrimaryPM25, eieiorpc.Pollutant_PNH4,
+			eieiorpc.Pollutant_PNO3, eieiorpc.Pollutant_PSO4, eieiorpc.Pollutant_SOA}
+	}
+	return []eieiorpc.Pollutant{pol}
+}
+
+// concentrationsBySCC returns the concentrations of the pollutant in input
+// in each grid cell (rows) caused by the emissions of each SCC (columns),
+// scaled as in getConcentrations.
+func concentrationsBySCC(ctx context.Context, s *eieio.Server, input *eieiorpc.ConcentrationInput) (*mat.Dense, error) {
+	var total *mat.Dense
+	for _, sp := range pollutantSpecies(input.Pollutant) {
+		conc, err := speciesConcentrationMatrix(ctx, s, input, sp)
+		if err != nil {
+			return nil, err
+		}
+		if total == nil {
+			total = conc
+		} else {
+			total.Add(total, conc)
+		}
+	}
+	return total, nil
+}
+
+// speciesConcentrationMatrix returns the concentrations of species sp
+// caused by the demand in input, by grid cell (rows) and SCC (columns),
+// with each SCC's scaled by the emission factor override and temporal
+// period multipliers of ctx for the emissions of its precursor.
+func speciesConcentrationMatrix(ctx context.Context, s *eieio.Server, input *eieiorpc.ConcentrationInput, sp eieiorpc.Pollutant) (*mat.Dense, error) {
+	m, err := emissionFactorMultipliers(ctx, s, speciesEmissions[sp], input.Year, input.AQM)
+	if err != nil {
+		return nil, err
+	}
+	if m, err = applyPeriod(ctx, s, m, speciesEmissions[sp]); err != nil {
+		return nil, err
+	}
+	conc, err := concentrationMatrix(ctx, s, &eieiorpc.ConcentrationMatrixInput{
+		Demand:    input.Demand,
+		Pollutant: sp,
+		Year:      input.Year,
+		Location:  input.Location,
+		AQM:       input.AQM,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "calculating %s concentrations", sp)
+	}
+	nCells, nSCCs := conc.Dims()
+	if m == nil {
+		return conc, nil
+	}
+	if nSCCs != len(m) {
+		return nil, errorf(kindNumeric, "expected concentrations to have #SCC %d columns, got %d", len(m), nSCCs)
+	}
+	for i := 0; i < nCells; i++ {
+		row := conc.RawRowView(i)
+		for j := range row {
+			row[j] *= m[j]
+		}
+	}
+	return conc, nil
+}
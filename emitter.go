@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/evookelj/inmap/sr"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/floats"
+	"os"
+	"sort"
+)
+
+// kgPerYearToUgPerS converts emissions from kg/year, the units of EIEIO
+// emissions, to μg/s, the units expected by the SR matrix.
+const kgPerYearToUgPerS = 1e9 / (365.25 * 24 * 60 * 60)
+
+// srPollutants maps each emitted species to the name of the SR matrix
+// variable holding the PM2.5 species it forms.
+var srPollutants = map[eieiorpc.Emission]string{
+	eieiorpc.Emission_PM25: "PrimaryPM25",
+	eieiorpc.Emission_NH3:  "pNH4",
+	eieiorpc.Emission_NOx:  "pNO3",
+	eieiorpc.Emission_SOx:  "pSO4",
+	eieiorpc.Emission_VOC:  "SOA",
+}
+
+// emitterRegions is the EmitterRegions setting in the [Sandbox] config
+// table: the regions, such as states, that exposure is attributed to.
+var emitterRegions regionConfig
+
+// emitterRegionHeader is the header of exposure_by_emitter_region.csv.
+var emitterRegionHeader = []string{"Region", "Population", "Label", "Exposure"}
+
+// emitterRegionRows returns a row of emitterRegionHeader for each emitter
+// region and census population, with the population's exposure caused by
+// the emissions in the region.
+func emitterRegionRows(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector) ([][]string, error) {
+	byRegion, err := getExposureByEmitterRegion(ctx, s, year, LOC, aqm, demand, emitterRegions)
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]string, 0, len(byRegion))
+	for region := range byRegion {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	var rows [][]string
+	for _, region := range regions {
+		for _, pop := range sortedKeys(byRegion[region]) {
+			rows = append(rows, []string{region, pop, labels.get(pop), formatFloat(byRegion[region][pop])})
+		}
+	}
+	return rows, nil
+}
+
+// Attribute each census population's exposure to total PM2.5 from the air
+// quality model aqm to the region (as named by cfg.Field) where the
+// responsible emissions occur. The result
+// is indexed by region name and then population name. Emissions from grid
+// cells outside every region are attributed to "Other".
+//
+// Because EIEIO emissions are aggregated to grid cells without stack
+// parameters, all emissions are treated as ground-level for this purpose.
+func getExposureByEmitterRegion(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location, aqm string, demand *eieiorpc.Vector, cfg regionConfig) (map[string]map[string]float64, error) {
+	ctx, span := startSpan(ctx, "getExposureByEmitterRegion")
+	defer span.End()
+	if cfg.Field == "" {
+		return nil, fmt.Errorf("emitter regions must specify a Field to name regions by")
+	}
+	regionNames, cellRegions, err := regionIndex(s, cfg, aqm)
+	if err != nil {
+		return nil, err
+	}
+	regionNames = append(regionNames, "Other")
+	other := len(regionNames) - 1
+
+	srFile, ok := s.SpatialEIO.CSTConfig.SRFiles[aqm]
+	if !ok {
+		return nil, errorf(kindConfig, "emitter regions require an SR matrix for air quality model %q", aqm)
+	}
+	f, err := os.Open(srFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening SR matrix")
+	}
+	defer f.Close()
+	srr, err := sr.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading SR matrix")
+	}
+
+	nCells := len(cellRegions)
+	concByRegion := make([][]float64, len(regionNames))
+	for i := range concByRegion {
+		concByRegion[i] = make([]float64, nCells)
+	}
+	emitters, err := emitterMask(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	for emission, srPol := range srPollutants {
+		done := timeRPC(ctx, "Emissions")
+		emis, err := s.SpatialEIO.Emissions(ctx, &eieiorpc.EmissionsInput{
+			Demand:   demand,
+			Emitters: emitters,
+			Emission: emission,
+			Year:     year,
+			Location: loc,
+			AQM:      aqm,
+		})
+		done(&err)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting %v emissions", emission)
+		}
+		if err := checkGrid(s, aqm, len(emis.Data), emission.String()+" emissions"); err != nil {
+			return nil, err
+		}
+		for source, e := range emis.Data {
+			if e == 0 {
+				continue
+			}
+			receptorConc, err := srr.Source(srPol, 0, source)
+			if err != nil {
+				return nil, err
+			}
+			region := cellRegions[source]
+			if region < 0 {
+				region = other
+			}
+			for receptor, c := range receptorConc {
+				concByRegion[region][receptor] += c * e * kgPerYearToUgPerS
+			}
+		}
+	}
+
+	// The contribution of each region is weighted by the exposure function
+	// and background concentration of the total concentration.
+	totalConc := make([]float64, nCells)
+	for _, conc := range concByRegion {
+		floats.Add(totalConc, conc)
+	}
+	cellWeights, err := exposureWeights(ctx, totalConc)
+	if err != nil {
+		return nil, err
+	}
+	for i := range concByRegion {
+		if concByRegion[i], err = scaleByCell(concByRegion[i], cellWeights); err != nil {
+			return nil, err
+		}
+	}
+
+	popNames, popGrids, err := getPopulationGrids(ctx, s, aqm, nCells)
+	if err != nil {
+		return nil, err
+	}
+	exposure := make(map[string]map[string]float64)
+	for regionIdx, regionName := range regionNames {
+		exposure[regionName] = make(map[string]float64)
+		for _, popName := range popNames {
+			var total float64
+			for cell, c := range concByRegion[regionIdx] {
+				total += c * popGrids[popName][cell]
+			}
+			exposure[regionName][popName] = total
+		}
+	}
+	return exposure, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// employmentHeader is the header of the table written by writeEmployment.
+var employmentHeader = []string{"Sector", "FinalDemand", "Jobs", "Emissions", "Exposure", "EmissionsPerJob", "ExposurePerJob", "ExposurePerDollar"}
+
+// readEmployment reads a CSV file of employment by sector, such as BLS
+// employment by industry matched to the EIO commodities, with columns
+// Sector and Jobs and, optionally, Year. If there is a Year column, only
+// the rows for year are used. It returns jobs by commodity index.
+func readEmployment(path string, year int32, commodities []string) (map[int]float64, error) {
+	header, rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{"Year": -1}
+	for i, h := range header {
+		col[strings.TrimSpace(h)] = i
+	}
+	for _, c := range []string{"Sector", "Jobs"} {
+		if _, ok := col[c]; !ok {
+			return nil, errorf(kindConfig, "%s: missing column %s", path, c)
+		}
+	}
+	index := make(map[string]int, len(commodities))
+	for i, c := range commodities {
+		index[c] = i
+	}
+	jobs := make(map[int]float64)
+	for i, r := range rows {
+		if y := col["Year"]; y >= 0 && strings.TrimSpace(r[y]) != strconv.Itoa(int(year)) {
+			continue
+		}
+		sector := strings.TrimSpace(r[col["Sector"]])
+		j, ok := index[sector]
+		if !ok {
+			return nil, errorf(kindConfig, "%s line %d: invalid sector %q; sectors are the commodities listed by `inspect -sectors`", path, i+2, sector)
+		}
+		if _, ok := jobs[j]; ok {
+			return nil, errorf(kindConfig, "%s line %d: duplicate sector %q", path, i+2, sector)
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(r[col["Jobs"]]), 64)
+		if err != nil || n < 0 {
+			return nil, errorf(kindConfig, "%s line %d: invalid jobs %q for %s", path, i+2, r[col["Jobs"]], sector)
+		}
+		jobs[j] = n
+	}
+	if len(jobs) == 0 {
+		return nil, errorf(kindConfig, "%s: no employment for %d", path, year)
+	}
+	return jobs, nil
+}
+
+// sectorImpact is the PM2.5 emissions (kg/year) and total population
+// exposure caused by the final demand for one commodity, including its
+// supply chain.
+type sectorImpact struct {
+	Sector                      string
+	Demand, Emissions, Exposure float64
+}
+
+// sectorImpacts returns the sectorImpact of each commodity with final
+// demand in demand, by commodity index. It requires one emissions and one
+// concentration calculation for each of them.
+func sectorImpacts(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, year int32, aqm string) (map[int]sectorImpact, error) {
+	ctx, span := startSpan(ctx, "sectorImpacts")
+	defer span.End()
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(commodities.List) != len(demand.Data) {
+		return nil, errorf(kindNumeric, "expected final demand for %d commodities, got %d", len(commodities.List), len(demand.Data))
+	}
+	totalPop := s.CSTConfig.CensusTotalPopColumn
+
+	// With a nonlinear exposure function or a background concentration,
+	// the concentrations caused by each sector are weighted by those of
+	// the total, so that sectors' exposures sum to the total exposure.
+	var cellWeights []float64
+	exposureCtx := ctx
+	if exposureWeighted(ctx) {
+		total, err := getCompositeConcentrations(ctx, s, year, LOC, aqm, demand, map[string]float64{eieiorpc.Pollutant_TotalPM25.String(): 1})
+		if err != nil {
+			return nil, err
+		}
+		if cellWeights, err = exposureWeights(ctx, total); err != nil {
+			return nil, err
+		}
+		exposureCtx = withUnweightedExposure(ctx)
+	}
+
+	impacts := make(map[int]sectorImpact)
+	sectorDemand := &eieiorpc.Vector{Data: make([]float64, len(demand.Data))}
+	for j, sector := range commodities.List {
+		if demand.Data[j] == 0 {
+			continue
+		}
+		im := sectorImpact{Sector: sector, Demand: demand.Data[j]}
+		sectorDemand.Data[j] = demand.Data[j]
+		emis, err := getEmissionsBySCC(ctx, sectorDemand, s, eieiorpc.Emission_PM25, year, LOC, aqm)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating emissions caused by %s", sector)
+		}
+		for _, e := range emis.RawVector().Data {
+			im.Emissions += e
+		}
+		conc, err := getCompositeConcentrations(ctx, s, year, LOC, aqm, sectorDemand, map[string]float64{eieiorpc.Pollutant_TotalPM25.String(): 1})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating concentrations caused by %s", sector)
+		}
+		if conc, err = scaleByCell(conc, cellWeights); err != nil {
+			return nil, err
+		}
+		byPop, err := populationExposure(exposureCtx, s, aqm, conc, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating exposure caused by %s", sector)
+		}
+		var ok bool
+		if im.Exposure, ok = (*byPop)[totalPop]; !ok {
+			return nil, errorf(kindConfig, "no exposure for the total population, %s; is it in CensusPopColumns?", totalPop)
+		}
+		sectorDemand.Data[j] = 0
+		impacts[j] = im
+		reportProgress(ctx, Progress{
+			Stage:   "impacts by sector",
+			Year:    year,
+			Percent: 100 * float64(j+1) / float64(len(commodities.List)),
+		})
+	}
+	return impacts, nil
+}
+
+// employmentRows returns a row of employmentHeader for each sector with
+// final demand in impacts or employment in jobs: the PM2.5 emissions
+// (kg/year) and total population exposure caused by the final demand for
+// its commodity, including its supply chain, per job in the sector and
+// per dollar of final demand. Values per job are NaN for sectors without
+// employment data.
+func employmentRows(commodities []string, impacts map[int]sectorImpact, jobs map[int]float64) [][]string {
+	var rows [][]string
+	for j, sector := range commodities {
+		im, hasDemand := impacts[j]
+		n, hasJobs := jobs[j]
+		if !hasDemand && !hasJobs {
+			continue
+		}
+		perJob := func(v float64) float64 {
+			if !hasJobs || n == 0 {
+				return math.NaN()
+			}
+			return v / n
+		}
+		perDollar := math.NaN()
+		if hasDemand {
+			perDollar = im.Exposure / im.Demand
+		}
+		jobsCol := math.NaN()
+		if hasJobs {
+			jobsCol = n
+		}
+		rows = append(rows, []string{sector, formatFloat(im.Demand), formatFloat(jobsCol), formatFloat(im.Emissions), formatFloat(im.Exposure),
+			formatFloat(perJob(im.Emissions)), formatFloat(perJob(im.Exposure)), formatFloat(perDollar)})
+	}
+	return rows
+}
+
+// readScenarioEmployment reads the employment in sc.EmploymentFile, by
+// commodity index, or returns nil if it isn't set.
+func readScenarioEmployment(ctx context.Context, s *eieio.Server, sc *scenario) (map[int]float64, error) {
+	if sc.EmploymentFile == "" {
+		return nil, nil
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return readEmployment(os.ExpandEnv(sc.EmploymentFile), sc.Year, commodities.List)
+}
+
+// writeEmployment writes the employmentRows of impacts and jobs to path.
+func writeEmployment(ctx context.Context, s *eieio.Server, impacts map[int]sectorImpact, jobs map[int]float64, path string) error {
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return writeCSV(path, employmentHeader, employmentRows(commodities.List, impacts, jobs))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Every setting can also be given in an environment variable, so that the
+// sandbox can run in a container without a mounted config file. The
+// precedence, highest first, is:
+//
+//	1. command-line flags
+//	2. INMAP_<COMMAND>_<FLAG> for flags, e.g. INMAP_EXPORT_SNAPSHOT_YEAR
+//	3. INMAP_<TABLE>_<KEY> for config settings, e.g. INMAP_SANDBOX_TRACEFILE
+//	   for TraceFile in [Sandbox]
+//	4. the config file, INMAP_SANDBOX_CONFIG (by default
+//	   ${INMAP_SANDBOX_ROOT}/data/my_config.toml)
+//	5. built-in defaults
+//
+// Names are upper case with non-alphanumeric characters replaced by "_".
+// Strings are given as is; other values, including arrays and tables, are
+// given in TOML syntax, e.g. INMAP_SPATIALEIO_SRFILES='{isrm = "/data/isrm.ncf"}'.
+// A table given this way replaces the whole table in the config file.
+
+// configEnv is the variable holding the path of the config file. If it is
+// set to "", no config file is read and all settings come from the
+// environment.
+const configEnv = "INMAP_SANDBOX_CONFIG"
+
+// configFile returns the path of the config file.
+func configFile() string {
+	if f, ok := os.LookupEnv(configEnv); ok {
+		return f
+	}
+	return os.ExpandEnv("${INMAP_SANDBOX_ROOT}/data/my_config.toml")
+}
+
+var envNameRE = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// envName returns the environment variable for the setting at path.
+func envName(path ...string) string {
+	return "INMAP_" + envNameRE.ReplaceAllString(strings.ToUpper(strings.Join(path, "_")), "_")
+}
+
+// applyEnv sets the fields of the struct pointed to by cfg from any
+// corresponding environment variables, returning the names of the
+// variables used.
+func applyEnv(cfg interface{}) ([]string, error) {
+	var used []string
+	err := applyEnvStruct(reflect.ValueOf(cfg).Elem(), nil, &used)
+	return used, err
+}
+
+func applyEnvStruct(v reflect.Value, path []string, used *[]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		fv := v.Field(i)
+		fPath := append(path[:len(path):len(path)], f.Name)
+		if f.Anonymous {
+			fPath = path // TOML keys of embedded structs are promoted
+		}
+		if f.Type.Kind() == reflect.Struct {
+			if err := applyEnvStruct(fv, fPath, used); err != nil {
+				return err
+			}
+			continue
+		}
+		name := envName(fPath...)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, val); err != nil {
+			return errorf(kindConfig, "invalid %s: %v", name, err)
+		}
+		*used = append(*used, name)
+	}
+	return nil
+}
+
+// setFromEnv sets v to val, which is a TOML value unless v is a string.
+func setFromEnv(v reflect.Value, val string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+		return nil
+	case reflect.Func, reflect.Chan, reflect.Interface, reflect.UnsafePointer:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	holder := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "V", Type: v.Type()}}))
+	if _, err := toml.Decode("V = "+val, holder.Interface()); err != nil {
+		return err
+	}
+	v.Set(holder.Elem().Field(0))
+	return nil
+}
+
+// parseFlags parses the command-line flags in args, then sets flags that
+// were not given from their INMAP_<COMMAND>_<FLAG> environment variables.
+// While collectFlags is set, it instead passes fs to it and returns
+// errFlagsCollected without parsing anything; see commandFlags.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if collectFlags != nil {
+		collectFlags(fs)
+		return errFlagsCollected
+	}
+	fs.Parse(args)
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(fs.Name(), f.Name)
+		val, ok := os.LookupEnv(name)
+		if set[f.Name] || !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, val); e != nil {
+			err = errorf(kindConfig, "invalid %s: %v", name, e)
+		}
+	})
+	return err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/optimize/convex/lp"
+	"log"
+	"os"
+	"sort"
+)
+
+// sectorExposure returns the population-weighted mean PM2.5 exposure of each
+// of groups caused by each SCC's emissions from demand, as a matrix with a
+// row for each group and a column for each SCC.
+func sectorExposure(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, year int32, aqm string, groups []string) (*mat.Dense, error) {
+	ctx, span := startSpan(ctx, "sectorExposure")
+	defer span.End()
+	conc, err := concentrationMatrix(ctx, s, &eieiorpc.ConcentrationMatrixInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	}) // rows = grid cells, cols = SCCs
+	if err != nil {
+		return nil, errors.Wrap(err, "error calculating concentrations by sector")
+	}
+	nCells, nSCC := conc.Dims()
+	_, pops, err := getPopulationGrids(ctx, s, aqm, nCells)
+	if err != nil {
+		return nil, err
+	}
+
+	// The concentration caused by each SCC is weighted by the exposure
+	// function and background concentration of the total concentration in
+	// each cell.
+	totalConc := make([]float64, nCells)
+	for i := range totalConc {
+		totalConc[i] = mat.Sum(conc.RowView(i))
+	}
+	cellWeights, err := exposureWeights(ctx, totalConc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Row g of weights is the fraction of group g living in each cell.
+	weights := mat.NewDense(len(groups), nCells, nil)
+	for g, group := range groups {
+		pop, ok := pops[group]
+		if !ok {
+			return nil, fmt.Errorf("invalid population %q", group)
+		}
+		var total float64
+		for _, v := range pop {
+			total += v
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("population %s is empty", group)
+		}
+		for i, v := range pop {
+			if cellWeights != nil {
+				v *= cellWeights[i]
+			}
+			weights.Set(g, i, v/total)
+		}
+	}
+	exposure := mat.NewDense(len(groups), nSCC, nil)
+	exposure.Mul(weights, conc)
+	return exposure, nil
+}
+
+// reducibleSectors returns the indices of the (at most) maxSectors SCCs
+// contributing most to the exposure of all groups.
+func reducibleSectors(exposure *mat.Dense, maxSectors int) []int {
+	_, nSCC := exposure.Dims()
+	var free []int
+	for j := 0; j < nSCC; j++ {
+		if mat.Sum(exposure.ColView(j)) > 0 {
+			free = append(free, j)
+		}
+	}
+	sort.Slice(free, func(a, b int) bool {
+		return mat.Sum(exposure.ColView(free[a])) > mat.Sum(exposure.ColView(free[b]))
+	})
+	if len(free) > maxSectors {
+		free = free[:maxSectors]
+	}
+	return free
+}
+
+// exposureGroups returns the census populations to compare: income
+// deciles if income is true, or otherwise every population except the
+// total.
+func exposureGroups(s *eieio.Server, income bool) []string {
+	if income {
+		return s.CSTConfig.CensusIncomeDecileNames
+	}
+	var groups []string
+	for _, pop := range s.CSTConfig.CensusPopColumns {
+		if pop != s.CSTConfig.CensusTotalPopColumn {
+			groups = append(groups, pop)
+		}
+	}
+	return groups
+}
+
+// equalExposure is the solution to an equal-exposure reallocation.
+type equalExposure struct {
+	// Remaining is the fraction of each SCC's emissions that remains.
+	Remaining []float64
+
+	// Exposure is the resulting mean exposure, which is the same for
+	// every group.
+	Exposure float64
+}
+
+// equalizeExposure finds the smallest reduction in emissions (weighted by
+// emis, the emissions of each SCC) that makes the mean exposure of every
+// group equal, where exposure is the group-by-SCC exposure matrix from
+// sectorExposure. Only the maxSectors SCCs contributing most to exposure
+// may be reduced; the others are held at their current emissions.
+func equalizeExposure(exposure *mat.Dense, emis []float64, maxSectors int) (*equalExposure, error) {
+	nGroups, nSCC := exposure.Dims()
+	if nGroups < 2 {
+		return nil, fmt.Errorf("at least 2 groups are required, got %d", nGroups)
+	}
+
+	free := reducibleSectors(exposure, maxSectors)
+	remaining := make([]float64, nSCC)
+	for j := range remaining {
+		remaining[j] = 1
+	}
+	isFree := make(map[int]bool)
+	for _, j := range free {
+		isFree[j] = true
+	}
+
+	// Standard form, with x = (remaining fraction of each free sector,
+	// slack):
+	//   maximize remaining emissions
+	//   s.t. (E_g - E_0)·x = -(E_g - E_0)·fixed for each group g > 0
+	//        x_j + slack_j = 1
+	n := len(free)
+	nRows := nGroups - 1 + n
+	a := mat.NewDense(nRows, 2*n, nil)
+	b := make([]float64, nRows)
+	c := make([]float64, 2*n)
+	for g := 1; g < nGroups; g++ {
+		for j := 0; j < nSCC; j++ {
+			diff := exposure.At(g, j) - exposure.At(0, j)
+			if !isFree[j] {
+				b[g-1] -= diff
+			}
+		}
+		for k, j := range free {
+			a.Set(g-1, k, exposure.At(g, j)-exposure.At(0, j))
+		}
+	}
+	for k, j := range free {
+		a.Set(nGroups-1+k, k, 1)
+		a.Set(nGroups-1+k, n+k, 1)
+		b[nGroups-1+k] = 1
+		c[k] = -emis[j]
+	}
+	_, x, err := lp.Simplex(c, a, b, 1e-10, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "exposure cannot be equalized by reducing the selected sectors")
+	}
+	for k, j := range free {
+		remaining[j] = x[k]
+	}
+
+	result := &equalExposure{Remaining: remaining}
+	for j := 0; j < nSCC; j++ {
+		result.Exposure += exposure.At(0, j) * remaining[j]
+	}
+	return result, nil
+}
+
+// equalizeCommand calculates the emission reductions required to equalize
+// exposure across census population groups.
+func equalizeCommand(args []string) error {
+	fs := flag.NewFlagSet("equalize", flag.ExitOnError)
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	income := fs.Bool("income", false, "equalize exposure across income deciles rather than ethnicities")
+	maxSectors := fs.Int("sectors", 200, "number of sectors, by contribution to exposure, that may be reduced")
+	out := fs.String("o", "equal_exposure.csv", "output CSV file")
+	expFunc := fs.String("exposure-function", "", "exposure function, e.g. threshold:2.4, overriding the ExposureFunction config setting")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s equalize [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	ctx, err := exposureFunctionFlag(context.Background(), *expFunc)
+	if err != nil {
+		return err
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            int32(*year),
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return errors.Wrap(err, "error getting final demand")
+	}
+
+	groups := exposureGroups(s, *income)
+	exposure, err := sectorExposure(ctx, s, demand, int32(*year), *aqm, groups)
+	if err != nil {
+		return err
+	}
+	emis, err := getEmissionsBySCC(ctx, demand, s, eieiorpc.Emission_PM25, int32(*year), LOC, *aqm)
+	if err != nil {
+		return err
+	}
+	result, err := equalizeExposure(exposure, emis.RawVector().Data, *maxSectors)
+	if err != nil {
+		return err
+	}
+
+	reduction, total, err := writeSectorReductions(*out, s, emis.RawVector().Data, result.Remaining)
+	if err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "equal_exposure.csv"); err != nil {
+		return err
+	}
+	log.Printf("Equalizing exposure across %d groups at %.4g μg/m³ requires reducing PM2.5 emissions by %.4g kg/year (%.2f%% of total); sector reductions written to %s",
+		len(groups), result.Exposure, reduction, reduction/total*100, *out)
+	return nil
+}
+
+// writeSectorReductions writes the reduction in each SCC's emissions, emis,
+// implied by the remaining fractions to path. It returns the total
+// reduction and total emissions.
+func writeSectorReductions(path string, s *eieio.Server, emis, remaining []float64) (reduction, total float64, err error) {
+	var rows [][]string
+	for j, e := range emis {
+		total += e
+		if remaining[j] < 1 {
+			r := e * (1 - remaining[j])
+			reduction += r
+			rows = append(rows, []string{string(s.SCCs[j]), formatFloat(e), formatFloat(r), formatFloat(1 - remaining[j])})
+		}
+	}
+	err = writeCSV(path, []string{"SCC", "Emissions", "Reduction", "ReductionFraction"}, rows)
+	return reduction, total, err
+}
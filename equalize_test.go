@@ -0,0 +1,44 @@
+package main
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"testing"
+)
+
+func TestEqualizeExposure(t *testing.T) {
+	// Equal exposure requires SCC 0 to be twice SCC 1, so the smallest
+	// reduction halves SCC 1, leaving both groups exposed to 2.
+	eq, err := equalizeExposure(testExposure(), []float64{1, 1, 1, 1}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{1, 0.5, 1, 1}
+	for j := range want {
+		if math.Abs(eq.Remaining[j]-want[j]) > 1e-9 {
+			t.Fatalf("got %v remaining, want %v", eq.Remaining, want)
+		}
+	}
+	if math.Abs(eq.Exposure-2) > 1e-9 {
+		t.Errorf("got exposure %g, want 2", eq.Exposure)
+	}
+	g := groupExposures(testExposure(), eq.Remaining)
+	if math.Abs(g[0]-g[1]) > 1e-9 {
+		t.Errorf("group exposures %v aren't equal", g)
+	}
+}
+
+func TestEqualizeExposureInfeasible(t *testing.T) {
+	// Only SCC 2 may be reduced, and reducing it lowers the second group's
+	// exposure less than the first's, so the gap can't be closed.
+	exposure := mat.NewDense(2, 3, []float64{
+		1, 0, 1,
+		0, 2, 1.5,
+	})
+	if _, err := equalizeExposure(exposure, []float64{1, 1, 1}, 1); err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := equalizeExposure(mat.NewDense(1, 3, []float64{1, 1, 1}), []float64{1, 1, 1}, 3); err == nil {
+		t.Error("one group: expected an error")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+)
+
+// errorKind classifies the errors that stop the sandbox, so that scripts
+// running it can branch on the exit status.
+type errorKind int
+
+const (
+	// kindOther is any error not classified below.
+	kindOther errorKind = iota
+
+	// kindUsage is an invalid command line, such as an unknown command or
+	// a missing argument.
+	kindUsage
+
+	// kindConfig is an invalid config file, manifest or setting, such as a
+	// year that isn't configured.
+	kindConfig
+
+	// kindDataMissing is input data that doesn't exist, such as a missing
+	// file or CES data for a year without it.
+	kindDataMissing
+
+	// kindRPC is a failed call to the EIEIO server.
+	kindRPC
+
+	// kindNumeric is a numerical inconsistency, such as results with the
+	// wrong dimensions or failed consistency checks.
+	kindNumeric
+)
+
+// exitCodes are the exit statuses by errorKind. kindUsage has the status
+// that the flag package uses for invalid flags.
+var exitCodes = map[errorKind]int{
+	kindOther:       1,
+	kindUsage:       2,
+	kindConfig:      3,
+	kindDataMissing: 4,
+	kindRPC:         5,
+	kindNumeric:     6,
+}
+
+var kindNames = map[errorKind]string{
+	kindOther:       "error",
+	kindUsage:       "usage error",
+	kindConfig:      "config error",
+	kindDataMissing: "missing data",
+	kindRPC:         "EIEIO error",
+	kindNumeric:     "numerical inconsistency",
+}
+
+// exitKind returns the errorKind whose exit status is code, or kindOther.
+func exitKind(code int) errorKind {
+	for kind, c := range exitCodes {
+		if c == code {
+			return kind
+		}
+	}
+	return kindOther
+}
+
+// kindError is an error classified as kind.
+type kindError struct {
+	kind errorKind
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+func (e *kindError) Cause() error  { return e.err }
+func (e *kindError) Unwrap() error { return e.err }
+
+// withKind classifies err as kind, or returns nil if err is nil. Errors
+// that are already classified keep their kind.
+func withKind(kind errorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// errorf formats an error of the given kind like fmt.Errorf.
+func errorf(kind errorKind, format string, args ...interface{}) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+// kindOf returns the kind of err, or kindDataMissing for unclassified
+// errors opening files that don't exist.
+func kindOf(err error) errorKind {
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return ke.kind
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return kindDataMissing
+	}
+	return kindOther
+}
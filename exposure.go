@@ -2,61 +2,307 @@ package main
 
 import (
 	"context"
+	"example.com/m/v2/exposuremath"
 	"fmt"
 	"github.com/evookelj/inmap/emissions/slca/eieio"
 	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
 	"log"
 )
 
-func getExposureByPopulation(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location, demand *eieiorpc.Vector) (*map[string]float64, error) {
-	vec, err := s.SpatialEIO.Concentrations(ctx, &eieiorpc.ConcentrationInput{
+// Get population-weighted exposure for each census population. If receptors
+// is non-nil, only grid cells where it is true are included.
+func getExposureByPopulation(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location, aqm string, demand *eieiorpc.Vector, receptors []bool) (*map[string]float64, error) {
+	ctx, span := startSpan(ctx, "getExposureByPopulation")
+	defer span.End()
+	vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
 		Demand:    demand,
 		Pollutant: eieiorpc.Pollutant_TotalPM25,
 		Year:      year,
 		Location:  loc,
-		AQM:       "isrm",
+		AQM:       aqm,
 	})
-	conc := vec.Data
 	if err != nil {
 		return nil, err
 	}
+	return populationExposure(ctx, s, aqm, vec.Data, receptors)
+}
 
-	popNames := append(s.CSTConfig.CensusPopColumns, s.CSTConfig.CensusIncomeDecileNames...)
-	populationGridsByPopName := make(map[string][]float64)
-	for i, popName := range popNames {
-			pop, err := s.CSTConfig.PopulationCount(ctx, &eieiorpc.PopulationCountInput{
-				Year:        2014, // year,
-				Population:  popName,
-				AQM:         "isrm",
-				IsIncomePop: i >= len(s.CSTConfig.CensusPopColumns), // based off gen of popNames above
-			})
-			if err != nil {
-				return nil, err
-			}
+// pm25Components groups PM2.5 species into the components reported by
+// getExposureBySpecies: primary PM2.5, secondary sulfate (from SOx),
+// secondary nitrate (ammonium nitrate, from NOx and NH3) and SOA (from VOC).
+var pm25Components = []struct {
+	Name    string
+	Species []eieiorpc.Pollutant
+}{
+	{"Primary", []eieiorpc.Pollutant{eieiorpc.Pollutant_PrimaryPM25}},
+	{"Sulfate", []eieiorpc.Pollutant{eieiorpc.Pollutant_PSO4}},
+	{"Nitrate", []eieiorpc.Pollutant{eieiorpc.Pollutant_PNO3, eieiorpc.Pollutant_PNH4}},
+	{"SOA", []eieiorpc.Pollutant{eieiorpc.Pollutant_SOA}},
+}
 
-			if len(pop) != len(conc) {
-				return nil, fmt.Errorf("expected len(population)=len(concentrations); got %d != %d", len(pop), len(conc))
+// Get population-weighted exposure for each census population split into
+// the PM2.5 components in pm25Components, indexed by population name and
+// then component name. With a nonlinear exposure function or a background
+// concentration, each component is weighted by those of the total
+// concentration, so that the components sum to the total exposure.
+func getExposureBySpecies(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location, aqm string, demand *eieiorpc.Vector, receptors []bool) (map[string]map[string]float64, error) {
+	ctx, span := startSpan(ctx, "getExposureBySpecies")
+	defer span.End()
+	var cellWeights []float64
+	if exposureWeighted(ctx) {
+		total, err := getCompositeConcentrations(ctx, s, year, loc, aqm, demand, map[string]float64{eieiorpc.Pollutant_TotalPM25.String(): 1})
+		if err != nil {
+			return nil, err
+		}
+		if cellWeights, err = exposureWeights(ctx, total); err != nil {
+			return nil, err
+		}
+		ctx = withUnweightedExposure(ctx)
+	}
+	bySpecies := make(map[string]map[string]float64)
+	for _, component := range pm25Components {
+		weights := make(map[string]float64)
+		for _, pol := range component.Species {
+			weights[pol.String()] = 1
+		}
+		conc, err := getCompositeConcentrations(ctx, s, year, loc, aqm, demand, weights)
+		if err != nil {
+			return nil, err
+		}
+		if conc, err = scaleByCell(conc, cellWeights); err != nil {
+			return nil, err
+		}
+		exposure, err := populationExposure(ctx, s, aqm, conc, receptors)
+		if err != nil {
+			return nil, err
+		}
+		for popName, e := range *exposure {
+			if bySpecies[popName] == nil {
+				bySpecies[popName] = make(map[string]float64)
 			}
-			populationGridsByPopName[popName] = pop
+			bySpecies[popName][component.Name] = e
+		}
+	}
+	return bySpecies, nil
+}
+
+// exposureWeightsSetting is the ExposureWeights setting in the [Sandbox]
+// config table, used by scenarios without ExposureWeights of their own.
+var exposureWeightsSetting map[string]float64
+
+// Get the composite concentration in each grid cell caused by demand, as the
+// sum of the concentrations of each pollutant (named as in
+// eieiorpc.Pollutant, e.g. "PSO4") multiplied by its weight.
+func getCompositeConcentrations(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location, aqm string, demand *eieiorpc.Vector, weights map[string]float64) ([]float64, error) {
+	ctx, span := startSpan(ctx, "getCompositeConcentrations")
+	defer span.End()
+	var composite []float64
+	for name, w := range weights {
+		pol, ok := eieiorpc.Pollutant_value[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid pollutant %q in exposure weights", name)
+		}
+		vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+			Demand:    demand,
+			Pollutant: eieiorpc.Pollutant(pol),
+			Year:      year,
+			Location:  loc,
+			AQM:       aqm,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if composite == nil {
+			composite = make([]float64, len(vec.Data))
+		}
+		for i, c := range vec.Data {
+			composite[i] += w * c
+		}
+	}
+	if composite == nil {
+		return nil, fmt.Errorf("no exposure weights specified")
 	}
+	return composite, nil
+}
 
-	popTotals := make(map[string]float64)
-	for _, pop := range popNames {
-		popTotals[pop] = 0
+// Get population-weighted exposure for each census population to the given
+// concentrations. If receptors is non-nil, only grid cells where it is true
+// are included, and if a subdomain is configured, only cells within it.
+func populationExposure(ctx context.Context, s *eieio.Server, aqm string, conc []float64, receptors []bool) (*map[string]float64, error) {
+	ctx, span := startSpan(ctx, "populationExposure")
+	defer span.End()
+	if receptors != nil && len(receptors) != len(conc) {
+		return nil, errorf(kindNumeric, "expected len(receptors)=len(concentrations); got %d != %d", len(receptors), len(conc))
 	}
+	g, err := getExposureGrids(ctx, s, aqm, conc, receptors)
+	if err != nil {
+		return nil, err
+	}
+	conc, receptors, restricted := g.conc, g.receptors, g.restricted
+	popNames, populationGridsByPopName := g.popNames, g.pops
 
-	exposureByPop := make(map[string]float64)
+	cells := make([]bool, len(conc))
 	for gridIdx, concentrationAmt := range conc {
+		if receptors != nil && !receptors[gridIdx] {
+			continue
+		}
+		cells[gridIdx] = true
 		log.Printf("\t[Grid %d] [Concentration=%.2f]", gridIdx, concentrationAmt)
 		for _, popName := range popNames {
 			numIndividuals := populationGridsByPopName[popName][gridIdx]
-			exposureByPop[popName] += numIndividuals * concentrationAmt
-			if popName != s.CSTConfig.CensusTotalPopColumn {
-				popTotals[popName] += numIndividuals
-			}
-			log.Printf("\t\t[Population %s] %.2f ppl --> %.2f exposure", popName, numIndividuals, numIndividuals*concentrationAmt)
+			log.Printf("\t\t[Population %s] %.2f ppl --> %.2f exposure", labels.get(popName), numIndividuals, numIndividuals*concentrationAmt)
+		}
+	}
+	exposureByPop, popTotals, err := exposuremath.PopulationWeighted(conc, populationGridsByPopName, cells)
+	if err != nil {
+		return nil, withKind(kindNumeric, err)
+	}
+	if len(timeActivity.HomeFraction) > 0 {
+		if err := timeActivity.checkPopulations(popNames); err != nil {
+			return nil, err
+		}
+		away := awayConcentration(conc, receptors, popNames, populationGridsByPopName, s.CSTConfig.CensusTotalPopColumn)
+		for popName, e := range exposureByPop {
+			exposureByPop[popName] = timeActivity.adjust(popName, e, popTotals[popName], away)
+		}
+	}
+	// Exposure is checked before suppression, which can report small
+	// populations as NaN by design.
+	if allFinite(conc) {
+		if err := checkFiniteMap(ctx, "population-weighted exposure", exposureByPop); err != nil {
+			return nil, err
+		}
+	}
+	if restricted && suppression.MinPopulation > 0 {
+		for popName, e := range exposureByPop {
+			exposureByPop[popName] = suppression.total(e, popTotals[popName])
 		}
 	}
 
 	return &exposureByPop, nil
-}
\ No newline at end of file
+}
+
+// maskedExposure returns the population-weighted exposure to conc of each
+// census population in the grid cells where mask is true, restricted to
+// the subdomain, if any, along with the people of each population in those
+// cells and their number.
+func maskedExposure(ctx context.Context, s *eieio.Server, aqm string, conc []float64, mask []bool) (exposure, people map[string]float64, cells int, err error) {
+	byPop, err := populationExposure(ctx, s, aqm, conc, mask)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	g, err := getExposureGrids(ctx, s, aqm, conc, mask)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	people = make(map[string]float64)
+	for i, in := range g.receptors {
+		if !in {
+			continue
+		}
+		cells++
+		for _, pop := range g.popNames {
+			people[pop] += g.pops[pop][i]
+		}
+	}
+	return *byPop, people, cells, nil
+}
+
+// exposureGrids are the concentrations and populations in each grid cell
+// from which exposure is calculated.
+type exposureGrids struct {
+	conc      []float64
+	receptors []bool
+	popNames  []string
+	pops      map[string][]float64
+
+	// restricted is whether the cells are only part of the domain, as
+	// with a receptor region or subdomain, so that results are subject to
+	// small-cell suppression.
+	restricted bool
+}
+
+// getExposureGrids returns the concentrations conc, weighted by the
+// exposure function of ctx, and the population of each census population
+// in the cells of the subdomain, if any, with receptors restricted to
+// those cells.
+func getExposureGrids(ctx context.Context, s *eieio.Server, aqm string, conc []float64, receptors []bool) (*exposureGrids, error) {
+	conc, err := exposureConcentrations(ctx, conc)
+	if err != nil {
+		return nil, err
+	}
+	popNames, pops, err := getPopulationGrids(ctx, s, aqm, len(conc))
+	if err != nil {
+		return nil, err
+	}
+	g := &exposureGrids{conc: conc, receptors: receptors, popNames: popNames, pops: pops, restricted: receptors != nil}
+	if d, err := getSubdomain(s, aqm); err != nil {
+		return nil, err
+	} else if d != nil {
+		g.restricted = true
+		if g.conc, err = d.restrict(conc); err != nil {
+			return nil, err
+		}
+		if g.receptors, err = d.restrictMask(receptors); err != nil {
+			return nil, err
+		}
+		for _, pop := range popNames {
+			if pops[pop], err = d.restrict(pops[pop]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return g, nil
+}
+
+// awayConcentration returns the population-weighted mean of conc in the
+// cells where receptors is true (or all cells, if it is nil), weighted by
+// the total population if it is among popNames and otherwise by the sum of
+// the populations.
+func awayConcentration(conc []float64, receptors []bool, popNames []string, grids map[string][]float64, totalPop string) float64 {
+	weights := popNames
+	if _, ok := grids[totalPop]; ok {
+		weights = []string{totalPop}
+	}
+	w := make([][]float64, len(weights))
+	for i, pop := range weights {
+		w[i] = grids[pop]
+	}
+	return exposuremath.WeightedMean(conc, w, receptors)
+}
+
+// Get the gridded population count for each census population (ethnicity
+// columns followed by income deciles), checking that they and the
+// concentrations they are to be combined with, with nCells cells, are on
+// the aqm grid. Populations are projected if ctx has a population
+// projection.
+func getPopulationGrids(ctx context.Context, s *eieio.Server, aqm string, nCells int) ([]string, map[string][]float64, error) {
+	popNames := append(s.CSTConfig.CensusPopColumns, s.CSTConfig.CensusIncomeDecileNames...)
+	populationGridsByPopName := make(map[string][]float64)
+	if err := checkGrid(s, aqm, nCells, "concentrations"); err != nil {
+		return nil, nil, err
+	}
+	for i, popName := range popNames {
+		done := timeRPC(ctx, "PopulationCount")
+		pop, err := s.CSTConfig.PopulationCount(ctx, &eieiorpc.PopulationCountInput{
+			Year:        2014, // year,
+			Population:  popName,
+			AQM:         aqm,
+			IsIncomePop: i >= len(s.CSTConfig.CensusPopColumns), // based off gen of popNames above
+		})
+		done(&err)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := checkGrid(s, aqm, len(pop), "population "+popName); err != nil {
+			return nil, nil, err
+		}
+		populationGridsByPopName[popName] = pop
+	}
+	if err := projectPopulationGrids(ctx, populationGridsByPopName); err != nil {
+		return nil, nil, err
+	}
+	popNames = addDerivedPopulations(popNames, populationGridsByPopName, s.CSTConfig.CensusTotalPopColumn, s.CSTConfig.CensusIncomeDecileNames)
+	return popNames, populationGridsByPopName, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exposureFunction transforms the concentration in each grid cell before it
+// is weighted by population, for sensitivity analyses of the linear
+// population×concentration exposure metric. It is specified as a name,
+// optionally followed by ":" and a parameter, e.g. "threshold:2.4".
+type exposureFunction struct {
+	Name  string
+	Param float64
+}
+
+// exposureFunctionDef defines a kind of exposureFunction.
+type exposureFunctionDef struct {
+	// defaultParam is the parameter if none is given.
+	defaultParam float64
+
+	// apply returns the weighted concentration for concentration c.
+	apply func(c, param float64) float64
+
+	// slope0 is the derivative of apply at zero concentration, which
+	// weights parts of the concentration in cells without any.
+	slope0 func(param float64) float64
+}
+
+// exposureFunctions are the available exposure functions by name.
+var exposureFunctions = map[string]exposureFunctionDef{
+	// linear is population-weighted concentration.
+	"linear": {
+		apply:  func(c, _ float64) float64 { return c },
+		slope0: func(float64) float64 { return 1 },
+	},
+	// squared emphasizes high concentrations, to test whether results
+	// depend on the response being linear.
+	"squared": {
+		apply:  func(c, _ float64) float64 { return c * c },
+		slope0: func(float64) float64 { return 0 },
+	},
+	// loglinear is the excess relative risk of a log-linear
+	// concentration–response function with coefficient param per μg/m³,
+	// divided by param to keep units of concentration:
+	// (exp(param×c) − 1) / param. The default is a relative risk of 1.06
+	// per 10 μg/m³.
+	"loglinear": {
+		defaultParam: math.Log(1.06) / 10,
+		apply:        func(c, beta float64) float64 { return math.Expm1(beta*c) / beta },
+		slope0:       func(float64) float64 { return 1 },
+	},
+	// threshold only counts concentrations above a background level of
+	// param μg/m³.
+	"threshold": {
+		defaultParam: 2.4,
+		apply:        func(c, t float64) float64 { return math.Max(c-t, 0) },
+		slope0: func(t float64) float64 {
+			if t > 0 {
+				return 0
+			}
+			return 1
+		},
+	},
+}
+
+var linearExposure = exposureFunction{Name: "linear"}
+
+// exposureFunctionNames returns the names of exposureFunctions, sorted.
+func exposureFunctionNames() []string {
+	var names []string
+	for name := range exposureFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseExposureFunction parses an exposure function specification such as
+// "loglinear" or "threshold:2.4". An empty spec is linear.
+func parseExposureFunction(spec string) (exposureFunction, error) {
+	if spec == "" {
+		return linearExposure, nil
+	}
+	name, param := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, param = spec[:i], spec[i+1:]
+	}
+	def, ok := exposureFunctions[name]
+	if !ok {
+		return exposureFunction{}, errorf(kindConfig, "invalid exposure function %q; valid functions are %s", name, strings.Join(exposureFunctionNames(), ", "))
+	}
+	f := exposureFunction{Name: name, Param: def.defaultParam}
+	if param != "" {
+		p, err := strconv.ParseFloat(param, 64)
+		if err != nil || p < 0 || (name == "loglinear" && p == 0) {
+			return exposureFunction{}, errorf(kindConfig, "invalid parameter %q for exposure function %s", param, name)
+		}
+		f.Param = p
+	}
+	return f, nil
+}
+
+// String returns the specification of f.
+func (f exposureFunction) String() string {
+	if f.Param == 0 {
+		return f.Name
+	}
+	return f.Name + ":" + strconv.FormatFloat(f.Param, 'g', -1, 64)
+}
+
+func (f exposureFunction) linear() bool { return f.Name == "" || f.Name == "linear" }
+
+// apply returns the weighted concentrations for conc, after subtracting
+// the background concentration in each cell, if background is not nil.
+func (f exposureFunction) apply(conc, background []float64) []float64 {
+	if f.linear() && background == nil {
+		return conc
+	}
+	def := exposureFunctions[f.Name]
+	if f.linear() {
+		def = exposureFunctions["linear"]
+	}
+	out := make([]float64, len(conc))
+	for i, c := range conc {
+		if background != nil {
+			c = math.Max(c-background[i], 0)
+		}
+		out[i] = def.apply(c, f.Param)
+	}
+	return out
+}
+
+// cellWeights returns the factor multiplying any part of the total
+// concentration in each grid cell, such as one PM2.5 species or the part
+// caused by one sector or emitter region: f(c−b)/c for total concentration
+// c and background b (zero if background is nil). Parts weighted this way
+// sum to the weighted total, so that attributions of exposure stay
+// consistent with it. It returns nil if f is linear and there is no
+// background.
+func (f exposureFunction) cellWeights(total, background []float64) []float64 {
+	if f.linear() && background == nil {
+		return nil
+	}
+	def := exposureFunctions[f.Name]
+	if f.linear() {
+		def = exposureFunctions["linear"]
+	}
+	w := make([]float64, len(total))
+	for i, c := range total {
+		var b float64
+		if background != nil {
+			b = background[i]
+		}
+		switch {
+		case c == 0 && b > 0:
+			w[i] = 0
+		case c == 0:
+			w[i] = def.slope0(f.Param)
+		default:
+			w[i] = def.apply(math.Max(c-b, 0), f.Param) / c
+		}
+	}
+	return w
+}
+
+// defaultExposureFunction is the exposure function used when ctx doesn't
+// have one, set from the ExposureFunction setting in the [Sandbox] config
+// table.
+var defaultExposureFunction = linearExposure
+
+type exposureFunctionKey struct{}
+
+// withExposureFunction returns a context in which exposure is calculated
+// with f.
+func withExposureFunction(ctx context.Context, f exposureFunction) context.Context {
+	return context.WithValue(ctx, exposureFunctionKey{}, f)
+}
+
+// exposureFunctionFor returns the exposure function of ctx.
+func exposureFunctionFor(ctx context.Context) exposureFunction {
+	if f, ok := ctx.Value(exposureFunctionKey{}).(exposureFunction); ok {
+		return f
+	}
+	return defaultExposureFunction
+}
+
+// exposureFunctionFlag returns the context for a command with an
+// -exposure-function flag given as spec, which overrides the config
+// setting if it is not empty.
+func exposureFunctionFlag(ctx context.Context, spec string) (context.Context, error) {
+	if spec == "" {
+		return ctx, nil
+	}
+	f, err := parseExposureFunction(spec)
+	if err != nil {
+		return nil, errorf(kindUsage, "-exposure-function: %v", err)
+	}
+	return withExposureFunction(ctx, f), nil
+}
+
+// exposureWeighted returns whether exposure in ctx is anything other than
+// population-weighted concentration, because of a nonlinear exposure
+// function or a background concentration.
+func exposureWeighted(ctx context.Context) bool {
+	return !exposureFunctionFor(ctx).linear() || !backgroundFor(ctx).empty()
+}
+
+// exposureSpec describes the exposure function and background
+// concentration of ctx, or returns "" if exposure isn't weighted.
+func exposureSpec(ctx context.Context) string {
+	var parts []string
+	if f := exposureFunctionFor(ctx); !f.linear() {
+		parts = append(parts, f.String())
+	}
+	if b := backgroundFor(ctx); !b.empty() {
+		parts = append(parts, "background:"+b.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// exposureConcentrations returns conc, a concentration in each grid cell,
+// with the background concentration of ctx subtracted and transformed by
+// its exposure function.
+func exposureConcentrations(ctx context.Context, conc []float64) ([]float64, error) {
+	bg, err := backgroundFor(ctx).grid(len(conc))
+	if err != nil {
+		return nil, err
+	}
+	return exposureFunctionFor(ctx).apply(conc, bg), nil
+}
+
+// exposureWeights returns the cellWeights of the exposure function of ctx
+// for total, with its background concentration.
+func exposureWeights(ctx context.Context, total []float64) ([]float64, error) {
+	bg, err := backgroundFor(ctx).grid(len(total))
+	if err != nil {
+		return nil, err
+	}
+	return exposureFunctionFor(ctx).cellWeights(total, bg), nil
+}
+
+// withUnweightedExposure returns a context for calculating the exposure
+// to parts of a concentration that have already been weighted with
+// exposureWeights.
+func withUnweightedExposure(ctx context.Context) context.Context {
+	return withBackground(withExposureFunction(ctx, linearExposure), backgroundConfig{})
+}
+
+// scaleByCell multiplies each value of v by the weight of its grid cell, if
+// weights is not nil.
+func scaleByCell(v, weights []float64) ([]float64, error) {
+	if weights == nil {
+		return v, nil
+	}
+	if len(v) != len(weights) {
+		return nil, errorf(kindNumeric, "expected %d grid cells for exposure weighting, got %d", len(weights), len(v))
+	}
+	out := make([]float64, len(v))
+	for i := range v {
+		out[i] = v[i] * weights[i]
+	}
+	return out, nil
+}
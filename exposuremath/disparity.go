@@ -0,0 +1,73 @@
+package exposuremath
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Disparity is a population's exposure relative to that of a reference
+// population.
+type Disparity struct {
+	Population string
+
+	// Exposure is the population's exposure, Difference its difference
+	// from that of the reference population and Ratio its ratio to it
+	// (NaN if the reference exposure is zero).
+	Exposure, Difference, Ratio float64
+}
+
+// Disparities compares the exposure of each population with that of the
+// reference population, e.g. "TotalPop", in order of population name.
+func Disparities(exposure map[string]float64, reference string) ([]Disparity, error) {
+	ref, ok := exposure[reference]
+	if !ok {
+		return nil, fmt.Errorf("exposuremath: no exposure for reference population %q", reference)
+	}
+	pops := make([]string, 0, len(exposure))
+	for pop := range exposure {
+		pops = append(pops, pop)
+	}
+	sort.Strings(pops)
+	d := make([]Disparity, len(pops))
+	for i, pop := range pops {
+		v := exposure[pop]
+		ratio := math.NaN()
+		if ref != 0 {
+			ratio = v / ref
+		}
+		d[i] = Disparity{Population: pop, Exposure: v, Difference: v - ref, Ratio: ratio}
+	}
+	return d, nil
+}
+
+// Largest returns the disparity whose exposure differs most from that of
+// the reference population, relative to it.
+func Largest(d []Disparity) Disparity {
+	var largest Disparity
+	max := -1.0
+	for _, g := range d {
+		if v := math.Abs(g.Ratio - 1); v > max {
+			largest, max = g, v
+		}
+	}
+	return largest
+}
+
+// Range returns the difference between the highest and lowest of values,
+// such as the mean exposures of groups, and the highest.
+func Range(values []float64) (diff, hi float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	hi, lo := values[0], values[0]
+	for _, v := range values[1:] {
+		if v > hi {
+			hi = v
+		}
+		if v < lo {
+			lo = v
+		}
+	}
+	return hi - lo, hi
+}
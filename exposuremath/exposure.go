@@ -0,0 +1,56 @@
+// Package exposuremath calculates population-weighted exposure, exposure
+// disparities and exposure inequality from gridded concentrations and
+// populations. It operates on plain slices indexed by grid cell and maps
+// keyed by population name, so it can be used with concentrations from any
+// source.
+package exposuremath
+
+import "fmt"
+
+// PopulationWeighted returns the exposure of each population in pops, the
+// sum over grid cells of its count in the cell multiplied by the
+// concentration there, along with its total count. If mask is non-nil, only
+// cells where it is true are included. Dividing exposure by the count
+// gives the population's mean concentration.
+func PopulationWeighted(conc []float64, pops map[string][]float64, mask []bool) (exposure, people map[string]float64, err error) {
+	if mask != nil && len(mask) != len(conc) {
+		return nil, nil, fmt.Errorf("exposuremath: %d grid cells in mask but %d in concentrations", len(mask), len(conc))
+	}
+	exposure = make(map[string]float64, len(pops))
+	people = make(map[string]float64, len(pops))
+	for name, pop := range pops {
+		if len(pop) != len(conc) {
+			return nil, nil, fmt.Errorf("exposuremath: %d grid cells in population %s but %d in concentrations", len(pop), name, len(conc))
+		}
+		var e, n float64
+		for i, c := range conc {
+			if mask != nil && !mask[i] {
+				continue
+			}
+			e += pop[i] * c
+			n += pop[i]
+		}
+		exposure[name], people[name] = e, n
+	}
+	return exposure, people, nil
+}
+
+// WeightedMean returns the mean of conc over the grid cells where mask is
+// true (or all cells, if it is nil), weighted by the sum of the counts of
+// the populations in weights. It returns 0 if there are no people.
+func WeightedMean(conc []float64, weights [][]float64, mask []bool) float64 {
+	var sum, n float64
+	for i, c := range conc {
+		if mask != nil && !mask[i] {
+			continue
+		}
+		for _, w := range weights {
+			sum += w[i] * c
+			n += w[i]
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / n
+}
@@ -0,0 +1,81 @@
+package exposuremath
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestPopulationWeighted(t *testing.T) {
+	conc := []float64{1, 2, 4}
+	pops := map[string][]float64{
+		"TotalPop": {2, 1, 1},
+		"Black":    {0, 1, 1},
+	}
+	for _, test := range []struct {
+		name             string
+		mask             []bool
+		exposure, people map[string]float64
+	}{
+		{
+			name:     "all cells",
+			exposure: map[string]float64{"TotalPop": 8, "Black": 6},
+			people:   map[string]float64{"TotalPop": 4, "Black": 2},
+		},
+		{
+			name:     "masked",
+			mask:     []bool{true, false, true},
+			exposure: map[string]float64{"TotalPop": 6, "Black": 4},
+			people:   map[string]float64{"TotalPop": 3, "Black": 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			exposure, people, err := PopulationWeighted(conc, pops, test.mask)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(exposure, test.exposure) || !reflect.DeepEqual(people, test.people) {
+				t.Errorf("got exposure %v of %v people, want %v of %v", exposure, people, test.exposure, test.people)
+			}
+		})
+	}
+}
+
+func TestPopulationWeightedLengths(t *testing.T) {
+	conc := []float64{1, 2}
+	if _, _, err := PopulationWeighted(conc, map[string][]float64{"TotalPop": {1}}, nil); err == nil {
+		t.Error("short population: expected an error")
+	}
+	if _, _, err := PopulationWeighted(conc, map[string][]float64{"TotalPop": {1, 1}}, []bool{true}); err == nil {
+		t.Error("short mask: expected an error")
+	}
+}
+
+func TestDisparities(t *testing.T) {
+	d, err := Disparities(map[string]float64{"TotalPop": 2, "Black": 3, "White": 1}, "TotalPop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Disparity{
+		{Population: "Black", Exposure: 3, Difference: 1, Ratio: 1.5},
+		{Population: "TotalPop", Exposure: 2, Difference: 0, Ratio: 1},
+		{Population: "White", Exposure: 1, Difference: -1, Ratio: 0.5},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("got %+v, want %+v", d, want)
+	}
+	if l := Largest(d); l.Population != "Black" {
+		t.Errorf("largest disparity: got %s, want Black", l.Population)
+	}
+
+	d, err = Disparities(map[string]float64{"TotalPop": 0, "Black": 1}, "TotalPop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(d[0].Ratio) {
+		t.Errorf("zero reference exposure: got ratio %g, want NaN", d[0].Ratio)
+	}
+	if _, err := Disparities(map[string]float64{"Black": 1}, "TotalPop"); err == nil {
+		t.Error("missing reference: expected an error")
+	}
+}
@@ -0,0 +1,160 @@
+package exposuremath
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Distribution describes the distribution of the individual exposures of
+// the members of a population, such as the concentration where each
+// lives.
+type Distribution struct {
+	People, Mean, StdDev    float64
+	P10, P25, P50, P75, P90 float64
+}
+
+// WeightedValue is a value with the number of people it applies to.
+type WeightedValue struct {
+	V, W float64
+}
+
+// NewDistribution returns the weighted mean, standard deviation and
+// percentiles of values, which it sorts. Each percentile is the lowest
+// value at which the cumulative population reaches it. All but People are
+// NaN if there are no people.
+func NewDistribution(values []WeightedValue) Distribution {
+	sort.Slice(values, func(i, j int) bool { return values[i].V < values[j].V })
+	var d Distribution
+	var sum float64
+	for _, x := range values {
+		d.People += x.W
+		sum += x.V * x.W
+	}
+	if d.People == 0 {
+		return Unknown(0)
+	}
+	d.Mean = sum / d.People
+	var ss float64
+	for _, x := range values {
+		ss += x.W * (x.V - d.Mean) * (x.V - d.Mean)
+	}
+	d.StdDev = math.Sqrt(ss / d.People)
+
+	ps := []*float64{&d.P10, &d.P25, &d.P50, &d.P75, &d.P90}
+	qs := []float64{0.1, 0.25, 0.5, 0.75, 0.9}
+	var cum float64
+	k := 0
+	for _, x := range values {
+		cum += x.W
+		for k < len(qs) && cum >= qs[k]*d.People {
+			*ps[k] = x.V
+			k++
+		}
+	}
+	for ; k < len(qs); k++ {
+		*ps[k] = values[len(values)-1].V
+	}
+	return d
+}
+
+// Unknown returns a distribution of people people whose statistics are
+// unknown (NaN), such as one suppressed for privacy.
+func Unknown(people float64) Distribution {
+	nan := math.NaN()
+	return Distribution{People: people, Mean: nan, StdDev: nan, P10: nan, P25: nan, P50: nan, P75: nan, P90: nan}
+}
+
+// ConcentrationIndex returns the concentration index of exposure over
+// ranked groups, such as income deciles, from the total exposure and
+// population of each group, lowest rank first: twice the covariance of
+// individual exposure and fractional rank, divided by the mean exposure.
+// It ranges from -1 to 1 and is negative when exposure is concentrated
+// among lower-ranked groups. It is NaN if there are no people or no
+// exposure.
+func ConcentrationIndex(exposure, pop []float64) (float64, error) {
+	if len(exposure) != len(pop) {
+		return math.NaN(), fmt.Errorf("exposuremath: %d groups in exposure but %d in populations", len(exposure), len(pop))
+	}
+	var total, totalExposure float64
+	for k := range pop {
+		total += pop[k]
+		totalExposure += exposure[k]
+	}
+	if total == 0 || totalExposure == 0 {
+		return math.NaN(), nil
+	}
+	mean := totalExposure / total
+	var ci, rank float64
+	for k := range pop {
+		f := pop[k] / total
+		if f == 0 {
+			continue
+		}
+		// The fractional rank of the middle of the group.
+		r := rank + f/2
+		ci += f * (exposure[k] / pop[k]) * r
+		rank += f
+	}
+	return 2*ci/mean - 1, nil
+}
+
+// JackknifeConcentrationIndex returns the concentration index over ranked
+// groups with the exposures and populations in each grid cell given by
+// exposures and pops, indexed by group (lowest rank first) and then grid
+// cell, along with its jackknife standard error from leaving out each
+// populated grid cell in turn and the number of those cells.
+func JackknifeConcentrationIndex(exposures, pops [][]float64) (ci, stdErr float64, n int, err error) {
+	if len(pops) == 0 {
+		return math.NaN(), math.NaN(), 0, fmt.Errorf("exposuremath: no groups")
+	}
+	if len(exposures) != len(pops) {
+		return math.NaN(), math.NaN(), 0, fmt.Errorf("exposuremath: %d groups in exposures but %d in populations", len(exposures), len(pops))
+	}
+	for k := range pops {
+		if len(pops[k]) != len(pops[0]) || len(exposures[k]) != len(pops[0]) {
+			return math.NaN(), math.NaN(), 0, fmt.Errorf("exposuremath: group %d has %d grid cells of population and %d of exposure, but group 0 has %d", k, len(pops[k]), len(exposures[k]), len(pops[0]))
+		}
+	}
+	exposure := make([]float64, len(pops))
+	pop := make([]float64, len(pops))
+	var cells []int
+	for i := range pops[0] {
+		var any bool
+		for k := range pops {
+			exposure[k] += exposures[k][i]
+			pop[k] += pops[k][i]
+			any = any || pops[k][i] > 0
+		}
+		if any {
+			cells = append(cells, i)
+		}
+	}
+	if ci, err = ConcentrationIndex(exposure, pop); err != nil {
+		return math.NaN(), math.NaN(), 0, err
+	}
+	n = len(cells)
+	if n < 2 {
+		return ci, math.NaN(), n, nil
+	}
+
+	loo := make([]float64, n)
+	var mean float64
+	e, p := make([]float64, len(pops)), make([]float64, len(pops))
+	for j, i := range cells {
+		for k := range pops {
+			e[k] = exposure[k] - exposures[k][i]
+			p[k] = pop[k] - pops[k][i]
+		}
+		if loo[j], err = ConcentrationIndex(e, p); err != nil {
+			return math.NaN(), math.NaN(), 0, err
+		}
+		mean += loo[j]
+	}
+	mean /= float64(n)
+	var ss float64
+	for _, v := range loo {
+		ss += (v - mean) * (v - mean)
+	}
+	return ci, math.Sqrt(float64(n-1) / float64(n) * ss), n, nil
+}
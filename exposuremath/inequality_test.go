@@ -0,0 +1,136 @@
+package exposuremath
+
+import (
+	"math"
+	"testing"
+)
+
+const tolerance = 1e-12
+
+func closeTo(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestConcentrationIndex(t *testing.T) {
+	nan := math.NaN()
+	for _, test := range []struct {
+		name          string
+		exposure, pop []float64
+		want          float64
+	}{
+		{name: "equal", exposure: []float64{2, 2}, pop: []float64{1, 1}, want: 0},
+		// Per capita exposures 1 and 3 at fractional ranks 0.25 and 0.75:
+		// 2 × cov(1, 3; 0.25, 0.75) / 2 = 0.25.
+		{name: "higher ranks", exposure: []float64{1, 3}, pop: []float64{1, 1}, want: 0.25},
+		{name: "lowest rank", exposure: []float64{2, 0}, pop: []float64{1, 1}, want: -0.5},
+		{name: "empty group", exposure: []float64{1, 0, 3}, pop: []float64{1, 0, 1}, want: 0.25},
+		{name: "no people", exposure: []float64{0, 0}, pop: []float64{0, 0}, want: nan},
+		{name: "no exposure", exposure: []float64{0, 0}, pop: []float64{1, 1}, want: nan},
+		{name: "no groups", want: nan},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ConcentrationIndex(test.exposure, test.pop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !closeTo(got, test.want) {
+				t.Errorf("got %g, want %g", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConcentrationIndexLengths(t *testing.T) {
+	for _, exposure := range [][]float64{{1}, {1, 2, 3}} {
+		if _, err := ConcentrationIndex(exposure, []float64{1, 1}); err == nil {
+			t.Errorf("%d exposures for 2 populations: expected an error", len(exposure))
+		}
+	}
+}
+
+func TestJackknifeConcentrationIndex(t *testing.T) {
+	nan := math.NaN()
+	for _, test := range []struct {
+		name            string
+		exposures, pops [][]float64
+		ci, stdErr      float64
+		n               int
+	}{
+		{
+			name:      "one cell",
+			exposures: [][]float64{{1}, {3}},
+			pops:      [][]float64{{1}, {1}},
+			ci:        0.25, stdErr: nan, n: 1,
+		},
+		{
+			// Leaving out either cell doesn't change the index.
+			name:      "identical cells",
+			exposures: [][]float64{{1, 1}, {3, 3}},
+			pops:      [][]float64{{1, 1}, {1, 1}},
+			ci:        0.25, stdErr: 0, n: 2,
+		},
+		{
+			// The index is 1/6; leaving out the cells gives 0 and 0.25,
+			// so the standard error is √(½ × 2 × 0.125²) = 0.125.
+			name:      "two cells",
+			exposures: [][]float64{{1, 1}, {3, 1}},
+			pops:      [][]float64{{1, 1}, {1, 1}},
+			ci:        1.0 / 6, stdErr: 0.125, n: 2,
+		},
+		{
+			name:      "unpopulated cell",
+			exposures: [][]float64{{1, 1, 0}, {3, 1, 0}},
+			pops:      [][]float64{{1, 1, 0}, {1, 1, 0}},
+			ci:        1.0 / 6, stdErr: 0.125, n: 2,
+		},
+		{
+			name:      "no cells",
+			exposures: [][]float64{{}, {}},
+			pops:      [][]float64{{}, {}},
+			ci:        nan, stdErr: nan, n: 0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ci, stdErr, n, err := JackknifeConcentrationIndex(test.exposures, test.pops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !closeTo(ci, test.ci) || !closeTo(stdErr, test.stdErr) || n != test.n {
+				t.Errorf("got %g ± %g over %d cells, want %g ± %g over %d", ci, stdErr, n, test.ci, test.stdErr, test.n)
+			}
+		})
+	}
+}
+
+func TestJackknifeConcentrationIndexInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		exposures, pops [][]float64
+	}{
+		{name: "no groups"},
+		{name: "fewer exposures", exposures: [][]float64{{1}}, pops: [][]float64{{1}, {1}}},
+		{name: "ragged populations", exposures: [][]float64{{1, 1}, {1, 1}}, pops: [][]float64{{1, 1}, {1}}},
+		{name: "ragged exposures", exposures: [][]float64{{1, 1}, {1}}, pops: [][]float64{{1, 1}, {1, 1}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, _, err := JackknifeConcentrationIndex(test.exposures, test.pops); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestNewDistribution(t *testing.T) {
+	d := NewDistribution([]WeightedValue{{V: 3, W: 2}, {V: 1, W: 1}, {V: 2, W: 1}})
+	want := Distribution{People: 4, Mean: 2.25, StdDev: math.Sqrt(0.6875),
+		P10: 1, P25: 1, P50: 2, P75: 3, P90: 3}
+	if d != want {
+		t.Errorf("got %+v, want %+v", d, want)
+	}
+	if d := NewDistribution(nil); d.People != 0 || !math.IsNaN(d.Mean) || !math.IsNaN(d.P50) {
+		t.Errorf("no people: got %+v, want unknown statistics", d)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+)
+
+// getDamagesPerDollar returns the health damages (dollars) caused by one
+// dollar of final demand for each commodity, including its supply chain,
+// valued using v.
+func getDamagesPerDollar(ctx context.Context, s *eieio.Server, year int32, hr, aqm string, v valuationConfig) ([]float64, error) {
+	ctx, span := startSpan(ctx, "getDamagesPerDollar")
+	defer span.End()
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := v.value(year)
+	perDollar := make([]float64, len(commodities.List))
+	unit := make([]float64, len(commodities.List))
+	for j, commodity := range commodities.List {
+		unit[j] = 1
+		deaths, err := totalHealth(ctx, s, &eieiorpc.Vector{Data: unit}, eieiorpc.Pollutant_TotalPM25, s.CSTConfig.CensusTotalPopColumn, year, hr, aqm)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating health impacts of %s", commodity)
+		}
+		perDollar[j] = deaths * value
+		unit[j] = 0
+	}
+	return perDollar, nil
+}
+
+// externalityCommand writes a table of PM2.5 health damages per dollar of
+// final demand for each commodity, for use in externality pricing.
+func externalityCommand(args []string) error {
+	fs := flag.NewFlagSet("externality", flag.ExitOnError)
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	hr := fs.String("hr", "NasariACS", "hazard ratio function")
+	var v valuationConfig
+	fs.Float64Var(&v.VSL, "vsl", 9.6e6, "value of a statistical life in dollars")
+	baseYear := fs.Int("vsl-year", int(defaultYear()), "year the value of a statistical life is expressed in")
+	fs.Float64Var(&v.Growth, "vsl-growth", 0, "annual fractional growth in the value of a statistical life")
+	fs.Float64Var(&v.Morbidity, "morbidity", 0, "morbidity costs as a fraction of mortality costs")
+	out := fs.String("o", "externality.csv", "output CSV file")
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s externality [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	v.BaseYear = int32(*baseYear)
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	ctx := context.Background()
+	perDollar, err := getDamagesPerDollar(ctx, s, int32(*year), *hr, *aqm, v)
+	if err != nil {
+		return err
+	}
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            int32(*year),
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return errors.Wrap(err, "error getting final demand")
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for j, commodity := range commodities.List {
+		rows = append(rows, []string{commodity, formatFloat(demand.Data[j]), formatFloat(perDollar[j] * demand.Data[j]), formatFloat(perDollar[j])})
+	}
+	if err := writeCSV(*out, []string{"Commodity", "FinalDemand", "Damages", "DamagesPerDollar"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "externality.csv"); err != nil {
+		return err
+	}
+	log.Printf("Wrote damages per dollar for %d commodities to %s", len(rows), *out)
+	return nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dataset is an input dataset that can be downloaded by the fetch-data
+// command.
+type dataset struct {
+	Name string
+
+	// Vintage is the release or year of the data, for reporting.
+	Vintage string
+
+	URL string
+
+	// SHA256 is the hex checksum of the download. Datasets without one
+	// fail verification and aren't downloaded.
+	SHA256 string
+
+	// File is where the download is saved.
+	File string
+
+	// Extract, if set, is the directory that the download, a zip archive,
+	// is extracted into, dropping the first StripComponents elements of
+	// each path in the archive.
+	Extract         string
+	StripComponents int
+
+	// Provides names the inputs that are extracted from the download, such
+	// as census or CES data, with their paths relative to Extract.
+	Provides map[string]string
+}
+
+// datasetManifest lists the datasets that can be downloaded.
+type datasetManifest struct {
+	Dataset []dataset
+}
+
+// datasetsFile is the default dataset manifest.
+func datasetsFile() string {
+	return os.ExpandEnv("${INMAP_SANDBOX_ROOT}/data/datasets.toml")
+}
+
+// loadDatasets reads a TOML dataset manifest from path, expanding
+// environment variables in paths.
+func loadDatasets(path string) ([]dataset, error) {
+	var m datasetManifest
+	if _, err := toml.DecodeFile(path, &m); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range m.Dataset {
+		d := &m.Dataset[i]
+		if d.Name == "" || d.URL == "" {
+			return nil, fmt.Errorf("dataset %d must specify a Name and URL", i)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("duplicate dataset name %q", d.Name)
+		}
+		names[d.Name] = true
+		extract := d.Extract
+		d.File, d.Extract = os.ExpandEnv(d.File), os.ExpandEnv(d.Extract)
+		if d.File == "" || (extract != "" && d.Extract == "") {
+			return nil, fmt.Errorf("dataset %s: File and Extract must not be empty; are the environment variables they refer to set?", d.Name)
+		}
+		if len(d.Provides) > 0 && d.Extract == "" {
+			return nil, fmt.Errorf("dataset %s: Provides requires Extract", d.Name)
+		}
+	}
+	return m.Dataset, nil
+}
+
+// fileSHA256 returns the hex SHA-256 checksum of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fetchDataset downloads d unless it has already been downloaded and
+// verified, then extracts it. With force, it is downloaded again in any
+// case.
+func fetchDataset(ctx context.Context, client *http.Client, d dataset, force bool) error {
+	if d.SHA256 == "" {
+		return fmt.Errorf("no SHA256 to verify %s against; set it in the manifest to the checksum published with the dataset", d.URL)
+	}
+	part := d.File + ".part"
+	if force {
+		for _, path := range []string{d.File, part} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	download := true
+	if _, err := os.Stat(d.File); err == nil {
+		sum, err := fileSHA256(d.File)
+		if err != nil {
+			return err
+		}
+		if download = !strings.EqualFold(sum, d.SHA256); download {
+			log.Printf("Dataset %s: %s has the wrong checksum; downloading it again", d.Name, d.File)
+			if err := os.Remove(d.File); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("Dataset %s: %s is already present", d.Name, d.File)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if download {
+		if err := os.MkdirAll(filepath.Dir(d.File), 0755); err != nil {
+			return err
+		}
+		if err := downloadFile(ctx, client, d.URL, part); err != nil {
+			return errors.Wrapf(err, "downloading %s", d.URL)
+		}
+		sum, err := fileSHA256(part)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(sum, d.SHA256) {
+			// Remove the download so that it isn't resumed.
+			os.Remove(part)
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", d.URL, d.SHA256, sum)
+		}
+		log.Printf("Dataset %s: downloaded and verified %s", d.Name, d.File)
+		if err := os.Rename(part, d.File); err != nil {
+			return err
+		}
+	}
+
+	if d.Extract == "" {
+		return nil
+	}
+	if err := extractZip(d.File, d.Extract, d.StripComponents); err != nil {
+		return err
+	}
+	for _, name := range d.provided() {
+		if _, err := os.Stat(d.providedPath(name)); err != nil {
+			return errors.Wrapf(err, "%s %s is missing from the download", d.Name, name)
+		}
+	}
+	return nil
+}
+
+// provided returns the names of the inputs that d provides, sorted.
+func (d dataset) provided() []string {
+	names := make([]string, 0, len(d.Provides))
+	for name := range d.Provides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providedPath returns the path of the input name that d provides.
+func (d dataset) providedPath(name string) string {
+	return filepath.Join(d.Extract, filepath.FromSlash(d.Provides[name]))
+}
+
+// downloadFile downloads url to path, resuming from the end of path if it
+// exists and the server supports range requests.
+func downloadFile(ctx context.Context, client *http.Client, url, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		log.Printf("Resuming download of %s at %d bytes", url, offset)
+	case http.StatusOK:
+		// The server sent the whole file.
+		if offset > 0 {
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if offset, err = f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The previous download was complete.
+		return nil
+	default:
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	w := &progressWriter{w: f, name: filepath.Base(path), n: offset, total: -1}
+	if resp.ContentLength >= 0 {
+		w.total = offset + resp.ContentLength
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// progressWriter logs the progress of a download every 100 MB.
+type progressWriter struct {
+	w        io.Writer
+	name     string
+	n, total int64
+}
+
+const progressInterval = 100 << 20
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if (p.n+int64(n))/progressInterval > p.n/progressInterval {
+		if p.total > 0 {
+			log.Printf("Downloaded %d of %d MB of %s", (p.n+int64(n))>>20, p.total>>20, p.name)
+		} else {
+			log.Printf("Downloaded %d MB of %s", (p.n+int64(n))>>20, p.name)
+		}
+	}
+	p.n += int64(n)
+	return n, err
+}
+
+// extractZip extracts the zip archive at path into dir, dropping the
+// first strip elements of each path in the archive. Files that are
+// already present with the same size are skipped.
+func extractZip(path, dir string, strip int) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", path)
+	}
+	defer r.Close()
+	root := filepath.Clean(dir) + string(os.PathSeparator)
+	var extracted, present int
+	for _, zf := range r.File {
+		parts := strings.Split(strings.Trim(zf.Name, "/"), "/")
+		if len(parts) <= strip {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(strings.Join(parts[strip:], "/")))
+		if !strings.HasPrefix(target, root) {
+			return fmt.Errorf("%s: %s is outside of the extraction directory", path, zf.Name)
+		}
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi, err := os.Stat(target); err == nil && fi.Size() == int64(zf.UncompressedSize64) {
+			present++
+			continue
+		}
+		if err := extractZipFile(zf, target); err != nil {
+			return errors.Wrapf(err, "extracting %s from %s", zf.Name, path)
+		}
+		extracted++
+	}
+	log.Printf("Extracted %d files from %s into %s (%d already present)", extracted, path, dir, present)
+	return nil
+}
+
+// extractZipFile writes zf to target.
+func extractZipFile(zf *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, zf.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fetchDataCommand downloads the input datasets listed in a manifest.
+func fetchDataCommand(args []string) error {
+	fs := flag.NewFlagSet("fetch-data", flag.ExitOnError)
+	manifest := fs.String("manifest", datasetsFile(), "dataset manifest")
+	force := fs.Bool("force", false, "download datasets again even if they are present")
+	var only stringList
+	fs.Var(&only, "only", "fetch only the named dataset (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s fetch-data [-manifest datasets.toml] [-force] [-only name]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errorf(kindUsage, "fetch-data takes no arguments")
+	}
+	datasets, err := loadDatasets(*manifest)
+	if err != nil {
+		return withKind(kindConfig, errors.Wrap(err, "error loading dataset manifest"))
+	}
+	known := make(map[string]bool)
+	for _, d := range datasets {
+		known[d.Name] = true
+	}
+	for _, name := range only {
+		if !known[name] {
+			return errorf(kindUsage, "unknown dataset %q", name)
+		}
+	}
+
+	ctx := context.Background()
+	client := &http.Client{}
+	var failed int
+	for _, d := range datasets {
+		if len(only) > 0 && !only.contains(d.Name) {
+			continue
+		}
+		if err := fetchDataset(ctx, client, d, *force); err != nil {
+			log.Printf("Dataset %s failed: %v", d.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d datasets could not be fetched; interrupted downloads resume when fetch-data is run again", failed)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// flightService serves the matrices of an arrowMatrices over Arrow
+// Flight. ListFlights lists the matrices, each with a single endpoint
+// whose ticket is the matrix's name (e.g. "emissions/PM25"), and DoGet
+// streams the matrix a ticket names as the same record batches as the
+// HTTP stream, sharing its calculations and cache.
+type flightService struct {
+	a    *arrowMatrices
+	keys *apiKeys
+}
+
+// startFlight serves the matrices of a over Arrow Flight on addr. If keys
+// isn't nil, only calls carrying one of them are served.
+func startFlight(addr string, a *arrowMatrices, keys *apiKeys) (flight.Server, error) {
+	srv := flight.NewFlightServer(nil)
+	if err := srv.Init(addr); err != nil {
+		return nil, errors.Wrapf(err, "listening for Arrow Flight on %s", addr)
+	}
+	f := &flightService{a: a, keys: keys}
+	srv.RegisterFlightService(&flight.FlightServiceService{
+		ListFlights: f.listFlights,
+		DoGet:       f.doGet,
+	})
+	go func() {
+		if err := srv.Serve(); err != nil {
+			log.Printf("Arrow Flight server: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// stopFlight stops srv accepting calls and waits up to drain for those in
+// progress to finish.
+func stopFlight(srv flight.Server, drain time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drain):
+		log.Printf("Arrow Flight calls still in progress after %s; abandoning them", drain)
+	}
+}
+
+// authorize checks the API key sent with a call, as "authorization:
+// Bearer KEY" or "x-api-key" metadata, as apiKeys.wrap does for HTTP
+// requests. All Flight calls only read, so keys of any role may make
+// them. It returns nil if the server doesn't use API keys.
+func (f *flightService) authorize(ctx context.Context) (*apiKey, error) {
+	if f.keys == nil {
+		return nil, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		key = strings.TrimSpace(strings.TrimPrefix(v[0], "Bearer "))
+	} else if v := md.Get("x-api-key"); len(v) > 0 {
+		key = v[0]
+	}
+	k, ok := f.keys.byHash[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, grpcstatus.Error(codes.Unauthenticated, "missing or unknown API key")
+	}
+	if wait := k.allow(time.Now()); wait > 0 {
+		return nil, grpcstatus.Errorf(codes.ResourceExhausted, "rate limit of %d requests per minute exceeded; retry in %s", k.cfg.RequestsPerMinute, wait.Round(time.Second))
+	}
+	if used, over := k.overQuota(time.Now()); over {
+		return nil, grpcstatus.Errorf(codes.ResourceExhausted, "daily compute quota of %g minutes is used up (%.3g minutes today); try again tomorrow (UTC)", k.cfg.ComputeMinutesPerDay, used)
+	}
+	return k, nil
+}
+
+// listFlights sends the FlightInfo of each matrix. The sizes of matrices
+// aren't known until they are calculated, so they are given as -1.
+func (f *flightService) listFlights(_ *flight.Criteria, stream flight.FlightService_ListFlightsServer) error {
+	if _, err := f.authorize(stream.Context()); err != nil {
+		return err
+	}
+	// The schema only depends on the SCCs of the EIEIO server, which
+	// don't change, so it doesn't need to wait for a worker of the pool.
+	schema := ipc.FlightInfoSchemaBytes(f.a.schema(f.a.pool.s), memory.DefaultAllocator)
+	for _, name := range f.a.names() {
+		err := stream.Send(&flight.FlightInfo{
+			Schema:           schema,
+			FlightDescriptor: &flight.FlightDescriptor{Type: flight.FlightDescriptor_PATH, Path: strings.Split(name, "/")},
+			Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: []byte(name)}}},
+			TotalRecords:     -1,
+			TotalBytes:       -1,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doGet streams the matrix named by t.
+func (f *flightService) doGet(t *flight.Ticket, stream flight.FlightService_DoGetServer) error {
+	k, err := f.authorize(stream.Context())
+	if err != nil {
+		return err
+	}
+	if k != nil {
+		start := time.Now()
+		defer func() { k.charge(start, time.Now()) }()
+	}
+	name := path.Clean(string(t.Ticket))
+	ctx, span := startSpan(stream.Context(), "flight", attribute.String("matrix", name))
+	defer span.End()
+	resp := f.a.stream(ctx, name)
+	if resp.err == errServerBusy {
+		return grpcstatus.Error(codes.Unavailable, resp.err.Error())
+	}
+	if resp.err != nil {
+		span.RecordError(resp.err)
+		return grpcstatus.Error(codes.InvalidArgument, resp.err.Error())
+	}
+	r, err := ipc.NewReader(bytes.NewReader(resp.body))
+	if err != nil {
+		return grpcstatus.Errorf(codes.Internal, "reading the cached stream of %s: %v", name, err)
+	}
+	defer r.Release()
+	log.Printf("Arrow Flight: sending %s", name)
+	w := ipc.NewFlightDataWriter(stream, ipc.WithSchema(r.Schema()))
+	for r.Next() {
+		if err := w.Write(r.Record()); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return grpcstatus.Errorf(codes.Internal, "reading the cached stream of %s: %v", name, err)
+	}
+	return w.Close()
+}
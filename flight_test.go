@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"gonum.org/v1/gonum/mat"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+// TestFlightDoGet checks that DoGet streams a matrix as the record
+// batches of its cached HTTP stream, and that calls must carry an API
+// key when the server has them.
+func TestFlightDoGet(t *testing.T) {
+	a := &arrowMatrices{cache: newResponseCache(1<<20, time.Hour), year: 2015, aqm: "isrm"}
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "a", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "b", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(schema))
+	m := mat.NewDense(3, 2, []float64{1, 2, 3, 4, 5, 6})
+	for _, rows := range [][2]int{{0, 2}, {2, 3}} {
+		rec := a.record(schema, m.Slice(rows[0], rows[1], 0, 2))
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+		rec.Release()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Cache the stream, so that it isn't calculated.
+	a.cache.get(a.cacheKey("emissions/PM25"), func() ([]byte, error) { return buf.Bytes(), nil })
+
+	keys, err := newAPIKeys(map[string]apiKeyConfig{"alice": {Key: "secret", Role: roleViewer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := startFlight("localhost:0", a, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+	c, err := flight.NewFlightClient(srv.Addr().String(), nil, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ticket := &flight.Ticket{Ticket: []byte("emissions/PM25")}
+
+	stream, err := c.DoGet(context.Background(), ticket)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if grpcstatus.Code(err) != codes.Unauthenticated {
+		t.Errorf("without a key: got error %v, want Unauthenticated", err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	stream, err = c.DoGet(ctx, ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ipc.NewFlightDataReader(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+	if !r.Schema().Equal(schema) {
+		t.Errorf("got schema %v, want %v", r.Schema(), schema)
+	}
+	var got []float64
+	batches := 0
+	for r.Next() {
+		batches++
+		rec := r.Record()
+		for i := 0; i < int(rec.NumRows()); i++ {
+			for j := 0; j < int(rec.NumCols()); j++ {
+				got = append(got, rec.Column(j).(*array.Float64).Value(i))
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if batches != 2 || !floatsEqual(got, m.RawMatrix().Data) {
+		t.Errorf("got %d batches of %v, want 2 of %v", batches, got, m.RawMatrix().Data)
+	}
+}
+
+func floatsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -4,7 +4,20 @@ go 1.15
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/apache/arrow/go/arrow v0.0.0-20210105145422-88aaea5262db
+	github.com/charmbracelet/bubbletea v0.13.4
+	github.com/ctessum/cdf v0.0.0-20181201011353-edced208ea9d
+	github.com/ctessum/geom v0.2.10
 	github.com/evookelj/inmap v0.0.3-exp
+	github.com/jonas-p/go-shp v0.1.2-0.20190401125246-9fd306ae10a6
 	github.com/pkg/errors v0.9.1
+	github.com/tealeg/xlsx v1.0.3
+	go.etcd.io/bbolt v1.3.6
+	go.opentelemetry.io/otel v0.20.0
+	go.opentelemetry.io/otel/exporters/trace/jaeger v0.20.0
+	go.opentelemetry.io/otel/sdk v0.20.0
+	go.opentelemetry.io/otel/trace v0.20.0
 	gonum.org/v1/gonum v0.0.0-20191009222026-5d5638e6749a
+	google.golang.org/api v0.30.0 // indirect
+	google.golang.org/grpc v1.32.0
 )
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// gridID identifies an air quality model grid by its geometry, as given by
+// the EIEIO server, so that layers calculated on different grids can be
+// told apart even if they have the same number of cells.
+type gridID struct {
+	AQM   string
+	Cells int
+
+	// Hash is the hex SHA-256 hash of the bounds of every cell, in order.
+	Hash string
+}
+
+func (g gridID) String() string {
+	return fmt.Sprintf("%s:%s", g.AQM, g.Hash[:12])
+}
+
+var (
+	gridIDsMx sync.Mutex
+	gridIDs   = make(map[string]gridID)
+)
+
+// getGridID returns the gridID of the aqm grid. IDs are cached by aqm.
+func getGridID(s *eieio.Server, aqm string) (gridID, error) {
+	gridIDsMx.Lock()
+	defer gridIDsMx.Unlock()
+	if id, ok := gridIDs[aqm]; ok {
+		return id, nil
+	}
+	cells, err := s.SpatialEIO.CSTConfig.Geometry(aqm)
+	if err != nil {
+		return gridID{}, errors.Wrapf(err, "error getting %s grid geometry", aqm)
+	}
+	h := sha256.New()
+	var b [8]byte
+	for _, cell := range cells {
+		bounds := cell.Bounds()
+		for _, v := range []float64{bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y} {
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			h.Write(b[:])
+		}
+	}
+	id := gridID{AQM: aqm, Cells: len(cells), Hash: hex.EncodeToString(h.Sum(nil))}
+	gridIDs[aqm] = id
+	return id, nil
+}
+
+// checkGrid returns an error if layer, a value for each cell of n grid
+// cells, such as concentrations or a population, can't be on the aqm grid.
+func checkGrid(s *eieio.Server, aqm string, n int, layer string) error {
+	id, err := getGridID(s, aqm)
+	if err != nil {
+		return err
+	}
+	if n != id.Cells {
+		return errorf(kindNumeric, "%s has %d grid cells, but the %s grid (%s) has %d; are the SR file and census data for the same grid?", layer, n, aqm, id, id.Cells)
+	}
+	return nil
+}
+
+// gridHeader is the header of the grid cell table written by writeGrid.
+var gridHeader = []string{"Cell", "GridCell", "Lon", "Lat", "X", "Y", "Area", "MinX", "MinY", "MaxX", "MaxY"}
+
+// gridCells returns the geometry of the cells of the aqm grid, the model
+// grid index of each cell that gridded results are indexed by (the
+// subdomain cells, if one is configured), and a transform from the grid's
+// spatial reference to longitude and latitude.
+func gridCells(s *eieio.Server, aqm string) ([]geom.Polygonal, []int, proj.Transformer, error) {
+	cells, err := s.SpatialEIO.CSTConfig.Geometry(aqm)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "error getting grid geometry")
+	}
+	gridSR, err := proj.Parse(s.SpatialEIO.CSTConfig.SpatialConfig.OutputSR)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "parsing grid spatial reference")
+	}
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ct, err := gridSR.NewTransform(lonLat)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d, err := getSubdomain(s, aqm)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	index := make([]int, len(cells))
+	for i := range index {
+		index[i] = i
+	}
+	if d != nil {
+		index = d.Cells
+	}
+	for _, c := range index {
+		if c >= len(cells) {
+			return nil, nil, nil, errorf(kindNumeric, "subdomain cell %d is outside of the %d cell grid", c, len(cells))
+		}
+	}
+	return cells, index, ct, nil
+}
+
+// gridRows returns a row for each cell that gridded results are indexed
+// by, giving its index in gridded results (Cell) and in the model grid
+// (GridCell), its centroid as longitude and latitude and in the grid's
+// spatial reference, its area, and its bounding box in the grid's spatial
+// reference.
+func gridRows(s *eieio.Server, aqm string) ([][]string, error) {
+	cells, index, ct, err := gridCells(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	rows := make([][]string, len(index))
+	for i, c := range index {
+		cell := cells[c]
+		centroid := cell.Centroid()
+		lon, lat, err := ct(centroid.X, centroid.Y)
+		if err != nil {
+			return nil, errors.Wrapf(err, "projecting the centroid of grid cell %d", c)
+		}
+		b := cell.Bounds()
+		rows[i] = []string{strconv.Itoa(i), strconv.Itoa(c), f(lon), f(lat), f(centroid.X), f(centroid.Y),
+			f(cell.Area()), f(b.Min.X), f(b.Min.Y), f(b.Max.X), f(b.Max.Y)}
+	}
+	return rows, nil
+}
+
+// writeGrid writes the grid cell table of gridRows to path.
+func writeGrid(s *eieio.Server, aqm, path string) (int, error) {
+	rows, err := gridRows(s, aqm)
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), writeCSV(path, gridHeader, rows)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/evookelj/inmap/epi"
+)
+
+// hrIntervalConfig specifies the confidence interval of a hazard ratio
+// function as multipliers of its coefficient (Beta of a Cox model, Gamma of
+// a Nasari model), e.g. Low = ln(1.04)/ln(1.06) for a hazard ratio of 1.06
+// (1.04–1.08) per 10 μg/m³.
+type hrIntervalConfig struct {
+	Low, High float64
+}
+
+// hrIntervals holds the names of the registered lower and upper bound
+// hazard ratio functions by central function name; set by registerHRIntervals.
+var hrIntervals = make(map[string][2]string)
+
+// scaleHR returns hr with its coefficient multiplied by f, named label.
+func scaleHR(hr epi.HRer, f float64, label string) (epi.HRer, error) {
+	switch h := hr.(type) {
+	case epi.Nasari:
+		h.Gamma *= f
+		h.Label = label
+		return h, nil
+	case epi.Cox:
+		h.Beta *= f
+		h.Label = label
+		return h, nil
+	}
+	return nil, errorf(kindConfig, "confidence intervals are not supported for hazard ratio function %s", hr.Name())
+}
+
+// registerHRIntervals adds the bounds of the confidence intervals in cfg,
+// keyed by hazard ratio function name, to hazardRatios as functions named
+// with a "Low" or "High" suffix, e.g. "NasariACSLow".
+func registerHRIntervals(cfg map[string]hrIntervalConfig) error {
+	for name, ci := range cfg {
+		if _, ok := hrIntervals[name]; ok {
+			continue
+		}
+		if ci.Low <= 0 || ci.Low > 1 || ci.High < 1 {
+			return errorf(kindConfig, "invalid confidence interval for hazard ratio function %s: Low must be in (0, 1] and High at least 1, got %g and %g", name, ci.Low, ci.High)
+		}
+		hr, err := hazardRatio(name)
+		if err != nil {
+			return err
+		}
+		low, err := scaleHR(hr, ci.Low, name+"Low")
+		if err != nil {
+			return err
+		}
+		high, err := scaleHR(hr, ci.High, name+"High")
+		if err != nil {
+			return err
+		}
+		hazardRatios = append(hazardRatios, low, high)
+		hrIntervals[name] = [2]string{low.Name(), high.Name()}
+	}
+	return nil
+}
+
+// intervalHeader returns the names of the columns holding a value calculated
+// with hr: col, followed by col+"Low" and col+"High" if hr has a confidence
+// interval.
+func intervalHeader(hr string, cols ...string) []string {
+	var header []string
+	for _, col := range cols {
+		header = append(header, col)
+		if _, ok := hrIntervals[hr]; ok {
+			header = append(header, col+"Low", col+"High")
+		}
+	}
+	return header
+}
+
+// totalHealthInterval returns the total attributable deaths of pop caused by
+// demand calculated with hr and, if hr has a confidence interval, with its
+// lower and upper bounds, in the order of intervalHeader.
+func totalHealthInterval(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, pol eieiorpc.Pollutant, pop string, year int32, hr, aqm string) ([]float64, error) {
+	hrs := []string{hr}
+	if bounds, ok := hrIntervals[hr]; ok {
+		hrs = append(hrs, bounds[0], bounds[1])
+	}
+	deaths := make([]float64, len(hrs))
+	for i, h := range hrs {
+		var err error
+		if deaths[i], err = totalHealth(ctx, s, demand, pol, pop, year, h, aqm); err != nil {
+			return nil, err
+		}
+	}
+	return deaths, nil
+}
+
+// formatFloats formats each of vs with formatFloat, after multiplying by
+// scale.
+func formatFloats(vs []float64, scale float64) []string {
+	out := make([]string, len(vs))
+	for i, v := range vs {
+		out[i] = formatFloat(v * scale)
+	}
+	return out
+}
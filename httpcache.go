@@ -0,0 +1,210 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCache keeps the bodies of server responses in memory, keyed by
+// normalized request parameters, so that repeated requests, such as from a
+// dashboard, don't recalculate results. Concurrent requests for the same
+// key wait for a single calculation. The least recently used responses are
+// evicted once the cache holds more than maxBytes; errors are not cached.
+type responseCache struct {
+	maxBytes int
+	maxAge   time.Duration
+
+	mx      sync.Mutex
+	entries map[string]*cachedResponse
+	lru     *list.List // keys of cached responses, most recently used first
+	size    int
+}
+
+type cachedResponse struct {
+	ready chan struct{} // closed when body, etag and err are set
+	body  []byte
+	etag  string
+	err   error
+	elem  *list.Element
+}
+
+// newResponseCache returns a cache of up to maxBytes of responses, which
+// clients are told they can reuse for maxAge.
+func newResponseCache(maxBytes int, maxAge time.Duration) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		entries:  make(map[string]*cachedResponse),
+		lru:      list.New(),
+	}
+}
+
+// get returns the response for key, calculating it with f if it is not
+// cached or being calculated.
+func (c *responseCache) get(key string, f func() ([]byte, error)) *cachedResponse {
+	c.mx.Lock()
+	if e, ok := c.entries[key]; ok {
+		if e.elem != nil {
+			c.lru.MoveToFront(e.elem)
+		}
+		c.mx.Unlock()
+		<-e.ready
+		return e
+	}
+	e := &cachedResponse{ready: make(chan struct{})}
+	c.entries[key] = e
+	c.mx.Unlock()
+
+	e.body, e.err = f()
+	if e.err == nil {
+		sum := sha256.Sum256(e.body)
+		e.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+	close(e.ready)
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if e.err != nil || len(e.body) > c.maxBytes {
+		delete(c.entries, key)
+		return e
+	}
+	e.elem = c.lru.PushFront(key)
+	c.size += len(e.body)
+	c.evict()
+	return e
+}
+
+// evict removes the least recently used responses until the cache holds
+// at most maxBytes. c.mx must be held.
+func (c *responseCache) evict() {
+	for c.size > c.maxBytes {
+		oldest := c.lru.Back()
+		old := c.entries[oldest.Value.(string)]
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(string))
+		c.size -= len(old.body)
+	}
+}
+
+// setLimits sets the size of the cache and the max-age of its responses,
+// evicting responses if it shrinks.
+func (c *responseCache) setLimits(maxBytes int, maxAge time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.maxBytes, c.maxAge = maxBytes, maxAge
+	c.evict()
+}
+
+// serve writes e to w with caching headers, or responds 304 Not Modified if
+// the client already has it.
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, e *cachedResponse, contentType string) {
+	c.mx.Lock()
+	maxAge := c.maxAge
+	c.mx.Unlock()
+	w.Header().Set("ETag", e.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if t := strings.TrimSpace(tag); t == e.etag || t == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(e.body)))
+	w.Write(e.body)
+}
+
+// savedResponses is the index of the responses saved to a directory by
+// save, most recently used first.
+type savedResponses struct {
+	// Config is the configFingerprint of the server that calculated the
+	// responses; they are only loaded by a server with the same config.
+	Config    string
+	Responses []savedResponse
+}
+
+type savedResponse struct {
+	Key, File, ETag string
+}
+
+// cacheIndexFile is the name of the index of the responses saved by save.
+const cacheIndexFile = "index.json"
+
+// save writes the cached responses to dir, so that they can be loaded by
+// a restarted server, and returns how many were written.
+func (c *responseCache) save(dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	index := savedResponses{Config: configFingerprint}
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		key := e.Value.(string)
+		r := c.entries[key]
+		file := strings.Trim(r.etag, `"`) + ".bin"
+		if err := ioutil.WriteFile(filepath.Join(dir, file), r.body, 0644); err != nil {
+			return 0, err
+		}
+		index.Responses = append(index.Responses, savedResponse{Key: key, File: file, ETag: r.etag})
+	}
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(index.Responses), ioutil.WriteFile(filepath.Join(dir, cacheIndexFile), b, 0644)
+}
+
+// load adds the responses saved to dir by save, up to the size of the
+// cache, and returns how many were added. Responses saved by a server with
+// a different config are ignored, as is a missing index.
+func (c *responseCache) load(dir string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, cacheIndexFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var index savedResponses
+	if err := json.Unmarshal(b, &index); err != nil {
+		return 0, errors.Wrapf(err, "reading %s", cacheIndexFile)
+	}
+	if index.Config != configFingerprint {
+		log.Printf("Not loading the responses cached in %s, which were calculated with a different config", dir)
+		return 0, nil
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	var n int
+	for _, s := range index.Responses {
+		if _, ok := c.entries[s.Key]; ok {
+			continue
+		}
+		body, err := ioutil.ReadFile(filepath.Join(dir, s.File))
+		if err != nil {
+			return n, err
+		}
+		if c.size+len(body) > c.maxBytes {
+			break
+		}
+		r := &cachedResponse{ready: make(chan struct{}), body: body, etag: s.ETag}
+		close(r.ready)
+		r.elem = c.lru.PushBack(s.Key)
+		c.entries[s.Key] = r
+		c.size += len(body)
+		n++
+	}
+	return n, nil
+}
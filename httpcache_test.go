@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestResponseCacheGet checks that responses are calculated once, even
+// for concurrent requests, and that errors aren't cached.
+func TestResponseCacheGet(t *testing.T) {
+	c := newResponseCache(100, time.Hour)
+	var mx sync.Mutex
+	calls := 0
+	calc := func() ([]byte, error) {
+		mx.Lock()
+		calls++
+		mx.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return []byte("body"), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e := c.get("a", calc); string(e.body) != "body" || e.err != nil {
+				t.Errorf("got %q, %v, want body", e.body, e.err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("got %d calculations for concurrent requests, want 1", calls)
+	}
+
+	fail := errors.New("failed")
+	if e := c.get("b", func() ([]byte, error) { return nil, fail }); e.err != fail {
+		t.Errorf("got error %v, want %v", e.err, fail)
+	}
+	if e := c.get("b", func() ([]byte, error) { return []byte("ok"), nil }); e.err != nil || string(e.body) != "ok" {
+		t.Errorf("after an error: got %q, %v, want the error not to be cached", e.body, e.err)
+	}
+}
+
+// TestResponseCacheEvict checks that the least recently used responses
+// are evicted once the cache is over its size, and that responses larger
+// than the cache aren't kept.
+func TestResponseCacheEvict(t *testing.T) {
+	c := newResponseCache(10, time.Hour)
+	body := func(b string) func() ([]byte, error) {
+		return func() ([]byte, error) { return []byte(b), nil }
+	}
+	c.get("a", body("aaaa"))
+	c.get("b", body("bbbb"))
+	c.get("a", body("aaaa")) // a is now the most recently used
+	c.get("c", body("cccc"))
+	cached := func(key string) bool {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		_, ok := c.entries[key]
+		return ok
+	}
+	if !cached("a") || cached("b") || !cached("c") || c.size != 8 {
+		t.Errorf("got a %v, b %v, c %v and size %d, want a and c cached, 8 bytes", cached("a"), cached("b"), cached("c"), c.size)
+	}
+	if e := c.get("big", body("0123456789x")); string(e.body) != "0123456789x" || cached("big") {
+		t.Error("a response larger than the cache was kept")
+	}
+
+	c.setLimits(4, time.Hour)
+	if !cached("c") || cached("a") || c.size != 4 {
+		t.Errorf("after shrinking, got a %v, c %v and size %d, want only c cached", cached("a"), cached("c"), c.size)
+	}
+}
+
+func TestResponseCacheServe(t *testing.T) {
+	c := newResponseCache(100, 90*time.Second)
+	e := c.get("a", func() ([]byte, error) { return []byte("body"), nil })
+	other := c.get("b", func() ([]byte, error) { return []byte("other"), nil })
+	if e.etag == "" || e.etag == other.etag {
+		t.Fatalf("got ETags %s and %s, want distinct ETags", e.etag, other.etag)
+	}
+	for _, test := range []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{"", http.StatusOK},
+		{e.etag, http.StatusNotModified},
+		{other.etag, http.StatusOK},
+		{other.etag + ", " + e.etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/a", nil)
+		if test.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		c.serve(w, r, e, "text/plain")
+		if w.Code != test.want {
+			t.Errorf("If-None-Match %q: got %d, want %d", test.ifNoneMatch, w.Code, test.want)
+		}
+		if w.Header().Get("ETag") != e.etag || w.Header().Get("Cache-Control") != "max-age=90" {
+			t.Errorf("If-None-Match %q: got headers %v", test.ifNoneMatch, w.Header())
+		}
+		if test.want == http.StatusOK && (w.Body.String() != "body" || w.Header().Get("Content-Type") != "text/plain") {
+			t.Errorf("got body %q of type %s, want body", w.Body.String(), w.Header().Get("Content-Type"))
+		}
+	}
+}
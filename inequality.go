@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"example.com/m/v2/exposuremath"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+)
+
+// distributionHeader is the header of exposure_distribution.csv.
+var distributionHeader = []string{"Population", "Label", "People", "Mean", "StdDev", "P10", "P25", "P50", "P75", "P90", "P90P10Ratio"}
+
+// distributionRow returns d, the distribution of individual PM2.5
+// exposure (μg/m³) within pop, as a row of distributionHeader.
+func distributionRow(pop string, d exposuremath.Distribution) []string {
+	return []string{pop, labels.get(pop), formatFloat(d.People), formatFloat(d.Mean), formatFloat(d.StdDev),
+		formatFloat(d.P10), formatFloat(d.P25), formatFloat(d.P50), formatFloat(d.P75), formatFloat(d.P90), formatFloat(d.P90 / d.P10)}
+}
+
+// getExposureDistribution returns the distribution of the individual PM2.5
+// exposure of each census population caused by demand, to show the
+// inequality within each population that its mean hides. If receptors is
+// non-nil, only grid cells where it is true are included.
+func getExposureDistribution(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector, receptors []bool) (map[string]exposuremath.Distribution, error) {
+	ctx, span := startSpan(ctx, "getExposureDistribution")
+	defer span.End()
+	vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	g, err := getExposureGrids(ctx, s, aqm, vec.Data, receptors)
+	if err != nil {
+		return nil, err
+	}
+	var away float64
+	if len(timeActivity.HomeFraction) > 0 {
+		if err := timeActivity.checkPopulations(g.popNames); err != nil {
+			return nil, err
+		}
+		away = awayConcentration(g.conc, g.receptors, g.popNames, g.pops, s.CSTConfig.CensusTotalPopColumn)
+	}
+
+	byPop := make(map[string]exposuremath.Distribution, len(g.popNames))
+	for _, pop := range g.popNames {
+		var values []exposuremath.WeightedValue
+		for i, c := range g.conc {
+			if (g.receptors != nil && !g.receptors[i]) || g.pops[pop][i] <= 0 {
+				continue
+			}
+			// The exposure of one person living in the cell.
+			values = append(values, exposuremath.WeightedValue{V: timeActivity.adjust(pop, c, 1, away), W: g.pops[pop][i]})
+		}
+		d := exposuremath.NewDistribution(values)
+		if g.restricted && suppression.MinPopulation > 0 && suppression.count(d.People) != d.People {
+			d = exposuremath.Unknown(suppression.count(d.People))
+		}
+		byPop[pop] = d
+	}
+	return byPop, nil
+}
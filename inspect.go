@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// enumNames returns the names of the values of an eieiorpc enum, in value
+// order.
+func enumNames(names map[int32]string) []string {
+	n := make([]string, len(names))
+	for v, name := range names {
+		n[v] = name
+	}
+	return n
+}
+
+// inspectCommand prints the valid values of the inputs to the analyses:
+// years, demographics, census populations, sector counts, air quality
+// models and the analysis profiles in the config.
+func inspectCommand(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	sectors := fs.Bool("sectors", false, "also list every commodity, industry and SCC")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s inspect [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	s, sandbox, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	ctx := context.Background()
+	years, err := s.Years(ctx, nil)
+	if err != nil {
+		return err
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return err
+	}
+	industries, err := s.Industries(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	yearNames := make([]string, len(years.Years))
+	for i, y := range years.Years {
+		yearNames[i] = fmt.Sprint(y)
+	}
+	fmt.Fprintf(w, "Years:\t%s\n", strings.Join(yearNames, ", "))
+	fmt.Fprintf(w, "CES income deciles:\t2014, 2015 only\n")
+	fmt.Fprintf(w, "Final demand types:\t%s\n", strings.Join(enumNames(eieiorpc.FinalDemandType_name), ", "))
+	fmt.Fprintf(w, "Emissions:\t%s\n", strings.Join(enumNames(eieiorpc.Emission_name), ", "))
+	fmt.Fprintf(w, "Pollutants:\t%s\n", strings.Join(enumNames(eieiorpc.Pollutant_name), ", "))
+
+	var aqms []string
+	for aqm := range s.CSTConfig.SRFiles {
+		aqms = append(aqms, aqm)
+	}
+	sort.Strings(aqms)
+	fmt.Fprintf(w, "Air quality models:\t%s\n", strings.Join(aqms, ", "))
+	fmt.Fprintf(w, "Commodities:\t%d\n", len(commodities.List))
+	fmt.Fprintf(w, "Industries:\t%d\n", len(industries.List))
+	fmt.Fprintf(w, "SCCs:\t%d\n", len(s.SCCs))
+
+	fmt.Fprintf(w, "\nDemographics (groups: ethnicity, decile):\n")
+	for _, dem := range append(ethnicityDemographs(), decileDemographs()...) {
+		fmt.Fprintf(w, "  %s\t%s\n", demographKey(dem), labels.demograph(dem))
+	}
+	fmt.Fprintf(w, "\nCensus populations:\n")
+	for _, pop := range s.CSTConfig.CensusPopColumns {
+		fmt.Fprintf(w, "  %s\t%s\n", pop, labels.get(pop))
+	}
+	if len(sandbox.Profiles) > 0 {
+		fmt.Fprintf(w, "\nProfiles (batch -profile):\n")
+		for _, name := range profileNames(sandbox.Profiles) {
+			fmt.Fprintf(w, "  %s\t%s\n", name, sandbox.Profiles[name].Description)
+		}
+	}
+	if *sectors {
+		printList(w, "Commodities", commodities.List)
+		printList(w, "Industries", industries.List)
+		sccs := make([]string, len(s.SCCs))
+		for i, scc := range s.SCCs {
+			sccs[i] = string(scc)
+		}
+		printList(w, "SCCs", sccs)
+	}
+	return w.Flush()
+}
+
+// printList prints a titled, numbered list.
+func printList(w io.Writer, title string, items []string) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for i, item := range items {
+		fmt.Fprintf(w, "  %d\t%s\n", i, item)
+	}
+}
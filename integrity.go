@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// runManifestFile is the name of the run manifest written to the output
+// directory of a batch or merge.
+const runManifestFile = "run_manifest.json"
+
+// unhashedFiles are the files of an output directory that are state
+// rather than results, and so change without the results changing.
+var unhashedFiles = map[string]bool{
+	runManifestFile:   true,
+	"jobs.db":         true,
+	"demographics.db": true,
+}
+
+// runManifest records the output files of a run with their SHA-256
+// checksums, so that they can be checked for changes with `verify`.
+type runManifest struct {
+	// Source is the manifest, profile or shards the outputs came from.
+	Source  string
+	Written time.Time
+	Files   []artifact
+}
+
+// artifact is an output file, with its path relative to the output
+// directory.
+type artifact struct {
+	Path   string
+	Bytes  int64
+	SHA256 string
+}
+
+// hashOutputs returns the output files in dir, sorted by path, with their
+// checksums.
+func hashOutputs(dir string) ([]artifact, error) {
+	var files []artifact
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if unhashedFiles[filepath.Base(rel)] {
+			return nil
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, artifact{Path: filepath.ToSlash(rel), Bytes: info.Size(), SHA256: sum})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+// writeRunManifest writes the run manifest of the outputs in dir, which
+// came from source.
+func writeRunManifest(dir, source string) error {
+	files, err := hashOutputs(dir)
+	if err != nil {
+		return errors.Wrap(err, "error hashing outputs")
+	}
+	b, err := json.MarshalIndent(runManifest{Source: source, Written: time.Now(), Files: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, runManifestFile), append(b, '\n'), 0644)
+}
+
+// verifyCommand re-hashes the outputs in a directory and checks them
+// against its run manifest, listing files that changed, are missing or
+// were added.
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s verify OutputDir\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "verify requires exactly one output directory")
+	}
+	dir := fs.Arg(0)
+	b, err := ioutil.ReadFile(filepath.Join(dir, runManifestFile))
+	if err != nil {
+		return err
+	}
+	var m runManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return errors.Wrapf(err, "reading %s", runManifestFile)
+	}
+	files, err := hashOutputs(dir)
+	if err != nil {
+		return errors.Wrap(err, "error hashing outputs")
+	}
+	current := make(map[string]artifact, len(files))
+	for _, f := range files {
+		current[f.Path] = f
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "File\tStatus\n")
+	var bad int
+	for _, f := range m.Files {
+		c, ok := current[f.Path]
+		delete(current, f.Path)
+		switch {
+		case !ok:
+			fmt.Fprintf(w, "%s\tmissing\n", f.Path)
+			bad++
+		case c.SHA256 != f.SHA256:
+			fmt.Fprintf(w, "%s\tchanged\n", f.Path)
+			bad++
+		}
+	}
+	for _, f := range files {
+		if _, ok := current[f.Path]; ok {
+			fmt.Fprintf(w, "%s\tnot in manifest\n", f.Path)
+			bad++
+		}
+	}
+	fmt.Fprintf(w, "\n%d files recorded %s from %s; %d changed, missing or added\n", len(m.Files), m.Written.Format(time.RFC3339), m.Source, bad)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if bad > 0 {
+		return errorf(kindNumeric, "%d of the outputs in %s don't match its run manifest", bad, dir)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/evookelj/inmap/sr"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// inventoryConfig specifies an emissions inventory, such as one derived
+// from the EPA NEI, to use in place of EIO-derived emissions.
+type inventoryConfig struct {
+	// File is the path to a CSV file with header
+	// SCC,Longitude,Latitude,Pollutant,Amount. Pollutant is an NEI
+	// pollutant code (e.g. "PM25-PRI", "NOX", "SO2") or Emission name.
+	File string
+
+	// SR is the Proj4 spatial reference of the coordinates in File.
+	// Defaults to "+proj=longlat".
+	SR string
+
+	// Units of Amount: "kg/year" (the default) or "tons/year" (short
+	// tons, as used by the NEI).
+	Units string
+}
+
+// inventorySetting is the Inventory setting in the [Sandbox] config table.
+var inventorySetting inventoryConfig
+
+// inventoryExposureHeader is the header of inventory_exposure.csv.
+var inventoryExposureHeader = []string{"Population", "Label", "Exposure", "EIOExposure"}
+
+// inventoryExposureRows returns a row of inventoryExposureHeader for each
+// census population: its exposure caused by the emissions of the
+// inventory in inventorySetting, regridded to the aqm grid, and eio, its
+// exposure caused by EIO-derived emissions.
+func inventoryExposureRows(ctx context.Context, s *eieio.Server, aqm string, eio map[string]float64) ([][]string, error) {
+	inv, err := loadInventory(s, inventorySetting, aqm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading emissions inventory")
+	}
+	conc, err := inv.concentrations(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	exposure, err := populationExposure(ctx, s, aqm, conc, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, pop := range sortedKeys(*exposure) {
+		rows = append(rows, []string{pop, labels.get(pop), formatFloat((*exposure)[pop]), formatFloat(eio[pop])})
+	}
+	return rows, nil
+}
+
+// shortTonsToKg converts short tons to kg.
+const shortTonsToKg = 907.18474
+
+// neiPollutants maps NEI pollutant codes to EIEIO emissions.
+var neiPollutants = map[string]eieiorpc.Emission{
+	"PM25-PRI": eieiorpc.Emission_PM25,
+	"PM2_5":    eieiorpc.Emission_PM25,
+	"PM25":     eieiorpc.Emission_PM25,
+	"NH3":      eieiorpc.Emission_NH3,
+	"NOX":      eieiorpc.Emission_NOx,
+	"SO2":      eieiorpc.Emission_SOx,
+	"SOX":      eieiorpc.Emission_SOx,
+	"VOC":      eieiorpc.Emission_VOC,
+}
+
+// inventory holds emissions read from an inventory file, in kg/year.
+type inventory struct {
+	// Gridded holds emissions by pollutant and AQM grid cell.
+	Gridded map[eieiorpc.Emission][]float64
+
+	// BySCC holds total emissions by pollutant and SCC.
+	BySCC map[eieiorpc.Emission]map[string]float64
+
+	// Outside is the total emissions by pollutant from records outside
+	// the AQM grid.
+	Outside map[eieiorpc.Emission]float64
+}
+
+// loadInventory reads the inventory specified by cfg and regrids it to the
+// aqm grid. Records with pollutants other than those in neiPollutants are
+// ignored.
+func loadInventory(s *eieio.Server, cfg inventoryConfig, aqm string) (*inventory, error) {
+	var scale float64
+	switch strings.ToLower(cfg.Units) {
+	case "", "kg/year":
+		scale = 1
+	case "tons/year":
+		scale = shortTonsToKg
+	default:
+		return nil, fmt.Errorf("invalid inventory units %q", cfg.Units)
+	}
+
+	cells, err := s.SpatialEIO.CSTConfig.Geometry(aqm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting grid geometry")
+	}
+	srString := cfg.SR
+	if srString == "" {
+		srString = "+proj=longlat"
+	}
+	src, err := proj.Parse(srString)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := proj.Parse(s.SpatialEIO.CSTConfig.SpatialConfig.OutputSR)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing grid spatial reference")
+	}
+	ct, err := src.NewTransform(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 5
+	if _, err := r.Read(); err != nil { // header
+		return nil, errors.Wrap(err, "reading inventory header")
+	}
+
+	inv := &inventory{
+		Gridded: make(map[eieiorpc.Emission][]float64),
+		BySCC:   make(map[eieiorpc.Emission]map[string]float64),
+		Outside: make(map[eieiorpc.Emission]float64),
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pol, ok := neiPollutants[strings.ToUpper(strings.TrimSpace(rec[3]))]
+		if !ok {
+			continue
+		}
+		var vals [3]float64
+		for i, col := range []int{1, 2, 4} {
+			if vals[i], err = strconv.ParseFloat(strings.TrimSpace(rec[col]), 64); err != nil {
+				return nil, fmt.Errorf("invalid inventory record %v: %v", rec, err)
+			}
+		}
+		var p geom.Geom = geom.Point{X: vals[0], Y: vals[1]}
+		if ct != nil {
+			if p, err = p.Transform(ct); err != nil {
+				return nil, err
+			}
+		}
+		amount := vals[2] * scale
+		scc := strings.TrimSpace(rec[0])
+
+		if inv.Gridded[pol] == nil {
+			inv.Gridded[pol] = make([]float64, len(cells))
+			inv.BySCC[pol] = make(map[string]float64)
+		}
+		inv.BySCC[pol][scc] += amount
+		cell := -1
+		for i, c := range cells {
+			if p.(geom.Point).Within(c) != geom.Outside {
+				cell = i
+				break
+			}
+		}
+		if cell < 0 {
+			inv.Outside[pol] += amount
+			continue
+		}
+		inv.Gridded[pol][cell] += amount
+	}
+	return inv, nil
+}
+
+// concentrations returns the total PM2.5 concentration in each grid cell
+// caused by inv, calculated with the aqm SR matrix. All emissions are
+// treated as ground-level.
+func (inv *inventory) concentrations(s *eieio.Server, aqm string) ([]float64, error) {
+	f, err := os.Open(s.SpatialEIO.CSTConfig.SRFiles[aqm])
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening SR matrix")
+	}
+	defer f.Close()
+	srr, err := sr.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading SR matrix")
+	}
+
+	var conc []float64
+	for pol, emis := range inv.Gridded {
+		for source, e := range emis {
+			if e == 0 {
+				continue
+			}
+			receptorConc, err := srr.Source(srPollutants[pol], 0, source)
+			if err != nil {
+				return nil, err
+			}
+			if conc == nil {
+				conc = make([]float64, len(receptorConc))
+			}
+			for receptor, c := range receptorConc {
+				conc[receptor] += c * e * kgPerYearToUgPerS
+			}
+		}
+	}
+	if conc == nil {
+		return nil, fmt.Errorf("inventory has no emissions within the grid")
+	}
+	return conc, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"os"
+	"sort"
+)
+
+// emissionsComparison compares EIO-derived and inventory emissions of one
+// pollutant from one SCC, in kg/year.
+type emissionsComparison struct {
+	SCC       string
+	Emission  eieiorpc.Emission
+	EIO       float64
+	Inventory float64
+}
+
+// relativeDifference returns (EIO - Inventory) / max(EIO, Inventory), which
+// ranges from -1 (only in the inventory) to 1 (only in the EIO model).
+func (c emissionsComparison) relativeDifference() float64 {
+	m := math.Max(c.EIO, c.Inventory)
+	if m == 0 {
+		return 0
+	}
+	return (c.EIO - c.Inventory) / m
+}
+
+// compareEmissions compares EIO emissions by SCC, eio, with inventory
+// emissions for each pollutant in inv, returning comparisons for each SCC
+// with emissions in either.
+func compareEmissions(sccs []string, eio map[eieiorpc.Emission][]float64, inv *inventory) []emissionsComparison {
+	var comparisons []emissionsComparison
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		pol := eieiorpc.Emission(val)
+		seen := make(map[string]bool)
+		for i, scc := range sccs {
+			c := emissionsComparison{SCC: scc, Emission: pol, Inventory: inv.BySCC[pol][scc]}
+			if eio[pol] != nil {
+				c.EIO = eio[pol][i]
+			}
+			seen[scc] = true
+			if c.EIO != 0 || c.Inventory != 0 {
+				comparisons = append(comparisons, c)
+			}
+		}
+		for scc, v := range inv.BySCC[pol] {
+			if !seen[scc] && v != 0 {
+				comparisons = append(comparisons, emissionsComparison{SCC: scc, Emission: pol, Inventory: v})
+			}
+		}
+	}
+	sort.Slice(comparisons, func(i, j int) bool {
+		if comparisons[i].Emission != comparisons[j].Emission {
+			return comparisons[i].Emission < comparisons[j].Emission
+		}
+		return comparisons[i].SCC < comparisons[j].SCC
+	})
+	return comparisons
+}
+
+// inventoryReportCommand writes a report comparing EIO-derived emissions by
+// SCC with those in the inventory configured in [Sandbox.Inventory].
+func inventoryReportCommand(args []string) error {
+	fs := flag.NewFlagSet("inventory-report", flag.ExitOnError)
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	threshold := fs.Float64("threshold", 0.5, "flag sectors whose relative difference exceeds this magnitude")
+	minEmissions := fs.Float64("min", 1000, "only flag sectors with at least this many kg/year in either source")
+	out := fs.String("o", "emissions_comparison.csv", "output CSV file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s inventory-report [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	s, sandbox, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	if sandbox.Inventory.File == "" {
+		return fmt.Errorf("no emissions inventory is configured in [Sandbox.Inventory]")
+	}
+	inv, err := loadInventory(s, sandbox.Inventory, *aqm)
+	if err != nil {
+		return errors.Wrap(err, "error loading emissions inventory")
+	}
+
+	ctx := context.Background()
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            int32(*year),
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return errors.Wrap(err, "error getting final demand")
+	}
+	eio := make(map[eieiorpc.Emission][]float64)
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		pol := eieiorpc.Emission(val)
+		emis, err := getEmissionsBySCC(ctx, demand, s, pol, int32(*year), LOC, *aqm)
+		if err != nil {
+			return errors.Wrapf(err, "error calculating %s emissions by sector", pol)
+		}
+		eio[pol] = emis.RawVector().Data
+	}
+	sccs := make([]string, len(s.SCCs))
+	for i, scc := range s.SCCs {
+		sccs[i] = string(scc)
+	}
+
+	var rows [][]string
+	var flagged int
+	for _, c := range compareEmissions(sccs, eio, inv) {
+		rd := c.relativeDifference()
+		discrepant := math.Abs(rd) > *threshold && math.Max(c.EIO, c.Inventory) >= *minEmissions
+		if discrepant {
+			flagged++
+		}
+		rows = append(rows, []string{c.SCC, c.Emission.String(), formatFloat(c.EIO), formatFloat(c.Inventory),
+			formatFloat(c.EIO - c.Inventory), formatFloat(rd), fmt.Sprint(discrepant)})
+	}
+	if err := writeCSV(*out, []string{"SCC", "Emission", "EIO", "Inventory", "Difference", "RelativeDifference", "Flagged"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "emissions_comparison.csv"); err != nil {
+		return err
+	}
+	for pol, v := range inv.Outside {
+		log.Printf("%.4g kg/year of inventory %s emissions are outside the grid", v, pol)
+	}
+	log.Printf("Compared %d sector-pollutant pairs; %d flagged. Report written to %s", len(rows), flagged, *out)
+	return nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverJob is a scenario run asynchronously by a jobServer.
+type serverJob struct {
+	ID       string
+	Scenario string
+	Owner    string `json:",omitempty"` // the name of the API key that submitted the job
+	Status   jobStatus
+	Error    string `json:",omitempty"`
+	Created  time.Time
+	Started  *time.Time `json:",omitempty"`
+	Finished *time.Time `json:",omitempty"`
+
+	// Expires is when a finished job and its files are deleted.
+	Expires *time.Time `json:",omitempty"`
+
+	// Files are the result files of a finished job, with links to
+	// download them.
+	Files []jobFile `json:",omitempty"`
+
+	sc     scenario
+	key    *apiKey
+	dir    string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobFile is a result file of a serverJob.
+type jobFile struct {
+	Name string
+	Size int64
+	URL  string
+}
+
+// jobServer runs scenarios posted to /jobs in the background, so that
+// analyses too slow to answer within an HTTP request can be polled for and
+// their results downloaded when done. Finished jobs are deleted, with their
+// files, after ttl. Job state is kept in memory, so it doesn't survive a
+// restart. Jobs run through a serverPool, so that they share its
+// parallelism with the other requests of the server.
+type jobServer struct {
+	s         *eieio.Server
+	pool      *serverPool
+	scenarios []scenario
+	base      scenario
+
+	// origin, if set, is the origin that browsers may call the API from.
+	origin string
+
+	queue chan *serverJob
+
+	mx   sync.Mutex
+	dir  string
+	ttl  time.Duration
+	jobs map[string]*serverJob
+}
+
+// newJobServer returns a job server running scenarios in subdirectories of
+// dir through pool, with up to workers jobs running or waiting for a worker
+// of pool at a time. Posted scenarios start from the settings of base or
+// the named one of scenarios, those of a manifest.
+func newJobServer(pool *serverPool, scenarios []scenario, base scenario, dir string, ttl time.Duration, workers int) (*jobServer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	js := &jobServer{s: pool.s, pool: pool, scenarios: scenarios, base: base, dir: dir, ttl: ttl, queue: make(chan *serverJob, 1000), jobs: make(map[string]*serverJob)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range js.queue {
+				js.run(j)
+			}
+		}()
+	}
+	return js, nil
+}
+
+// configure sets the directory of jobs submitted from now on and the time
+// finished jobs are kept, creating dir.
+func (js *jobServer) configure(dir string, ttl time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	js.mx.Lock()
+	js.dir, js.ttl = dir, ttl
+	js.mx.Unlock()
+	return nil
+}
+
+// submit queues a job to run sc, charging its compute time to key, if
+// any.
+func (js *jobServer) submit(sc scenario, key *apiKey) (*serverJob, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &serverJob{ID: hex.EncodeToString(b), Scenario: sc.Name, Status: jobPending, Created: time.Now(), sc: sc, ctx: ctx, cancel: cancel}
+	if key != nil {
+		j.Owner, j.key = key.name, key
+	}
+	js.mx.Lock()
+	defer js.mx.Unlock()
+	j.dir = filepath.Join(js.dir, j.ID)
+	select {
+	case js.queue <- j:
+	default:
+		cancel()
+		return nil, fmt.Errorf("too many jobs queued; try again later")
+	}
+	js.jobs[j.ID] = j
+	go func() {
+		<-ctx.Done()
+		js.mx.Lock()
+		if j.Status == jobPending {
+			js.finish(j, ctx.Err())
+		}
+		js.mx.Unlock()
+	}()
+	return j, nil
+}
+
+// run runs j, unless it was cancelled while queued.
+func (js *jobServer) run(j *serverJob) {
+	js.mx.Lock()
+	if j.Status != jobPending {
+		js.mx.Unlock()
+		return
+	}
+	now := time.Now()
+	j.Status, j.Started = jobRunning, &now
+	js.mx.Unlock()
+
+	log.Printf("Running job %s (scenario %s)", j.ID, j.Scenario)
+	err := os.MkdirAll(j.dir, 0755)
+	if err == nil {
+		// The pool is given a context that isn't cancelled with the job,
+		// so that a cancelled job is only finished once runScenario has
+		// stopped writing to its directory.
+		err = js.pool.do(context.Background(), func(_ context.Context, s *eieio.Server) error {
+			ctx, span := startSpan(j.ctx, "job")
+			_, err := runScenario(ctx, s, j.sc, j.dir)
+			endSpan(span, err)
+			return err
+		})
+	}
+	if err == nil {
+		err = writeDataDictionaries(j.dir)
+	}
+	if err != nil {
+		log.Printf("Job %s failed: %v", j.ID, err)
+	} else {
+		log.Printf("Finished job %s", j.ID)
+	}
+	js.mx.Lock()
+	js.finish(j, err)
+	js.mx.Unlock()
+	if j.key != nil {
+		j.key.charge(*j.Started, *j.Finished)
+	}
+	j.cancel()
+}
+
+// finish records the outcome of j. js.mx must be held.
+func (js *jobServer) finish(j *serverJob, err error) {
+	now := time.Now()
+	expires := now.Add(js.ttl)
+	j.Finished, j.Expires = &now, &expires
+	j.Status = jobDone
+	if err != nil {
+		j.Status, j.Error = jobFailed, err.Error()
+	}
+}
+
+// prune deletes the jobs that have expired and their files.
+func (js *jobServer) prune() {
+	js.mx.Lock()
+	defer js.mx.Unlock()
+	now := time.Now()
+	for id, j := range js.jobs {
+		if j.Expires != nil && now.After(*j.Expires) {
+			if err := os.RemoveAll(j.dir); err != nil {
+				log.Printf("Error deleting expired job %s: %v", id, err)
+				continue
+			}
+			delete(js.jobs, id)
+		}
+	}
+}
+
+// close cancels the jobs that are queued or running, returning the IDs of
+// those that were running.
+func (js *jobServer) close() []string {
+	js.mx.Lock()
+	defer js.mx.Unlock()
+	var running []string
+	for id, j := range js.jobs {
+		if j.Status == jobRunning {
+			running = append(running, id)
+		}
+		j.cancel()
+	}
+	sort.Strings(running)
+	return running
+}
+
+// view returns a copy of j to report, with links to its files, if it is
+// done, relative to the server at base.
+func (js *jobServer) view(j *serverJob, base string) (serverJob, error) {
+	v := *j
+	if j.Status != jobDone {
+		return v, nil
+	}
+	err := filepath.Walk(j.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(j.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		v.Files = append(v.Files, jobFile{Name: rel, Size: info.Size(), URL: base + "/jobs/" + j.ID + "/files/" + rel})
+		return nil
+	})
+	return v, err
+}
+
+// ServeHTTP serves the job API:
+//
+//	POST /jobs                 queue a scenario; 202 Accepted with the job
+//	GET  /jobs                 list jobs, newest first (paginated)
+//	GET  /jobs/ID              a job's status and, once done, its files
+//	GET  /jobs/ID/files/NAME   download a result file of a finished job
+//	DELETE /jobs/ID            cancel a job or delete a finished one
+//
+// The body of a POST is a JSON object of scenario settings, as in a batch
+// manifest, applied over those of the served scenario or, with the
+// scenario query parameter, the named scenario of the manifest. With API
+// keys, a job can only be deleted with the key that submitted it or an
+// admin key. Posted settings can't name files on the server, and browsers
+// may only call the API from origin, if set.
+func (js *jobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if js.origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", js.origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	js.prune()
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/", 3)
+	switch {
+	case parts[0] == "" && r.Method == http.MethodPost:
+		js.servePost(w, r, base)
+	case parts[0] == "" && r.Method == http.MethodGet:
+		js.serveList(w, r, base)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		js.mx.Lock()
+		j, ok := js.jobs[parts[0]]
+		var v serverJob
+		var err error
+		if ok {
+			v, err = js.view(j, base)
+		}
+		js.mx.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("no job %q; it may have expired", parts[0]), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		js.mx.Lock()
+		j, ok := js.jobs[parts[0]]
+		if k := requestAPIKey(r.Context()); ok && k != nil && k.name != j.Owner && k.cfg.Role != roleAdmin {
+			js.mx.Unlock()
+			http.Error(w, fmt.Sprintf("job %s was submitted by another key", j.ID), http.StatusForbidden)
+			return
+		}
+		if ok && j.Finished != nil {
+			if err := os.RemoveAll(j.dir); err != nil {
+				js.mx.Unlock()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			delete(js.jobs, j.ID)
+		}
+		js.mx.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("no job %q; it may have expired", parts[0]), http.StatusNotFound)
+			return
+		}
+		// Cancelling a running job stops it at its next check of the
+		// context; it is then failed and expires as usual.
+		j.cancel()
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[1] == "files" && r.Method == http.MethodGet:
+		js.serveFile(w, r, parts[0], parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// servePost queues the scenario posted in r.
+func (js *jobServer) servePost(w http.ResponseWriter, r *http.Request, base string) {
+	sc := js.base
+	if name := r.URL.Query().Get("scenario"); name != "" {
+		found := false
+		for _, msc := range js.scenarios {
+			if msc.Name == name {
+				sc, found = msc, true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("no scenario %q in the manifest", name), http.StatusBadRequest)
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var posted scenario
+	if err := decodeScenario(body, &posted); err != nil {
+		http.Error(w, fmt.Sprintf("invalid scenario: %v", err), http.StatusBadRequest)
+		return
+	}
+	if files := scenarioFiles(posted); len(files) > 0 {
+		http.Error(w, fmt.Sprintf("posted scenarios can't name files on the server; remove %s", strings.Join(files, ", ")), http.StatusBadRequest)
+		return
+	}
+	if err := decodeScenario(body, &sc); err != nil {
+		http.Error(w, fmt.Sprintf("invalid scenario: %v", err), http.StatusBadRequest)
+		return
+	}
+	sc, err = scenarioFrom(sc).build("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := Year(sc.Year).validate(r.Context(), js.s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := js.submit(sc, requestAPIKey(r.Context()))
+	if err != nil {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Queued job %s (scenario %s)", j.ID, j.Scenario)
+	js.mx.Lock()
+	v := *j
+	js.mx.Unlock()
+	w.Header().Set("Location", base+"/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, v)
+}
+
+// decodeScenario decodes the JSON scenario settings in b over those of
+// sc. An empty b leaves sc unchanged.
+func decodeScenario(b []byte, sc *scenario) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(sc); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// scenarioFiles returns the settings of sc that name files, such as
+// DemandFile, that are set.
+func scenarioFiles(sc scenario) []string {
+	var set []string
+	for _, f := range []struct{ name, v string }{
+		{"DemandFile", sc.DemandFile},
+		{"EmploymentFile", sc.EmploymentFile},
+		{"Background.File", sc.Background.File},
+		{"EmissionFactors.File", sc.EmissionFactors.File},
+		{"Controls.File", sc.Controls.File},
+		{"Controls.States.File", sc.Controls.States.File},
+		{"Population.GridFile", sc.Population.GridFile},
+		{"Population.RegionFactorsFile", sc.Population.RegionFactorsFile},
+		{"Population.Regions.File", sc.Population.Regions.File},
+	} {
+		if f.v != "" {
+			set = append(set, f.name)
+		}
+	}
+	return set
+}
+
+// serveList lists the jobs, newest first, a page at a time.
+func (js *jobServer) serveList(w http.ResponseWriter, r *http.Request, base string) {
+	js.mx.Lock()
+	jobs := make([]serverJob, 0, len(js.jobs))
+	for _, j := range js.jobs {
+		jobs = append(jobs, *j)
+	}
+	js.mx.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.After(jobs[j].Created) })
+	lo, hi, err := paginate(w, r, len(jobs))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs[lo:hi])
+}
+
+// serveFile serves the named result file of the job id.
+func (js *jobServer) serveFile(w http.ResponseWriter, r *http.Request, id, name string) {
+	js.mx.Lock()
+	j, ok := js.jobs[id]
+	var status jobStatus
+	var dir string
+	if ok {
+		status, dir = j.Status, j.dir
+	}
+	js.mx.Unlock()
+	switch {
+	case !ok:
+		http.Error(w, fmt.Sprintf("no job %q; it may have expired", id), http.StatusNotFound)
+		return
+	case status != jobDone:
+		http.Error(w, fmt.Sprintf("job %s is %s; its files are available once it is done", id, status), http.StatusConflict)
+		return
+	}
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(dir, path); err != nil || strings.HasPrefix(rel, "..") {
+		http.NotFound(w, r)
+		return
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeFile(w, r, path)
+}
+
+// writeJSON writes v as the JSON response of a request, with status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestJobServerRejectsFiles checks that posted scenarios naming files on
+// the server are refused before they are queued.
+func TestJobServerRejectsFiles(t *testing.T) {
+	js := &jobServer{base: scenario{Name: "base", DemandFile: "demand.csv"}, jobs: make(map[string]*serverJob)}
+	for _, test := range []struct{ body, field string }{
+		{`{"DemandFile": "/etc/passwd"}`, "DemandFile"},
+		{`{"EmploymentFile": "jobs.csv"}`, "EmploymentFile"},
+		{`{"Background": {"File": "bg.csv"}}`, "Background.File"},
+		{`{"EmissionFactors": {"File": "ef.csv"}}`, "EmissionFactors.File"},
+		{`{"Controls": {"File": "controls.csv"}}`, "Controls.File"},
+		{`{"Controls": {"States": {"File": "states.geojson"}}}`, "Controls.States.File"},
+		{`{"Population": {"GridFile": "pop.csv"}}`, "Population.GridFile"},
+		{`{"Population": {"RegionFactorsFile": "factors.csv"}}`, "Population.RegionFactorsFile"},
+		{`{"Population": {"Regions": {"File": "regions.geojson"}}}`, "Population.Regions.File"},
+	} {
+		w := httptest.NewRecorder()
+		js.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(test.body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), test.field) {
+			t.Errorf("%s: got %d %q, want 400 naming %s", test.body, w.Code, w.Body.String(), test.field)
+		}
+		if len(js.jobs) != 0 {
+			t.Fatalf("%s: a job was queued", test.body)
+		}
+	}
+
+	// Only the posted settings are checked, not the manifest's.
+	if files := scenarioFiles(js.base); len(files) != 1 || files[0] != "DemandFile" {
+		t.Errorf("got files %v, want [DemandFile]", files)
+	}
+}
+
+func TestJobServerOrigin(t *testing.T) {
+	js := &jobServer{jobs: make(map[string]*serverJob)}
+	w := httptest.NewRecorder()
+	js.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+	if v := w.Header().Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("no origin: got Access-Control-Allow-Origin %q, want none", v)
+	}
+	js.origin = "https://maps.example.org"
+	w = httptest.NewRecorder()
+	js.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+	if v := w.Header().Get("Access-Control-Allow-Origin"); v != js.origin {
+		t.Errorf("got Access-Control-Allow-Origin %q, want %q", v, js.origin)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// jobSpecOptions are the settings of the jobs written by jobSpecCommand.
+type jobSpecOptions struct {
+	Format    string // "k8s" or "aws-batch"
+	Image     string // container image with the sandbox binary
+	Binary    string // path of the sandbox binary in the image
+	Manifest  string // path of the manifest in the container
+	CPU       string // CPUs requested per scenario
+	MemoryMiB int    // memory requested per scenario
+	OutputURL string // object store prefix, e.g. s3://bucket/runs
+	JobQueue  string // AWS Batch job queue
+	JobDef    string // AWS Batch job definition
+}
+
+// jobOutputDir is where jobs write their results in the container.
+const jobOutputDir = "/output"
+
+var (
+	jobNameRE   = regexp.MustCompile(`[^a-z0-9-]+`)
+	shellSafeRE = regexp.MustCompile(`^[A-Za-z0-9_./=:-]+$`)
+)
+
+// jobName returns a name for the job running the scenario named name that
+// is valid for Kubernetes and AWS Batch: lower case letters, digits and
+// hyphens, at most 63 characters.
+func jobName(name string) string {
+	n := strings.Trim(jobNameRE.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	n = "inmap-" + n
+	if len(n) > 63 {
+		n = strings.TrimRight(n[:63], "-")
+	}
+	return n
+}
+
+// script returns the shell command that runs scenario name and copies its
+// results to the object store, if any.
+func (o *jobSpecOptions) script(name string) string {
+	args := []string{o.Binary, "batch", "-scenario", shellQuote(name), "-output", jobOutputDir, shellQuote(o.Manifest)}
+	dir := path.Join(jobOutputDir, shellQuote(name))
+	script := strings.Join(args, " ")
+	if o.OutputURL != "" {
+		dest := strings.TrimRight(o.OutputURL, "/") + strings.TrimPrefix(dir, jobOutputDir)
+		switch {
+		case strings.HasPrefix(o.OutputURL, "s3://"):
+			script += " && aws s3 cp --recursive " + dir + " " + dest
+		case strings.HasPrefix(o.OutputURL, "gs://"):
+			script += " && gsutil -m cp -r " + dir + "/* " + dest + "/"
+		}
+	}
+	return script
+}
+
+// shellQuote quotes s for sh if it contains special characters.
+func shellQuote(s string) string {
+	if shellSafeRE.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// k8sJobs returns a Kubernetes List of a Job for each scenario.
+func k8sJobs(m *batchManifest, o *jobSpecOptions) interface{} {
+	var items []interface{}
+	for _, sc := range m.Scenario {
+		resources := map[string]string{"cpu": o.CPU, "memory": strconv.Itoa(o.MemoryMiB) + "Mi"}
+		items = append(items, map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "Job",
+			"metadata": map[string]interface{}{
+				"name":   jobName(sc.Name),
+				"labels": map[string]string{"app": "inmap-sandbox"},
+				"annotations": map[string]string{
+					"inmap-sandbox/scenario": sc.Name,
+					"inmap-sandbox/year":     strconv.Itoa(int(sc.Year)),
+					"inmap-sandbox/output":   o.OutputURL,
+				},
+			},
+			"spec": map[string]interface{}{
+				"backoffLimit": 2,
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"restartPolicy": "Never",
+						"containers": []interface{}{map[string]interface{}{
+							"name":    "sandbox",
+							"image":   o.Image,
+							"command": []string{"sh", "-c", o.script(sc.Name)},
+							"resources": map[string]interface{}{
+								"requests": resources,
+								"limits":   map[string]string{"memory": resources["memory"]},
+							},
+						}},
+					},
+				},
+			},
+		})
+	}
+	return map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items}
+}
+
+// awsBatchJobs returns the input of an AWS Batch SubmitJob request for
+// each scenario.
+func awsBatchJobs(m *batchManifest, o *jobSpecOptions) interface{} {
+	var jobs []interface{}
+	for _, sc := range m.Scenario {
+		job := map[string]interface{}{
+			"jobName":       jobName(sc.Name),
+			"jobQueue":      o.JobQueue,
+			"jobDefinition": o.JobDef,
+			"tags":          map[string]string{"scenario": sc.Name, "year": strconv.Itoa(int(sc.Year))},
+			"containerOverrides": map[string]interface{}{
+				"command": []string{"sh", "-c", o.script(sc.Name)},
+				"resourceRequirements": []map[string]string{
+					{"type": "VCPU", "value": o.CPU},
+					{"type": "MEMORY", "value": strconv.Itoa(o.MemoryMiB)},
+				},
+			},
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// jobSpecCommand writes Kubernetes Job specs or AWS Batch job submissions
+// that run each scenario of a batch manifest as a separate job.
+func jobSpecCommand(args []string) error {
+	fs := flag.NewFlagSet("batch k8s-manifest", flag.ExitOnError)
+	var o jobSpecOptions
+	fs.StringVar(&o.Format, "format", "k8s", "job format: k8s (Kubernetes Jobs) or aws-batch (AWS Batch SubmitJob inputs)")
+	fs.StringVar(&o.Image, "image", "inmap-sandbox:latest", "container image with the sandbox (k8s only; set in the job definition for AWS Batch)")
+	fs.StringVar(&o.Binary, "binary", "inmap-sandbox", "path of the sandbox binary in the image")
+	fs.StringVar(&o.Manifest, "manifest", "", "path of the manifest in the container (default /config/ and the manifest's file name)")
+	fs.StringVar(&o.CPU, "cpu", "2", "CPUs to request for each scenario")
+	fs.IntVar(&o.MemoryMiB, "memory", 8192, "memory (MiB) to request for each scenario")
+	fs.StringVar(&o.OutputURL, "output-url", "", "s3:// or gs:// prefix to copy each scenario's results to")
+	fs.StringVar(&o.JobQueue, "job-queue", "", "AWS Batch job queue (aws-batch only)")
+	fs.StringVar(&o.JobDef, "job-definition", "inmap-sandbox", "AWS Batch job definition (aws-batch only)")
+	out := fs.String("o", "", "output file (default standard output)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s batch k8s-manifest [flags] manifest.toml\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "batch k8s-manifest requires exactly one manifest file")
+	}
+	if o.OutputURL != "" && !strings.HasPrefix(o.OutputURL, "s3://") && !strings.HasPrefix(o.OutputURL, "gs://") {
+		return errorf(kindUsage, "-output-url must start with s3:// or gs://")
+	}
+	m, err := loadBatchManifest(fs.Arg(0))
+	if err != nil {
+		return withKind(kindConfig, errors.Wrap(err, "error loading batch manifest"))
+	}
+	if o.Manifest == "" {
+		o.Manifest = path.Join("/config", path.Base(fs.Arg(0)))
+	}
+
+	var spec interface{}
+	switch o.Format {
+	case "k8s":
+		spec = k8sJobs(m, &o)
+	case "aws-batch":
+		if o.JobQueue == "" {
+			return errorf(kindUsage, "-format aws-batch requires -job-queue")
+		}
+		spec = awsBatchJobs(m, &o)
+	default:
+		return errorf(kindUsage, "invalid -format %q; valid formats are k8s and aws-batch", o.Format)
+	}
+	if *out == "" {
+		return encodeJobSpec(os.Stdout, spec)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := encodeJobSpec(f, spec); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encodeJobSpec writes spec to w as indented JSON, which kubectl accepts
+// like YAML.
+func encodeJobSpec(w io.Writer, spec interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(spec)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+// jobStatus is the state of a batch scenario run.
+type jobStatus string
+
+const (
+	jobPending jobStatus = "pending"
+	jobRunning jobStatus = "running"
+	jobDone    jobStatus = "done"
+	jobFailed  jobStatus = "failed"
+)
+
+// jobState is the persisted state of a single batch scenario.
+type jobState struct {
+	Status   jobStatus
+	Error    string
+	ExitCode int `json:",omitempty"` // the exit status the error would give; see exitCodes
+	Attempts int
+	Updated  time.Time
+
+	// Spec identifies the scenario settings the job last finished with;
+	// see scenarioSpec.
+	Spec string `json:",omitempty"`
+}
+
+var jobsBucket = []byte("jobs")
+
+// jobStore persists batch job state so interrupted runs can be resumed.
+type jobStore struct {
+	db *bbolt.DB
+}
+
+// openJobStore opens or creates the job store at path.
+func openJobStore(path string) (*jobStore, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &jobStore{db: db}, nil
+}
+
+func (js *jobStore) Close() error { return js.db.Close() }
+
+// get returns the state of the named job, which is pending if the job
+// has never been recorded.
+func (js *jobStore) get(name string) (jobState, error) {
+	st := jobState{Status: jobPending}
+	err := js.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(jobsBucket).Get([]byte(name))
+		if b == nil {
+			return nil
+		}
+		return json.Unmarshal(b, &st)
+	})
+	return st, err
+}
+
+// set records the status of the named job. Moving a job to running
+// increments its attempt count.
+func (js *jobStore) set(name string, status jobStatus, runErr error) error {
+	return js.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		var st jobState
+		if b := bucket.Get([]byte(name)); b != nil {
+			if err := json.Unmarshal(b, &st); err != nil {
+				return err
+			}
+		}
+		st.Status = status
+		st.Error, st.ExitCode = "", 0
+		if runErr != nil {
+			st.Error = runErr.Error()
+			st.ExitCode = exitCodes[kindOf(runErr)]
+		}
+		if status == jobRunning {
+			st.Attempts++
+		}
+		st.Updated = time.Now()
+		b, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), b)
+	})
+}
+
+// setSpec records the settings the named job finished with.
+func (js *jobStore) setSpec(name, spec string) error {
+	return js.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		var st jobState
+		if b := bucket.Get([]byte(name)); b != nil {
+			if err := json.Unmarshal(b, &st); err != nil {
+				return err
+			}
+		}
+		st.Spec = spec
+		b, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), b)
+	})
+}
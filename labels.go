@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/ces"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"strings"
+)
+
+// labelRegistry maps demographics and census population columns to the
+// human-readable names used in logs and output tables.
+type labelRegistry struct {
+	names map[string]string
+}
+
+// labels is the registry used throughout the sandbox. User overrides from
+// the [Sandbox.Labels] table of CONFIG are applied by getEIOServer.
+var labels = newLabelRegistry()
+
+func newLabelRegistry() *labelRegistry {
+	r := &labelRegistry{names: map[string]string{
+		"ethnicity:Black":         "Black",
+		"ethnicity:Hispanic":      "Hispanic/Latino",
+		"ethnicity:WhiteOther":    "White and other (non-Hispanic)",
+		"ethnicity:Ethnicity_All": "All ethnicities",
+		"decile:Decile_All":       "All income deciles",
+
+		"TotalPop":   "Total population",
+		"WhiteNoLat": "White (non-Latino)",
+		"Black":      "Black",
+		"Native":     "Native American",
+		"Asian":      "Asian",
+		"Latino":     "Latino",
+	}}
+	for val := 0; val < len(eieiorpc.Decile_value); val++ {
+		dec := eieiorpc.Decile(val)
+		if dec == eieiorpc.Decile_Decile_All {
+			continue
+		}
+		name := fmt.Sprintf("Income decile %d", val+1)
+		if dec == eieiorpc.Decile_LowestTen {
+			name += " (lowest)"
+		} else if dec == eieiorpc.Decile_HighestTen {
+			name += " (highest)"
+		}
+		r.names["decile:"+dec.String()] = name
+		r.names[fmt.Sprintf("IncomeDec%d", val)] = name
+	}
+	return r
+}
+
+// override replaces registry entries with user-supplied names. Keys are
+// either demograph keys (see demographKey) or census population columns.
+func (r *labelRegistry) override(names map[string]string) {
+	for key, name := range names {
+		r.names[key] = name
+	}
+}
+
+// get returns the label for key, falling back to the key itself.
+func (r *labelRegistry) get(key string) string {
+	if name, ok := r.names[key]; ok {
+		return name
+	}
+	return key
+}
+
+// demograph returns the label for dem.
+func (r *labelRegistry) demograph(dem *eieiorpc.Demograph) string {
+	return r.get(demographKey(dem))
+}
+
+// demographKey returns a stable identifier for dem such as
+// "ethnicity:Black" or "decile:LowestTen".
+func demographKey(dem *eieiorpc.Demograph) string {
+	switch typedDem := dem.GetDemographic().(type) {
+	case *eieiorpc.Demograph_Ethnicity:
+		return "ethnicity:" + typedDem.Ethnicity.String()
+	case *eieiorpc.Demograph_Decile:
+		return "decile:" + typedDem.Decile.String()
+	}
+	return dem.String()
+}
+
+// parseDemographs is the inverse of demographKey. It also accepts the group
+// names "ethnicity" and "decile", which expand to every ethnicity or income
+// decile excluding the "All" value.
+func parseDemographs(key string) ([]*eieiorpc.Demograph, error) {
+	switch key {
+	case "ethnicity":
+		return ethnicityDemographs(), nil
+	case "decile":
+		return decileDemographs(), nil
+	}
+	if strings.HasPrefix(key, "ethnicity:") {
+		if v, ok := eieiorpc.Ethnicity_value[strings.TrimPrefix(key, "ethnicity:")]; ok {
+			return []*eieiorpc.Demograph{ces.EthnicityToDemograph(eieiorpc.Ethnicity(v))}, nil
+		}
+	} else if strings.HasPrefix(key, "decile:") {
+		if v, ok := eieiorpc.Decile_value[strings.TrimPrefix(key, "decile:")]; ok {
+			return []*eieiorpc.Demograph{ces.DecileToDemograph(eieiorpc.Decile(v))}, nil
+		}
+	}
+	return nil, errorf(kindConfig, "invalid demographic %q", key)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+)
+
+// leontief holds the EIO requirements matrices for one year and location,
+// along with emission intensities, so that a footprint can be broken down
+// into supply-chain paths. EIEIO only exposes the total requirements
+// through EconomicImpacts, so the direct requirements are recovered by
+// inverting them: A = I - L⁻¹. This requires the same number of
+// industries and commodities.
+type leontief struct {
+	// total is the total requirements matrix L: dollars of each sector's
+	// output per dollar of final demand for each commodity.
+	total *mat.Dense
+
+	// direct is the direct requirements matrix A: dollars of each sector's
+	// output purchased per dollar of each sector's output.
+	direct *mat.Dense
+
+	// intensity is the direct emissions (kg) per dollar of each sector's
+	// output.
+	intensity *mat.VecDense
+
+	// multiplier is the total supply-chain emissions (kg) per dollar of
+	// final demand for each commodity.
+	multiplier *mat.VecDense
+}
+
+// newLeontief builds the requirements matrices and intensities of
+// pollutant pol for the given year, location and air quality model.
+// It requires one EIO and one emissions calculation per commodity.
+func newLeontief(ctx context.Context, s *eieio.Server, year int32, loc eieiorpc.Location, pol eieiorpc.Emission, aqm string) (*leontief, error) {
+	ctx, span := startSpan(ctx, "newLeontief")
+	defer span.End()
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	industries, err := s.Industries(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	n := len(commodities.List)
+	if len(industries.List) != n {
+		return nil, errorf(kindNumeric, "path decomposition requires the same number of industries and commodities, got %d and %d", len(industries.List), n)
+	}
+
+	emitters, err := emitterMask(s, nil)
+	if err != nil {
+		return nil, err
+	}
+	l := &leontief{
+		total:      mat.NewDense(n, n, nil),
+		multiplier: mat.NewVecDense(n, nil),
+	}
+	unit := make([]float64, n)
+	for j := 0; j < n; j++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		unit[j] = 1
+		done := timeRPC(ctx, "EconomicImpacts")
+		output, err := s.EIO.EconomicImpacts(mat.NewVecDense(n, unit), eieio.Year(year), eieio.Location(loc))
+		done(&err)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating total requirements")
+		}
+		l.total.SetCol(j, output.RawVector().Data)
+
+		done = timeRPC(ctx, "Emissions")
+		emis, err := s.Emissions(ctx, &eieiorpc.EmissionsInput{
+			Demand:   &eieiorpc.Vector{Data: unit},
+			Emitters: emitters,
+			Emission: pol,
+			Year:     year,
+			Location: loc,
+			AQM:      aqm,
+		})
+		done(&err)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating emissions for %s", commodities.List[j])
+		}
+		var total float64
+		for _, v := range emis.Data {
+			total += v
+		}
+		l.multiplier.SetVec(j, total)
+		unit[j] = 0
+	}
+
+	var inv mat.Dense
+	if err := inv.Inverse(l.total); err != nil {
+		return nil, errors.Wrap(err, "error inverting total requirements")
+	}
+	l.direct = mat.NewDense(n, n, nil)
+	l.direct.Sub(eye(n), &inv)
+
+	// The total multiplier is m = fL, so the direct intensity is f = mL⁻¹.
+	l.intensity = mat.NewVecDense(n, nil)
+	l.intensity.MulVec(inv.T(), l.multiplier)
+	return l, nil
+}
+
+// split divides the emissions caused by demand into those occurring in the
+// sectors that produce the purchased commodities (direct) and those
+// occurring further up the supply chain (indirect): fy and f(L-I)y.
+func (l *leontief) split(demand []float64) (direct, indirect float64) {
+	var total float64
+	for j, d := range demand {
+		direct += l.intensity.AtVec(j) * d
+		total += l.multiplier.AtVec(j) * d
+	}
+	return direct, total - direct
+}
+
+// eye returns an n×n identity matrix.
+func eye(n int) *mat.Dense {
+	m := mat.NewDense(n, n, nil)
+	for i := 0; i < n; i++ {
+		m.Set(i, i, 1)
+	}
+	return m
+}
@@ -5,47 +5,104 @@ import (
 	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
 	"github.com/pkg/errors"
 	"log"
+	"os"
 )
 
-const YEAR int32 = 2015
 const LOC = eieiorpc.Location_Domestic
 
 func mainHelper() error {
 	ctx := context.Background()
 
-	s, err := getEIOServer()
+	s, _, err := getEIOServer()
 	if err != nil {
 		return errors.Wrap(err, "error creating EIO server")
 	}
+	year := int32(defaultYear())
 
+	done := timeRPC(ctx, "FinalDemand")
 	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
 		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
-		Year:            YEAR,
+		Year:            year,
 		Location:        LOC,
 	})
+	done(&err)
 	if err != nil {
 		return errors.Wrap(err, "error getting final demand")
 	}
+	if demand, err = stateDemand(ctx, s, demand); err != nil {
+		return err
+	}
 
-	/*err = contributionSideTest(ctx, s, YEAR, LOC, demand)
+	/*err = contributionSideTest(ctx, s, year, LOC)
 	if err != nil {
 		return err
 	}*/
 
-	exposureByPop, err := getExposureByPopulation(ctx, s, YEAR, LOC, demand)
+	receptors, err := regionMask(s, receptorRegion, "isrm")
+	if err != nil {
+		return errors.Wrap(err, "error creating receptor region")
+	}
+
+	exposureByPop, err := getExposureByPopulation(ctx, s, year, LOC, "isrm", demand, receptors)
 	if err != nil {
 		return err
 	}
 	for popName, exposure := range *exposureByPop {
-		log.Printf("Pop name: %s\tExposure: %.2f", popName, exposure)
+		log.Printf("Pop name: %s\tExposure: %.2f", labels.get(popName), exposure)
 	}
 
 	return nil
 }
 
+// commands maps subcommand names to their implementations. Running without
+// a subcommand performs the default analysis in mainHelper. Commands can
+// also be run by their commandAliases.
+var commands = map[string]func(args []string) error{
+	"analyze":          analyzeCommand,
+	"arrow":            arrowCommand,
+	"batch":            batchCommand,
+	"browse":           browseCommand,
+	"data":             dataCommand,
+	"decompose":        decomposeCommand,
+	"demand":           demandCommand,
+	"equalize":         equalizeCommand,
+	"export":           exportCommand,
+	"externality":      externalityCommand,
+	"fetch-data":       fetchDataCommand,
+	"gen-testdata":     genTestdataCommand,
+	"inspect":          inspectCommand,
+	"inventory-report": inventoryReportCommand,
+	"merge":            mergeCommand,
+	"monitor-report":   monitorReportCommand,
+	"optimize":         optimizeCommand,
+	"paths":            pathsCommand,
+	"precompute":       precomputeCommand,
+	"serve":            serveCommand,
+	"serve-map":        serveMapCommand,
+	"stability":        stabilityCommand,
+	"totals-report":    totalsReportCommand,
+	"trends":           trendsCommand,
+	"verify":           verifyCommand,
+}
+
 func main() {
-	err := mainHelper()
+	watchStatus()
+	var err error
+	if len(os.Args) > 1 {
+		cmd, ok := commands[resolveCommand(os.Args[1])]
+		if !ok {
+			log.Printf("unknown command %q", os.Args[1])
+			os.Exit(exitCodes[kindUsage])
+		}
+		err = cmd(os.Args[2:])
+	} else {
+		err = mainHelper()
+	}
+	timings.finish()
+	shutdownTracing()
 	if err != nil {
-		log.Fatalf(err.Error())
+		kind := kindOf(err)
+		log.Printf("%s: %v", kindNames[kind], err)
+		os.Exit(exitCodes[kind])
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ctessum/geom/encoding/geojson"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layers served by the map server, with their units.
+var mapLayers = map[string]string{
+	"concentration": "μg/m³",
+	"population":    "people",
+	"exposure":      "people·μg/m³",
+}
+
+// mapCell is a grid cell of the map server, with its geometry and bounds
+// in longitude and latitude.
+type mapCell struct {
+	geometry       *geojson.Geometry
+	minLon, minLat float64
+	maxLon, maxLat float64
+}
+
+// mapServer serves the concentrations caused by the demand of a batch
+// scenario, and the census populations and their exposure, as GeoJSON grid
+// cells within a bounding box or slippy map tile, for map frontends such as
+// Leaflet or Mapbox. Layers are calculated when first requested, through
+// pool.
+type mapServer struct {
+	s      *eieio.Server
+	pool   *serverPool
+	ctx    context.Context
+	sc     scenario
+	demand *eieiorpc.Vector
+	cells  []mapCell
+	index  []int
+	nCells int // cells in the model grid
+
+	mx     sync.Mutex
+	layers map[string][]float64
+}
+
+// newMapServer returns a map server of the results of sc, projecting the
+// grid cells and calculating its demand.
+func newMapServer(ctx context.Context, pool *serverPool, sc scenario) (*mapServer, error) {
+	s := pool.s
+	ctx, err := scenarioContext(ctx, sc)
+	if err != nil {
+		return nil, err
+	}
+	demand, _, err := scenarioDemand(ctx, s, &sc)
+	if err != nil {
+		return nil, err
+	}
+	cells, index, ct, err := gridCells(s, sc.AQM)
+	if err != nil {
+		return nil, err
+	}
+	m := &mapServer{s: s, pool: pool, ctx: ctx, sc: sc, demand: demand, index: index, nCells: len(cells),
+		cells: make([]mapCell, len(index)), layers: make(map[string][]float64)}
+	for i, c := range index {
+		g, err := cells[c].Transform(ct)
+		if err != nil {
+			return nil, errors.Wrapf(err, "projecting grid cell %d", c)
+		}
+		geometry, err := geojson.ToGeoJSON(g)
+		if err != nil {
+			return nil, err
+		}
+		b := g.Bounds()
+		m.cells[i] = mapCell{geometry: geometry, minLon: b.Min.X, minLat: b.Min.Y, maxLon: b.Max.X, maxLat: b.Max.Y}
+	}
+	return m, nil
+}
+
+// concentrations returns the concentrations of pol in the model grid.
+func (m *mapServer) concentrations(ctx context.Context, s *eieio.Server, pol eieiorpc.Pollutant) ([]float64, error) {
+	vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    m.demand,
+		Pollutant: pol,
+		Year:      m.sc.Year,
+		Location:  LOC,
+		AQM:       m.sc.AQM,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error calculating %s concentrations", pol)
+	}
+	return vec.Data, nil
+}
+
+// layer returns the values of layer in each cell: the concentration of
+// pol, the count of pop, or the exposure of pop to pol, as in
+// exposure.csv. Populations and exposure are subject to small-cell
+// suppression.
+func (m *mapServer) layer(layer string, pol eieiorpc.Pollutant, pop string) ([]float64, error) {
+	key := strings.Join([]string{layer, pol.String(), pop}, "|")
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if v, ok := m.layers[key]; ok {
+		return v, nil
+	}
+	var values []float64
+	err := m.pool.do(m.ctx, func(ctx context.Context, s *eieio.Server) error {
+		var err error
+		values, err = m.calculateLayer(ctx, s, layer, pol, pop)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.layers[key] = values
+	return values, nil
+}
+
+// calculateLayer calculates the values of layer in each cell.
+func (m *mapServer) calculateLayer(ctx context.Context, s *eieio.Server, layer string, pol eieiorpc.Pollutant, pop string) ([]float64, error) {
+	values := make([]float64, len(m.index))
+	switch layer {
+	case "concentration":
+		conc, err := m.concentrations(ctx, s, pol)
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range m.index {
+			values[i] = conc[c]
+		}
+	case "population":
+		_, grids, err := getPopulationGrids(ctx, s, m.sc.AQM, m.nCells)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkMapPopulation(grids, pop); err != nil {
+			return nil, err
+		}
+		for i, c := range m.index {
+			values[i] = suppression.count(grids[pop][c])
+		}
+	case "exposure":
+		conc, err := m.concentrations(ctx, s, pol)
+		if err != nil {
+			return nil, err
+		}
+		g, err := getExposureGrids(ctx, s, m.sc.AQM, conc, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkMapPopulation(g.pops, pop); err != nil {
+			return nil, err
+		}
+		var away float64
+		if len(timeActivity.HomeFraction) > 0 {
+			away = awayConcentration(g.conc, g.receptors, g.popNames, g.pops, s.CSTConfig.CensusTotalPopColumn)
+		}
+		for i, c := range g.conc {
+			n := g.pops[pop][i]
+			values[i] = suppression.total(timeActivity.adjust(pop, c*n, n, away), n)
+		}
+	}
+	return values, nil
+}
+
+// checkMapPopulation returns an error if pop isn't among grids.
+func checkMapPopulation(grids map[string][]float64, pop string) error {
+	if _, ok := grids[pop]; ok {
+		return nil
+	}
+	var names []string
+	for name := range grids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return errorf(kindUsage, "invalid population %q; valid populations are %s", pop, strings.Join(names, ", "))
+}
+
+// bounds returns the bounding box of the grid as minimum longitude,
+// minimum latitude, maximum longitude and maximum latitude.
+func (m *mapServer) bounds() [4]float64 {
+	b := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, c := range m.cells {
+		b[0], b[1] = math.Min(b[0], c.minLon), math.Min(b[1], c.minLat)
+		b[2], b[3] = math.Max(b[2], c.maxLon), math.Max(b[3], c.maxLat)
+	}
+	return b
+}
+
+// tileBounds returns the bounding box, as in bounds, of the slippy map
+// tile z/x/y in the Web Mercator tiling scheme.
+func tileBounds(z, x, y int) [4]float64 {
+	n := math.Exp2(float64(z))
+	lon := func(x int) float64 { return float64(x)/n*360 - 180 }
+	lat := func(y int) float64 { return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi }
+	return [4]float64{lon(x), lat(y + 1), lon(x + 1), lat(y)}
+}
+
+// features returns the cells within bbox as a GeoJSON FeatureCollection,
+// with the properties Cell and GridCell as in gridRows and the cell's
+// Value in values, or null if it is missing or suppressed.
+func (m *mapServer) features(values []float64, bbox [4]float64) popMap {
+	fc := popMap{Type: "FeatureCollection", Features: []popMapFeature{}}
+	for i, c := range m.cells {
+		if c.maxLon < bbox[0] || c.minLon > bbox[2] || c.maxLat < bbox[1] || c.minLat > bbox[3] {
+			continue
+		}
+		props := map[string]interface{}{"Cell": i, "GridCell": m.index[i], "Value": values[i]}
+		if math.IsNaN(values[i]) || math.IsInf(values[i], 0) {
+			props["Value"] = nil
+		}
+		fc.Features = append(fc.Features, popMapFeature{Type: "Feature", Geometry: c.geometry, Properties: props})
+	}
+	return fc
+}
+
+// layerParams returns the layer, pollutant and population named by the
+// layer, pollutant and population query parameters, which default to
+// concentration, TotalPM25 and the total population.
+func (m *mapServer) layerParams(r *http.Request) (string, eieiorpc.Pollutant, string, error) {
+	p := r.URL.Query()
+	layer := p.Get("layer")
+	if layer == "" {
+		layer = "concentration"
+	}
+	if _, ok := mapLayers[layer]; !ok {
+		return "", 0, "", fmt.Errorf("invalid layer %q; valid layers are %s", layer, "concentration, exposure and population")
+	}
+	pol := eieiorpc.Pollutant_TotalPM25
+	if v := p.Get("pollutant"); v != "" && layer != "population" {
+		i, ok := eieiorpc.Pollutant_value[v]
+		if !ok {
+			return "", 0, "", fmt.Errorf("invalid pollutant %q", v)
+		}
+		pol = eieiorpc.Pollutant(i)
+	}
+	var pop string
+	if layer != "concentration" {
+		if pop = p.Get("population"); pop == "" {
+			pop = m.s.CSTConfig.CensusTotalPopColumn
+		}
+	}
+	return layer, pol, pop, nil
+}
+
+// mapInfo describes the scenario and layers of a map server.
+type mapInfo struct {
+	Scenario    string
+	Year        int32
+	AQM         string
+	Bounds      [4]float64
+	Layers      map[string]string
+	Pollutants  []string
+	Populations []string
+}
+
+// ServeHTTP serves a description of the scenario and layers at /layers,
+// and the cells of a layer as GeoJSON at /geojson, within the bounding box
+// given by the bbox query parameter (minLon,minLat,maxLon,maxLat; the whole
+// grid if omitted), and at /tiles/z/x/y.geojson, within a slippy map tile.
+func (m *mapServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var result interface{}
+	switch {
+	case r.URL.Path == "/layers":
+		var popNames []string
+		err := m.pool.do(r.Context(), func(ctx context.Context, s *eieio.Server) error {
+			var err error
+			popNames, _, err = getPopulationGrids(ctx, s, m.sc.AQM, m.nCells)
+			return err
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pols := make([]string, 0, len(eieiorpc.Pollutant_name))
+		for i := 0; i < len(eieiorpc.Pollutant_name); i++ {
+			pols = append(pols, eieiorpc.Pollutant(i).String())
+		}
+		pops := append([]string(nil), popNames...)
+		sort.Strings(pops)
+		result = mapInfo{Scenario: m.sc.Name, Year: m.sc.Year, AQM: m.sc.AQM, Bounds: m.bounds(),
+			Layers: mapLayers, Pollutants: pols, Populations: pops}
+		w.Header().Set("Content-Type", "application/json")
+	case r.URL.Path == "/geojson" || strings.HasPrefix(r.URL.Path, "/tiles/"):
+		bbox, err := m.requestBounds(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		layer, pol, pop, err := m.layerParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values, err := m.layer(layer, pol, pop)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if kindOf(err) == kindUsage {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		result = m.features(values, bbox)
+		w.Header().Set("Content-Type", "application/geo+json")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// requestBounds returns the bounding box of the cells requested by r: the
+// tile in its path, its bbox query parameter, or the whole grid.
+func (m *mapServer) requestBounds(r *http.Request) ([4]float64, error) {
+	if strings.HasPrefix(r.URL.Path, "/tiles/") {
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tiles/"), ".geojson"), "/")
+		if len(parts) != 3 {
+			return [4]float64{}, fmt.Errorf("invalid tile %q; must be /tiles/z/x/y.geojson", r.URL.Path)
+		}
+		var zxy [3]int
+		for i, v := range parts {
+			var err error
+			if zxy[i], err = strconv.Atoi(v); err != nil || zxy[i] < 0 {
+				return [4]float64{}, fmt.Errorf("invalid tile %q; must be /tiles/z/x/y.geojson", r.URL.Path)
+			}
+		}
+		if zxy[0] > 30 || zxy[1] >= 1<<uint(zxy[0]) || zxy[2] >= 1<<uint(zxy[0]) {
+			return [4]float64{}, fmt.Errorf("tile %q is outside of the tiling scheme", r.URL.Path)
+		}
+		return tileBounds(zxy[0], zxy[1], zxy[2]), nil
+	}
+	v := r.URL.Query().Get("bbox")
+	if v == "" {
+		return m.bounds(), nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return [4]float64{}, fmt.Errorf("invalid bbox %q; must be minLon,minLat,maxLon,maxLat", v)
+	}
+	var b [4]float64
+	for i, p := range parts {
+		var err error
+		if b[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil {
+			return [4]float64{}, fmt.Errorf("invalid bbox %q; must be minLon,minLat,maxLon,maxLat", v)
+		}
+	}
+	return b, nil
+}
+
+// serveMapCommand serves the concentration, population and exposure layers
+// of a batch scenario as GeoJSON for interactive maps.
+func serveMapCommand(args []string) error {
+	fs := flag.NewFlagSet("serve-map", flag.ExitOnError)
+	name := fs.String("scenario", "", "scenario to map (default the manifest's only scenario)")
+	addr := fs.String("addr", "localhost:8817", "address to listen on")
+	drain := fs.Duration("drain", 30*time.Second, "on SIGTERM, how long to wait for requests in progress to finish")
+	jobsDir := fs.String("jobs-dir", filepath.Join(os.TempDir(), "inmap-sandbox-jobs"), "directory for the results of scenarios posted to /jobs")
+	jobTTL := fs.Duration("job-ttl", 24*time.Hour, "how long finished jobs and their results are kept")
+	parallelism := fs.Int("parallelism", 1, "number of calculations (map layers, posted scenarios and -warm targets) to run at once")
+	jobsOrigin := fs.String("jobs-origin", "", "origin, such as https://maps.example.org, that browsers may call /jobs from (default none)")
+	jobWorkers := fs.Int("job-workers", 1, "number of posted scenarios to run at a time, at most -parallelism of them calculating at once")
+	warm := fs.Bool("warm", false, "on startup, calculate the total PM2.5 concentrations of every configured year for total demand and the -warm-demographics in the background, so that first requests are answered from the cache")
+	warmDems := fs.String("warm-demographics", standardDemographics, "comma-separated demograph keys or groups to warm with -warm")
+	watch := fs.Duration("watch", 5*time.Second, "how often to check the config for changed [Sandbox.Server] settings (0 to not check)")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s serve-map [flags] manifest.toml\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "serve-map requires a batch manifest")
+	}
+	manifest, err := loadBatchManifest(fs.Arg(0))
+	if err != nil {
+		return withKind(kindConfig, errors.Wrap(err, "error reading batch manifest"))
+	}
+	var sc *scenario
+	for i := range manifest.Scenario {
+		if manifest.Scenario[i].Name == *name || (*name == "" && len(manifest.Scenario) == 1) {
+			sc = &manifest.Scenario[i]
+		}
+	}
+	if sc == nil {
+		var names []string
+		for _, s := range manifest.Scenario {
+			names = append(names, s.Name)
+		}
+		return errorf(kindUsage, "no scenario %q in %s; use -scenario with one of %s", *name, fs.Arg(0), strings.Join(names, ", "))
+	}
+
+	s, sandbox, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	if err := Year(sc.Year).validate(context.Background(), s); err != nil {
+		return err
+	}
+	flags := serverSettings{parallelism: *parallelism, jobsDir: *jobsDir, jobTTL: *jobTTL}
+	st, err := sandbox.Server.resolve(fs, flags)
+	if err != nil {
+		return err
+	}
+	// Map layers are calculated one at a time and warm targets in turn, so
+	// the queue has room for a layer, the populations of /layers, a warm
+	// target and a scenario of each job worker, and is never full.
+	pool := newServerPool(s, st.parallelism, *jobWorkers+3)
+	m, err := newMapServer(context.Background(), pool, *sc)
+	if err != nil {
+		return err
+	}
+	js, err := newJobServer(pool, manifest.Scenario, *sc, st.jobsDir, st.jobTTL, *jobWorkers)
+	if err != nil {
+		return errors.Wrap(err, "error creating jobs directory")
+	}
+	js.origin = *jobsOrigin
+	watchConfig(*watch, func(cfg *config) {
+		next, err := cfg.Sandbox.Server.resolve(fs, flags)
+		if err != nil {
+			log.Printf("Ignoring changed server settings: %v", err)
+			return
+		}
+		if next == st {
+			return
+		}
+		if err := js.configure(next.jobsDir, next.jobTTL); err != nil {
+			log.Printf("Ignoring changed server settings: creating jobs directory: %v", err)
+			return
+		}
+		st = next
+		pool.resize(st.parallelism, *jobWorkers+3)
+		log.Printf("Applied server settings: parallelism %d, jobs directory %s, job TTL %s", st.parallelism, st.jobsDir, st.jobTTL)
+	})
+	warmCtx, cancelWarm := context.WithCancel(context.Background())
+	defer cancelWarm()
+	if *warm {
+		targets, err := warmTargets(warmCtx, s, *warmDems)
+		if err != nil {
+			return errors.Wrap(err, "-warm-demographics")
+		}
+		log.Printf("Warm: calculating %d year and demographic concentrations in the background", len(targets))
+		go warmCache(warmCtx, pool, targets, sc.AQM)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", js)
+	mux.Handle("/jobs/", js)
+	mux.Handle("/", m)
+	log.Printf("Serving maps of scenario %s on http://%s/", sc.Name, *addr)
+	return serveUntilSignal(*addr, mux, *drain, func() error {
+		cancelWarm()
+		if running := js.close(); len(running) > 0 {
+			return fmt.Errorf("cancelled running jobs %s", strings.Join(running, ", "))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"os"
+	"time"
+)
+
+// labeledMatrix is a result matrix together with the labels of its
+// dimensions and a record of how it was calculated, so that it can be
+// saved and used by other programs without re-running the analysis.
+type labeledMatrix struct {
+	// RowDim and ColDim name the dimensions, e.g. "Demographic" and "SCC".
+	RowDim, ColDim string
+
+	// RowLabels and ColLabels identify each row and column.
+	RowLabels, ColLabels []string
+
+	// Units of the values, e.g. "kg/year".
+	Units string
+
+	Provenance matrixProvenance
+
+	// Data holds the values in row-major order.
+	Data matrixData
+}
+
+// matrixData is a slice of values that encodes NaN (e.g. for demographics
+// skipped because of missing CES data) as JSON null.
+type matrixData []float64
+
+// MarshalJSON implements json.Marshaler.
+func (d matrixData) MarshalJSON() ([]byte, error) {
+	v := make([]*float64, len(d))
+	for i := range d {
+		if !math.IsNaN(d[i]) {
+			v[i] = &d[i]
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *matrixData) UnmarshalJSON(b []byte) error {
+	var v []*float64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*d = make(matrixData, len(v))
+	for i, x := range v {
+		if x == nil {
+			(*d)[i] = math.NaN()
+		} else {
+			(*d)[i] = *x
+		}
+	}
+	return nil
+}
+
+// matrixProvenance records how a labeledMatrix was calculated.
+type matrixProvenance struct {
+	Year               int32
+	AQM                string
+	Location           string
+	Emission           string
+	HR                 string // hazard ratio function, for deaths
+	PopulationAdjusted bool
+	PrunedSCCs         int `json:",omitempty"` // SCCs without emissions, omitted
+	MissingCES         string
+	Config             string
+	Created            time.Time
+}
+
+// newLabeledMatrix returns m with the given labels. The number of labels
+// must match the dimensions of m.
+func newLabeledMatrix(m *mat.Dense, rowDim string, rowLabels []string, colDim string, colLabels []string, units string, prov matrixProvenance) (*labeledMatrix, error) {
+	r, c := m.Dims()
+	if r != len(rowLabels) || c != len(colLabels) {
+		return nil, errorf(kindNumeric, "matrix is %d×%d but there are %d row and %d column labels", r, c, len(rowLabels), len(colLabels))
+	}
+	data := make([]float64, 0, r*c)
+	for i := 0; i < r; i++ {
+		data = append(data, m.RawRowView(i)...)
+	}
+	return &labeledMatrix{
+		RowDim:     rowDim,
+		ColDim:     colDim,
+		RowLabels:  rowLabels,
+		ColLabels:  colLabels,
+		Units:      units,
+		Provenance: prov,
+		Data:       data,
+	}, nil
+}
+
+// Dense returns the values of m as a matrix.
+func (m *labeledMatrix) Dense() *mat.Dense {
+	return mat.NewDense(len(m.RowLabels), len(m.ColLabels), m.Data)
+}
+
+// demSCCMatrix calculates the population-adjusted PM2.5 emissions
+// (kg/year) attributable to each of dems, by SCC.
+func demSCCMatrix(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, year int32, aqm string) (*labeledMatrix, error) {
+	m, err := contributionMatrix(ctx, s, dems, year, LOC, aqm, nil)
+	if err != nil {
+		return nil, err
+	}
+	demKeys := make([]string, len(dems))
+	for i, dem := range dems {
+		demKeys[i] = demographKey(dem)
+	}
+	sccNames := make([]string, len(m.SCCs))
+	for i, scc := range m.SCCs {
+		sccNames[i] = string(scc)
+	}
+	return newLabeledMatrix(m.Emissions, "Demographic", demKeys, "SCC", sccNames, "kg/year", matrixProvenance{
+		Year:               year,
+		AQM:                aqm,
+		Location:           LOC.String(),
+		Emission:           eieiorpc.Emission_PM25.String(),
+		PopulationAdjusted: true,
+		PrunedSCCs:         m.Pruned,
+		MissingCES:         string(missingCES),
+		Config:             CONFIG,
+		Created:            time.Now(),
+	})
+}
+
+// demSCCDeathsMatrix calculates the deaths (per year) of the total
+// population attributable to the PM2.5 caused by each of dems, by emitting
+// SCC, using the hazard ratio function hr. Unlike demSCCMatrix, the values
+// are not population-adjusted.
+func demSCCDeathsMatrix(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, year int32, hr, aqm string) (*labeledMatrix, error) {
+	deaths, err := demAndDeaths(ctx, s, dems, year, hr, aqm, nil)
+	if err != nil {
+		return nil, err
+	}
+	demKeys := make([]string, len(dems))
+	for i, dem := range dems {
+		demKeys[i] = demographKey(dem)
+	}
+	sccNames := make([]string, len(s.SCCs))
+	for i, scc := range s.SCCs {
+		sccNames[i] = string(scc)
+	}
+	return newLabeledMatrix(deaths, "Demographic", demKeys, "SCC", sccNames, "deaths/year", matrixProvenance{
+		Year:       year,
+		AQM:        aqm,
+		Location:   LOC.String(),
+		HR:         hr,
+		MissingCES: string(missingCES),
+		Config:     CONFIG,
+		Created:    time.Now(),
+	})
+}
+
+// saveMatrix writes m to path as JSON.
+func saveMatrix(path string, m *labeledMatrix) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadMatrix reads a matrix written by saveMatrix.
+func loadMatrix(path string) (*labeledMatrix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := new(labeledMatrix)
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, fmt.Errorf("reading matrix %s: %v", path, err)
+	}
+	if len(m.Data) != len(m.RowLabels)*len(m.ColLabels) {
+		return nil, errorf(kindNumeric, "matrix %s has %d values but %d×%d labels", path, len(m.Data), len(m.RowLabels), len(m.ColLabels))
+	}
+	return m, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a number of bytes, written with an optional unit, such as
+// "512MB" or "8GiB". Units are decimal (KB, MB, GB, TB) or binary (KiB,
+// MiB, GiB, TiB); a bare K, M, G or T is binary.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	if b == nil {
+		return "0"
+	}
+	for i := 3; i >= 0; i-- {
+		if u := byteUnits[i]; int64(*b) >= u.size {
+			return strconv.FormatFloat(float64(*b)/float64(u.size), 'g', 3, 64) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*b), 10) + "B"
+}
+
+// Set implements flag.Value.
+// Sizes that are negative, not finite or too large for an int64 are
+// invalid.
+func (b *byteSize) Set(s string) error {
+	num := strings.TrimSpace(s)
+	scale := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(num), strings.ToUpper(u.suffix)) {
+			num, scale = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || !(v >= 0) || math.IsInf(v, 1) {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	if v*float64(scale) >= math.MaxInt64 {
+		return fmt.Errorf("size %q is too large", s)
+	}
+	*b = byteSize(v * float64(scale))
+	return nil
+}
+
+// maxMemory is the -max-memory setting: the heap memory a run may use,
+// or 0 for no limit. Calculations that would exceed
+// it switch to ones that use less memory, where there are any, and
+// otherwise fail with an explanation rather than risk the process being
+// killed for running out of memory.
+var maxMemory byteSize
+
+// memoryFlag adds the -max-memory flag, which sets maxMemory, to fs.
+func memoryFlag(fs *flag.FlagSet) {
+	fs.Var(&maxMemory, "max-memory", "limit on heap memory, e.g. 8GB (0 for no limit); grid×SCC matrix calculations that would exceed it are done in chunks where possible and otherwise refused")
+}
+
+// matrixBytes returns the memory needed by a rows×cols matrix.
+func matrixBytes(rows, cols int) int64 {
+	return int64(rows) * int64(cols) * 8
+}
+
+// memoryAvailable returns the memory that can be allocated without
+// exceeding maxMemory, or -1 if there is no limit.
+func memoryAvailable() int64 {
+	if maxMemory <= 0 {
+		return -1
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if free := int64(maxMemory) - int64(ms.HeapAlloc); free > 0 {
+		return free
+	}
+	return 0
+}
+
+// fitsMemory reports whether need bytes can be allocated without exceeding
+// maxMemory, collecting garbage first if they otherwise wouldn't.
+func fitsMemory(need int64) bool {
+	if maxMemory <= 0 || need <= memoryAvailable() {
+		return true
+	}
+	runtime.GC()
+	return need <= memoryAvailable()
+}
+
+// reserveMemory returns an error if what, needing need bytes, can't be
+// allocated without exceeding maxMemory.
+func reserveMemory(what string, need int64) error {
+	if fitsMemory(need) {
+		return nil
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	n, used := byteSize(need), byteSize(ms.HeapAlloc)
+	return errorf(kindConfig, "%s needs about %s of memory, but %s of -max-memory %s is already in use; raise -max-memory to run it", what, &n, &used, &maxMemory)
+}
+
+// reserveGridMatrix returns an error if a grid×SCC matrix of what in the
+// aqm grid, along with the grid×SCC factors EIEIO calculates it from,
+// wouldn't fit within maxMemory. EIEIO calculates these matrices whole, so
+// they can't be split into pieces that would fit.
+func reserveGridMatrix(s *eieio.Server, aqm, what string) error {
+	if maxMemory <= 0 {
+		return nil
+	}
+	id, err := getGridID(s, aqm)
+	if err != nil {
+		return err
+	}
+	return reserveMemory(fmt.Sprintf("the %d×%d matrix of %s by grid cell and SCC", id.Cells, len(s.SCCs), what), 2*matrixBytes(id.Cells, len(s.SCCs)))
+}
+
+// gridMatrix converts m, a grid×SCC matrix calculated by EIEIO, checking
+// that it has a column for each SCC of s.
+func gridMatrix(s *eieio.Server, m *eieiorpc.Matrix, what string) (*mat.Dense, error) {
+	if int(m.Cols) != len(s.SCCs) {
+		return nil, errorf(kindNumeric, "expected %s to have #SCC %d columns, got %d", what, len(s.SCCs), m.Cols)
+	}
+	return rpc2mat(m), nil
+}
+
+// emissionsMatrix returns the emissions of input.Emission from each grid
+// cell (rows) by SCC (columns), first checking that they fit within
+// maxMemory. SCCs left out by the SCC filter aren't zeroed.
+func emissionsMatrix(ctx context.Context, s *eieio.Server, input *eieiorpc.EmissionsMatrixInput) (*mat.Dense, error) {
+	what := fmt.Sprintf("%s emissions", input.Emission)
+	if err := reserveGridMatrix(s, input.AQM, what); err != nil {
+		return nil, err
+	}
+	done := timeRPC(ctx, "EmissionsMatrix")
+	m, err := s.EmissionsMatrix(ctx, input)
+	done(&err)
+	if err != nil {
+		return nil, err
+	}
+	return gridMatrix(s, m, what)
+}
+
+// healthMatrix returns the deaths of input.Population in each grid cell
+// (rows) attributable to the emissions of each SCC (columns), first
+// checking that they fit within maxMemory. SCCs left out by the SCC filter
+// aren't zeroed.
+func healthMatrix(ctx context.Context, s *eieio.Server, input *eieiorpc.HealthMatrixInput) (*mat.Dense, error) {
+	what := fmt.Sprintf("%s deaths of %s", input.Pollutant, input.Population)
+	if err := reserveGridMatrix(s, input.AQM, what); err != nil {
+		return nil, err
+	}
+	done := timeRPC(ctx, "HealthMatrix")
+	m, err := s.SpatialEIO.HealthMatrix(ctx, input)
+	done(&err)
+	if err != nil {
+		return nil, err
+	}
+	return gridMatrix(s, m, what)
+}
+
+// concentrationMatrix returns the concentrations of input.Pollutant in each
+// grid cell (rows) caused by the emissions of each SCC (columns), zero for
+// SCCs left out by the SCC filter, first checking that the matrix and the
+// concentration factors it is calculated from fit within maxMemory.
+func concentrationMatrix(ctx context.Context, s *eieio.Server, input *eieiorpc.ConcentrationMatrixInput) (*mat.Dense, error) {
+	what := fmt.Sprintf("%s concentrations", input.Pollutant)
+	if err := reserveGridMatrix(s, input.AQM, what); err != nil {
+		return nil, err
+	}
+	done := timeRPC(ctx, "ConcentrationMatrix")
+	m, err := s.SpatialEIO.ConcentrationMatrix(ctx, input)
+	done(&err)
+	if err != nil {
+		return nil, err
+	}
+	conc, err := gridMatrix(s, m, what)
+	if err != nil {
+		return nil, err
+	}
+	if err := filterSCCColumns(s, conc); err != nil {
+		return nil, err
+	}
+	if allFinite(input.Demand.Data) {
+		raw := conc.RawMatrix()
+		if err := checkFinite(ctx, fmt.Sprintf("%s concentrations by grid cell and SCC", input.Pollutant), raw.Data, matrixLabel(s, raw.Stride)); err != nil {
+			return nil, err
+		}
+	}
+	return conc, nil
+}
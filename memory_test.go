@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestByteSizeSet(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want byteSize
+		err  string
+	}{
+		{in: "0", want: 0},
+		{in: "1024", want: 1024},
+		{in: "512B", want: 512},
+		{in: "1KB", want: 1e3},
+		{in: "1KiB", want: 1 << 10},
+		{in: "1K", want: 1 << 10},
+		{in: "1.5KiB", want: 1536},
+		{in: "512MB", want: 512e6},
+		{in: "512MiB", want: 512 << 20},
+		{in: "8GB", want: 8e9},
+		{in: "8gib", want: 8 << 30},
+		{in: " 16 G ", want: 16 << 30},
+		{in: "2TB", want: 2e12},
+		{in: "2TiB", want: 2 << 40},
+		{in: "2T", want: 2 << 40},
+		{in: "8000000TiB", want: 8000000 << 40},
+		{in: "", err: "invalid size"},
+		{in: "GB", err: "invalid size"},
+		{in: "eight GB", err: "invalid size"},
+		{in: "8PB", err: "invalid size"},
+		{in: "-1GB", err: "invalid size"},
+		{in: "NaN", err: "invalid size"},
+		{in: "Inf", err: "invalid size"},
+		{in: "9223372036854775807", err: "too large"},
+		{in: "9000000TiB", err: "too large"},
+		{in: "1e300TB", err: "too large"},
+	} {
+		var b byteSize
+		err := b.Set(test.in)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", test.in, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: got %d, %v, want an error containing %q", test.in, b, err, test.err)
+		case test.err == "" && b != test.want:
+			t.Errorf("%q: got %d, want %d", test.in, b, test.want)
+		}
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	for _, test := range []struct {
+		b    byteSize
+		want string
+	}{
+		{0, "0B"},
+		{512, "512B"},
+		{1 << 10, "1KiB"},
+		{1536, "1.5KiB"},
+		{8 << 30, "8GiB"},
+		{2 << 40, "2TiB"},
+	} {
+		b := test.b
+		if got := b.String(); got != test.want {
+			t.Errorf("%d: got %s, want %s", test.b, got, test.want)
+		}
+		var back byteSize
+		if err := back.Set(b.String()); err != nil || back != b {
+			t.Errorf("%s: got %d, %v, want %d", b.String(), back, err, b)
+		}
+	}
+}
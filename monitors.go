@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// monitor is an air quality monitoring site with its observed annual mean
+// PM2.5 concentration (μg/m³).
+type monitor struct {
+	Site     string
+	Lon, Lat float64
+	Observed float64
+
+	// Cell is the index of the grid cell the site is in, or -1 if it is
+	// outside of the grid, and Modeled the concentration there.
+	Cell    int
+	Modeled float64
+}
+
+// aqsColumns are the columns of EPA AQS annual or daily summary files
+// (e.g. annual_conc_by_monitor_2015.csv or daily_88101_2015.csv) that
+// readAQSMonitors uses. The others are optional.
+var aqsColumns = []string{"State Code", "County Code", "Site Num", "Parameter Code", "POC", "Latitude", "Longitude", "Arithmetic Mean"}
+
+// readAQSMonitors reads the monitors measuring parameter (e.g. "88101",
+// PM2.5 by FRM/FEM) in year from an EPA AQS annual or daily summary file,
+// by column name. A site's observed concentration is the mean of its
+// monitors (POCs), each the mean of its daily values in a daily file.
+// Rows for another year or that exclude exceptional events are skipped
+// (observations including the events are used), as are duplicate rows
+// for other pollutant standards.
+func readAQSMonitors(path, parameter string, year int32) ([]*monitor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading AQS header")
+	}
+	col := make(map[string]int, len(header))
+	for i, h := range header {
+		col[strings.TrimSpace(h)] = i
+	}
+	for _, c := range aqsColumns {
+		if _, ok := col[c]; !ok {
+			return nil, fmt.Errorf("AQS file %s has no %q column", path, c)
+		}
+	}
+	get := func(rec []string, c string) string {
+		if i, ok := col[c]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+
+	sites := make(map[string]*monitor)
+	// byPOC holds the values of each monitor (POC) at each site, by date
+	// for daily files.
+	byPOC := make(map[string][]float64)
+	seen := make(map[string]bool)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if get(rec, "Parameter Code") != parameter {
+			continue
+		}
+		if y := get(rec, "Year"); y != "" && y != strconv.Itoa(int(year)) {
+			continue
+		}
+		if d := get(rec, "Date Local"); d != "" && !strings.HasPrefix(d, strconv.Itoa(int(year))) {
+			continue
+		}
+		if strings.Contains(get(rec, "Event Type"), "Excluded") {
+			continue
+		}
+		site := get(rec, "State Code") + "-" + get(rec, "County Code") + "-" + get(rec, "Site Num")
+		instance := site + "|" + get(rec, "POC") + "|" + get(rec, "Sample Duration") + "|" + get(rec, "Date Local")
+		m, ok := sites[site]
+		if !ok {
+			m = &monitor{Site: site}
+			if m.Lat, err = strconv.ParseFloat(get(rec, "Latitude"), 64); err != nil {
+				return nil, fmt.Errorf("invalid latitude in AQS record %v", rec)
+			}
+			if m.Lon, err = strconv.ParseFloat(get(rec, "Longitude"), 64); err != nil {
+				return nil, fmt.Errorf("invalid longitude in AQS record %v", rec)
+			}
+			sites[site] = m
+		}
+		if seen[instance] {
+			continue // the same values for another pollutant standard
+		}
+		seen[instance] = true
+		v, err := strconv.ParseFloat(get(rec, "Arithmetic Mean"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arithmetic mean in AQS record %v", rec)
+		}
+		poc := site + "|" + get(rec, "POC")
+		byPOC[poc] = append(byPOC[poc], v)
+	}
+
+	observations := make(map[string][]float64)
+	for poc, values := range byPOC {
+		site := strings.SplitN(poc, "|", 2)[0]
+		observations[site] = append(observations[site], mean(values))
+	}
+	monitors := make([]*monitor, 0, len(sites))
+	for site, m := range sites {
+		m.Observed = mean(observations[site])
+		monitors = append(monitors, m)
+	}
+	sort.Slice(monitors, func(i, j int) bool { return monitors[i].Site < monitors[j].Site })
+	return monitors, nil
+}
+
+// mean returns the mean of vs.
+func mean(vs []float64) float64 {
+	var sum float64
+	for _, v := range vs {
+		sum += v
+	}
+	return sum / float64(len(vs))
+}
+
+// locateMonitors sets the aqm grid cell of each monitor, or -1 if it is
+// outside of the grid.
+func locateMonitors(s *eieio.Server, aqm string, monitors []*monitor) error {
+	cells, err := s.SpatialEIO.CSTConfig.Geometry(aqm)
+	if err != nil {
+		return errors.Wrap(err, "error getting grid geometry")
+	}
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return err
+	}
+	gridSR, err := proj.Parse(s.SpatialEIO.CSTConfig.SpatialConfig.OutputSR)
+	if err != nil {
+		return errors.Wrap(err, "parsing grid spatial reference")
+	}
+	ct, err := lonLat.NewTransform(gridSR)
+	if err != nil {
+		return err
+	}
+	bounds := make([]*geom.Bounds, len(cells))
+	for i, c := range cells {
+		bounds[i] = c.Bounds()
+	}
+	for _, m := range monitors {
+		g, err := geom.Point{X: m.Lon, Y: m.Lat}.Transform(ct)
+		if err != nil {
+			return errors.Wrapf(err, "projecting monitor %s", m.Site)
+		}
+		p := g.(geom.Point)
+		m.Cell = -1
+		for i, c := range cells {
+			if p.X < bounds[i].Min.X || p.X > bounds[i].Max.X || p.Y < bounds[i].Min.Y || p.Y > bounds[i].Max.Y {
+				continue
+			}
+			if p.Within(c) != geom.Outside {
+				m.Cell = i
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// modelPerformance summarizes the agreement of modeled and observed
+// concentrations (μg/m³) at monitors.
+type modelPerformance struct {
+	N                              int
+	MeanObserved, MeanModeled      float64
+	MeanBias, NormalizedMeanBias   float64
+	MeanError, NormalizedMeanError float64
+	RMSE, Correlation              float64
+}
+
+// evaluate returns the performance of the model at monitors within the
+// grid.
+func evaluate(monitors []*monitor) modelPerformance {
+	var p modelPerformance
+	var sumObs, sumMod, sumBias, sumErr, sumSq float64
+	for _, m := range monitors {
+		if m.Cell < 0 {
+			continue
+		}
+		p.N++
+		sumObs += m.Observed
+		sumMod += m.Modeled
+		sumBias += m.Modeled - m.Observed
+		sumErr += math.Abs(m.Modeled - m.Observed)
+		sumSq += (m.Modeled - m.Observed) * (m.Modeled - m.Observed)
+	}
+	n := float64(p.N)
+	p.MeanObserved, p.MeanModeled = sumObs/n, sumMod/n
+	p.MeanBias, p.MeanError = sumBias/n, sumErr/n
+	p.NormalizedMeanBias, p.NormalizedMeanError = sumBias/sumObs, sumErr/sumObs
+	p.RMSE = math.Sqrt(sumSq / n)
+
+	var cov, varObs, varMod float64
+	for _, m := range monitors {
+		if m.Cell < 0 {
+			continue
+		}
+		cov += (m.Observed - p.MeanObserved) * (m.Modeled - p.MeanModeled)
+		varObs += (m.Observed - p.MeanObserved) * (m.Observed - p.MeanObserved)
+		varMod += (m.Modeled - p.MeanModeled) * (m.Modeled - p.MeanModeled)
+	}
+	p.Correlation = cov / math.Sqrt(varObs*varMod)
+	return p
+}
+
+// monitorReportCommand compares the modeled PM2.5 concentrations caused
+// by total final demand with the observations of EPA AQS monitors.
+func monitorReportCommand(args []string) error {
+	fs := flag.NewFlagSet("monitor-report", flag.ExitOnError)
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	aqs := fs.String("aqs", "", "EPA AQS annual or daily summary file, e.g. annual_conc_by_monitor_2015.csv")
+	parameter := fs.String("parameter", "88101", "AQS parameter code of the observations")
+	demandType := fs.String("demand", eieiorpc.FinalDemandType_AllDemand.String(), "final demand type to model")
+	background := fs.Bool("background", false, "add the configured Background concentration to modeled concentrations")
+	out := fs.String("o", "monitor_comparison.csv", "output CSV file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s monitor-report -aqs file [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *aqs == "" {
+		fs.Usage()
+		return errorf(kindUsage, "monitor-report requires an AQS file (-aqs)")
+	}
+
+	monitors, err := readAQSMonitors(*aqs, *parameter, int32(*year))
+	if err != nil {
+		return errors.Wrap(err, "error reading AQS monitors")
+	}
+	if len(monitors) == 0 {
+		return errorf(kindDataMissing, "no monitors of parameter %s in %d in %s", *parameter, *year, *aqs)
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	ctx := context.Background()
+	if err := year.validate(ctx, s); err != nil {
+		return err
+	}
+	demand, _, err := modelDemand(ctx, s, *demandType, int32(*year))
+	if err != nil {
+		return err
+	}
+	vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      int32(*year),
+		Location:  LOC,
+		AQM:       *aqm,
+	})
+	if err != nil {
+		return errors.Wrap(err, "error calculating concentrations")
+	}
+	conc := append([]float64(nil), vec.Data...)
+	if *background {
+		bg, err := backgroundFor(ctx).grid(len(conc))
+		if err != nil {
+			return err
+		}
+		for i, v := range bg {
+			conc[i] += v
+		}
+	}
+
+	if err := locateMonitors(s, *aqm, monitors); err != nil {
+		return err
+	}
+	var rows [][]string
+	var outside int
+	for _, m := range monitors {
+		if m.Cell < 0 {
+			outside++
+			continue
+		}
+		m.Modeled = conc[m.Cell]
+		rows = append(rows, []string{m.Site, formatFloat(m.Lon), formatFloat(m.Lat), strconv.Itoa(m.Cell),
+			formatFloat(m.Observed), formatFloat(m.Modeled), formatFloat(m.Modeled - m.Observed)})
+	}
+	if outside > 0 {
+		log.Printf("%d of %d monitors are outside of the %s grid", outside, len(monitors), *aqm)
+	}
+	if len(rows) == 0 {
+		return errorf(kindDataMissing, "none of the monitors in %s are within the %s grid", *aqs, *aqm)
+	}
+	if err := writeCSV(*out, []string{"Site", "Lon", "Lat", "GridCell", "Observed", "Modeled", "Bias"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "monitor_comparison.csv"); err != nil {
+		return err
+	}
+
+	p := evaluate(monitors)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Monitors\t%d\n", p.N)
+	fmt.Fprintf(w, "Mean observed (μg/m³)\t%.3g\n", p.MeanObserved)
+	fmt.Fprintf(w, "Mean modeled (μg/m³)\t%.3g\n", p.MeanModeled)
+	fmt.Fprintf(w, "Mean bias (μg/m³)\t%.3g\n", p.MeanBias)
+	fmt.Fprintf(w, "Normalized mean bias\t%.1f%%\n", 100*p.NormalizedMeanBias)
+	fmt.Fprintf(w, "Mean error (μg/m³)\t%.3g\n", p.MeanError)
+	fmt.Fprintf(w, "Normalized mean error\t%.1f%%\n", 100*p.NormalizedMeanError)
+	fmt.Fprintf(w, "RMSE (μg/m³)\t%.3g\n", p.RMSE)
+	fmt.Fprintf(w, "Correlation (r)\t%.3f\n", p.Correlation)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Monitor comparison written to %s", *out)
+	return nil
+}
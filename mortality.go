@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/evookelj/inmap/epi"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hazardRatios are the hazard ratio functions available for health impact
+// calculations.
+var hazardRatios = []epi.HRer{epi.NasariACS}
+
+// hazardRatio returns the hazard ratio function named name.
+func hazardRatio(name string) (epi.HRer, error) {
+	var names []string
+	for _, hr := range hazardRatios {
+		if hr.Name() == name {
+			return hr, nil
+		}
+		names = append(names, hr.Name())
+	}
+	return nil, errorf(kindConfig, "invalid hazard ratio function %q; valid functions are %s", name, strings.Join(names, ", "))
+}
+
+// ageMortalityConfig specifies baseline mortality by age group, for
+// age-stratified health impacts.
+type ageMortalityConfig struct {
+	// File is the path to a CSV file with columns
+	// Population,AgeGroup,Share,Incidence,LifeExpectancy. Share is the
+	// fraction of the population (a census population or income decile)
+	// in the age group, Incidence the baseline all-cause mortality rate in
+	// the age group (deaths per year per 100,000 people) and
+	// LifeExpectancy the remaining life expectancy (years) at that age
+	// from a standard life table, used to calculate years of life lost. A
+	// Population of "*" applies to populations without entries of their
+	// own. Only list the age groups the hazard ratio function applies to,
+	// e.g. adults 30 and over for NasariACS.
+	File string
+
+	// DiscountRate is the annual rate at which future years of life lost
+	// are discounted, e.g. 0.03. Zero (the default) does not discount.
+	DiscountRate float64
+
+	// AgeWeighting is the degree (0 to 1) of age weighting of years of life
+	// lost, as in the Global Burden of Disease 1990 study, which values
+	// years lived as a young adult more than those lived as a child or in
+	// old age. It requires age groups named like "30-34" or "85+".
+	AgeWeighting float64
+
+	// YLDRatio is the years lived with disability per year of life lost,
+	// added to years of life lost to give DALYs. Zero (the default) counts
+	// mortality only.
+	YLDRatio float64
+}
+
+// ageMortality is the age-stratified mortality configured in the
+// AgeMortality table of CONFIG; set by getEIOServer.
+var ageMortality ageMortalityConfig
+
+// ageGroup is the baseline mortality of an age group of a census
+// population.
+type ageGroup struct {
+	Name           string
+	Share          float64
+	Incidence      float64 // deaths per year per 100,000 people
+	LifeExpectancy float64 // years
+	Age            float64 // age at death, for age weighting
+}
+
+// readAgeGroups reads the age groups of each census population from a file
+// in the format described by ageMortalityConfig.
+func readAgeGroups(path string) (map[string][]ageGroup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 5
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	groups := make(map[string][]ageGroup)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pop := strings.TrimSpace(rec[0])
+		g := ageGroup{Name: strings.TrimSpace(rec[1])}
+		for i, v := range []*float64{&g.Share, &g.Incidence, &g.LifeExpectancy} {
+			if *v, err = strconv.ParseFloat(strings.TrimSpace(rec[i+2]), 64); err != nil || *v < 0 {
+				return nil, fmt.Errorf("invalid value %q for age group %s of population %s", rec[i+2], g.Name, pop)
+			}
+		}
+		groups[pop] = append(groups[pop], g)
+	}
+	return groups, nil
+}
+
+// ageBurden holds the attributable deaths, years of life lost (YLL) and
+// disability-adjusted life years (DALYs) in an age group of a population.
+type ageBurden struct {
+	AgeGroup          string
+	Deaths, YLL, DALY float64
+}
+
+// add adds the deaths, YLL and DALYs of o to b.
+func (b *ageBurden) add(o ageBurden) {
+	b.Deaths += o.Deaths
+	b.YLL += o.YLL
+	b.DALY += o.DALY
+}
+
+// Age weighting constants of the Global Burden of Disease 1990 study.
+const (
+	ageWeightC    = 0.1658
+	ageWeightBeta = 0.04
+)
+
+// yll returns the years of life lost to a death at age a with remaining
+// life expectancy l, discounted and age weighted as configured, using the
+// formula of Murray and Lopez (1996), The Global Burden of Disease.
+func (c ageMortalityConfig) yll(a, l float64) float64 {
+	r, k := c.DiscountRate, c.AgeWeighting
+	var y float64
+	if r == 0 {
+		y = (1 - k) * l
+	} else {
+		y = (1 - k) / r * (1 - math.Exp(-r*l))
+	}
+	if k != 0 {
+		rb := r + ageWeightBeta
+		y += k * ageWeightC * math.Exp(r*a) / (rb * rb) *
+			(math.Exp(-rb*(l+a))*(-rb*(l+a)-1) - math.Exp(-rb*a)*(-rb*a-1))
+	}
+	return y
+}
+
+// burden returns the YLL and DALYs of deaths in g.
+func (c ageMortalityConfig) burden(g ageGroup, deaths float64) ageBurden {
+	yll := deaths * c.yll(g.Age, g.LifeExpectancy)
+	return ageBurden{AgeGroup: g.Name, Deaths: deaths, YLL: yll, DALY: yll * (1 + c.YLDRatio)}
+}
+
+// healthBurden holds the health burden of the PM2.5 caused by a demand.
+type healthBurden struct {
+	// ByAge is the burden by population (census populations and income
+	// deciles) and age group, in the order of the age mortality file.
+	ByAge map[string][]ageBurden
+
+	// BySCC is the burden by population and emitting SCC, indexed as
+	// s.SCCs, summed over age groups.
+	BySCC map[string][]ageBurden
+}
+
+// getHealthBurden returns the deaths attributable to the PM2.5 caused by
+// demand, and the resulting YLL and DALYs, by population, age group and
+// emitting SCC.
+//
+// As in EIEIO's health impact calculations, the concentration response in
+// each grid cell is linearized around the baseline concentration from the
+// evaluation inventory, but with the baseline incidence of each age group
+// rather than the all-age incidence of the mortality rate file. Since PM2.5
+// mortality is concentrated in older people, this matters for populations
+// whose age distributions differ.
+func getHealthBurden(ctx context.Context, s *eieio.Server, year int32, aqm, hrName string, demand *eieiorpc.Vector) (*healthBurden, error) {
+	ctx, span := startSpan(ctx, "getHealthBurden")
+	defer span.End()
+	hr, err := hazardRatio(hrName)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readAgeGroups(ageMortality.File)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading age-stratified mortality")
+	}
+	if ageMortality.AgeWeighting != 0 {
+		for _, popGroups := range groups {
+			for i := range popGroups {
+				if popGroups[i].Age, err = ageGroupAge(popGroups[i].Name); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	conc, err := concentrationMatrix(ctx, s, &eieiorpc.ConcentrationMatrixInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nCells, nSCCs := conc.Dims()
+	if nSCCs != len(s.SCCs) {
+		return nil, errorf(kindNumeric, "expected concentrations to have #SCC %d columns, got %d", len(s.SCCs), nSCCs)
+	}
+	done := timeRPC(ctx, "EvaluationConcentrations")
+	baseline, err := s.CSTConfig.EvaluationConcentrations(ctx, &eieiorpc.EvaluationConcentrationsInput{
+		Year:      year,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		AQM:       aqm,
+	})
+	done(&err)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting baseline concentrations")
+	}
+	if err := checkGrid(s, aqm, len(baseline.Data), "baseline concentrations"); err != nil {
+		return nil, err
+	}
+	// response is the deaths per person per μg/m³ in each grid cell for a
+	// baseline incidence of one death per year per 100,000 people; deaths
+	// in each age group scale with its incidence and share of the
+	// population.
+	response := make([]float64, nCells)
+	for i, z := range baseline.Data {
+		if z > 0 {
+			response[i] = epi.Outcome(1, z, epi.Io(z, hr, 1e-5), hr) / z
+		}
+	}
+	// Only PM2.5 above the background concentration counts.
+	if !backgroundFor(ctx).empty() {
+		total := make([]float64, nCells)
+		for i := range total {
+			total[i] = mat.Sum(conc.RowView(i))
+		}
+		bg, err := backgroundFor(ctx).grid(nCells)
+		if err != nil {
+			return nil, err
+		}
+		if response, err = scaleByCell(response, linearExposure.cellWeights(total, bg)); err != nil {
+			return nil, err
+		}
+	}
+
+	popNames, grids, err := getPopulationGrids(ctx, s, aqm, nCells)
+	if err != nil {
+		return nil, err
+	}
+	d, err := getSubdomain(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	cells := make([]int, nCells)
+	for i := range cells {
+		cells[i] = i
+	}
+	if d != nil {
+		cells = d.Cells
+	}
+
+	b := &healthBurden{ByAge: make(map[string][]ageBurden), BySCC: make(map[string][]ageBurden)}
+	for _, pop := range popNames {
+		popGroups, ok := groups[pop]
+		if !ok {
+			popGroups = groups["*"]
+		}
+		if len(popGroups) == 0 {
+			return nil, fmt.Errorf("no age groups for population %s", pop)
+		}
+		byAge := make([]ageBurden, len(popGroups))
+		for k, g := range popGroups {
+			byAge[k].AgeGroup = g.Name
+		}
+		bySCC := make([]ageBurden, nSCCs)
+		for j := range bySCC {
+			var perIncidence float64
+			for _, i := range cells {
+				perIncidence += grids[pop][i] * response[i] * conc.At(i, j)
+			}
+			bySCC[j].AgeGroup = ageTotal
+			if perIncidence == 0 {
+				continue
+			}
+			for k, g := range popGroups {
+				burden := ageMortality.burden(g, perIncidence*g.Incidence*g.Share)
+				byAge[k].add(burden)
+				bySCC[j].add(burden)
+			}
+		}
+		b.ByAge[pop], b.BySCC[pop] = byAge, bySCC
+	}
+	return b, nil
+}
+
+// ageGroupAge returns the age at death used for age weighting for an age
+// group named "lo-hi" (the midpoint) or "lo+" (lo).
+func ageGroupAge(name string) (float64, error) {
+	if lo := strings.TrimSuffix(name, "+"); lo != name {
+		return strconv.ParseFloat(lo, 64)
+	}
+	parts := strings.Split(name, "-")
+	if len(parts) == 2 {
+		lo, err1 := strconv.ParseFloat(parts[0], 64)
+		hi, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 == nil && err2 == nil && hi >= lo {
+			return (lo + hi + 1) / 2, nil
+		}
+	}
+	return 0, fmt.Errorf("age weighting requires age groups named like \"30-34\" or \"85+\", not %q", name)
+}
+
+// ageTotal is the AgeGroup of results that sum over age groups.
+const ageTotal = "All"
+
+var burdenHeader = []string{"Deaths", "YLL", "DALY"}
+
+// writeHealthBurden writes the deaths, YLL and DALYs attributable to the
+// PM2.5 caused by demand by population and age group to path, and by
+// population and emitting SCC to sectorsPath.
+func writeHealthBurden(ctx context.Context, s *eieio.Server, sc *scenario, demand *eieiorpc.Vector, path, sectorsPath string) error {
+	b, err := getHealthBurden(ctx, s, sc.Year, sc.AQM, sc.HR, demand)
+	if err != nil {
+		return err
+	}
+	totals := make(map[string]float64)
+	for pop, byAge := range b.ByAge {
+		for _, d := range byAge {
+			totals[pop] += d.Deaths
+		}
+	}
+	row := func(pop, key string, d ageBurden) []string {
+		return []string{pop, labels.get(pop), key, formatFloat(d.Deaths), formatFloat(d.YLL), formatFloat(d.DALY)}
+	}
+	var rows [][]string
+	for _, pop := range sortedKeys(totals) {
+		total := ageBurden{AgeGroup: ageTotal}
+		for _, d := range b.ByAge[pop] {
+			total.add(d)
+			rows = append(rows, row(pop, d.AgeGroup, d))
+		}
+		rows = append(rows, row(pop, ageTotal, total))
+	}
+	if err := writeCSV(path, append([]string{"Population", "Label", "AgeGroup"}, burdenHeader...), rows); err != nil {
+		return err
+	}
+
+	rows = rows[:0]
+	for _, pop := range sortedKeys(totals) {
+		for j, d := range b.BySCC[pop] {
+			if d.Deaths != 0 {
+				rows = append(rows, row(pop, string(s.SCCs[j]), d))
+			}
+		}
+	}
+	return writeCSV(sectorsPath, append([]string{"Population", "Label", "SCC"}, burdenHeader...), rows)
+}
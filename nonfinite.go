@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"log"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Policies for NaN and infinite values produced by a pipeline stage; see
+// the NonFinite setting.
+const (
+	// nonFiniteFail stops with a numeric error naming the stage and the
+	// offending entries.
+	nonFiniteFail = "fail"
+
+	// nonFiniteZero replaces the values with zero and logs a warning,
+	// which is recorded in metadata.csv.
+	nonFiniteZero = "zero"
+)
+
+// nonFinitePolicy is the NonFinite setting in the [Sandbox] config table.
+var nonFinitePolicy = nonFiniteFail
+
+// setNonFinitePolicy sets nonFinitePolicy to p, which defaults to fail.
+func setNonFinitePolicy(p string) error {
+	switch p {
+	case "":
+		p = nonFiniteFail
+	case nonFiniteFail, nonFiniteZero:
+	default:
+		return errorf(kindConfig, "invalid NonFinite %q; must be %s or %s", p, nonFiniteFail, nonFiniteZero)
+	}
+	nonFinitePolicy = p
+	return nil
+}
+
+// nonFiniteReportLimit is the number of offending entries named in
+// errors and warnings.
+const nonFiniteReportLimit = 5
+
+// allFinite returns whether none of v is NaN or infinite.
+func allFinite(v []float64) bool {
+	for _, x := range v {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFinite applies nonFinitePolicy to the values v produced by stage,
+// whose entries are named by label, e.g. the SCC of each index. Callers
+// only check stages whose inputs are finite, so that the stage reported
+// is the one that introduced the values; the demand of a demographic
+// skipped for missing CES data, for one, is NaN by design.
+func checkFinite(ctx context.Context, stage string, v []float64, label func(i int) string) error {
+	var bad []int
+	for i, x := range v {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	var entries []string
+	for _, i := range bad {
+		if len(entries) == nonFiniteReportLimit {
+			entries = append(entries, fmt.Sprintf("and %d more", len(bad)-nonFiniteReportLimit))
+			break
+		}
+		entries = append(entries, fmt.Sprintf("%s=%g", label(i), v[i]))
+	}
+	msg := fmt.Sprintf("%s produced %d non-finite values of %d: %s", stage, len(bad), len(v), strings.Join(entries, ", "))
+	if nonFinitePolicy == nonFiniteFail {
+		return errorf(kindNumeric, "%s; set NonFinite = %q in [Sandbox] to zero them instead", msg, nonFiniteZero)
+	}
+	for _, i := range bad {
+		v[i] = 0
+	}
+	recordNonFinite(ctx, msg+"; replaced with 0")
+	return nil
+}
+
+// checkFiniteMap applies checkFinite to the values of m, whose entries are
+// labeled by their keys.
+func checkFiniteMap(ctx context.Context, stage string, m map[string]float64) error {
+	keys := sortedKeys(m)
+	v := make([]float64, len(keys))
+	for i, k := range keys {
+		v[i] = m[k]
+	}
+	if err := checkFinite(ctx, stage, v, func(i int) string { return keys[i] }); err != nil {
+		return err
+	}
+	for i, k := range keys {
+		m[k] = v[i]
+	}
+	return nil
+}
+
+// matrixLabel labels the entries of the raw data of a matrix with cols
+// columns by grid cell (row) and SCC of s (column).
+func matrixLabel(s *eieio.Server, cols int) func(int) string {
+	return func(i int) string { return fmt.Sprintf("cell %d SCC %s", i/cols, s.SCCs[i%cols]) }
+}
+
+// indexLabel labels entries by their index, prefixed by what they index,
+// e.g. "cell 12".
+func indexLabel(what string) func(int) string {
+	return func(i int) string { return fmt.Sprintf("%s %d", what, i) }
+}
+
+// sccLabel labels entries by the SCCs of s.
+func sccLabel(s *eieio.Server) func(int) string {
+	return func(i int) string { return "SCC " + string(s.SCCs[i]) }
+}
+
+// commodityLabel labels entries by the commodities of s, or by index if
+// they can't be listed.
+func commodityLabel(ctx context.Context, s *eieio.Server) func(int) string {
+	return func(i int) string {
+		if c, err := s.Commodities(ctx, nil); err == nil && i < len(c.List) {
+			return c.List[i]
+		}
+		return indexLabel("commodity")(i)
+	}
+}
+
+// nonFiniteLog collects the warnings of zero-filled values during a
+// scenario, for its metadata.
+type nonFiniteLog struct {
+	mx    sync.Mutex
+	notes []string
+}
+
+type nonFiniteLogKey struct{}
+
+// withNonFiniteLog returns a context that collects the warnings of
+// checkFinite in the returned log.
+func withNonFiniteLog(ctx context.Context) (context.Context, *nonFiniteLog) {
+	l := &nonFiniteLog{}
+	return context.WithValue(ctx, nonFiniteLogKey{}, l), l
+}
+
+// recordNonFinite logs a warning about zero-filled values and adds it to
+// the nonFiniteLog in ctx, if any. Repeats of a warning in the same log,
+// such as for each demographic, are only logged once.
+func recordNonFinite(ctx context.Context, note string) {
+	l, ok := ctx.Value(nonFiniteLogKey{}).(*nonFiniteLog)
+	if !ok {
+		log.Printf("Warning: %s", note)
+		return
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	for _, n := range l.notes {
+		if n == note {
+			return
+		}
+	}
+	log.Printf("Warning: %s", note)
+	l.notes = append(l.notes, note)
+}
+
+// Notes returns the warnings recorded in l.
+func (l *nonFiniteLog) Notes() []string {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return append([]string{}, l.notes...)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifyConfig specifies where to send a summary when a batch finishes.
+// Values may reference environment variables, e.g. Password = "${SMTP_PASSWORD}".
+type notifyConfig struct {
+	// WebhookURL receives an HTTP POST of the batch summary as JSON.
+	WebhookURL string
+
+	// SlackWebhookURL and TeamsWebhookURL are incoming webhooks of a
+	// Slack or Microsoft Teams channel, which is posted a compact
+	// summary: each scenario's headline metrics, its most and least
+	// exposed populations and the sectors with the most PM2.5 emissions,
+	// with links to the results.
+	SlackWebhookURL string
+	TeamsWebhookURL string
+
+	// ArtifactURL, if set, is the URL at which OutputDir is published,
+	// e.g. that of a bucket it is copied to, for the links in Slack and
+	// Teams summaries. Otherwise they give local paths.
+	ArtifactURL string
+
+	// SMTP specifies an email server and recipients for a plain-text
+	// summary. Email is sent only if Host and To are set.
+	SMTP struct {
+		Host     string
+		Port     int
+		Username string
+		Password string
+		From     string
+		To       []string
+	}
+}
+
+// batchSummary summarizes the outcome of a batch run.
+type batchSummary struct {
+	Manifest  string
+	OutputDir string
+	Started   time.Time
+	Finished  time.Time
+	Done      int
+	Failed    int
+	Scenarios []scenarioSummary
+}
+
+// scenarioSummary summarizes the outcome of one scenario in a batch.
+// Metrics are only available for scenarios run in the current invocation.
+type scenarioSummary struct {
+	Name      string
+	Status    jobStatus
+	Error     string `json:",omitempty"`
+	ExitCode  int    `json:",omitempty"`
+	OutputDir string
+	Metrics   map[string]float64 `json:",omitempty"`
+
+	// Disparities are the populations with the highest and lowest mean
+	// exposure relative to that of the total population.
+	Disparities []populationDisparity `json:",omitempty"`
+
+	// TopSectors are the SCCs with the greatest PM2.5 emissions.
+	TopSectors []sectorShare `json:",omitempty"`
+}
+
+// populationDisparity is a population's mean exposure and its ratio to
+// that of the total population.
+type populationDisparity struct {
+	Population   string
+	Label        string
+	MeanExposure float64
+	RatioToTotal float64
+}
+
+// summarySectorsCount is the number of sectors listed in notifications.
+const summarySectorsCount = 3
+
+// summaryMetrics picks the headline metrics of r for a notification:
+// total-population exposure, deaths and damages.
+func summaryMetrics(r *scenarioResult, totalPopColumn string) map[string]float64 {
+	if r == nil {
+		return nil
+	}
+	m := make(map[string]float64)
+	if v, ok := r.Exposure[totalPopColumn]; ok {
+		m["Exposure"] = v
+	}
+	if v, ok := r.Deaths[totalPopColumn]; ok {
+		m["Deaths"] = v
+	}
+	if v, ok := r.Damages[totalPopColumn]; ok {
+		m["Damages"] = v
+	}
+	return m
+}
+
+// summaryDisparities returns the populations of r with the highest and
+// lowest mean exposure relative to that of the total population, or nil
+// if r has no mean exposure for the total population.
+func summaryDisparities(r *scenarioResult, totalPopColumn string) []populationDisparity {
+	if r == nil {
+		return nil
+	}
+	total := r.MeanExposure[totalPopColumn]
+	if total == 0 {
+		return nil
+	}
+	var high, low *populationDisparity
+	for _, popName := range sortedKeys(r.MeanExposure) {
+		if popName == totalPopColumn {
+			continue
+		}
+		v := r.MeanExposure[popName]
+		d := &populationDisparity{Population: popName, Label: labels.get(popName), MeanExposure: v, RatioToTotal: v / total}
+		if high == nil || d.RatioToTotal > high.RatioToTotal {
+			high = d
+		}
+		if low == nil || d.RatioToTotal < low.RatioToTotal {
+			low = d
+		}
+	}
+	if high == nil {
+		return nil
+	}
+	if high == low {
+		return []populationDisparity{*high}
+	}
+	return []populationDisparity{*high, *low}
+}
+
+// String formats the summary as a plain-text message.
+func (b *batchSummary) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Batch %s finished at %s (%s)\n", b.Manifest, b.Finished.Format(time.RFC3339), b.Finished.Sub(b.Started).Round(time.Second))
+	fmt.Fprintf(&buf, "%d done, %d not completed\n", b.Done, b.Failed)
+	fmt.Fprintf(&buf, "Output: %s\n\n", b.OutputDir)
+	for _, sc := range b.Scenarios {
+		fmt.Fprintf(&buf, "%s: %s", sc.Name, sc.Status)
+		for _, name := range []string{"Exposure", "Deaths", "Damages"} {
+			if v, ok := sc.Metrics[name]; ok {
+				fmt.Fprintf(&buf, "; %s=%.4g", name, v)
+			}
+		}
+		if sc.Error != "" {
+			fmt.Fprintf(&buf, "; error: %s", sc.Error)
+		}
+		fmt.Fprintf(&buf, "\n    %s\n", sc.OutputDir)
+	}
+	return buf.String()
+}
+
+// notify sends summary to the destinations in cfg. All destinations are
+// attempted; the first error encountered is returned.
+func notify(cfg notifyConfig, summary *batchSummary) error {
+	var firstErr error
+	if url := os.ExpandEnv(cfg.WebhookURL); url != "" {
+		if err := postJSON(url, summary); err != nil {
+			firstErr = fmt.Errorf("webhook notification: %v", err)
+		}
+	}
+	if url := os.ExpandEnv(cfg.SlackWebhookURL); url != "" {
+		text := strings.Join(summary.chatLines(cfg, slackMarkup), "\n")
+		if err := postJSON(url, map[string]string{"text": text}); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Slack notification: %v", err)
+		}
+	}
+	if url := os.ExpandEnv(cfg.TeamsWebhookURL); url != "" {
+		if err := postJSON(url, teamsCard(summary.chatLines(cfg, teamsMarkup))); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Teams notification: %v", err)
+		}
+	}
+	if cfg.SMTP.Host != "" && len(cfg.SMTP.To) > 0 {
+		if err := sendEmail(cfg, summary); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("email notification: %v", err)
+		}
+	}
+	return firstErr
+}
+
+// chatMarkup is the markup of a chat message.
+type chatMarkup struct {
+	bold   func(text string) string
+	link   func(text, url string) string
+	escape func(text string) string
+}
+
+var (
+	slackMarkup = chatMarkup{
+		bold:   func(text string) string { return "*" + text + "*" },
+		link:   func(text, url string) string { return "<" + url + "|" + text + ">" },
+		escape: strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace,
+	}
+	teamsMarkup = chatMarkup{
+		bold:   func(text string) string { return "**" + text + "**" },
+		link:   func(text, url string) string { return "[" + text + "](" + url + ")" },
+		escape: strings.NewReplacer("*", "\\*", "_", "\\_", "[", "\\[", "]", "\\]").Replace,
+	}
+)
+
+// chatLines formats the summary as the lines of a compact chat message in
+// markup m, linking to the outputs at cfg.ArtifactURL.
+func (b *batchSummary) chatLines(cfg notifyConfig, m chatMarkup) []string {
+	base := strings.TrimSuffix(os.ExpandEnv(cfg.ArtifactURL), "/")
+	artifact := func(text, rel string) string {
+		if base == "" {
+			return "`" + filepath.Join(b.OutputDir, rel) + "`"
+		}
+		return m.link(m.escape(text), base+"/"+filepath.ToSlash(rel))
+	}
+	lines := []string{
+		fmt.Sprintf("%s: %d done, %d not completed in %s", m.bold(m.escape("Batch "+b.Manifest)), b.Done, b.Failed, b.Finished.Sub(b.Started).Round(time.Second)),
+		"Index: " + artifact("index.csv", "index.csv"),
+	}
+	for _, sc := range b.Scenarios {
+		line := fmt.Sprintf("• %s %s", m.bold(m.escape(sc.Name)), sc.Status)
+		for _, name := range []string{"Exposure", "Deaths", "Damages"} {
+			if v, ok := sc.Metrics[name]; ok {
+				line += fmt.Sprintf("; %s %.4g", name, v)
+			}
+		}
+		if sc.Error != "" {
+			line += "; error: " + m.escape(sc.Error)
+		}
+		lines = append(lines, line)
+		if len(sc.Disparities) > 0 {
+			var parts []string
+			for i, d := range sc.Disparities {
+				which := "most exposed"
+				if i > 0 {
+					which = "least exposed"
+				}
+				parts = append(parts, fmt.Sprintf("%s: %s, %.2f× the total population's mean", which, m.escape(d.Label), d.RatioToTotal))
+			}
+			lines = append(lines, "    "+strings.Join(parts, "; "))
+		}
+		if len(sc.TopSectors) > 0 {
+			var parts []string
+			for _, sector := range sc.TopSectors {
+				parts = append(parts, fmt.Sprintf("%s (%.0f%%)", sector.SCC, sector.Share*100))
+			}
+			lines = append(lines, "    top PM2.5 sectors: "+strings.Join(parts, ", "))
+		}
+		if sc.Status == jobDone {
+			lines = append(lines, "    results: "+artifact(sc.Name, sc.Name))
+		}
+	}
+	return lines
+}
+
+// teamsCard returns a Microsoft Teams message of an Adaptive Card with a
+// text block for each of lines.
+func teamsCard(lines []string) interface{} {
+	var body []map[string]interface{}
+	for _, line := range lines {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": line, "wrap": true})
+	}
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.2",
+				"body":    body,
+			},
+		}},
+	}
+}
+
+// postJSON posts v as JSON to url.
+func postJSON(url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func sendEmail(cfg notifyConfig, summary *batchSummary) error {
+	host, from := os.ExpandEnv(cfg.SMTP.Host), os.ExpandEnv(cfg.SMTP.From)
+	port := cfg.SMTP.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if cfg.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", os.ExpandEnv(cfg.SMTP.Username), os.ExpandEnv(cfg.SMTP.Password), host)
+	}
+	status := "completed"
+	if summary.Failed > 0 {
+		status = fmt.Sprintf("%d scenarios not completed", summary.Failed)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: inmap_sandbox batch %s\r\n\r\n%s",
+		from, strings.Join(cfg.SMTP.To, ", "), status,
+		strings.Replace(summary.String(), "\n", "\r\n", -1))
+	return smtp.SendMail(host+":"+strconv.Itoa(port), auth, from, cfg.SMTP.To, []byte(msg))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"example.com/m/v2/exposuremath"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/optimize/convex/lp"
+	"log"
+	"os"
+)
+
+// Disparity metrics that can be minimized by optimizeReductions.
+const (
+	// disparityRange is the difference between the highest and lowest
+	// group mean exposures.
+	disparityRange = "range"
+
+	// disparityMax is the highest group mean exposure.
+	disparityMax = "max"
+)
+
+// groupExposures returns the mean exposure of each group when each SCC's
+// emissions are scaled by remaining.
+func groupExposures(exposure *mat.Dense, remaining []float64) []float64 {
+	nGroups, _ := exposure.Dims()
+	e := mat.NewVecDense(nGroups, nil)
+	e.MulVec(exposure, mat.NewVecDense(len(remaining), remaining))
+	return e.RawVector().Data
+}
+
+// disparity returns the value of metric for the given group exposures.
+func disparity(metric string, groupExposure []float64) float64 {
+	diff, hi := exposuremath.Range(groupExposure)
+	if metric == disparityMax {
+		return hi
+	}
+	return diff
+}
+
+// optimizeReductions chooses reductions in the emissions of the maxSectors
+// SCCs contributing most to exposure, reducing total emissions (emis, by
+// SCC) by no more than budget, so as to minimize metric. exposure is the
+// group-by-SCC exposure matrix from sectorExposure. It returns the
+// fraction of each SCC's emissions that remains.
+func optimizeReductions(exposure *mat.Dense, emis []float64, budget float64, metric string, maxSectors int) ([]float64, error) {
+	if metric != disparityRange && metric != disparityMax {
+		return nil, fmt.Errorf("invalid disparity metric %q", metric)
+	}
+	nGroups, nSCC := exposure.Dims()
+	free := reducibleSectors(exposure, maxSectors)
+	remaining := make([]float64, nSCC)
+	for j := range remaining {
+		remaining[j] = 1
+	}
+	isFree := make(map[int]bool)
+	for _, j := range free {
+		isFree[j] = true
+	}
+	fixed := groupExposures(exposure, func() []float64 {
+		f := make([]float64, nSCC)
+		for j := range f {
+			if !isFree[j] {
+				f[j] = 1
+			}
+		}
+		return f
+	}())
+
+	// Standard form, with variables x (remaining fraction of each free
+	// sector), u and l (upper and lower bounds on group exposure), and
+	// slacks:
+	//   minimize u - l (or u)
+	//   s.t. E_g·x + fixed_g - u + s_g = 0   for each group g
+	//        -E_g·x - fixed_g + l + t_g = 0  for each group g
+	//        x_k + r_k = 1                   for each free sector k
+	//        Σ emis_k (1 - x_k) + q = budget
+	n := len(free)
+	uCol, lCol := n, n+1
+	nVars := n + 2 + 2*nGroups + n + 1
+	nRows := 2*nGroups + n + 1
+	a := mat.NewDense(nRows, nVars, nil)
+	b := make([]float64, nRows)
+	c := make([]float64, nVars)
+	slack := n + 2
+	for g := 0; g < nGroups; g++ {
+		for k, j := range free {
+			a.Set(g, k, exposure.At(g, j))
+			a.Set(nGroups+g, k, -exposure.At(g, j))
+		}
+		a.Set(g, uCol, -1)
+		a.Set(g, slack, 1)
+		b[g] = -fixed[g]
+		slack++
+		a.Set(nGroups+g, lCol, 1)
+		a.Set(nGroups+g, slack, 1)
+		b[nGroups+g] = fixed[g]
+		slack++
+	}
+	budgetRow := nRows - 1
+	b[budgetRow] = budget
+	for k, j := range free {
+		row := 2*nGroups + k
+		a.Set(row, k, 1)
+		a.Set(row, slack, 1)
+		b[row] = 1
+		slack++
+		a.Set(budgetRow, k, -emis[j])
+		b[budgetRow] -= emis[j]
+	}
+	a.Set(budgetRow, slack, 1)
+	c[uCol] = 1
+	if metric == disparityRange {
+		c[lCol] = -1
+	}
+
+	_, x, err := lp.Simplex(c, a, b, 1e-10, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error optimizing sector reductions")
+	}
+	for k, j := range free {
+		remaining[j] = x[k]
+	}
+	return remaining, nil
+}
+
+// optimizeCommand chooses the sector emission reductions, within a budget,
+// that minimize exposure disparity across census population groups.
+func optimizeCommand(args []string) error {
+	fs := flag.NewFlagSet("optimize", flag.ExitOnError)
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	income := fs.Bool("income", false, "compare income deciles rather than ethnicities")
+	budget := fs.Float64("budget", 0.1, "maximum reduction in total PM2.5 emissions, as a fraction")
+	metric := fs.String("metric", disparityRange, "disparity metric to minimize: range (highest minus lowest group exposure) or max (highest group exposure)")
+	maxSectors := fs.Int("sectors", 200, "number of sectors, by contribution to exposure, that may be reduced")
+	out := fs.String("o", "optimal_reductions.csv", "output CSV file")
+	expFunc := fs.String("exposure-function", "", "exposure function, e.g. threshold:2.4, overriding the ExposureFunction config setting")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s optimize [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	ctx, err := exposureFunctionFlag(context.Background(), *expFunc)
+	if err != nil {
+		return err
+	}
+	if *budget < 0 || *budget > 1 {
+		return errorf(kindUsage, "budget must be between 0 and 1, got %g", *budget)
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            int32(*year),
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return errors.Wrap(err, "error getting final demand")
+	}
+	groups := exposureGroups(s, *income)
+	exposure, err := sectorExposure(ctx, s, demand, int32(*year), *aqm, groups)
+	if err != nil {
+		return err
+	}
+	emisVec, err := getEmissionsBySCC(ctx, demand, s, eieiorpc.Emission_PM25, int32(*year), LOC, *aqm)
+	if err != nil {
+		return err
+	}
+	emis := emisVec.RawVector().Data
+	remaining, err := optimizeReductions(exposure, emis, *budget*mat.Sum(emisVec), *metric, *maxSectors)
+	if err != nil {
+		return err
+	}
+
+	reduction, total, err := writeSectorReductions(*out, s, emis, remaining)
+	if err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "optimal_reductions.csv"); err != nil {
+		return err
+	}
+	ones := make([]float64, len(remaining))
+	for i := range ones {
+		ones[i] = 1
+	}
+	log.Printf("Reducing PM2.5 emissions by %.4g kg/year (%.2f%% of total) changes exposure disparity (%s) from %.4g to %.4g μg/m³; sector reductions written to %s",
+		reduction, reduction/total*100, *metric, disparity(*metric, groupExposures(exposure, ones)), disparity(*metric, groupExposures(exposure, remaining)), *out)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"testing"
+)
+
+// testExposure is a group-by-SCC exposure matrix of two groups: the first
+// is exposed only to SCC 0, the second twice as much to SCC 1, and both to
+// SCC 2. SCC 3 causes no exposure. At current emissions, the groups'
+// exposures are 2 and 3.
+func testExposure() *mat.Dense {
+	return mat.NewDense(2, 4, []float64{
+		1, 0, 1, 0,
+		0, 2, 1, 0,
+	})
+}
+
+func TestOptimizeReductions(t *testing.T) {
+	emis := []float64{1, 1, 1, 1}
+	for _, test := range []struct {
+		name      string
+		metric    string
+		budget    float64
+		disparity float64
+	}{
+		// Halving SCC 1 equalizes the groups.
+		{name: "range", metric: disparityRange, budget: 1, disparity: 0},
+		{name: "range within a small budget", metric: disparityRange, budget: 0.25, disparity: 0.5},
+		// Halving SCC 1 brings the second group down to the first, and
+		// halving SCC 2 then lowers both.
+		{name: "max", metric: disparityMax, budget: 1, disparity: 1.5},
+		{name: "no budget", metric: disparityMax, budget: 0, disparity: 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			remaining, err := optimizeReductions(testExposure(), emis, test.budget, test.metric, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reduced float64
+			for j, r := range remaining {
+				if r < -1e-9 || r > 1+1e-9 {
+					t.Errorf("SCC %d: remaining fraction %g is outside [0, 1]", j, r)
+				}
+				reduced += emis[j] * (1 - r)
+			}
+			if reduced > test.budget+1e-9 {
+				t.Errorf("reduced emissions by %g, more than the budget %g", reduced, test.budget)
+			}
+			if remaining[3] != 1 {
+				t.Errorf("SCC 3 causes no exposure but was reduced to %g", remaining[3])
+			}
+			if got := disparity(test.metric, groupExposures(testExposure(), remaining)); math.Abs(got-test.disparity) > 1e-9 {
+				t.Errorf("got %s disparity %g with %v remaining, want %g", test.metric, got, remaining, test.disparity)
+			}
+		})
+	}
+}
+
+func TestOptimizeReductionsInvalidMetric(t *testing.T) {
+	if _, err := optimizeReductions(testExposure(), []float64{1, 1, 1, 1}, 1, "mean", 4); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// supplyChainPath is one path through the supply chain, starting with the
+// commodity purchased by final consumers and ending with the sector where
+// the emissions occur.
+type supplyChainPath struct {
+	// Sectors are indices into the commodity list, from final demand upstream.
+	Sectors []int
+
+	// Emissions (kg/year) occurring in the last sector of the path.
+	Emissions float64
+}
+
+// structuralPaths performs a structural path analysis of demand, returning
+// the topN paths of at most maxDepth upstream steps with the greatest
+// emissions. Branches whose total upstream emissions fall below
+// threshold times the total footprint are not explored.
+func structuralPaths(l *leontief, demand []float64, maxDepth, topN int, threshold float64) []supplyChainPath {
+	var total float64
+	for j, d := range demand {
+		total += l.multiplier.AtVec(j) * d
+	}
+	cutoff := threshold * total
+
+	var paths []supplyChainPath
+	var visit func(path []int, flow float64)
+	visit = func(path []int, flow float64) {
+		i := path[len(path)-1]
+		if e := l.intensity.AtVec(i) * flow; e > cutoff {
+			paths = append(paths, supplyChainPath{
+				Sectors:   append([]int(nil), path...),
+				Emissions: e,
+			})
+		}
+		if len(path) > maxDepth {
+			return
+		}
+		for k := range demand {
+			upstream := l.direct.At(k, i) * flow
+			if upstream <= 0 || l.multiplier.AtVec(k)*upstream < cutoff {
+				continue
+			}
+			visit(append(path, k), upstream)
+		}
+	}
+	for j, d := range demand {
+		if d <= 0 || l.multiplier.AtVec(j)*d < cutoff {
+			continue
+		}
+		visit([]int{j}, d)
+	}
+
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Emissions > paths[j].Emissions })
+	if len(paths) > topN {
+		paths = paths[:topN]
+	}
+	return paths
+}
+
+// getDemographicPaths returns the top supply-chain paths of the emissions
+// of pollutant pol caused by the consumption of dem.
+func getDemographicPaths(ctx context.Context, s *eieio.Server, dem *eieiorpc.Demograph, year int32, loc eieiorpc.Location, pol eieiorpc.Emission, aqm string, maxDepth, topN int) ([]supplyChainPath, error) {
+	ctx, span := startSpan(ctx, "getDemographicPaths")
+	defer span.End()
+	demand, err := getDemographicDemand(ctx, s, dem, year, nil)
+	if err != nil {
+		return nil, err
+	}
+	l, err := newLeontief(ctx, s, year, loc, pol, aqm)
+	if err != nil {
+		return nil, err
+	}
+	return structuralPaths(l, demand.Data, maxDepth, topN, 1e-6), nil
+}
+
+// pathsCommand writes the top supply-chain paths of a demographic's
+// emission footprint to a CSV file.
+func pathsCommand(args []string) error {
+	fs := flag.NewFlagSet("paths", flag.ExitOnError)
+	demKey := fs.String("demographic", "decile:LowestTen", "demograph key to analyze")
+	depth := fs.Int("depth", 3, "maximum number of upstream supply-chain steps")
+	top := fs.Int("top", 20, "number of paths to report")
+	emission := fs.String("emission", eieiorpc.Emission_PM25.String(), "emitted pollutant")
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	out := fs.String("o", "paths.csv", "output CSV file")
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s paths [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	dems, err := parseDemographs(*demKey)
+	if err != nil {
+		return err
+	}
+	if len(dems) != 1 {
+		return errorf(kindUsage, "paths requires a single demographic, got %q", *demKey)
+	}
+	pol, ok := eieiorpc.Emission_value[*emission]
+	if !ok {
+		return errorf(kindUsage, "invalid emission %q", *emission)
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	ctx := context.Background()
+	paths, err := getDemographicPaths(ctx, s, dems[0], int32(*year), LOC, eieiorpc.Emission(pol), *aqm, *depth, *top)
+	if err != nil {
+		return errors.Wrap(err, "error decomposing footprint")
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for rank, p := range paths {
+		names := make([]string, len(p.Sectors))
+		for i, sector := range p.Sectors {
+			names[i] = commodities.List[sector]
+		}
+		rows = append(rows, []string{strconv.Itoa(rank + 1), strconv.Itoa(len(p.Sectors) - 1), "Households > " + strings.Join(names, " > "), formatFloat(p.Emissions)})
+	}
+	if err := writeCSV(*out, []string{"Rank", "Depth", "Path", "Emissions"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "paths.csv"); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d supply-chain paths for %s to %s", len(paths), labels.demograph(dems[0]), *out)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// errServerBusy is returned by serverPool.do when its queue is full.
+var errServerBusy = errors.New("server busy: too many queued requests")
+
+// serverPool provides safe concurrent use of an eieio.Server by the request
+// handlers of a frontend such as an HTTP server. The server does not
+// document whether its methods can be called concurrently, and some of them
+// load data on first use, so requests are run by a fixed number of workers,
+// queueing while all workers are busy. With the default parallelism of one,
+// calls to the server are serialized; higher parallelism relies on the
+// server's internal caches being safe for concurrent use, as running
+// several years at once with Analyzer does.
+type serverPool struct {
+	s  *eieio.Server
+	wg sync.WaitGroup
+
+	mx        sync.Mutex
+	cond      *sync.Cond
+	pending   []*poolRequest
+	workers   int // running workers
+	idle      int // workers waiting for a request
+	target    int // parallelism
+	queueSize int
+	closed    bool
+}
+
+type poolRequest struct {
+	ctx  context.Context
+	f    func(ctx context.Context, s *eieio.Server) error
+	done chan error
+}
+
+// newServerPool starts parallelism workers running requests to s, with up
+// to queueSize requests waiting for a worker.
+func newServerPool(s *eieio.Server, parallelism, queueSize int) *serverPool {
+	p := &serverPool{s: s}
+	p.cond = sync.NewCond(&p.mx)
+	p.resize(parallelism, queueSize)
+	return p
+}
+
+// resize sets the number of workers and the number of requests that can
+// wait for one. Workers above the new parallelism stop once they finish
+// their current request, and queued requests are kept.
+func (p *serverPool) resize(parallelism, queueSize int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.target, p.queueSize = parallelism, queueSize
+	for ; p.workers < p.target; p.workers++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	p.cond.Broadcast()
+}
+
+func (p *serverPool) work() {
+	defer p.wg.Done()
+	p.mx.Lock()
+	for {
+		p.idle++
+		for len(p.pending) == 0 && !p.closed && p.workers <= p.target {
+			p.cond.Wait()
+		}
+		p.idle--
+		if p.workers > p.target || len(p.pending) == 0 {
+			p.workers--
+			p.mx.Unlock()
+			return
+		}
+		req := p.pending[0]
+		p.pending = p.pending[1:]
+		p.mx.Unlock()
+		if err := req.ctx.Err(); err != nil {
+			req.done <- err // abandoned while queued
+		} else {
+			req.done <- p.run(req)
+		}
+		p.mx.Lock()
+	}
+}
+
+// run calls req.f, recovering from panics so that one bad request doesn't
+// stop the worker.
+func (p *serverPool) run(req *poolRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in request: %v", r)
+		}
+	}()
+	return req.f(req.ctx, p.s)
+}
+
+// do runs f on a worker and waits until it returns or ctx is done. f must
+// not keep s after it returns. If all workers are busy and the queue is
+// full, do returns errServerBusy without running f.
+func (p *serverPool) do(ctx context.Context, f func(ctx context.Context, s *eieio.Server) error) error {
+	req := &poolRequest{ctx: ctx, f: f, done: make(chan error, 1)}
+	p.mx.Lock()
+	if len(p.pending) >= p.queueSize+p.idle {
+		p.mx.Unlock()
+		return errServerBusy
+	}
+	p.pending = append(p.pending, req)
+	p.cond.Signal()
+	p.mx.Unlock()
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queued returns the number of requests waiting for a worker.
+func (p *serverPool) queued() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return len(p.pending)
+}
+
+// close waits for queued and running requests to finish and stops the
+// workers. do must not be called after close.
+func (p *serverPool) close() {
+	p.mx.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mx.Unlock()
+	p.wg.Wait()
+}
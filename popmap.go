@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ctessum/geom/encoding/geojson"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+)
+
+// popMapFeature is a grid cell in a population map.
+type popMapFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geojson.Geometry      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// popMap is a GeoJSON FeatureCollection of grid cells.
+type popMap struct {
+	Type     string          `json:"type"`
+	Features []popMapFeature `json:"features"`
+}
+
+// writePopulationMap writes a GeoJSON map of the count and density (people
+// per km², assuming the grid's spatial reference is in meters) of each of
+// the named census populations in each grid cell of aqm to path, so that
+// population layers can be checked visually. Cells are polygons in
+// longitude and latitude, with the properties Cell and GridCell as in
+// gridRows, and the count and density of each population as POP and
+// POPDensity. If pops is empty, all census populations are included.
+// Counts are subject to small-cell suppression; suppressed ones are null.
+func writePopulationMap(ctx context.Context, s *eieio.Server, aqm string, pops []string, path string) (int, error) {
+	ctx, span := startSpan(ctx, "writePopulationMap")
+	defer span.End()
+	cells, index, ct, err := gridCells(s, aqm)
+	if err != nil {
+		return 0, err
+	}
+	popNames, grids, err := getPopulationGrids(ctx, s, aqm, len(cells))
+	if err != nil {
+		return 0, err
+	}
+	if len(pops) == 0 {
+		pops = popNames
+	}
+	for _, pop := range pops {
+		if _, ok := grids[pop]; !ok {
+			return 0, errorf(kindUsage, "invalid population %q; valid populations are the CensusPopColumns, CensusIncomeDecileNames and Sandbox.Populations in the config", pop)
+		}
+	}
+
+	m := popMap{Type: "FeatureCollection", Features: make([]popMapFeature, len(index))}
+	for i, c := range index {
+		cell := cells[c]
+		km2 := cell.Area() / 1e6
+		g, err := cell.Transform(ct)
+		if err != nil {
+			return 0, errors.Wrapf(err, "projecting grid cell %d", c)
+		}
+		geometry, err := geojson.ToGeoJSON(g)
+		if err != nil {
+			return 0, err
+		}
+		props := map[string]interface{}{"Cell": i, "GridCell": c}
+		for _, pop := range pops {
+			n := suppression.count(grids[pop][c])
+			if math.IsNaN(n) {
+				props[pop], props[pop+"Density"] = nil, nil
+				continue
+			}
+			props[pop] = n
+			if km2 > 0 {
+				props[pop+"Density"] = n / km2
+			}
+		}
+		m.Features[i] = popMapFeature{Type: "Feature", Geometry: geometry, Properties: props}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.NewEncoder(f).Encode(m); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return len(index), f.Close()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// derivedPopulation is a population group defined by an expression over
+// census populations, such as "Poverty & Under18", whose count in each
+// grid cell is calculated from theirs. Expressions use Go syntax and
+// precedence, with the operators below, where total is the cell's total
+// population:
+//   - a + b, a - b: the sum and difference of the counts (each
+//     difference below zero is zero, as in (a - b) + c)
+//   - a * b, a / b: the product and quotient, usually with a number, such
+//     as 0.5 * TotalPop
+//   - a & b: the people in both a and b, estimated as a·b/total, assuming
+//     that membership is independent within a cell
+//   - a | b: the people in either, a + b - a&b
+//   - !a: the people not in a, total - a
+type derivedPopulation struct {
+	Name, Expression string
+	expr             ast.Expr
+}
+
+// derivedPopulations are the populations defined in the config's
+// [Sandbox.Populations], sorted by name.
+var derivedPopulations []derivedPopulation
+
+// setDerivedPopulations parses the expressions of pops, by name, which
+// may refer to the census populations in censusPops.
+func setDerivedPopulations(pops map[string]string, censusPops []string) error {
+	known := make(map[string]bool, len(censusPops))
+	for _, p := range censusPops {
+		known[p] = true
+	}
+	derivedPopulations = nil
+	for name, e := range pops {
+		if known[name] {
+			return errorf(kindConfig, "population %q in [Sandbox.Populations] is already a census population", name)
+		}
+		expr, err := parser.ParseExpr(e)
+		if err != nil {
+			return errorf(kindConfig, "invalid expression %q for population %s: %v", e, name, err)
+		}
+		if err := checkPopulationExpr(expr, known); err != nil {
+			return errorf(kindConfig, "invalid expression %q for population %s: %v", e, name, err)
+		}
+		derivedPopulations = append(derivedPopulations, derivedPopulation{Name: name, Expression: e, expr: expr})
+	}
+	sort.Slice(derivedPopulations, func(i, j int) bool { return derivedPopulations[i].Name < derivedPopulations[j].Name })
+	return nil
+}
+
+// checkPopulationExpr returns an error if e uses an unsupported operator
+// or refers to a population not in known.
+func checkPopulationExpr(e ast.Expr, known map[string]bool) error {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return checkPopulationExpr(e.X, known)
+	case *ast.Ident:
+		if !known[e.Name] {
+			valid := make([]string, 0, len(known))
+			for p := range known {
+				valid = append(valid, p)
+			}
+			sort.Strings(valid)
+			return fmt.Errorf("unknown population %q; valid populations are %s", e.Name, strings.Join(valid, ", "))
+		}
+		return nil
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return fmt.Errorf("invalid number %s", e.Value)
+		}
+		return nil
+	case *ast.UnaryExpr:
+		if e.Op != token.NOT && e.Op != token.SUB {
+			return fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		return checkPopulationExpr(e.X, known)
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.AND, token.OR:
+		default:
+			return fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		if err := checkPopulationExpr(e.X, known); err != nil {
+			return err
+		}
+		return checkPopulationExpr(e.Y, known)
+	default:
+		return fmt.Errorf("unsupported expression %T", e)
+	}
+}
+
+// evalPopulationExpr evaluates e for a grid cell with the given census
+// population counts and total population.
+func evalPopulationExpr(e ast.Expr, counts map[string]float64, total float64) float64 {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return evalPopulationExpr(e.X, counts, total)
+	case *ast.Ident:
+		return counts[e.Name]
+	case *ast.BasicLit:
+		v, _ := strconv.ParseFloat(e.Value, 64)
+		return v
+	case *ast.UnaryExpr:
+		x := evalPopulationExpr(e.X, counts, total)
+		if e.Op == token.SUB {
+			return -x
+		}
+		return total - x
+	case *ast.BinaryExpr:
+		x := evalPopulationExpr(e.X, counts, total)
+		y := evalPopulationExpr(e.Y, counts, total)
+		switch e.Op {
+		case token.ADD:
+			return x + y
+		case token.SUB:
+			if y > x {
+				return 0
+			}
+			return x - y
+		case token.MUL:
+			return x * y
+		case token.QUO:
+			if y == 0 {
+				return 0
+			}
+			return x / y
+		case token.AND:
+			if total == 0 {
+				return 0
+			}
+			return x * y / total
+		case token.OR:
+			if total == 0 {
+				return x + y
+			}
+			return x + y - x*y/total
+		}
+	}
+	return 0
+}
+
+// addDerivedPopulations calculates the count in each grid cell of the
+// derived populations from the census population grids, adding them to
+// grids and their names to popNames. The total population of a cell is
+// that of totalPop if it is one of the census populations, and otherwise
+// the sum of the income deciles in decileNames.
+func addDerivedPopulations(popNames []string, grids map[string][]float64, totalPop string, decileNames []string) []string {
+	if len(derivedPopulations) == 0 {
+		return popNames
+	}
+	census := popNames
+	var nCells int
+	for _, g := range grids {
+		nCells = len(g)
+		break
+	}
+	total := grids[totalPop]
+	if total == nil {
+		total = make([]float64, nCells)
+		for _, d := range decileNames {
+			for i, v := range grids[d] {
+				total[i] += v
+			}
+		}
+	}
+	derived := make([][]float64, len(derivedPopulations))
+	for j := range derived {
+		derived[j] = make([]float64, nCells)
+	}
+	counts := make(map[string]float64, len(census))
+	for i := 0; i < nCells; i++ {
+		for _, p := range census {
+			counts[p] = grids[p][i]
+		}
+		for j, d := range derivedPopulations {
+			if v := evalPopulationExpr(d.expr, counts, total[i]); v > 0 {
+				derived[j][i] = v
+			}
+		}
+	}
+	names := append([]string{}, popNames...)
+	for j, d := range derivedPopulations {
+		grids[d.Name] = derived[j]
+		names = append(names, d.Name)
+	}
+	return names
+}
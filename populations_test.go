@@ -0,0 +1,80 @@
+package main
+
+import (
+	"go/parser"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCheckPopulationExpr(t *testing.T) {
+	known := map[string]bool{"TotalPop": true, "Poverty": true, "Under18": true}
+	for _, test := range []struct {
+		expr, err string
+	}{
+		{expr: "Poverty & Under18"},
+		{expr: "!(Poverty | Under18)"},
+		{expr: "0.5 * TotalPop - Poverty / 2"},
+		{expr: "-Poverty + TotalPop"},
+		{expr: "Poverty & Elderly", err: `unknown population "Elderly"`},
+		{expr: "Poverty ^ Under18", err: "unsupported operator ^"},
+		{expr: "Poverty % 2", err: "unsupported operator %"},
+		{expr: "^Poverty", err: "unsupported operator ^"},
+		{expr: `"Poverty"`, err: "invalid number"},
+		{expr: "Poverty[0]", err: "unsupported expression"},
+		{expr: "f(Poverty)", err: "unsupported expression"},
+	} {
+		e, err := parser.ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expr, err)
+		}
+		err = checkPopulationExpr(e, known)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.expr, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %q", test.expr, err, test.err)
+		}
+	}
+}
+
+func TestEvalPopulationExpr(t *testing.T) {
+	counts := map[string]float64{"Poverty": 20, "Under18": 50}
+	const total = 100
+	for _, test := range []struct {
+		expr string
+		want float64
+	}{
+		{"Poverty + Under18", 70},
+		{"Under18 - Poverty", 30},
+		{"Poverty - Under18", 0}, // differences below zero are zero
+		{"(Poverty - Under18) + 5", 5},
+		{"0.5 * Under18", 25},
+		{"Under18 / 4", 12.5},
+		{"Under18 / (Poverty - Poverty)", 0},
+		{"Poverty & Under18", 10},
+		{"Poverty | Under18", 60},
+		{"!Poverty", 80},
+		{"!(Poverty | Under18)", 40},
+		{"Poverty & !Under18", 10},
+		{"-Poverty + Under18", 30},
+		{"Unknown", 0},
+	} {
+		e, err := parser.ParseExpr(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expr, err)
+		}
+		if got := evalPopulationExpr(e, counts, total); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got %g, want %g", test.expr, got, test.want)
+		}
+	}
+
+	// Without people in the cell, intersections are empty and unions are
+	// sums.
+	for expr, want := range map[string]float64{"Poverty & Under18": 0, "Poverty | Under18": 70} {
+		e, _ := parser.ParseExpr(expr)
+		if got := evalPopulationExpr(e, counts, 0); got != want {
+			t.Errorf("%s with no total: got %g, want %g", expr, got, want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"log"
+	"os"
+	"strings"
+)
+
+// emitterGroup is a group of SCCs, such as electricity generation, as
+// defined by the SCCAggregatorFile in the config.
+type emitterGroup struct {
+	Abbrev string
+	Mask   []float64 // 1 for SCCs in the group, 0 otherwise
+}
+
+// getEmitterGroups returns the emitter groups configured in s.
+func getEmitterGroups(ctx context.Context, s *eieio.Server) ([]emitterGroup, error) {
+	abbrevs, err := s.EmitterGroupAbbrevs(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]emitterGroup, len(abbrevs.List))
+	for i, abbrev := range abbrevs.List {
+		m, err := s.EmitterMask(ctx, &eieiorpc.StringInput{String_: abbrev})
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = emitterGroup{Abbrev: abbrev, Mask: m.Data}
+	}
+	return groups, nil
+}
+
+// cubeTotalGroup is the group of cube cells summed over all SCCs.
+const cubeTotalGroup = "All"
+
+// precomputeCells calculates the result cube cells for one year and
+// demographic: the emissions of each eieiorpc.Emission (kg/year) and the
+// exposure of the total population to each eieiorpc.Pollutant
+// (people·μg/m³) caused by the demographic's consumption, for all SCCs and
+// for each emitter group. totalPop is the population in each grid cell.
+// With a nonlinear exposure function or a background concentration,
+// concentrations are weighted by those of the total PM2.5 concentration.
+func precomputeCells(ctx context.Context, s *eieio.Server, year int32, dem *eieiorpc.Demograph, aqm string, groups []emitterGroup, totalPop []float64) ([]cubeCell, error) {
+	demand, err := getDemographicDemand(ctx, s, dem, year, nil)
+	if err != nil {
+		return nil, err
+	}
+	var cells []cubeCell
+	add := func(pol, metric string, bySCC []float64) {
+		cell := cubeCell{Year: year, Demographic: demographKey(dem), Pollutant: pol, Group: cubeTotalGroup, Metric: metric}
+		for _, v := range bySCC {
+			cell.Value += v
+		}
+		cells = append(cells, cell)
+		for _, g := range groups {
+			cell.Group, cell.Value = g.Abbrev, 0
+			for j, in := range g.Mask {
+				if in != 0 {
+					cell.Value += bySCC[j]
+				}
+			}
+			cells = append(cells, cell)
+		}
+	}
+
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		pol := eieiorpc.Emission(val)
+		emis, err := getEmissionsBySCC(ctx, demand, s, pol, year, LOC, aqm)
+		if err != nil {
+			return nil, errors.Wrapf(err, "calculating %s emissions", pol)
+		}
+		add(pol.String(), "emissions", emis.RawVector().Data)
+	}
+	exposureMetric := "exposure"
+	if exposureWeighted(ctx) {
+		exposureMetric += ":" + exposureSpec(ctx)
+		total, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+			Demand:    demand,
+			Pollutant: eieiorpc.Pollutant_TotalPM25,
+			Year:      year,
+			Location:  LOC,
+			AQM:       aqm,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "calculating total PM2.5 concentrations")
+		}
+		weights, err := exposureWeights(ctx, total.Data)
+		if err != nil {
+			return nil, err
+		}
+		if totalPop, err = scaleByCell(totalPop, weights); err != nil {
+			return nil, err
+		}
+	}
+	for val := 0; val < len(eieiorpc.Pollutant_name); val++ {
+		pol := eieiorpc.Pollutant(val)
+		conc, err := concentrationMatrix(ctx, s, &eieiorpc.ConcentrationMatrixInput{
+			Demand:    demand,
+			Pollutant: pol,
+			Year:      year,
+			Location:  LOC,
+			AQM:       aqm,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "calculating %s concentrations", pol)
+		}
+		if r, _ := conc.Dims(); r != len(totalPop) {
+			return nil, checkGrid(s, aqm, r, pol.String()+" concentrations")
+		}
+		var exposure mat.VecDense
+		exposure.MulVec(conc.T(), mat.NewVecDense(len(totalPop), totalPop))
+		add(pol.String(), exposureMetric, exposure.RawVector().Data)
+	}
+	return cells, nil
+}
+
+// cubeTotalPopulation returns the total population in each grid cell,
+// zero outside the subdomain if one is configured. This is the
+// CensusTotalPopColumn if it is one of the CensusPopColumns, and otherwise
+// the sum of the income decile populations, which partition it.
+func cubeTotalPopulation(ctx context.Context, s *eieio.Server, aqm string) ([]float64, error) {
+	popNames, isIncome := s.CSTConfig.CensusIncomeDecileNames, true
+	for _, p := range s.CSTConfig.CensusPopColumns {
+		if p == s.CSTConfig.CensusTotalPopColumn {
+			popNames, isIncome = []string{p}, false
+		}
+	}
+	var total []float64
+	for _, popName := range popNames {
+		done := timeRPC(ctx, "PopulationCount")
+		pop, err := s.CSTConfig.PopulationCount(ctx, &eieiorpc.PopulationCountInput{
+			Year:        2014, // census populations are only configured for 2014; see getPopulationGrids
+			Population:  popName,
+			AQM:         aqm,
+			IsIncomePop: isIncome,
+		})
+		done(&err)
+		if err != nil {
+			return nil, err
+		}
+		if total == nil {
+			total = make([]float64, len(pop))
+		}
+		if err := checkGrid(s, aqm, len(pop), "population "+popName); err != nil {
+			return nil, err
+		}
+		floats.Add(total, pop)
+	}
+	d, err := getSubdomain(s, aqm)
+	if err != nil || d == nil {
+		return total, err
+	}
+	in := make([]bool, len(total))
+	for _, c := range d.Cells {
+		in[c] = true
+	}
+	for i := range total {
+		if !in[i] {
+			total[i] = 0
+		}
+	}
+	return total, nil
+}
+
+// precomputeCommand materializes the standard result cube (year ×
+// demographic × pollutant × emitter group × metric) into a result
+// database, to be served by the serve command. Year and demographic pairs
+// already in the database are skipped, so an interrupted run can be
+// resumed.
+func precomputeCommand(args []string) error {
+	fs := flag.NewFlagSet("precompute", flag.ExitOnError)
+	dbPath := fs.String("db", "results.db", "result database")
+	demKeys := fs.String("demographics", "decile,ethnicity", "comma-separated demograph keys or groups; CES income deciles are only available for 2014-2015")
+	from := fs.Int("from", 2014, "first year")
+	to := fs.Int("to", 2015, "last year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	expFunc := fs.String("exposure-function", "", "exposure function, e.g. threshold:2.4, overriding the ExposureFunction config setting")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s precompute [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var dems []*eieiorpc.Demograph
+	for _, key := range strings.Split(*demKeys, ",") {
+		d, err := parseDemographs(strings.TrimSpace(key))
+		if err != nil {
+			return err
+		}
+		dems = append(dems, d...)
+	}
+	var years []int32
+	for y := *from; y <= *to; y++ {
+		if _, err := parseYear(y); err != nil {
+			return err
+		}
+		years = append(years, int32(y))
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	db, err := openResultDB(*dbPath, false)
+	if err != nil {
+		return errors.Wrap(err, "opening result database")
+	}
+	defer db.Close()
+
+	ctx, err := exposureFunctionFlag(context.Background(), *expFunc)
+	if err != nil {
+		return err
+	}
+	groups, err := getEmitterGroups(ctx, s)
+	if err != nil {
+		return errors.Wrap(err, "getting emitter groups")
+	}
+	totalPop, err := cubeTotalPopulation(ctx, s, *aqm)
+	if err != nil {
+		return errors.Wrap(err, "getting population")
+	}
+	for _, year := range years {
+		if err := Year(year).validate(ctx, s); err != nil {
+			return err
+		}
+		for _, dem := range dems {
+			unit := fmt.Sprintf("%d|%s|%s", year, demographKey(dem), *aqm)
+			if exposureWeighted(ctx) {
+				unit += "|" + exposureSpec(ctx)
+			}
+			if done, err := db.precomputed(unit); err != nil || done {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			cells, err := precomputeCells(ctx, s, year, dem, *aqm, groups, totalPop)
+			if err != nil {
+				return errors.Wrapf(err, "year %d, %s", year, demographKey(dem))
+			}
+			if err := db.put(unit, cells); err != nil {
+				return err
+			}
+			log.Printf("Precomputed %d results for %d, %s", len(cells), year, labels.demograph(dem))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// profileConfig is a named analysis preset, such as a team-standard
+// analysis of exposure by income decile, defined in the [Sandbox.Profiles]
+// config table and run with `batch -profile`.
+type profileConfig struct {
+	// Description says what the profile is for.
+	Description string
+
+	// Years are the analysis years. A scenario named by its year is run
+	// for each. Defaults to defaultYear.
+	Years []int
+
+	// OutputDir is where the scenarios are written, as for a batch
+	// manifest. Defaults to the profile name.
+	OutputDir string
+
+	// Parallel is the number of scenarios to run at once. Defaults to 1.
+	Parallel int
+
+	// Scenario holds the settings of each scenario, such as the
+	// demographics, the results to calculate and the output formats.
+	// Its Name and Year are set by the profile.
+	Scenario scenario
+}
+
+// profileNames returns the names of profiles, sorted.
+func profileNames(profiles map[string]profileConfig) []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileManifest returns a batch manifest running the named profile from
+// the config.
+func profileManifest(name string) (*batchManifest, error) {
+	cfg, _, err := readConfig()
+	if err != nil {
+		return nil, withKind(kindConfig, err)
+	}
+	p, ok := cfg.Sandbox.Profiles[name]
+	if !ok {
+		names := profileNames(cfg.Sandbox.Profiles)
+		if len(names) == 0 {
+			return nil, errorf(kindUsage, "unknown profile %q; the config doesn't define any in [Sandbox.Profiles]", name)
+		}
+		return nil, errorf(kindUsage, "unknown profile %q; valid profiles are %s", name, strings.Join(names, ", "))
+	}
+	m := &batchManifest{OutputDir: os.ExpandEnv(p.OutputDir), Parallel: p.Parallel}
+	if m.OutputDir == "" {
+		m.OutputDir = name
+	}
+	years := p.Years
+	if len(years) == 0 {
+		years = []int{int(defaultYear())}
+	}
+	for _, y := range years {
+		sc := p.Scenario
+		sc.Name = strconv.Itoa(y)
+		sc.Year = int32(y)
+		m.Scenario = append(m.Scenario, sc)
+	}
+	if err := m.check(); err != nil {
+		return nil, withKind(kindConfig, fmt.Errorf("profile %s: %v", name, err))
+	}
+	return m, nil
+}
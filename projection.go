@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// populationProjection specifies projected census populations, such as for
+// a future year, to calculate exposure under demographic change. Census
+// populations are replaced by the grids in GridFile, if any, and then
+// multiplied by Factors and by the factors in RegionFactorsFile.
+type populationProjection struct {
+	// GridFile is the path to a CSV file with columns
+	// Population,Cell,Count giving the projected count of census
+	// populations in grid cells, indexed as in the air quality model grid.
+	// The grid of each population in the file replaces its census grid,
+	// with zero in cells that are not listed.
+	GridFile string
+
+	// Factors multiplies census populations by name. The key "*" applies
+	// to populations without a specific entry.
+	Factors map[string]float64
+
+	// Regions are the regions, named by Regions.Field, that
+	// RegionFactorsFile refers to.
+	Regions regionConfig
+
+	// RegionFactorsFile is the path to a CSV file with columns
+	// Region,Population,Factor multiplying census populations in the grid
+	// cells whose centroids are within each region. A Population of "*"
+	// applies to populations without a specific entry for the region.
+	RegionFactorsFile string
+}
+
+// empty returns whether p specifies no projection.
+func (p populationProjection) empty() bool {
+	return p.GridFile == "" && len(p.Factors) == 0 && p.RegionFactorsFile == ""
+}
+
+// populationProjector projects census population grids as specified by a
+// populationProjection.
+type populationProjector struct {
+	grids   map[string]map[int]float64 // projected count by population and grid cell
+	factors map[string]float64
+
+	// regionFactors is the factor by population for each region, and
+	// cellRegions the index of the region of each grid cell, or -1.
+	regionFactors []map[string]float64
+	cellRegions   []int
+}
+
+// newPopulationProjector reads the files of p for the aqm grid.
+func newPopulationProjector(s *eieio.Server, p populationProjection, aqm string) (*populationProjector, error) {
+	pp := &populationProjector{factors: p.Factors}
+	if p.GridFile != "" {
+		var err error
+		if pp.grids, err = readProjectedGrids(os.ExpandEnv(p.GridFile)); err != nil {
+			return nil, errors.Wrap(err, "reading projected population grids")
+		}
+	}
+	if p.RegionFactorsFile != "" {
+		if p.Regions.File == "" {
+			return nil, fmt.Errorf("population RegionFactorsFile requires Regions")
+		}
+		p.Regions.File = os.ExpandEnv(p.Regions.File)
+		names, cellRegions, err := regionIndex(s, p.Regions, aqm)
+		if err != nil {
+			return nil, err
+		}
+		byRegion, err := readRegionFactors(os.ExpandEnv(p.RegionFactorsFile))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading population region factors")
+		}
+		pp.cellRegions = cellRegions
+		pp.regionFactors = make([]map[string]float64, len(names))
+		for i, name := range names {
+			pp.regionFactors[i] = byRegion[name]
+			delete(byRegion, name)
+		}
+		for name := range byRegion {
+			return nil, fmt.Errorf("population region factors for unknown region %q", name)
+		}
+	}
+	return pp, nil
+}
+
+// readProjectedGrids reads a CSV file with columns Population,Cell,Count.
+func readProjectedGrids(path string) (map[string]map[int]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	grids := make(map[string]map[int]float64)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pop := strings.TrimSpace(rec[0])
+		cell, err := strconv.Atoi(strings.TrimSpace(rec[1]))
+		if err != nil || cell < 0 {
+			return nil, fmt.Errorf("invalid grid cell %q for population %s", rec[1], pop)
+		}
+		count, err := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid count %q for population %s in cell %d", rec[2], pop, cell)
+		}
+		if grids[pop] == nil {
+			grids[pop] = make(map[int]float64)
+		}
+		grids[pop][cell] += count
+	}
+	return grids, nil
+}
+
+// readRegionFactors reads a CSV file with columns Region,Population,Factor.
+func readRegionFactors(path string) (map[string]map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	factors := make(map[string]map[string]float64)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		region := strings.TrimSpace(rec[0])
+		factor, err := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+		if err != nil || factor < 0 {
+			return nil, fmt.Errorf("invalid factor %q for region %s", rec[2], region)
+		}
+		if factors[region] == nil {
+			factors[region] = make(map[string]float64)
+		}
+		factors[region][strings.TrimSpace(rec[1])] = factor
+	}
+	return factors, nil
+}
+
+// projectionFactor returns the entry in m for pop, or for "*", or 1 if
+// there is none.
+func projectionFactor(m map[string]float64, pop string) float64 {
+	if f, ok := m[pop]; ok {
+		return f
+	}
+	if f, ok := m["*"]; ok {
+		return f
+	}
+	return 1
+}
+
+// project returns the projected grid of the named census population, given
+// its census grid, which is not modified.
+func (p *populationProjector) project(pop string, census []float64) ([]float64, error) {
+	projected := make([]float64, len(census))
+	if grid, ok := p.grids[pop]; ok {
+		for cell, count := range grid {
+			if cell >= len(projected) {
+				return nil, fmt.Errorf("projected population %s is in grid cell %d, but the grid has %d cells", pop, cell, len(projected))
+			}
+			projected[cell] = count
+		}
+	} else {
+		copy(projected, census)
+	}
+	f := projectionFactor(p.factors, pop)
+	if p.cellRegions != nil && len(p.cellRegions) != len(projected) {
+		return nil, errorf(kindNumeric, "expected %d grid cells in projection regions, got %d", len(projected), len(p.cellRegions))
+	}
+	for i := range projected {
+		projected[i] *= f
+		if p.cellRegions != nil && p.cellRegions[i] >= 0 {
+			projected[i] *= projectionFactor(p.regionFactors[p.cellRegions[i]], pop)
+		}
+	}
+	return projected, nil
+}
+
+type projectionKey struct{}
+
+// withPopulationProjection returns a context in which getPopulationGrids
+// returns populations projected by p.
+func withPopulationProjection(ctx context.Context, p *populationProjector) context.Context {
+	return context.WithValue(ctx, projectionKey{}, p)
+}
+
+// projectPopulationGrids replaces the grids in pops with their projections
+// if ctx has a population projection.
+func projectPopulationGrids(ctx context.Context, pops map[string][]float64) error {
+	p, ok := ctx.Value(projectionKey{}).(*populationProjector)
+	if !ok {
+		return nil
+	}
+	for name, census := range pops {
+		projected, err := p.project(name, census)
+		if err != nil {
+			return err
+		}
+		pops[name] = projected
+	}
+	return nil
+}
+
+var projectionHeader = []string{"Population", "Label", "CensusCount", "ProjectedCount",
+	"CensusExposure", "ProjectedExposure", "CensusMean", "ProjectedMean", "CensusMeanRatioToTotal", "ProjectedMeanRatioToTotal"}
+
+// projectionRows compares the exposure caused by demand under census and
+// projected populations (projectedCtx has the projection). The mean is
+// population-weighted mean concentration (exposure divided by count), and
+// its ratio to that of the total population measures disparity; totals
+// change with population counts, so means are compared rather than totals.
+func projectionRows(ctx, projectedCtx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector) ([][]string, error) {
+	vec, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		count, exposure map[string]float64
+	}
+	var results [2]result
+	for i, c := range []context.Context{ctx, projectedCtx} {
+		exposure, err := populationExposure(c, s, aqm, vec.Data, nil)
+		if err != nil {
+			return nil, err
+		}
+		count, err := populationCounts(c, s, aqm, len(vec.Data))
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result{count: count, exposure: *exposure}
+	}
+	mean := func(r result, pop string) float64 {
+		if r.count[pop] == 0 {
+			return math.NaN()
+		}
+		return r.exposure[pop] / r.count[pop]
+	}
+	// The total population is the sum of the income deciles, which
+	// partition it, if CensusTotalPopColumn is not a census population.
+	totalPop := s.CSTConfig.CensusTotalPopColumn
+	for i := range results {
+		if _, ok := results[i].count[totalPop]; ok {
+			continue
+		}
+		for _, pop := range s.CSTConfig.CensusIncomeDecileNames {
+			results[i].count[totalPop] += results[i].count[pop]
+			results[i].exposure[totalPop] += results[i].exposure[pop]
+		}
+	}
+	ratio := func(r result, pop string) float64 {
+		return mean(r, pop) / mean(r, totalPop)
+	}
+	census, projected := results[0], results[1]
+	var rows [][]string
+	for _, pop := range sortedKeys(census.count) {
+		rows = append(rows, []string{pop, labels.get(pop),
+			formatFloat(census.count[pop]), formatFloat(projected.count[pop]),
+			formatFloat(census.exposure[pop]), formatFloat(projected.exposure[pop]),
+			formatFloat(mean(census, pop)), formatFloat(mean(projected, pop)),
+			formatFloat(ratio(census, pop)), formatFloat(ratio(projected, pop))})
+	}
+	return rows, nil
+}
+
+// populationCounts returns the count of each census population, within the
+// subdomain if one is configured.
+func populationCounts(ctx context.Context, s *eieio.Server, aqm string, nCells int) (map[string]float64, error) {
+	popNames, grids, err := getPopulationGrids(ctx, s, aqm, nCells)
+	if err != nil {
+		return nil, err
+	}
+	d, err := getSubdomain(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]float64)
+	for _, pop := range popNames {
+		grid, err := d.restrict(grids[pop])
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range grid {
+			counts[pop] += c
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"os"
+	"sort"
+)
+
+// provenanceValue is a value reported in a result table along with the
+// inputs that contribute most to it, for auditing.
+type provenanceValue struct {
+	// Table is the result file the value is reported in, and Row and
+	// Column identify its cell: Row is the value of the table's first
+	// column, e.g. a population or demograph key.
+	Table, Row, Column string
+	Value              float64
+
+	// Contributors lists the top contributors to the value, largest
+	// first, by kind of input: "SCC" (the emitting sector), "Cluster"
+	// (the 1° longitude/latitude tile of the receptor grid cells, named
+	// by its southwest corner, e.g. "-98,39") and "Pollutant" (the PM2.5
+	// component, as in speciation.csv).
+	Contributors map[string][]provenanceContributor
+}
+
+// provenanceContributor is an input's contribution to a provenanceValue.
+type provenanceContributor struct {
+	ID string
+
+	// Value is the part of the reported value attributable to the input,
+	// and Share its fraction of the reported value.
+	Value, Share float64
+}
+
+// topContributors returns the n inputs with the largest amounts, which are
+// apportioned to the reported value in proportion to their share of the
+// total amount. Inputs with no amount are omitted.
+func topContributors(amounts map[string]float64, reported float64, n int) []provenanceContributor {
+	ids := make([]string, 0, len(amounts))
+	for id, a := range amounts {
+		if a != 0 {
+			ids = append(ids, id)
+		}
+	}
+	// The total is summed in a fixed order, so that the results are
+	// reproducible.
+	sort.Strings(ids)
+	var total float64
+	for _, id := range ids {
+		total += amounts[id]
+	}
+	if total == 0 {
+		return []provenanceContributor{}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		ai, aj := math.Abs(amounts[ids[i]]), math.Abs(amounts[ids[j]])
+		if ai != aj {
+			return ai > aj
+		}
+		return ids[i] < ids[j]
+	})
+	if n < len(ids) {
+		ids = ids[:n]
+	}
+	top := make([]provenanceContributor, len(ids))
+	for i, id := range ids {
+		share := amounts[id] / total
+		top[i] = provenanceContributor{ID: id, Value: share * reported, Share: share}
+	}
+	return top
+}
+
+// gridClusters returns the 1° longitude/latitude tile of the centroid of
+// each cell that gridded results are indexed by (see gridCells), along
+// with the model grid index of each cell.
+func gridClusters(s *eieio.Server, aqm string) ([]string, []int, error) {
+	cells, index, ct, err := gridCells(s, aqm)
+	if err != nil {
+		return nil, nil, err
+	}
+	clusters := make([]string, len(index))
+	for i, c := range index {
+		centroid := cells[c].Centroid()
+		lon, lat, err := ct(centroid.X, centroid.Y)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "projecting the centroid of grid cell %d", c)
+		}
+		clusters[i] = fmt.Sprintf("%g,%g", math.Floor(lon), math.Floor(lat))
+	}
+	return clusters, index, nil
+}
+
+// exposureProvenance returns the n top SCCs, grid clusters and PM2.5
+// components contributing to each population's exposure to the PM2.5
+// caused by demand in the whole grid (or subdomain), as reported in
+// exposure. Each population's exposure is apportioned by the
+// population-weighted concentrations of each component from each SCC in
+// each grid cell, weighted as in getExposureBySpecies if the exposure
+// function is nonlinear or there is a background concentration.
+func exposureProvenance(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector, exposure map[string]float64, n int) ([]provenanceValue, error) {
+	ctx, span := startSpan(ctx, "exposureProvenance")
+	defer span.End()
+	clusters, index, err := gridClusters(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	id, err := getGridID(s, aqm)
+	if err != nil {
+		return nil, err
+	}
+	nCells := id.Cells
+	input := &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	}
+	var cellWeights []float64
+	if exposureWeighted(ctx) {
+		total, err := getConcentrations(ctx, s, input)
+		if err != nil {
+			return nil, err
+		}
+		if cellWeights, err = exposureWeights(ctx, total.Data); err != nil {
+			return nil, err
+		}
+	}
+	popNames, pops, err := getPopulationGrids(ctx, s, aqm, nCells)
+	if err != nil {
+		return nil, err
+	}
+
+	// weights holds the weight of the concentrations in each grid cell in
+	// the exposure of each population.
+	var reported []string
+	var weights []*mat.VecDense
+	for _, pop := range popNames {
+		if e, ok := exposure[pop]; !ok || math.IsNaN(e) {
+			continue
+		}
+		v := mat.NewVecDense(nCells, nil)
+		for _, c := range index {
+			w := pops[pop][c]
+			if cellWeights != nil {
+				w *= cellWeights[c]
+			}
+			v.SetVec(c, w)
+		}
+		reported = append(reported, pop)
+		weights = append(weights, v)
+	}
+
+	// The concentrations of one species are calculated at a time, adding
+	// their contributions to each population's exposure.
+	bySCC := make([][]float64, len(reported))
+	byCluster := make([]map[string]float64, len(reported))
+	byComponent := make([]map[string]float64, len(reported))
+	for p := range reported {
+		bySCC[p] = make([]float64, len(s.SCCs))
+		byCluster[p] = make(map[string]float64)
+		byComponent[p] = make(map[string]float64)
+	}
+	cellConc := make([]float64, nCells)
+	var scc mat.VecDense
+	for _, component := range pm25Components {
+		for _, sp := range component.Species {
+			conc, err := speciesConcentrationMatrix(ctx, s, input, sp)
+			if err != nil {
+				return nil, err
+			}
+			if r, c := conc.Dims(); r != nCells || c != len(s.SCCs) {
+				return nil, errorf(kindNumeric, "expected %s concentrations for %d grid cells and %d SCCs, got %d and %d", sp, nCells, len(s.SCCs), r, c)
+			}
+			for c := range cellConc {
+				cellConc[c] = mat.Sum(conc.RowView(c))
+			}
+			for p, v := range weights {
+				scc.MulVec(conc.T(), v)
+				for j := range bySCC[p] {
+					bySCC[p][j] += scc.AtVec(j)
+				}
+				for i, c := range index {
+					a := v.AtVec(c) * cellConc[c]
+					byCluster[p][clusters[i]] += a
+					byComponent[p][component.Name] += a
+				}
+			}
+		}
+	}
+
+	values := make([]provenanceValue, len(reported))
+	for p, pop := range reported {
+		sccs := make(map[string]float64, len(s.SCCs))
+		for j, a := range bySCC[p] {
+			sccs[string(s.SCCs[j])] = a
+		}
+		e := exposure[pop]
+		values[p] = provenanceValue{
+			Table: "exposure.csv", Row: pop, Column: "Exposure", Value: e,
+			Contributors: map[string][]provenanceContributor{
+				"SCC":       topContributors(sccs, e, n),
+				"Cluster":   topContributors(byCluster[p], e, n),
+				"Pollutant": topContributors(byComponent[p], e, n),
+			},
+		}
+	}
+	return values, nil
+}
+
+// contributionProvenance returns the n top SCCs contributing to each
+// demographic's total emissions in m, as reported in contribution.csv.
+// The emissions are PM2.5 emissions at their source, so they have no grid
+// cluster or component contributors.
+func contributionProvenance(m *ContributionMatrix, n int) []provenanceValue {
+	totals := m.Totals()
+	values := make([]provenanceValue, len(m.Demographics))
+	for i, dem := range m.Demographics {
+		bySCC := make(map[string]float64)
+		for j, e := range m.Emissions.RawRowView(i) {
+			bySCC[string(m.SCCs[j])] += e
+		}
+		values[i] = provenanceValue{
+			Table: "contribution.csv", Row: demographKey(dem), Column: "Emissions", Value: totals[i],
+			Contributors: map[string][]provenanceContributor{"SCC": topContributors(bySCC, totals[i], n)},
+		}
+	}
+	return values
+}
+
+// writeProvenance writes values to path as JSON.
+func writeProvenance(path string, values []provenanceValue) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(values); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+// receptorRegion is the ReceptorRegion setting in the [Sandbox] config
+// table: the region, such as one state, whose residents' exposure is
+// reported separately.
+var receptorRegion regionConfig
+
+// receptorHeader is the header of receptor_exposure.csv.
+var receptorHeader = []string{"Population", "Label", "Cells", "People", "Exposure", "MeanConcentration"}
+
+// receptorRows returns a row of receptorHeader for each census population:
+// the population's exposure to the total PM2.5 concentrations caused by
+// demand in the cells of the receptor region, their number and the number
+// of people in them, and the population-weighted mean concentration. The
+// region is restricted to the subdomain, if any.
+func receptorRows(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, year int32, aqm string) ([][]string, error) {
+	ctx, span := startSpan(ctx, "receptorRows")
+	defer span.End()
+	mask, err := regionMask(s, receptorRegion, aqm)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading receptor region")
+	}
+	conc, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      year,
+		Location:  LOC,
+		AQM:       aqm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(mask) != len(conc.Data) {
+		return nil, checkGrid(s, aqm, len(conc.Data), "concentrations")
+	}
+	exposure, people, cells, err := maskedExposure(ctx, s, aqm, conc.Data, mask)
+	if err != nil {
+		return nil, err
+	}
+	if cells == 0 {
+		return nil, errorf(kindConfig, "no %s grid cells are within the receptor region of %s", aqm, receptorRegion.File)
+	}
+	var rows [][]string
+	for _, pop := range sortedKeys(exposure) {
+		e, n := exposure[pop], suppression.count(people[pop])
+		rows = append(rows, []string{pop, labels.get(pop), strconv.Itoa(cells),
+			formatFloat(n), formatFloat(e), formatFloat(e / n)})
+	}
+	return rows, nil
+}
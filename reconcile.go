@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"math"
+	"strings"
+)
+
+// Contribution is calculated for CES demographics, while exposure is
+// calculated for the census population layers of the spatial model, and
+// the two taxonomies differ: CES groups non-Hispanic people other than
+// Black people into a single "WhiteOther" group, and CES income deciles
+// rank consumer units rather than the people in census income deciles.
+// demographLayerNames maps each CES demographic to the census
+// population layers that together cover the same people, as closely as
+// the census columns allow.
+var demographLayerNames = map[string][]string{
+	"ethnicity:Black":         {"Black"},
+	"ethnicity:Hispanic":      {"Latino"},
+	"ethnicity:WhiteOther":    {"WhiteNoLat", "Native", "Asian"},
+	"ethnicity:Ethnicity_All": {"TotalPop"},
+	"decile:Decile_All":       {"TotalPop"},
+}
+
+// Kinds of match between a CES demographic and census population layers.
+const (
+	layerMatchExact    = "exact"
+	layerMatchCombined = "combined"
+	layerMatchNone     = "none"
+)
+
+// demographLayers is the census population layers matching a CES demographic.
+type demographLayers struct {
+	Demograph *eieiorpc.Demograph
+	Layers    []string
+
+	// Match is layerMatchExact for a single layer, layerMatchCombined for a
+	// sum of layers, and layerMatchNone if no layers correspond.
+	Match string
+}
+
+// reconcileDemographs matches each of dems with the census population
+// layers of s. Income deciles match the corresponding
+// CensusIncomeDecileNames layer, if configured.
+func reconcileDemographs(s *eieio.Server, dems []*eieiorpc.Demograph) []demographLayers {
+	available := make(map[string]bool)
+	for _, pop := range append(s.CSTConfig.CensusPopColumns, s.CSTConfig.CensusIncomeDecileNames...) {
+		available[pop] = true
+	}
+	result := make([]demographLayers, len(dems))
+	for i, dem := range dems {
+		layers := append([]string(nil), demographLayerNames[demographKey(dem)]...)
+		if d, ok := dem.GetDemographic().(*eieiorpc.Demograph_Decile); ok && d.Decile != eieiorpc.Decile_Decile_All {
+			layers = nil
+			if int(d.Decile) < len(s.CSTConfig.CensusIncomeDecileNames) {
+				layers = []string{s.CSTConfig.CensusIncomeDecileNames[d.Decile]}
+			}
+		}
+		if s.CSTConfig.CensusTotalPopColumn != "" {
+			for j, l := range layers {
+				if l == "TotalPop" {
+					layers[j] = s.CSTConfig.CensusTotalPopColumn
+				}
+			}
+		}
+		result[i] = demographLayers{Demograph: dem, Match: layerMatchNone}
+		for _, l := range layers {
+			if !available[l] {
+				layers = nil
+				break
+			}
+		}
+		switch len(layers) {
+		case 0:
+		case 1:
+			result[i].Layers, result[i].Match = layers, layerMatchExact
+		default:
+			result[i].Layers, result[i].Match = layers, layerMatchCombined
+		}
+	}
+	return result
+}
+
+// exposure returns the exposure of the demographic, the sum of the
+// exposures of its layers in exposureByPop, or NaN if it has no layers.
+func (d demographLayers) exposure(exposureByPop map[string]float64) float64 {
+	if len(d.Layers) == 0 {
+		return math.NaN()
+	}
+	var e float64
+	for _, l := range d.Layers {
+		e += exposureByPop[l]
+	}
+	return e
+}
+
+// demographicsTable joins exposure by census population and contribution
+// by CES demographic into a single table with a row for each of dems.
+func demographicsTable(s *eieio.Server, dems []*eieiorpc.Demograph, exposureByPop map[string]float64, contributions []float64) [][]string {
+	var rows [][]string
+	for i, d := range reconcileDemographs(s, dems) {
+		rows = append(rows, []string{demographKey(d.Demograph), labels.demograph(d.Demograph),
+			strings.Join(d.Layers, "+"), d.Match, formatFloat(d.exposure(exposureByPop)), formatFloat(contributions[i])})
+	}
+	return rows
+}
+
+// demographicsHeader is the header of the table returned by demographicsTable.
+var demographicsHeader = []string{"Demographic", "Label", "PopulationLayers", "Match", "Exposure", "Emissions"}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/geojson"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// regionConfig specifies a geographic region read from a polygon file.
+type regionConfig struct {
+	// File is the path to a GeoJSON (.geojson or .json) or shapefile (.shp)
+	// holding the region polygons. Leave empty to use the whole domain.
+	File string
+
+	// SR is the Proj4 spatial reference of File if it is GeoJSON.
+	// Shapefiles use their .prj file. Defaults to "+proj=longlat".
+	SR string
+
+	// Field and Values select a subset of the features in File, e.g.
+	// Field = "STATEFP" and Values = ["06"] for California. If Values is
+	// empty, all features are used.
+	Field  string
+	Values []string
+}
+
+// String describes c, for metadata.csv.
+func (c regionConfig) String() string {
+	if c.File == "" {
+		return "none"
+	}
+	if c.Field == "" || len(c.Values) == 0 {
+		return c.File
+	}
+	return fmt.Sprintf("%s (%s in %s)", c.File, c.Field, strings.Join(c.Values, ", "))
+}
+
+// geoJSONFeatureCollection is the subset of a GeoJSON FeatureCollection
+// needed to read region polygons.
+type geoJSONFeatureCollection struct {
+	Features []struct {
+		Geometry   geojson.Geometry
+		Properties map[string]interface{}
+	}
+}
+
+// selected returns whether a feature with the given value of
+// cfg.Field should be included in the region.
+func (cfg regionConfig) selected(value string) bool {
+	if len(cfg.Values) == 0 {
+		return true
+	}
+	for _, v := range cfg.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// regionFeature is a single polygon feature from a region file, named by
+// the value of its regionConfig.Field attribute.
+type regionFeature struct {
+	geom.Polygonal
+	Name string
+}
+
+// loadRegion reads the polygons specified by cfg and projects them to gridSR.
+func loadRegion(cfg regionConfig, gridSR string) ([]regionFeature, error) {
+	var polys []geom.Geom
+	var names []string
+	var src *proj.SR
+	var err error
+
+	switch strings.ToLower(filepath.Ext(cfg.File)) {
+	case ".shp":
+		dec, err := shp.NewDecoder(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		src, err = dec.SR()
+		if err != nil {
+			return nil, errors.Wrap(err, "reading region shapefile projection")
+		}
+		var fields []string
+		if cfg.Field != "" {
+			fields = append(fields, cfg.Field)
+		}
+		for {
+			g, attrs, more := dec.DecodeRowFields(fields...)
+			if !more {
+				break
+			}
+			if cfg.selected(attrs[cfg.Field]) {
+				polys = append(polys, g)
+				names = append(names, attrs[cfg.Field])
+			}
+		}
+		if err := dec.Error(); err != nil {
+			return nil, err
+		}
+	case ".geojson", ".json":
+		b, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		var fc geoJSONFeatureCollection
+		if err := json.Unmarshal(b, &fc); err != nil {
+			return nil, errors.Wrap(err, "decoding region GeoJSON")
+		}
+		for _, f := range fc.Features {
+			var name string
+			if cfg.Field != "" {
+				name = fmt.Sprint(f.Properties[cfg.Field])
+			}
+			if !cfg.selected(name) {
+				continue
+			}
+			g, err := geojson.FromGeoJSON(&f.Geometry)
+			if err != nil {
+				return nil, err
+			}
+			polys = append(polys, g)
+			names = append(names, name)
+		}
+		srString := cfg.SR
+		if srString == "" {
+			srString = "+proj=longlat"
+		}
+		src, err = proj.Parse(srString)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported region file type %s", cfg.File)
+	}
+
+	dst, err := proj.Parse(gridSR)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing grid spatial reference")
+	}
+	ct, err := src.NewTransform(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	region := make([]regionFeature, 0, len(polys))
+	for i, g := range polys {
+		if ct != nil {
+			if g, err = g.Transform(ct); err != nil {
+				return nil, err
+			}
+		}
+		p, ok := g.(geom.Polygonal)
+		if !ok {
+			return nil, fmt.Errorf("region features must be polygons, got %T", g)
+		}
+		region = append(region, regionFeature{Polygonal: p, Name: names[i]})
+	}
+	if len(region) == 0 {
+		return nil, fmt.Errorf("no region features selected from %s", cfg.File)
+	}
+	return region, nil
+}
+
+// regionMask returns whether the centroid of each grid cell in the aqm grid
+// is within cfg's region, or nil if no region is configured.
+func regionMask(s *eieio.Server, cfg regionConfig, aqm string) ([]bool, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	_, cellRegions, err := regionIndex(s, cfg, aqm)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]bool, len(cellRegions))
+	for i, r := range cellRegions {
+		mask[i] = r >= 0
+	}
+	return mask, nil
+}
+
+// regionIndex groups the features in cfg by name and returns the sorted
+// region names along with the index into names of the region containing
+// the centroid of each grid cell in the aqm grid, or -1 for cells outside
+// every region.
+func regionIndex(s *eieio.Server, cfg regionConfig, aqm string) (names []string, cellRegions []int, err error) {
+	region, err := loadRegion(cfg, s.SpatialEIO.CSTConfig.SpatialConfig.OutputSR)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error loading region")
+	}
+	cells, err := s.SpatialEIO.CSTConfig.Geometry(aqm)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting grid geometry")
+	}
+
+	nameIdx := make(map[string]int)
+	for _, f := range region {
+		nameIdx[f.Name] = 0
+	}
+	for name := range nameIdx {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		nameIdx[name] = i
+	}
+
+	cellRegions = make([]int, len(cells))
+	for i, cell := range cells {
+		cellRegions[i] = -1
+		c := cell.Centroid()
+		for _, f := range region {
+			if c.Within(f.Polygonal) != geom.Outside {
+				cellRegions[i] = nameIdx[f.Name]
+				break
+			}
+		}
+	}
+	return names, cellRegions, nil
+}
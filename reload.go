@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"time"
+)
+
+// serverConfig holds settings of the server commands (arrow and serve-map)
+// that are applied while they run: they are read again whenever the config
+// file changes, without restarting the EIEIO server. Unset settings, and
+// those given as command-line flags (or their environment variables),
+// keep the flag's value. Each server only uses the settings it has flags
+// for.
+type serverConfig struct {
+	// Parallelism is the number of requests to calculate at once.
+	Parallelism *int
+
+	// Queue is the number of requests that can wait for a calculation
+	// before the server responds 503.
+	Queue *int
+
+	// CacheMB is the megabytes of responses to keep in memory for repeated
+	// requests.
+	CacheMB *int
+
+	// MaxAge is how long clients may reuse a response without revalidating
+	// it, e.g. "1h".
+	MaxAge string
+
+	// JobsDir is the directory for the results of scenarios posted to
+	// serve-map's /jobs. Jobs already submitted keep their directories.
+	JobsDir string
+
+	// JobTTL is how long finished jobs and their results are kept, e.g.
+	// "24h".
+	JobTTL string
+}
+
+// serverSettings are the server settings in effect.
+type serverSettings struct {
+	parallelism, queue, cacheMB int
+	maxAge, jobTTL              time.Duration
+	jobsDir                     string
+}
+
+// resolve returns flags, the settings from the command-line flags fs,
+// with those that weren't set on the command line replaced by c's. Only
+// the settings of flags defined in fs are replaced.
+func (c serverConfig) resolve(fs *flag.FlagSet, flags serverSettings) (serverSettings, error) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	use := func(name string) bool { return fs.Lookup(name) != nil && !set[name] }
+	st := flags
+	for _, s := range []struct {
+		flag string
+		v    *int
+		dst  *int
+	}{
+		{"parallelism", c.Parallelism, &st.parallelism},
+		{"queue", c.Queue, &st.queue},
+		{"cache", c.CacheMB, &st.cacheMB},
+	} {
+		if s.v != nil && use(s.flag) {
+			*s.dst = *s.v
+		}
+	}
+	for _, d := range []struct {
+		flag, name, v string
+		dst           *time.Duration
+	}{
+		{"max-age", "MaxAge", c.MaxAge, &st.maxAge},
+		{"job-ttl", "JobTTL", c.JobTTL, &st.jobTTL},
+	} {
+		if d.v == "" || !use(d.flag) {
+			continue
+		}
+		v, err := time.ParseDuration(d.v)
+		if err != nil {
+			return st, errorf(kindConfig, "invalid Server %s %q: %v", d.name, d.v, err)
+		}
+		*d.dst = v
+	}
+	if c.JobsDir != "" && use("jobs-dir") {
+		st.jobsDir = os.ExpandEnv(c.JobsDir)
+	}
+	return st, nil
+}
+
+// watchConfig checks CONFIG for changes every interval and, when its
+// contents change, reads it again and calls apply with the new config. A
+// config that can't be read is logged and ignored. Changes to settings
+// other than [Sandbox.Server] are logged, since they only take effect on
+// restart.
+func watchConfig(interval time.Duration, apply func(*config)) {
+	if CONFIG == "" || interval <= 0 {
+		return
+	}
+	last, err := ioutil.ReadFile(CONFIG)
+	if err != nil {
+		log.Printf("Not watching the config for changes: %v", err)
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			b, err := ioutil.ReadFile(CONFIG)
+			if err != nil || bytes.Equal(b, last) {
+				continue
+			}
+			cfg, _, err := readConfig()
+			if err != nil {
+				log.Printf("Ignoring changed config %s: %v", CONFIG, err)
+				last = b
+				continue
+			}
+			if !sameExceptServer(last, b) {
+				log.Printf("Config %s changed; settings other than [Sandbox.Server] take effect on restart", CONFIG)
+			}
+			last = b
+			apply(cfg)
+		}
+	}()
+}
+
+// sameExceptServer returns whether the configs a and b have the same
+// settings other than [Sandbox.Server].
+func sameExceptServer(a, b []byte) bool {
+	var ta, tb map[string]interface{}
+	if _, err := toml.Decode(string(a), &ta); err != nil {
+		return false
+	}
+	if _, err := toml.Decode(string(b), &tb); err != nil {
+		return false
+	}
+	for _, t := range []map[string]interface{}{ta, tb} {
+		if sb, ok := t["Sandbox"].(map[string]interface{}); ok {
+			delete(sb, "Server")
+		}
+	}
+	return reflect.DeepEqual(ta, tb)
+}
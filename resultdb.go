@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cubeCell is one value of the precomputed result cube.
+type cubeCell struct {
+	Year        int32
+	Demographic string // demograph key, e.g. "decile:LowestTen"
+	Pollutant   string // an eieiorpc.Emission for emissions, eieiorpc.Pollutant for exposure
+	Group       string // emitter group abbreviation, or "All"
+	Metric      string // "emissions" (kg/year) or "exposure" (people·μg/m³), followed by ":" and the exposureSpec if exposure is weighted
+	Value       float64
+}
+
+// cubeKeySep separates the dimensions in the keys of the cube bucket.
+const cubeKeySep = "|"
+
+func (c cubeCell) key() []byte {
+	return []byte(strings.Join([]string{strconv.Itoa(int(c.Year)), c.Demographic, c.Pollutant, c.Group, c.Metric}, cubeKeySep))
+}
+
+// MarshalJSON implements json.Marshaler, writing NaN values (from missing
+// CES data) as null.
+func (c cubeCell) MarshalJSON() ([]byte, error) {
+	type cell cubeCell
+	v := struct {
+		cell
+		Value *float64
+	}{cell: cell(c)}
+	if !math.IsNaN(c.Value) {
+		v.Value = &c.Value
+	}
+	return json.Marshal(v)
+}
+
+// matches returns whether c has the values of each non-empty dimension of q.
+func (c cubeCell) matches(q cubeCell) bool {
+	return (q.Year == 0 || q.Year == c.Year) &&
+		(q.Demographic == "" || q.Demographic == c.Demographic) &&
+		(q.Pollutant == "" || q.Pollutant == c.Pollutant) &&
+		(q.Group == "" || q.Group == c.Group) &&
+		(q.Metric == "" || q.Metric == c.Metric)
+}
+
+func parseCubeCell(k, v []byte) (cubeCell, error) {
+	parts := strings.Split(string(k), cubeKeySep)
+	if len(parts) != 5 || len(v) != 8 {
+		return cubeCell{}, fmt.Errorf("invalid result cube entry %q", k)
+	}
+	year, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return cubeCell{}, fmt.Errorf("invalid result cube entry %q", k)
+	}
+	return cubeCell{Year: int32(year), Demographic: parts[1], Pollutant: parts[2], Group: parts[3], Metric: parts[4],
+		Value: math.Float64frombits(binary.BigEndian.Uint64(v))}, nil
+}
+
+var (
+	cubeBucket = []byte("cube")
+
+	// precomputedBucket records the year and demographic pairs whose
+	// cells have all been stored, so interrupted runs can be resumed.
+	precomputedBucket = []byte("precomputed")
+)
+
+// resultDB stores the precomputed result cube.
+type resultDB struct {
+	db *bbolt.DB
+}
+
+// openResultDB opens or creates the result database at path. A database
+// opened read-only can be shared by several processes, but not with one
+// that is writing to it.
+func openResultDB(path string, readOnly bool) (*resultDB, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return &resultDB{db: db}, nil
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, b := range [][]byte{cubeBucket, precomputedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &resultDB{db: db}, nil
+}
+
+func (r *resultDB) Close() error { return r.db.Close() }
+
+// put stores cells and marks unit as precomputed, in one transaction.
+func (r *resultDB) put(unit string, cells []cubeCell) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(cubeBucket)
+		for _, c := range cells {
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, math.Float64bits(c.Value))
+			if err := b.Put(c.key(), v); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(precomputedBucket).Put([]byte(unit), []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+// precomputed returns whether unit has been stored.
+func (r *resultDB) precomputed(unit string) (bool, error) {
+	var ok bool
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		ok = tx.Bucket(precomputedBucket).Get([]byte(unit)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+// query returns the cells matching q; see cubeCell.matches.
+func (r *resultDB) query(q cubeCell) ([]cubeCell, error) {
+	var cells []cubeCell
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(cubeBucket)
+		if b == nil {
+			return fmt.Errorf("no precomputed results")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			c, err := parseCubeCell(k, v)
+			if err != nil {
+				return err
+			}
+			if c.matches(q) {
+				cells = append(cells, c)
+			}
+			return nil
+		})
+	})
+	return cells, err
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"example.com/m/v2/exposuremath"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"gonum.org/v1/gonum/mat"
+	"io"
+	"math"
+	"sort"
+)
+
+// ExposureResult is the population-weighted PM2.5 exposure of each census
+// population in one year: the concentration each member is exposed to
+// (μg/m³), summed over the population's members (people·μg/m³), with the
+// count of each population.
+type ExposureResult struct {
+	Year     int32
+	AQM      string
+	Exposure map[string]float64
+	People   map[string]float64
+}
+
+// Populations returns the names of the populations in r, sorted.
+func (r *ExposureResult) Populations() []string {
+	return sortedKeys(r.Exposure)
+}
+
+// MeanExposure returns the mean concentration (μg/m³) each population's
+// members are exposed to. Populations without people are omitted.
+func (r *ExposureResult) MeanExposure() map[string]float64 {
+	mean := make(map[string]float64)
+	for pop, e := range r.Exposure {
+		if n := r.People[pop]; n > 0 && !math.IsNaN(e) {
+			mean[pop] = e / n
+		}
+	}
+	return mean
+}
+
+// Disparity compares the mean exposure of each population with that of
+// the reference population, e.g. "TotalPop".
+func (r *ExposureResult) Disparity(reference string) (*DisparityReport, error) {
+	groups, err := exposuremath.Disparities(r.MeanExposure(), reference)
+	if err != nil {
+		return nil, withKind(kindDataMissing, err)
+	}
+	return &DisparityReport{Year: r.Year, Reference: reference, Groups: groups}, nil
+}
+
+// WriteCSV writes r to w in the format of a scenario's exposure.csv.
+func (r *ExposureResult) WriteCSV(w io.Writer) error {
+	var rows [][]string
+	for _, pop := range r.Populations() {
+		rows = append(rows, []string{pop, labels.get(pop), formatFloat(r.Exposure[pop]), formatFloat(suppression.count(r.People[pop]))})
+	}
+	return writeCSVTo(w, []string{"Population", "Label", "Exposure", "People"}, rows)
+}
+
+// DisparityReport compares the mean exposure of each population with that
+// of a reference population.
+type DisparityReport struct {
+	Year      int32
+	Reference string
+	Groups    []Disparity
+}
+
+// Disparity is a population's mean exposure (μg/m³) relative to that of
+// the reference population of a DisparityReport.
+type Disparity = exposuremath.Disparity
+
+// Largest returns the group whose mean exposure differs most from that of the
+// reference population, relative to it.
+func (d *DisparityReport) Largest() Disparity {
+	return exposuremath.Largest(d.Groups)
+}
+
+// WriteCSV writes d to w.
+func (d *DisparityReport) WriteCSV(w io.Writer) error {
+	var rows [][]string
+	for _, g := range d.Groups {
+		rows = append(rows, []string{g.Population, labels.get(g.Population), formatFloat(g.Exposure), formatFloat(g.Difference), formatFloat(g.Ratio)})
+	}
+	return writeCSVTo(w, []string{"Population", "Label", "Exposure", "Difference", "Ratio"}, rows)
+}
+
+// ContributionMatrix holds the population-adjusted PM2.5 emissions
+// (kg/year) attributable to each demographic's consumption, by SCC.
+// SCCs without emissions for any demographic are pruned.
+type ContributionMatrix struct {
+	Year         int32
+	AQM          string
+	Demographics []*eieiorpc.Demograph
+	SCCs         []slca.SCC
+
+	// Columns is the index of each of SCCs in the model's SCCs.
+	Columns []int
+
+	// Pruned is the number of the model's SCCs pruned.
+	Pruned int
+
+	// Emissions has a row for each of Demographics and a column for each
+	// of SCCs.
+	Emissions *mat.Dense
+}
+
+// contributionMatrix calculates the contribution matrix of dems.
+// multipliers optionally scales each commodity's demand; see
+// getDemographicDemand.
+func contributionMatrix(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, year int32, loc eieiorpc.Location, aqm string, multipliers []float64) (*ContributionMatrix, error) {
+	rows, err := demEmissionRows(ctx, s, dems, eieiorpc.Emission_PM25, year, loc, aqm, multipliers)
+	if err != nil {
+		return nil, err
+	}
+	emis, cols := pruneZeroColumns(rows, len(s.SCCs))
+	m := &ContributionMatrix{Year: year, AQM: aqm, Demographics: dems, Columns: cols, Pruned: len(s.SCCs) - len(cols), Emissions: emis}
+	for _, j := range cols {
+		m.SCCs = append(m.SCCs, s.SCCs[j])
+	}
+	if err := populationAdjust(ctx, s, emis, dems, year); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// pruneZeroColumns returns a matrix of the columns of rows, each of c
+// values, that aren't all zero, with their indices in rows. Only those
+// columns are copied, so the full matrix is never allocated. gonum
+// matrices can't be empty, so if every column is zero, every column is
+// returned.
+func pruneZeroColumns(rows [][]float64, c int) (*mat.Dense, []int) {
+	var cols []int
+	for j := 0; j < c; j++ {
+		for _, row := range rows {
+			if row[j] != 0 {
+				cols = append(cols, j)
+				break
+			}
+		}
+	}
+	if len(cols) == 0 {
+		cols = make([]int, c)
+		for j := range cols {
+			cols[j] = j
+		}
+	}
+	pruned := mat.NewDense(len(rows), len(cols), nil)
+	for i, row := range rows {
+		dst := pruned.RawRowView(i)
+		for k, j := range cols {
+			dst[k] = row[j]
+		}
+	}
+	return pruned, cols
+}
+
+// ZeroSCCs returns the number of the model's SCCs without emissions from
+// the demographics in rows from to to (exclusive) of m, including those
+// pruned from m.
+func (m *ContributionMatrix) ZeroSCCs(from, to int) int {
+	n := m.Pruned
+	for j := range m.SCCs {
+		zero := true
+		for i := from; i < to; i++ {
+			if m.Emissions.At(i, j) != 0 {
+				zero = false
+				break
+			}
+		}
+		if zero {
+			n++
+		}
+	}
+	return n
+}
+
+// PruningRatio returns the fraction of the model's SCCs pruned from m.
+func (m *ContributionMatrix) PruningRatio() float64 {
+	n := len(m.SCCs) + m.Pruned
+	if n == 0 {
+		return 0
+	}
+	return float64(m.Pruned) / float64(n)
+}
+
+// Totals returns the total emissions attributable to each demographic.
+func (m *ContributionMatrix) Totals() []float64 {
+	totals := make([]float64, len(m.Demographics))
+	for i := range totals {
+		for _, v := range m.Emissions.RawRowView(i) {
+			totals[i] += v
+		}
+	}
+	return totals
+}
+
+// SectorEmissions is the emissions from an SCC.
+type SectorEmissions struct {
+	SCC       slca.SCC
+	Emissions float64
+}
+
+// TopSectors returns the n SCCs with the most emissions, summed over the
+// demographics, largest first.
+func (m *ContributionMatrix) TopSectors(n int) []SectorEmissions {
+	sectors := make([]SectorEmissions, len(m.SCCs))
+	for j, scc := range m.SCCs {
+		sectors[j] = SectorEmissions{SCC: scc, Emissions: mat.Sum(m.Emissions.ColView(j))}
+	}
+	sort.SliceStable(sectors, func(i, j int) bool { return sectors[i].Emissions > sectors[j].Emissions })
+	if n < len(sectors) {
+		sectors = sectors[:n]
+	}
+	return sectors
+}
+
+// NormalizeMode is how ContributionMatrix.Normalize scales emissions to
+// shares.
+type NormalizeMode string
+
+const (
+	// NormalizeDemographic divides each demographic's emissions by its
+	// total, giving the share of its emissions from each SCC.
+	NormalizeDemographic NormalizeMode = "demographic"
+
+	// NormalizeSector divides each SCC's emissions by their total, giving
+	// the share attributable to each demographic.
+	NormalizeSector NormalizeMode = "sector"
+
+	// NormalizeTotal divides all emissions by their total.
+	NormalizeTotal NormalizeMode = "total"
+)
+
+// Normalize returns a copy of m with its emissions scaled to shares
+// according to mode. Shares of zero totals are zero. The shares aren't
+// checked for non-finite values, as the emissions were when calculated
+// and finite emissions give finite shares.
+func (m *ContributionMatrix) Normalize(mode NormalizeMode) (*ContributionMatrix, error) {
+	r, c := m.Emissions.Dims()
+	norm := mat.DenseCopyOf(m.Emissions)
+	total := mat.Sum(norm)
+	for i := 0; i < r; i++ {
+		rowTotal := mat.Sum(norm.RowView(i))
+		for j := 0; j < c; j++ {
+			var div float64
+			switch mode {
+			case NormalizeDemographic:
+				div = rowTotal
+			case NormalizeSector:
+				div = mat.Sum(m.Emissions.ColView(j))
+			case NormalizeTotal:
+				div = total
+			default:
+				return nil, fmt.Errorf("invalid normalization %q", mode)
+			}
+			if div == 0 {
+				norm.Set(i, j, 0)
+			} else {
+				norm.Set(i, j, m.Emissions.At(i, j)/div)
+			}
+		}
+	}
+	n := *m
+	n.Emissions = norm
+	return &n, nil
+}
+
+// WriteCSV writes the nonzero emissions of m to w, with a row for each
+// demographic and SCC.
+func (m *ContributionMatrix) WriteCSV(w io.Writer) error {
+	var rows [][]string
+	for i, dem := range m.Demographics {
+		for j, v := range m.Emissions.RawRowView(i) {
+			if v != 0 {
+				rows = append(rows, []string{demographKey(dem), labels.demograph(dem), string(m.SCCs[j]), formatFloat(v)})
+			}
+		}
+	}
+	return writeCSVTo(w, []string{"Demographic", "Label", "SCC", "Emissions"}, rows)
+}
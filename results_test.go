@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/evookelj/inmap/emissions/slca"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"testing"
+	"testing/quick"
+)
+
+func TestPruneZeroColumns(t *testing.T) {
+	rows := [][]float64{
+		{0, 1, 0, 2},
+		{0, 3, 0, 0},
+	}
+	m, cols := pruneZeroColumns(rows, 4)
+	if len(cols) != 2 || cols[0] != 1 || cols[1] != 3 {
+		t.Fatalf("got columns %v, want [1 3]", cols)
+	}
+	if want := mat.NewDense(2, 2, []float64{1, 2, 3, 0}); !mat.Equal(m, want) {
+		t.Errorf("got %v, want %v", mat.Formatted(m), mat.Formatted(want))
+	}
+
+	// Nothing is pruned if every column is zero.
+	m, cols = pruneZeroColumns([][]float64{{0, 0}}, 2)
+	if r, c := m.Dims(); r != 1 || c != 2 || len(cols) != 2 {
+		t.Errorf("all zero: got a %d×%d matrix of columns %v, want all 2 columns", r, c, cols)
+	}
+}
+
+func TestZeroSCCs(t *testing.T) {
+	m := &ContributionMatrix{SCCs: make([]slca.SCC, 2), Pruned: 3,
+		Emissions: mat.NewDense(2, 2, []float64{1, 0, 0, 2})}
+	if n := m.ZeroSCCs(0, 2); n != 3 {
+		t.Errorf("both demographics: got %d, want 3", n)
+	}
+	if n := m.ZeroSCCs(0, 1); n != 4 {
+		t.Errorf("first demographic: got %d, want 4", n)
+	}
+}
+
+// contributionOf returns a contribution matrix of 3 demographics by 4
+// SCCs with emissions values, whose columns are zeroed where zero is set.
+func contributionOf(values [12]float64, zero [4]bool) *ContributionMatrix {
+	data := make([]float64, 12)
+	for i, v := range values {
+		if !zero[i%4] {
+			data[i] = math.Abs(bounded(v))
+		}
+	}
+	return &ContributionMatrix{SCCs: make([]slca.SCC, 4), Emissions: mat.NewDense(3, 4, data)}
+}
+
+// TestNormalizeQuick checks that the shares of each demographic, each SCC
+// or the whole matrix sum to one, or are zero if there are no emissions,
+// and that all-zero columns have zero shares.
+func TestNormalizeQuick(t *testing.T) {
+	sumsToOne := func(v []float64) bool {
+		var sum float64
+		for _, x := range v {
+			if x < 0 || math.IsNaN(x) {
+				return false
+			}
+			sum += x
+		}
+		return sum == 0 || math.Abs(sum-1) < 1e-9
+	}
+	f := func(values [12]float64, zero [4]bool) bool {
+		m := contributionOf(values, zero)
+		for _, mode := range []NormalizeMode{NormalizeDemographic, NormalizeSector, NormalizeTotal} {
+			n, err := m.Normalize(mode)
+			if err != nil {
+				return false
+			}
+			switch mode {
+			case NormalizeDemographic:
+				for i := 0; i < 3; i++ {
+					if !sumsToOne(n.Emissions.RawRowView(i)) {
+						return false
+					}
+				}
+			case NormalizeSector:
+				for j := 0; j < 4; j++ {
+					if !sumsToOne(mat.Col(nil, j, n.Emissions)) {
+						return false
+					}
+				}
+			case NormalizeTotal:
+				if !sumsToOne(n.Emissions.RawMatrix().Data) {
+					return false
+				}
+			}
+			for j, z := range zero {
+				if z && mat.Sum(n.Emissions.ColView(j)) != 0 {
+					return false
+				}
+			}
+		}
+		// The original emissions are unchanged.
+		return mat.Equal(m.Emissions, contributionOf(values, zero).Emissions)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNormalizeNaN(t *testing.T) {
+	nan := math.NaN()
+	m := &ContributionMatrix{SCCs: make([]slca.SCC, 2), Emissions: mat.NewDense(2, 2, []float64{
+		1, nan,
+		1, 3,
+	})}
+	n, err := m.Normalize(NormalizeDemographic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A NaN spreads to the shares of its demographic, not to zero shares
+	// or the other demographics.
+	if row := n.Emissions.RawRowView(0); !math.IsNaN(row[0]) || !math.IsNaN(row[1]) {
+		t.Errorf("demographic with NaN emissions: got shares %v, want NaN", row)
+	}
+	if row := n.Emissions.RawRowView(1); row[0] != 0.25 || row[1] != 0.75 {
+		t.Errorf("other demographic: got shares %v, want [0.25 0.75]", row)
+	}
+	if _, err := m.Normalize("county"); err == nil {
+		t.Error("invalid mode: expected an error")
+	}
+}
+
+// TestExposureResultDisparity checks that disparities compare mean
+// exposure: a small population whose members are highly exposed is the
+// largest disparity, though its summed exposure is the smallest.
+func TestExposureResultDisparity(t *testing.T) {
+	r := &ExposureResult{
+		Exposure: map[string]float64{"TotalPop": 2000, "Large": 1800, "Small": 100},
+		People:   map[string]float64{"TotalPop": 1000, "Large": 990, "Small": 10},
+	}
+	d, err := r.Disparity("TotalPop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := d.Largest()
+	if g.Population != "Small" || g.Exposure != 10 || g.Ratio != 5 || g.Difference != 8 {
+		t.Errorf("got largest disparity %+v, want Small with mean exposure 10, 5 times the total's", g)
+	}
+
+	// The reference population has no mean exposure without people.
+	r.People = nil
+	if _, err := r.Disparity("TotalPop"); kindOf(err) != kindDataMissing {
+		t.Errorf("no people: got error %v, want missing data", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"os"
+	"path"
+	"strings"
+)
+
+// sccPatterns is a list of SCC patterns, such as "2810*" or "2310??1000",
+// as in path.Match, set by a flag that may be repeated and whose values
+// are comma-separated patterns or "@file", naming a file with a pattern on
+// each line. Leading zeros of patterns and SCCs are ignored, as in
+// control scenario files.
+type sccPatterns []string
+
+func (p *sccPatterns) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(*p, ",")
+}
+
+// Set implements flag.Value.
+func (p *sccPatterns) Set(v string) error {
+	var patterns []string
+	if strings.HasPrefix(v, "@") {
+		var err error
+		if patterns, err = readSCCList(v[1:]); err != nil {
+			return err
+		}
+	} else {
+		patterns = strings.Split(v, ",")
+	}
+	for _, pat := range patterns {
+		pat = strings.TrimLeft(strings.TrimSpace(pat), "0")
+		if pat == "" {
+			continue
+		}
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid SCC pattern %q", pat)
+		}
+		*p = append(*p, pat)
+	}
+	return nil
+}
+
+// readSCCList reads the SCC patterns in the file at path, one per line.
+// Blank lines and those starting with # are skipped, as is anything after
+// the first comma or whitespace, so that a CSV file of SCCs and their
+// descriptions can be used.
+func readSCCList(path string) ([]string, error) {
+	f, err := os.Open(os.ExpandEnv(path))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading SCC list")
+	}
+	defer f.Close()
+	var patterns []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexAny(line, ", \t"); i >= 0 {
+			line = line[:i]
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, errors.Wrap(sc.Err(), "reading SCC list")
+}
+
+// match reports whether scc matches any of p.
+func (p sccPatterns) match(scc string) bool {
+	scc = strings.TrimLeft(scc, "0")
+	for _, pat := range p {
+		if ok, _ := path.Match(pat, scc); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// includeSCC and excludeSCC are the -include-scc and -exclude-scc
+// settings. Emissions, and the concentrations and health impacts they
+// cause, are only counted for SCCs that match includeSCC, if it is set,
+// and don't match excludeSCC.
+var includeSCC, excludeSCC sccPatterns
+
+// sccFilterFlags adds the -include-scc and -exclude-scc flags to fs.
+func sccFilterFlags(fs *flag.FlagSet) {
+	fs.Var(&includeSCC, "include-scc", "count only the emissions of SCCs matching these patterns, e.g. 2310* or @point_sccs.txt (repeatable)")
+	fs.Var(&excludeSCC, "exclude-scc", "omit the emissions of SCCs matching these patterns, e.g. 2810* for fires (repeatable)")
+}
+
+// sccFilterSetting describes the SCC filter, for recording in results and
+// keying cached ones.
+func sccFilterSetting() string {
+	var parts []string
+	if len(includeSCC) > 0 {
+		parts = append(parts, "include "+includeSCC.String())
+	}
+	if len(excludeSCC) > 0 {
+		parts = append(parts, "exclude "+excludeSCC.String())
+	}
+	if parts == nil {
+		return "none"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// sccFilterMask returns 1 for each SCC of s, in the order of s.SCCs,
+// counted under the SCC filter and 0 for each that isn't, or nil if there
+// is no filter.
+func sccFilterMask(s *eieio.Server) ([]float64, error) {
+	if len(includeSCC) == 0 && len(excludeSCC) == 0 {
+		return nil, nil
+	}
+	mask := make([]float64, len(s.SCCs))
+	var n int
+	for j, scc := range s.SCCs {
+		if (len(includeSCC) == 0 || includeSCC.match(string(scc))) && !excludeSCC.match(string(scc)) {
+			mask[j] = 1
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, errorf(kindConfig, "no SCCs are left by the SCC filter (%s)", sccFilterSetting())
+	}
+	return mask, nil
+}
+
+// emitterMask returns m, a mask of the SCCs to calculate impacts for (nil
+// for all), restricted to those counted under the SCC filter.
+func emitterMask(s *eieio.Server, m *eieiorpc.Mask) (*eieiorpc.Mask, error) {
+	mask, err := sccFilterMask(s)
+	if mask == nil || err != nil {
+		return m, err
+	}
+	if m != nil {
+		if len(m.Data) != len(mask) {
+			return nil, errorf(kindNumeric, "expected emitter mask to have #SCC %d values, got %d", len(mask), len(m.Data))
+		}
+		for j, v := range m.Data {
+			mask[j] *= v
+		}
+	}
+	return &eieiorpc.Mask{Data: mask}, nil
+}
+
+// filterSCCColumns sets the columns of m, a matrix with a column for each
+// SCC of s, of the SCCs not counted under the SCC filter to zero.
+func filterSCCColumns(s *eieio.Server, m *mat.Dense) error {
+	mask, err := sccFilterMask(s)
+	if mask == nil || err != nil {
+		return err
+	}
+	r, c := m.Dims()
+	if c != len(mask) {
+		return errorf(kindNumeric, "expected matrix to have #SCC %d columns, got %d", len(mask), c)
+	}
+	for i := 0; i < r; i++ {
+		row := m.RawRowView(i)
+		for j, in := range mask {
+			if in == 0 {
+				row[j] = 0
+			}
+		}
+	}
+	return nil
+}
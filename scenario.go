@@ -0,0 +1,817 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// scenario specifies a single analysis run.
+type scenario struct {
+	// Name identifies the scenario and names its output directory.
+	Name string
+
+	// Year is the analysis year. Defaults to defaultYear.
+	Year int32
+
+	// FinalDemandType is the name of the eieiorpc.FinalDemandType to
+	// analyze, e.g. "PersonalConsumption". Defaults to "AllDemand".
+	FinalDemandType string
+
+	// DemandFile, if set, is a CSV file with columns Commodity,Dollars,
+	// such as one written by `demand export` and edited, giving the final
+	// demand for the listed commodities in place of the model's. Other
+	// commodities keep the model's demand. Demographic consumption, which
+	// comes from the CES, is not affected.
+	DemandFile string
+
+	// DemandRescale is how the demand from DemandFile is rescaled to keep
+	// the model's total final demand: "none" (the default), "total" (all
+	// commodities scaled by the same factor) or "unedited" (the
+	// commodities whose demand differs from the model's are kept and the
+	// others scaled to make up the difference).
+	DemandRescale string
+
+	// DemandScale multiplies final demand, and each demographic's
+	// consumption, for the named commodities. The key "*" applies to all
+	// commodities without a specific entry.
+	DemandScale map[string]float64
+
+	// ImportSubstitution is how changes in final demand from DemandFile
+	// and DemandScale are split between domestic production, whose
+	// emissions are modeled, and imports: "fixed" (the default; each
+	// commodity keeps its model import share), "domestic" (the whole
+	// change in a commodity's total demand falls on domestic production)
+	// or "import" (it falls on imports). Demand scales are interpreted as
+	// scaling total demand, and a demand file's dollars as domestic
+	// demand at the model import shares. Decreases larger than the
+	// baseline domestic production or imports fall on the other. Demand
+	// scales of demographic consumption are adjusted in the same way.
+	ImportSubstitution string
+
+	// ExposureFunction, if set, overrides the ExposureFunction config
+	// setting for the exposure results of this scenario, e.g.
+	// "threshold:2.4". Health impacts are calculated by the hazard ratio
+	// function regardless.
+	ExposureFunction string
+
+	// Background, if set, overrides the Background config setting for
+	// this scenario: a background PM2.5 concentration subtracted from
+	// modeled concentrations before exposure and health impacts are
+	// calculated.
+	Background backgroundConfig
+
+	// EmissionFactors, if File is set, overrides the EmissionFactors
+	// config setting for this scenario.
+	EmissionFactors emissionFactorConfig
+
+	// ExposureWeights, if set, also calculates a composite exposure index
+	// as the weighted sum of the concentrations of the named pollutants,
+	// written to composite_exposure.csv. Defaults to the ExposureWeights of
+	// the config.
+	ExposureWeights map[string]float64
+
+	// Speciation specifies whether to split each population's exposure into
+	// primary PM2.5, secondary sulfate, secondary nitrate and SOA, written
+	// to speciation.csv.
+	Speciation bool
+
+	// ExposureDistribution specifies whether to describe the distribution
+	// of individual exposure within each population, by grid cell: its
+	// standard deviation and percentiles, written to
+	// exposure_distribution.csv.
+	ExposureDistribution bool
+
+	// ConcentrationIndex specifies whether to compute, for each pollutant,
+	// the concentration index of exposure over the income deciles and its
+	// jackknife standard error, written to concentration_index.csv.
+	ConcentrationIndex bool
+
+	// Temporal, if "month" or "season", also calculates each population's
+	// exposure in each month or season (winter being December to
+	// February), from the monthly emission profiles in
+	// [Sandbox.Temporal], written to exposure_by_period.csv.
+	Temporal string
+
+	// CategoryTree specifies whether to attribute each population's PM2.5
+	// exposure to the nested CES consumption categories of the purchased
+	// commodities (e.g. Housing > Utilities > Electricity), written to
+	// categories.json and, as treemap rows, categories.csv. CES
+	// categories cover household purchases, so this is most meaningful
+	// with FinalDemandType "PersonalConsumption"; other commodities are
+	// reported as "Unclassified".
+	CategoryTree bool
+
+	// Demographics lists the demographics to calculate emission
+	// contributions for, as demograph keys ("decile:LowestTen") or groups
+	// ("decile", "ethnicity"). If empty, contributions are not calculated.
+	Demographics []string
+
+	// SupplyChain specifies whether to split each demographic's emissions
+	// into those from the sectors it purchases from directly and those
+	// from upstream supply chains. Requires Demographics.
+	SupplyChain bool
+
+	// PollutantContribution specifies whether to write each demographic's
+	// population-adjusted emissions of every emitted pollutant by SCC to
+	// contribution_by_pollutant.csv, rather than only the PM2.5 total of
+	// contribution.csv. If ContributionByLocation is also set, emissions
+	// from domestic and imported production are reported separately.
+	// Requires Demographics.
+	PollutantContribution  bool
+	ContributionByLocation bool
+
+	// NAICSContribution specifies whether to write each demographic's
+	// PM2.5 emissions by NAICS code to contribution_by_naics.csv, through
+	// the crosswalk from SCCs to NAICS codes written by the export
+	// crosswalk command. Requires Demographics.
+	NAICSContribution bool
+
+	// ConsumptionShares specifies whether to write each demographic's
+	// consumption by end-use group of the IOAggregatorFile, and its share
+	// of the demographic's total, to consumption_shares.csv, with the
+	// emissions each group causes per dollar. Requires Demographics.
+	ConsumptionShares bool
+
+	// Population, if set, projects census populations, e.g. for a future
+	// year. Exposure results are then for the projected populations, and
+	// projection.csv compares them with those for census populations.
+	// Health impacts are still calculated for census populations.
+	Population populationProjection
+
+	// Controls, if set, applies an emission control scenario that scales
+	// emissions by SCC, state and year, e.g. for a future policy. The
+	// exposure of each population with and without the controls is
+	// written to controls.csv and the emissions by SCC to
+	// controls_sectors.csv; other results are for uncontrolled emissions.
+	Controls controlConfig
+
+	// EmploymentFile, if set, is a CSV file of employment by sector, such
+	// as BLS employment by industry matched to the EIO commodities, with
+	// columns Sector, Jobs and, optionally, Year. The PM2.5 emissions and
+	// exposure caused by the final demand for each sector are written to
+	// employment.csv along with them per job and per dollar, for tradeoff
+	// analyses.
+	EmploymentFile string
+
+	// ExposureEfficiency specifies whether to write the total population
+	// exposure caused per dollar of final demand for each sector, and per
+	// job with an EmploymentFile, to exposure_efficiency.csv, ranked from
+	// the most exposure per dollar to the least.
+	ExposureEfficiency bool
+
+	// Sectors specifies whether to write the emissions of each pollutant
+	// by SCC caused by the final demand to sectors.csv, as shown by the
+	// browse command.
+	Sectors bool
+
+	// Inventory specifies whether to also calculate each population's
+	// exposure caused by the emissions of the inventory in
+	// [Sandbox.Inventory] in place of those derived from the final demand,
+	// written to inventory_exposure.csv beside the exposure caused by the
+	// final demand for comparison.
+	Inventory bool
+
+	// Provenance, if positive, is the number of top contributing inputs to
+	// list for each population's exposure and each demographic's
+	// contribution, by SCC and, for exposure, by grid cluster and PM2.5
+	// component, written to provenance.json for audit tools.
+	Provenance int
+
+	// AQM is the air quality model to use. Defaults to "isrm".
+	AQM string
+
+	// HR is the hazard ratio function used to calculate deaths, e.g.
+	// "NasariACS". If empty, health impacts are not calculated.
+	HR string
+
+	// Valuation specifies how deaths are valued in dollars. Damages are
+	// calculated only if HR and Valuation.VSL are set.
+	Valuation valuationConfig
+
+	// Workbook specifies whether to also write the results as an Excel
+	// workbook, results.xlsx.
+	Workbook bool
+}
+
+// setDefaults fills in unspecified scenario fields.
+func (sc *scenario) setDefaults() {
+	if sc.Year == 0 {
+		sc.Year = int32(defaultYear())
+	}
+	if sc.FinalDemandType == "" {
+		sc.FinalDemandType = eieiorpc.FinalDemandType_AllDemand.String()
+	}
+	if sc.AQM == "" {
+		sc.AQM = "isrm"
+	}
+	if sc.ImportSubstitution == "" {
+		sc.ImportSubstitution = substituteFixed
+	}
+}
+
+// scenarioContext returns ctx with the settings of sc that override the
+// config: its exposure function, background and emission factors.
+func scenarioContext(ctx context.Context, sc scenario) (context.Context, error) {
+	if sc.ExposureFunction != "" {
+		f, err := parseExposureFunction(sc.ExposureFunction)
+		if err != nil {
+			return nil, err
+		}
+		ctx = withExposureFunction(ctx, f)
+	}
+	if !sc.Background.empty() {
+		ctx = withBackground(ctx, sc.Background)
+	}
+	if sc.EmissionFactors.File != "" {
+		ctx = withEmissionFactors(ctx, sc.EmissionFactors)
+	}
+	return ctx, nil
+}
+
+// scenarioDemand returns the final demand specified by sc, restricted to
+// the DemandStates of the config, if any, along with the
+// per-commodity multipliers from sc.DemandScale (nil if none), with
+// changes in demand split between domestic production and imports
+// according to sc.ImportSubstitution.
+func scenarioDemand(ctx context.Context, s *eieio.Server, sc *scenario) (*eieiorpc.Vector, []float64, error) {
+	ctx, span := startSpan(ctx, "scenarioDemand")
+	defer span.End()
+	if err := checkImportSubstitution(sc.ImportSubstitution); err != nil {
+		return nil, nil, err
+	}
+	demand, commodities, err := modelDemand(ctx, s, sc.FinalDemandType, sc.Year)
+	if err != nil {
+		return nil, nil, err
+	}
+	if demand, err = stateDemand(ctx, s, demand); err != nil {
+		return nil, nil, err
+	}
+	base := append([]float64{}, demand.Data...)
+	if sc.DemandFile != "" {
+		dollars, err := readDemandFile(os.ExpandEnv(sc.DemandFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := applyDemandFile(demand, commodities, dollars, sc.DemandRescale); err != nil {
+			return nil, nil, errors.Wrapf(err, "applying demand file %s", sc.DemandFile)
+		}
+	}
+	multipliers, err := demandMultipliers(ctx, s, sc.DemandScale)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := scaleDemand(demand, multipliers); err != nil {
+		return nil, nil, err
+	}
+	if sc.ImportSubstitution != "" && sc.ImportSubstitution != substituteFixed {
+		total, err := totalDemand(ctx, s, sc.FinalDemandType, sc.Year)
+		if err != nil {
+			return nil, nil, err
+		}
+		if multipliers, err = substituteImports(sc.ImportSubstitution, demand, base, total.Data, multipliers); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := checkFinite(ctx, "final demand", demand.Data, commodityLabel(ctx, s)); err != nil {
+		return nil, nil, err
+	}
+	return demand, multipliers, nil
+}
+
+// scenarioResult holds the headline results of a scenario run.
+type scenarioResult struct {
+	// Exposure is population-weighted exposure by census population.
+	Exposure map[string]float64
+
+	// Contribution is population-adjusted emissions by demograph key.
+	Contribution map[string]float64
+
+	// Deaths is attributable deaths by census population.
+	Deaths map[string]float64
+
+	// Damages is the dollar value of attributable deaths by census population.
+	Damages map[string]float64
+
+	// MeanExposure is exposure per person by census population, for
+	// populations with people.
+	MeanExposure map[string]float64
+
+	// TopSectors are the SCCs with the greatest PM2.5 emissions.
+	TopSectors []sectorShare
+
+	// MissingCES records where CES data was missing and how it was handled
+	// under the MissingCES policy.
+	MissingCES []string
+}
+
+// runScenario performs the analysis specified by sc and writes the result
+// tables to dir.
+func runScenario(ctx context.Context, s *eieio.Server, sc scenario, dir string) (*scenarioResult, error) {
+	ctx, span := startSpan(ctx, "runScenario")
+	defer span.End()
+	sc.setDefaults()
+	if err := Year(sc.Year).validate(ctx, s); err != nil {
+		return nil, err
+	}
+	if len(sc.ExposureWeights) == 0 {
+		sc.ExposureWeights = exposureWeightsSetting
+	}
+	if sc.Temporal != "" {
+		if _, err := temporalPeriods(sc.Temporal); err != nil {
+			return nil, err
+		}
+		if temporalSetting.File == "" {
+			return nil, errorf(kindConfig, "scenario %s: Temporal requires monthly emission profiles in [Sandbox.Temporal]", sc.Name)
+		}
+	}
+	if sc.Inventory && inventorySetting.File == "" {
+		return nil, errorf(kindConfig, "scenario %s: Inventory requires an emissions inventory in [Sandbox.Inventory]", sc.Name)
+	}
+	ctx, cesNotes := withCESLog(ctx)
+	ctx, nonFiniteNotes := withNonFiniteLog(ctx)
+	ctx, err := scenarioContext(ctx, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	demand, multipliers, err := scenarioDemand(ctx, s, &sc)
+	if err != nil {
+		return nil, err
+	}
+
+	if !sc.Population.empty() {
+		p, err := newPopulationProjector(s, sc.Population, sc.AQM)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading population projection")
+		}
+		censusCtx := ctx
+		ctx = withPopulationProjection(ctx, p)
+		rows, err := projectionRows(censusCtx, ctx, s, sc.Year, sc.AQM, demand)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating exposure for projected populations")
+		}
+		if err := writeCSV(filepath.Join(dir, "projection.csv"), projectionHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	exposureByPop, err := getExposureByPopulation(ctx, s, sc.Year, LOC, sc.AQM, demand, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calculating exposure")
+	}
+	result := &scenarioResult{Exposure: *exposureByPop}
+	id, err := getGridID(s, sc.AQM)
+	if err != nil {
+		return nil, err
+	}
+	people, err := populationCounts(ctx, s, sc.AQM, id.Cells)
+	if err != nil {
+		return nil, errors.Wrap(err, "error counting populations")
+	}
+	var rows [][]string
+	for _, popName := range sortedKeys(*exposureByPop) {
+		rows = append(rows, []string{popName, labels.get(popName), formatFloat((*exposureByPop)[popName]), formatFloat(suppression.count(people[popName]))})
+	}
+	if err := writeCSV(filepath.Join(dir, "exposure.csv"), []string{"Population", "Label", "Exposure", "People"}, rows); err != nil {
+		return nil, err
+	}
+	if receptorRegion.File != "" {
+		rows, err := receptorRows(ctx, s, demand, sc.Year, sc.AQM)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating exposure in the receptor region")
+		}
+		if err := writeCSV(filepath.Join(dir, "receptor_exposure.csv"), receptorHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+	if emitterRegions.File != "" {
+		rows, err := emitterRegionRows(ctx, s, sc.Year, sc.AQM, demand)
+		if err != nil {
+			return nil, errors.Wrap(err, "error attributing exposure to emitter regions")
+		}
+		if err := writeCSV(filepath.Join(dir, "exposure_by_emitter_region.csv"), emitterRegionHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+	if nonattainmentConfig.File != "" {
+		rows, err := attainmentRows(ctx, s, demand, sc.Year, sc.AQM)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating exposure by attainment status")
+		}
+		if err := writeCSV(filepath.Join(dir, "exposure_by_attainment.csv"), attainmentHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+	result.MeanExposure = make(map[string]float64)
+	for popName, e := range *exposureByPop {
+		if n := people[popName]; n > 0 && !math.IsNaN(e) {
+			result.MeanExposure[popName] = e / n
+		}
+	}
+
+	if len(sc.ExposureWeights) > 0 {
+		conc, err := getCompositeConcentrations(ctx, s, sc.Year, LOC, sc.AQM, demand, sc.ExposureWeights)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating composite concentrations")
+		}
+		compositeByPop, err := populationExposure(ctx, s, sc.AQM, conc, nil)
+		if err != nil {
+			return nil, err
+		}
+		rows = rows[:0]
+		for _, popName := range sortedKeys(*compositeByPop) {
+			rows = append(rows, []string{popName, labels.get(popName), formatFloat((*compositeByPop)[popName])})
+		}
+		if err := writeCSV(filepath.Join(dir, "composite_exposure.csv"), []string{"Population", "Label", "CompositeExposure"}, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.Speciation {
+		bySpecies, err := getExposureBySpecies(ctx, s, sc.Year, LOC, sc.AQM, demand, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating exposure by PM2.5 component")
+		}
+		header := []string{"Population", "Label"}
+		for _, component := range pm25Components {
+			header = append(header, component.Name)
+		}
+		rows = rows[:0]
+		for _, popName := range sortedKeys(*exposureByPop) {
+			row := []string{popName, labels.get(popName)}
+			for _, component := range pm25Components {
+				row = append(row, formatFloat(bySpecies[popName][component.Name]))
+			}
+			rows = append(rows, row)
+		}
+		if err := writeCSV(filepath.Join(dir, "speciation.csv"), header, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.ExposureDistribution {
+		byPop, err := getExposureDistribution(ctx, s, sc.Year, sc.AQM, demand, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating exposure distributions")
+		}
+		rows = rows[:0]
+		for _, popName := range sortedKeys(*exposureByPop) {
+			rows = append(rows, distributionRow(popName, byPop[popName]))
+		}
+		if err := writeCSV(filepath.Join(dir, "exposure_distribution.csv"), distributionHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.Inventory {
+		rows, err := inventoryExposureRows(ctx, s, sc.AQM, *exposureByPop)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating exposure caused by the inventory")
+		}
+		if err := writeCSV(filepath.Join(dir, "inventory_exposure.csv"), inventoryExposureHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.ConcentrationIndex {
+		rows, err := concentrationIndexRows(ctx, s, sc.Year, sc.AQM, demand)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating concentration indices")
+		}
+		if err := writeCSV(filepath.Join(dir, "concentration_index.csv"), concentrationIndexHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.Temporal != "" {
+		rows, err := periodExposureRows(ctx, s, sc.Year, sc.AQM, demand, sc.Temporal, *exposureByPop)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating exposure by period")
+		}
+		if err := writeCSV(filepath.Join(dir, "exposure_by_period.csv"), periodExposureHeader, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.CategoryTree {
+		if err := writeCategoryTree(ctx, s, sc.Year, sc.AQM, demand, filepath.Join(dir, "categories.json"), filepath.Join(dir, "categories.csv")); err != nil {
+			return nil, errors.Wrap(err, "error attributing exposure to consumption categories")
+		}
+	}
+
+	if sc.Controls.File != "" {
+		if err := writeControls(ctx, s, sc.Controls, sc.Year, sc.AQM, demand, filepath.Join(dir, "controls.csv"), filepath.Join(dir, "controls_sectors.csv")); err != nil {
+			return nil, errors.Wrap(err, "error applying emission controls")
+		}
+	}
+
+	if sc.EmploymentFile != "" || sc.ExposureEfficiency {
+		jobs, err := readScenarioEmployment(ctx, s, &sc)
+		if err != nil {
+			return nil, err
+		}
+		impacts, err := sectorImpacts(ctx, s, demand, sc.Year, sc.AQM)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating emissions and exposure by sector")
+		}
+		if sc.EmploymentFile != "" {
+			if err := writeEmployment(ctx, s, impacts, jobs, filepath.Join(dir, "employment.csv")); err != nil {
+				return nil, err
+			}
+		}
+		if sc.ExposureEfficiency {
+			if err := writeCSV(filepath.Join(dir, "exposure_efficiency.csv"), efficiencyHeader, efficiencyRows(impacts, jobs)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var provenance []provenanceValue
+	if sc.Provenance > 0 {
+		if provenance, err = exposureProvenance(ctx, s, sc.Year, sc.AQM, demand, *exposureByPop, sc.Provenance); err != nil {
+			return nil, errors.Wrap(err, "error attributing exposure to its inputs")
+		}
+	}
+
+	var dems []*eieiorpc.Demograph
+	var sccPruning []string
+	// keyEnds holds the end of the rows of dems of each of sc.Demographics.
+	keyEnds := make([]int, len(sc.Demographics))
+	for i, key := range sc.Demographics {
+		d, err := parseDemographs(key)
+		if err != nil {
+			return nil, err
+		}
+		dems = append(dems, d...)
+		keyEnds[i] = len(dems)
+	}
+
+	if len(dems) > 0 {
+		contributionMx, err := contributionMatrix(ctx, s, dems, sc.Year, LOC, sc.AQM, multipliers)
+		if err != nil {
+			return nil, errors.Wrap(err, "error calculating contributions")
+		}
+		contributions := contributionMx.Totals()
+		// The SCCs without emissions are recorded for each demograph key,
+		// followed by those pruned from the matrix of all of them.
+		pruning := func(what string, zero int) string {
+			return fmt.Sprintf("%s: %d of %d SCCs without emissions (%.1f%%)", what, zero, len(s.SCCs), 100*float64(zero)/float64(len(s.SCCs)))
+		}
+		for i, key := range sc.Demographics {
+			var from int
+			if i > 0 {
+				from = keyEnds[i-1]
+			}
+			sccPruning = append(sccPruning, pruning(key, contributionMx.ZeroSCCs(from, keyEnds[i])))
+		}
+		sccPruning = append(sccPruning, pruning("all", contributionMx.Pruned))
+		if sc.Provenance > 0 {
+			provenance = append(provenance, contributionProvenance(contributionMx, sc.Provenance)...)
+		}
+		result.Contribution = make(map[string]float64)
+		rows = rows[:0]
+		for i, dem := range dems {
+			result.Contribution[demographKey(dem)] = contributions[i]
+			rows = append(rows, []string{demographKey(dem), labels.demograph(dem), formatFloat(contributions[i])})
+		}
+		if err := writeCSV(filepath.Join(dir, "contribution.csv"), []string{"Demographic", "Label", "Emissions"}, rows); err != nil {
+			return nil, err
+		}
+		rows = demographicsTable(s, dems, *exposureByPop, contributions)
+		if err := writeCSV(filepath.Join(dir, "demographics.csv"), demographicsHeader, rows); err != nil {
+			return nil, err
+		}
+		if rows, err = consumptionRows(ctx, s, &sc, dems, multipliers); err != nil {
+			return nil, errors.Wrap(err, "error calculating consumption in constant dollars")
+		}
+		if err := writeCSV(filepath.Join(dir, "consumption.csv"), consumptionHeader, rows); err != nil {
+			return nil, err
+		}
+
+		if sc.SupplyChain {
+			if err := writeSupplyChainSplit(ctx, s, &sc, dems, multipliers, filepath.Join(dir, "supply_chain.csv")); err != nil {
+				return nil, errors.Wrap(err, "error splitting direct and supply-chain emissions")
+			}
+		}
+
+		if sc.PollutantContribution {
+			if err := writePollutantContribution(ctx, s, &sc, dems, multipliers, filepath.Join(dir, "contribution_by_pollutant.csv")); err != nil {
+				return nil, errors.Wrap(err, "error calculating contributions by pollutant")
+			}
+		}
+
+		if sc.NAICSContribution {
+			if err := writeNAICSContribution(ctx, s, contributionMx, filepath.Join(dir, "contribution_by_naics.csv")); err != nil {
+				return nil, errors.Wrap(err, "error calculating contributions by NAICS code")
+			}
+		}
+
+		if sc.ConsumptionShares {
+			if err := writeConsumptionShares(ctx, s, &sc, dems, multipliers, filepath.Join(dir, "consumption_shares.csv")); err != nil {
+				return nil, errors.Wrap(err, "error calculating consumption shares")
+			}
+		}
+	}
+
+	if sc.Provenance > 0 {
+		if err := writeProvenance(filepath.Join(dir, "provenance.json"), provenance); err != nil {
+			return nil, err
+		}
+	}
+
+	if sc.HR != "" {
+		result.Deaths = make(map[string]float64)
+		rows = rows[:0]
+		for _, popName := range s.CSTConfig.CensusPopColumns {
+			deaths, err := totalHealthInterval(ctx, s, demand, eieiorpc.Pollutant_TotalPM25, popName, sc.Year, sc.HR, sc.AQM)
+			if err != nil {
+				return nil, err
+			}
+			result.Deaths[popName] = deaths[0]
+			rows = append(rows, append([]string{popName, labels.get(popName)}, formatFloats(deaths, 1)...))
+		}
+		if err := writeCSV(filepath.Join(dir, "health.csv"), append([]string{"Population", "Label"}, intervalHeader(sc.HR, "Deaths")...), rows); err != nil {
+			return nil, err
+		}
+
+		if ageMortality.File != "" {
+			if err := writeHealthBurden(ctx, s, &sc, demand, filepath.Join(dir, "health_by_age.csv"), filepath.Join(dir, "health_by_sector.csv")); err != nil {
+				return nil, errors.Wrap(err, "error calculating health impacts by age")
+			}
+		}
+
+		if len(dems) > 0 {
+			if err := writeDeathsByDemographic(ctx, s, &sc, dems, multipliers, filepath.Join(dir, "deaths_by_demographic_sector.csv")); err != nil {
+				return nil, errors.Wrap(err, "error calculating deaths by demographic and sector")
+			}
+		}
+
+		if sc.Valuation.VSL != 0 {
+			result.Damages, err = writeDamages(ctx, s, &sc, demand, dems, multipliers, dir)
+			if err != nil {
+				return nil, errors.Wrap(err, "error valuing health impacts")
+			}
+		}
+	}
+
+	emis, err := getEmissionsBySCC(ctx, demand, s, eieiorpc.Emission_PM25, sc.Year, LOC, sc.AQM)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calculating emissions by sector")
+	}
+	pm25BySCC := emis.RawVector().Data
+	result.TopSectors = topSectors(s, pm25BySCC, summarySectorsCount)
+	if sc.Sectors {
+		if err := writeSectors(ctx, s, demand, &sc, pm25BySCC, filepath.Join(dir, "sectors.csv")); err != nil {
+			return nil, err
+		}
+	}
+
+	result.MissingCES = cesNotes.Notes()
+	rows = [][]string{
+		{"MissingCES", string(missingCES)},
+		{"CESWeights", cesWeightSetting.String()},
+		{"ExposureFunction", exposureFunctionFor(ctx).String()},
+		{"Background", backgroundFor(ctx).String()},
+		{"EmissionFactors", emissionFactorsFor(ctx).String()},
+		{"TimeActivity", timeActivity.String()},
+		{"Deflator", deflator.String()},
+		{"NonFinite", nonFinitePolicy},
+		{"Temporal", temporalSetting.String()},
+		{"ImportSubstitution", sc.ImportSubstitution},
+		{"DemandStates", demandStatesSetting()},
+		{"SCCFilter", sccFilterSetting()},
+		{"Nonattainment", nonattainmentConfig.String()},
+		{"ReceptorRegion", receptorRegion.String()},
+		{"EmitterRegions", emitterRegions.String()},
+		{"Suppression", suppression.String()},
+	}
+	grid, err := getGridID(s, sc.AQM)
+	if err != nil {
+		return nil, err
+	}
+	rows = append(rows, []string{"Grid", grid.String()})
+	for _, d := range derivedPopulations {
+		rows = append(rows, []string{"Population", d.Name + " = " + d.Expression})
+	}
+	if sc.NAICSContribution {
+		rows = append(rows, []string{"NAICSCrosswalk", useDetailFile})
+	}
+	if sc.Inventory {
+		rows = append(rows, []string{"Inventory", inventorySetting.File})
+	}
+	for _, p := range sccPruning {
+		rows = append(rows, []string{"SCCPruning", p})
+	}
+	for _, note := range result.MissingCES {
+		rows = append(rows, []string{"CESNote", note})
+	}
+	for _, note := range nonFiniteNotes.Notes() {
+		rows = append(rows, []string{"NonFiniteNote", note})
+	}
+	if err := writeCSV(filepath.Join(dir, "metadata.csv"), []string{"Field", "Value"}, rows); err != nil {
+		return nil, err
+	}
+
+	if sc.Workbook {
+		if err := writeWorkbook(filepath.Join(dir, "results.xlsx"), scenarioWorkbookTables(s, &sc, pm25BySCC, result)); err != nil {
+			return nil, errors.Wrap(err, "error writing workbook")
+		}
+	}
+	return result, nil
+}
+
+// writeDeathsByDemographic writes the deaths of the total population
+// attributable to each demographic's consumption, by emitting SCC, to path.
+func writeDeathsByDemographic(ctx context.Context, s *eieio.Server, sc *scenario, dems []*eieiorpc.Demograph, multipliers []float64, path string) error {
+	deaths, err := demAndDeaths(ctx, s, dems, sc.Year, sc.HR, sc.AQM, multipliers)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for i, dem := range dems {
+		for j, d := range deaths.RawRowView(i) {
+			if d != 0 {
+				rows = append(rows, []string{demographKey(dem), labels.demograph(dem), string(s.SCCs[j]), formatFloat(d)})
+			}
+		}
+	}
+	return writeCSV(path, []string{"Demographic", "Label", "SCC", "Deaths"}, rows)
+}
+
+// writeSupplyChainSplit writes each demographic's direct and upstream
+// supply-chain PM2.5 emissions (kg/year, not population-adjusted) to path.
+func writeSupplyChainSplit(ctx context.Context, s *eieio.Server, sc *scenario, dems []*eieiorpc.Demograph, multipliers []float64, path string) error {
+	ctx, span := startSpan(ctx, "writeSupplyChainSplit")
+	defer span.End()
+	l, err := newLeontief(ctx, s, sc.Year, LOC, eieiorpc.Emission_PM25, sc.AQM)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, dem := range dems {
+		demand, err := getDemographicDemand(ctx, s, dem, sc.Year, multipliers)
+		if err != nil {
+			return err
+		}
+		direct, indirect := l.split(demand.Data)
+		var share float64
+		if direct+indirect != 0 {
+			share = indirect / (direct + indirect)
+		}
+		rows = append(rows, []string{demographKey(dem), labels.demograph(dem), formatFloat(direct), formatFloat(indirect), formatFloat(share)})
+	}
+	return writeCSV(path, []string{"Demographic", "Label", "Direct", "SupplyChain", "SupplyChainShare"}, rows)
+}
+
+// writePollutantContribution writes each demographic's population-adjusted
+// emissions (kg/year) by location, emission and SCC to path, omitting
+// zeros.
+func writePollutantContribution(ctx context.Context, s *eieio.Server, sc *scenario, dems []*eieiorpc.Demograph, multipliers []float64, path string) error {
+	e, err := demAndEmissionsByPollutant(ctx, s, dems, sc.Year, sc.AQM, multipliers, sc.ContributionByLocation, true)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for d, dem := range dems {
+		for i, loc := range e.Locations {
+			for j, pol := range e.Emissions {
+				for k, v := range e.Values[i][j].RawRowView(d) {
+					if v != 0 {
+						rows = append(rows, []string{demographKey(dem), labels.demograph(dem), loc.String(), pol.String(), string(s.SCCs[k]), formatFloat(v)})
+					}
+				}
+			}
+		}
+	}
+	return writeCSV(path, []string{"Demographic", "Label", "Location", "Emission", "SCC", "Emissions"}, rows)
+}
+
+// writeSectors writes the emissions (kg/year) of each pollutant by SCC
+// caused by demand to path, omitting zeros. pm25 are the PM2.5 emissions,
+// which have already been calculated.
+func writeSectors(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, sc *scenario, pm25 []float64, path string) error {
+	var rows [][]string
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		pol := eieiorpc.Emission(val)
+		emis := pm25
+		if pol != eieiorpc.Emission_PM25 {
+			v, err := getEmissionsBySCC(ctx, demand, s, pol, sc.Year, LOC, sc.AQM)
+			if err != nil {
+				return errors.Wrapf(err, "error calculating %s emissions by sector", pol)
+			}
+			emis = v.RawVector().Data
+		}
+		for i, v := range emis {
+			if v != 0 {
+				rows = append(rows, []string{string(s.SCCs[i]), pol.String(), formatFloat(v)})
+			}
+		}
+	}
+	return writeCSV(path, []string{"SCC", "Emission", "Emissions"}, rows)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// cubeServer answers queries of the result cube from a result database
+// written by the precompute command, without loading the EIEIO server.
+type cubeServer struct {
+	db *resultDB
+}
+
+// dimensions returns the distinct values of each dimension of the cube.
+func (c *cubeServer) dimensions() (map[string][]string, error) {
+	cells, err := c.db.query(cubeCell{})
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]map[string]float64{
+		"year": {}, "demographic": {}, "pollutant": {}, "group": {}, "metric": {},
+	}
+	for _, cell := range cells {
+		values["year"][strconv.Itoa(int(cell.Year))] = 1
+		values["demographic"][cell.Demographic] = 1
+		values["pollutant"][cell.Pollutant] = 1
+		values["group"][cell.Group] = 1
+		values["metric"][cell.Metric] = 1
+	}
+	dims := make(map[string][]string)
+	for dim, v := range values {
+		dims[dim] = sortedKeys(v)
+	}
+	return dims, nil
+}
+
+// ServeHTTP serves the cube dimensions at /dimensions and the cells
+// matching the year, demographic, pollutant, group and metric query
+// parameters at /query, a page at a time with limit and offset. Omitted
+// parameters match all values.
+func (c *cubeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	var err error
+	switch r.URL.Path {
+	case "/dimensions":
+		result, err = c.dimensions()
+	case "/query":
+		p := r.URL.Query()
+		q := cubeCell{
+			Demographic: p.Get("demographic"),
+			Pollutant:   p.Get("pollutant"),
+			Group:       p.Get("group"),
+			Metric:      p.Get("metric"),
+		}
+		if y := p.Get("year"); y != "" {
+			year, yErr := strconv.Atoi(y)
+			if yErr != nil {
+				http.Error(w, fmt.Sprintf("invalid year %q", y), http.StatusBadRequest)
+				return
+			}
+			q.Year = int32(year)
+		}
+		cells, qErr := c.db.query(q)
+		if cells == nil {
+			cells = []cubeCell{}
+		}
+		lo, hi, pErr := paginate(w, r, len(cells))
+		if pErr != nil {
+			http.Error(w, pErr.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = cells[lo:hi], qErr
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveCommand serves the precomputed result cube as JSON.
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	dbPath := fs.String("db", "results.db", "result database written by the precompute command")
+	addr := fs.String("addr", "localhost:8816", "address to listen on")
+	drain := fs.Duration("drain", 30*time.Second, "on SIGTERM, how long to wait for requests in progress to finish")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s serve [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	db, err := openResultDB(*dbPath, true)
+	if err != nil {
+		return errors.Wrap(err, "opening result database")
+	}
+	defer db.Close()
+	log.Printf("Serving precomputed results on http://%s/", *addr)
+	return serveUntilSignal(*addr, &cubeServer{db: db}, *drain, nil)
+}
+
+// paginate returns the range [lo, hi) of the n items of a response to
+// return for the limit (default all) and offset query parameters of r,
+// setting the X-Total-Count header to n and, if there are more items, a
+// Link header to the next page.
+func paginate(w http.ResponseWriter, r *http.Request, n int) (lo, hi int, err error) {
+	p := r.URL.Query()
+	limit := n
+	if v := p.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid limit %q; must be a positive integer", v)
+		}
+	}
+	if v := p.Get("offset"); v != "" {
+		if lo, err = strconv.Atoi(v); err != nil || lo < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q; must be a non-negative integer", v)
+		}
+	}
+	if lo > n {
+		lo = n
+	}
+	hi = n
+	if limit < n-lo {
+		hi = lo + limit
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(n))
+	if hi < n {
+		p.Set("offset", strconv.Itoa(hi))
+		next := *r.URL
+		next.RawQuery = p.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	return lo, hi, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	for _, test := range []struct {
+		query  string
+		n      int
+		lo, hi int
+		link   string
+		err    bool
+	}{
+		{query: "", n: 5, lo: 0, hi: 5},
+		{query: "", n: 0, lo: 0, hi: 0},
+		{query: "limit=2", n: 5, lo: 0, hi: 2, link: `</jobs?limit=2&offset=2>; rel="next"`},
+		{query: "limit=2&offset=2", n: 5, lo: 2, hi: 4, link: `</jobs?limit=2&offset=4>; rel="next"`},
+		{query: "limit=2&offset=4", n: 5, lo: 4, hi: 5},
+		{query: "offset=3", n: 5, lo: 3, hi: 5},
+		{query: "offset=9", n: 5, lo: 5, hi: 5},
+		{query: "limit=9", n: 5, lo: 0, hi: 5},
+		{query: "limit=0", n: 5, err: true},
+		{query: "limit=-1", n: 5, err: true},
+		{query: "limit=two", n: 5, err: true},
+		{query: "offset=-1", n: 5, err: true},
+		{query: "offset=one", n: 5, err: true},
+	} {
+		w := httptest.NewRecorder()
+		lo, hi, err := paginate(w, httptest.NewRequest("GET", "/jobs?"+test.query, nil), test.n)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.query)
+			}
+			continue
+		}
+		if err != nil || lo != test.lo || hi != test.hi {
+			t.Errorf("%q of %d: got [%d, %d), %v, want [%d, %d)", test.query, test.n, lo, hi, err, test.lo, test.hi)
+		}
+		if link := w.Header().Get("Link"); link != test.link {
+			t.Errorf("%q of %d: got Link %q, want %q", test.query, test.n, link, test.link)
+		}
+		if total := w.Header().Get("X-Total-Count"); total != strconv.Itoa(test.n) {
+			t.Errorf("%q of %d: got X-Total-Count %s", test.query, test.n, total)
+		}
+	}
+}
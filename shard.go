@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// shard is one of Count disjoint sets of a batch's scenarios, so that
+// separate processes, such as on different machines, can each run their
+// own. Index is from 0 to Count-1; the zero shard is every scenario.
+// Scenarios are dealt to shards in turn, in manifest order. A scenario's
+// cost is mostly that of its concentrations, which EIEIO calculates for
+// the whole grid at once, so scenarios rather than grid cells are split.
+type shard struct {
+	Index, Count int
+}
+
+// String formats sh as "i/N", as given to the -shard flag, or "none".
+func (sh *shard) String() string {
+	if sh.Count == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d/%d", sh.Index, sh.Count)
+}
+
+// Set parses a shard in the form "i/N".
+func (sh *shard) Set(v string) error {
+	parts := strings.Split(v, "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid shard %q; must be i/N, e.g. 0/4", v)
+	}
+	i, err1 := strconv.Atoi(parts[0])
+	n, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || n < 1 || i < 0 || i >= n {
+		return fmt.Errorf("invalid shard %q; must be i/N with 0 <= i < N", v)
+	}
+	sh.Index, sh.Count = i, n
+	return nil
+}
+
+// dir is the subdirectory of a batch's output directory holding the
+// results of sh.
+func (sh shard) dir() string {
+	return fmt.Sprintf("shard-%d-of-%d", sh.Index, sh.Count)
+}
+
+// parseShardDir returns the shard whose results are in dir, named by
+// shard.dir.
+func parseShardDir(dir string) (shard, error) {
+	var sh shard
+	_, err := fmt.Sscanf(filepath.Base(filepath.Clean(dir)), "shard-%d-of-%d", &sh.Index, &sh.Count)
+	if err != nil || sh.Count < 1 || sh.Index < 0 || sh.Index >= sh.Count {
+		return shard{}, errorf(kindUsage, "%s is not the output of batch -shard, which is named shard-i-of-N", dir)
+	}
+	return sh, nil
+}
+
+// scenarios returns those of scenarios in sh.
+func (sh shard) scenarios(scenarios []scenario) []scenario {
+	if sh.Count == 0 {
+		return scenarios
+	}
+	var in []scenario
+	for i, sc := range scenarios {
+		if i%sh.Count == sh.Index {
+			in = append(in, sc)
+		}
+	}
+	return in
+}
+
+// mergeCommand combines the results of the shards of a sharded batch into
+// a single batch output directory.
+func mergeCommand(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := fs.String("o", "merged", "directory to write the merged batch to")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s merge [-o dir] shard-dir...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errorf(kindUsage, "merge requires the output directories of the shards")
+	}
+	shardDirs := fs.Args()
+
+	// Every shard must be given exactly once, and each scenario must have
+	// been run by only one of them.
+	var count int
+	seen := make(map[int]string)
+	ran := make(map[string]string)
+	var header []string
+	var rows [][]string
+	for _, d := range shardDirs {
+		sh, err := parseShardDir(d)
+		if err != nil {
+			return err
+		}
+		if count != 0 && sh.Count != count {
+			return errorf(kindUsage, "%s: shard %s is not one of %d shards", d, sh.String(), count)
+		}
+		if other, ok := seen[sh.Index]; ok {
+			return errorf(kindUsage, "shard %s is given twice, as %s and %s", sh.String(), other, d)
+		}
+		count = sh.Count
+		seen[sh.Index] = d
+
+		h, index, err := readCSV(filepath.Join(d, "index.csv"))
+		if err != nil {
+			return withKind(kindDataMissing, errors.Wrapf(err, "%s: reading the shard's batch index", d))
+		}
+		if header == nil {
+			header = h
+		} else if strings.Join(h, ",") != strings.Join(header, ",") {
+			return errorf(kindUsage, "%s: index.csv columns differ from those of %s", d, shardDirs[0])
+		}
+		for _, r := range index {
+			name, dir := r[0], r[4]
+			if other, ok := ran[name]; ok {
+				return errorf(kindUsage, "scenario %s was run by both %s and %s", name, other, d)
+			}
+			ran[name] = d
+			if err := copyTree(filepath.Join(d, dir), filepath.Join(*out, dir)); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "copying scenario %s", name)
+			}
+		}
+		rows = append(rows, index...)
+	}
+	if len(seen) != count {
+		return errorf(kindUsage, "have %d of %d shards", len(seen), count)
+	}
+	if err := writeCSV(filepath.Join(*out, "index.csv"), header, rows); err != nil {
+		return errors.Wrap(err, "error writing batch index")
+	}
+	log.Printf("Merged %d scenarios from %d shards", len(rows), count)
+	if err := writeDataDictionaries(*out); err != nil {
+		return err
+	}
+	return writeRunManifest(*out, "merge of "+strings.Join(shardDirs, ", "))
+}
+
+// copyTree copies the files in the directory src and its subdirectories to
+// dst.
+func copyTree(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, in); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestShardScenarios checks that every scenario is run by exactly one
+// shard, whether or not there are more shards than scenarios.
+func TestShardScenarios(t *testing.T) {
+	scenarios := []scenario{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}, {Name: "e"}}
+	for count := 1; count <= 7; count++ {
+		runs := make(map[string]int)
+		for i := 0; i < count; i++ {
+			for _, sc := range (shard{Index: i, Count: count}).scenarios(scenarios) {
+				runs[sc.Name]++
+			}
+		}
+		for _, sc := range scenarios {
+			if runs[sc.Name] != 1 {
+				t.Errorf("%d shards: scenario %s is run %d times", count, sc.Name, runs[sc.Name])
+			}
+		}
+	}
+	if n := len((shard{}).scenarios(scenarios)); n != len(scenarios) {
+		t.Errorf("no shard: got %d scenarios, want all %d", n, len(scenarios))
+	}
+}
+
+func TestParseShardDir(t *testing.T) {
+	sh, err := parseShardDir("out/shard-2-of-4/")
+	if err != nil || sh != (shard{Index: 2, Count: 4}) {
+		t.Errorf("got %v, %v, want shard 2/4", sh, err)
+	}
+	for _, dir := range []string{"out", "shard-4-of-4", "shard-0-of-0", "shard--1-of-2"} {
+		if _, err := parseShardDir(dir); kindOf(err) != kindUsage {
+			t.Errorf("%s: got error %v, want a usage error", dir, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inFlight tracks the requests a server is handling, so that it can drain
+// them on shutdown and report those that didn't finish.
+type inFlight struct {
+	mx       sync.Mutex
+	next     int
+	active   map[int]inFlightRequest
+	draining bool
+}
+
+type inFlightRequest struct {
+	desc  string
+	start time.Time
+}
+
+// wrap returns h, recording its requests in f and refusing new ones with
+// 503 Service Unavailable once f is draining.
+func (f *inFlight) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mx.Lock()
+		if f.draining {
+			f.mx.Unlock()
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		id := f.next
+		f.next++
+		f.active[id] = inFlightRequest{desc: r.Method + " " + r.URL.RequestURI(), start: time.Now()}
+		f.mx.Unlock()
+		defer func() {
+			f.mx.Lock()
+			delete(f.active, id)
+			f.mx.Unlock()
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// drain stops f accepting requests and returns the number in progress.
+func (f *inFlight) drain() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.draining = true
+	return len(f.active)
+}
+
+// unfinished describes the requests in progress, oldest first.
+func (f *inFlight) unfinished() []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	reqs := make([]inFlightRequest, 0, len(f.active))
+	for _, r := range f.active {
+		reqs = append(reqs, r)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].start.Before(reqs[j].start) })
+	descs := make([]string, len(reqs))
+	for i, r := range reqs {
+		descs[i] = r.desc + " (running " + time.Since(r.start).Round(time.Millisecond).String() + ")"
+	}
+	return descs
+}
+
+// serveUntilSignal serves h on addr until the process receives SIGTERM or
+// an interrupt. It then refuses new requests, waits up to drain (or until
+// a second signal) for those in progress to finish, and calls cleanup,
+// such as to save caches, before returning. Requests that didn't finish
+// are logged and returned as an error. If the config has API keys, only
+// requests carrying one are served.
+func serveUntilSignal(addr string, h http.Handler, drain time.Duration, cleanup func() error) error {
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		log.Printf("Requiring one of %d API keys", len(keys.keys))
+		h = keys.wrap(h)
+	}
+	f := &inFlight{active: make(map[int]inFlightRequest)}
+	srv := &http.Server{Addr: addr, Handler: f.wrap(h)}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		log.Printf("Received %v; finishing %d requests in progress (up to %s) before shutting down", s, f.drain(), drain)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("Received %v again; shutting down now", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var unfinished []string
+	if err := srv.Shutdown(ctx); err != nil {
+		// Note the requests before closing their connections cancels them.
+		unfinished = f.unfinished()
+		srv.Close()
+	}
+
+	if cleanup != nil {
+		if err := cleanup(); err != nil {
+			log.Printf("Error cleaning up: %v", err)
+		}
+	}
+	if len(unfinished) > 0 {
+		for _, r := range unfinished {
+			log.Printf("Incomplete: %s", r)
+		}
+		return errorf(kindOther, "%d requests did not finish before shutdown: %s", len(unfinished), strings.Join(unfinished, "; "))
+	}
+	log.Printf("All requests finished; shut down")
+	return nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"strings"
+)
+
+// snapshotArray is a row-major float64 array in a snapshot.
+type snapshotArray struct {
+	Name  string
+	Shape []int
+	Data  []float64
+}
+
+// snapshotMetadata describes the arrays in a snapshot. It is stored as
+// metadata.json in the archive.
+type snapshotMetadata struct {
+	Year         int32
+	AQM          string
+	Location     string
+	Commodities  []string
+	Demographics []string
+	SCCs         []string
+	Emissions    []string
+	Pollutants   []string
+	Populations  []string
+
+	// Units of each array, by array name.
+	Units map[string]string
+
+	// Cells, if a subdomain is configured, holds the model grid index of
+	// each grid cell in the arrays.
+	Cells []int `json:",omitempty"`
+
+	// Grid identifies the grid of the gridded arrays; see gridID.
+	Grid gridID
+
+	// MissingCES is the policy for missing CES data, and CESNotes records
+	// where it was applied.
+	MissingCES string
+	CESNotes   []string
+
+	// Suppression describes the small-cell suppression of populations.
+	Suppression string
+}
+
+// writeNPY writes a in NumPy .npy format (version 1.0, little-endian float64).
+func writeNPY(w *bytes.Buffer, a snapshotArray) {
+	dims := make([]string, len(a.Shape))
+	for i, d := range a.Shape {
+		dims[i] = fmt.Sprint(d)
+	}
+	shape := strings.Join(dims, ", ")
+	if len(dims) == 1 {
+		shape += ","
+	}
+	header := fmt.Sprintf("{'descr': '<f8', 'fortran_order': False, 'shape': (%s), }", shape)
+	// The magic string, version, header length and header must be padded
+	// to a multiple of 64 bytes, ending in a newline.
+	pad := 64 - (10+len(header)+1)%64
+	header += strings.Repeat(" ", pad%64) + "\n"
+
+	w.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(w, binary.LittleEndian, uint16(len(header)))
+	w.WriteString(header)
+	binary.Write(w, binary.LittleEndian, a.Data)
+}
+
+// writeSnapshot writes arrays and their metadata to path as a compressed
+// NumPy .npz archive.
+func writeSnapshot(path string, arrays []snapshotArray, meta *snapshotMetadata) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(f)
+	for _, a := range arrays {
+		w, err := z.CreateHeader(&zip.FileHeader{Name: a.Name + ".npy", Method: zip.Deflate})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		var buf bytes.Buffer
+		writeNPY(&buf, a)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	w, err := z.CreateHeader(&zip.FileHeader{Name: "metadata.json", Method: zip.Deflate})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(meta); err != nil {
+		f.Close()
+		return err
+	}
+	if err := z.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// buildSnapshot calculates the derived arrays for a snapshot: final demand,
+// consumption by demographic, emissions by SCC, concentrations and
+// populations.
+func buildSnapshot(ctx context.Context, s *eieio.Server, year int32, aqm string) ([]snapshotArray, *snapshotMetadata, error) {
+	ctx, span := startSpan(ctx, "buildSnapshot")
+	defer span.End()
+	ctx, cesNotes := withCESLog(ctx)
+	var err error
+	meta := &snapshotMetadata{
+		Year:        year,
+		AQM:         aqm,
+		Location:    LOC.String(),
+		MissingCES:  string(missingCES),
+		Suppression: suppression.String(),
+		Units: map[string]string{
+			"demand":         "dollars/year",
+			"consumption":    "dollars/year",
+			"emissions":      "kg/year",
+			"concentrations": "μg/m³",
+			"populations":    "people",
+		},
+	}
+	if meta.Grid, err = getGridID(s, aqm); err != nil {
+		return nil, nil, err
+	}
+	commodities, err := s.Commodities(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta.Commodities = commodities.List
+
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            year,
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting final demand")
+	}
+	arrays := []snapshotArray{{Name: "demand", Shape: []int{len(demand.Data)}, Data: demand.Data}}
+
+	dems := append(decileDemographs(), ethnicityDemographs()...)
+	consumption := snapshotArray{Name: "consumption", Shape: []int{len(dems), len(demand.Data)}}
+	for _, dem := range dems {
+		d, err := getDemographicDemand(ctx, s, dem, year, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		meta.Demographics = append(meta.Demographics, demographKey(dem))
+		consumption.Data = append(consumption.Data, d.Data...)
+	}
+	arrays = append(arrays, consumption)
+	meta.CESNotes = cesNotes.Notes()
+
+	for _, scc := range s.SCCs {
+		meta.SCCs = append(meta.SCCs, string(scc))
+	}
+	emissions := snapshotArray{Name: "emissions", Shape: []int{len(eieiorpc.Emission_name), len(s.SCCs)}}
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		pol := eieiorpc.Emission(val)
+		e, err := getEmissionsBySCC(ctx, demand, s, pol, year, LOC, aqm)
+		if err != nil {
+			return nil, nil, err
+		}
+		meta.Emissions = append(meta.Emissions, pol.String())
+		emissions.Data = append(emissions.Data, e.RawVector().Data...)
+	}
+	arrays = append(arrays, emissions)
+
+	d, err := getSubdomain(s, aqm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d != nil {
+		meta.Cells = d.Cells
+	}
+	var nCells int
+	concentrations := snapshotArray{Name: "concentrations"}
+	for val := 0; val < len(eieiorpc.Pollutant_name); val++ {
+		pol := eieiorpc.Pollutant(val)
+		c, err := getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+			Demand:    demand,
+			Pollutant: pol,
+			Year:      year,
+			Location:  LOC,
+			AQM:       aqm,
+		})
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error calculating %s concentrations", pol)
+		}
+		nCells = len(c.Data)
+		sub, err := d.restrict(c.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		meta.Pollutants = append(meta.Pollutants, pol.String())
+		concentrations.Data = append(concentrations.Data, sub...)
+	}
+	popNames, pops, err := getPopulationGrids(ctx, s, aqm, nCells)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d != nil {
+		nCells = len(d.Cells)
+	}
+	concentrations.Shape = []int{len(meta.Pollutants), nCells}
+	arrays = append(arrays, concentrations)
+
+	populations := snapshotArray{Name: "populations", Shape: []int{len(popNames), nCells}}
+	for _, pop := range popNames {
+		sub, err := d.restrict(pops[pop])
+		if err != nil {
+			return nil, nil, err
+		}
+		meta.Populations = append(meta.Populations, pop)
+		for _, n := range sub {
+			populations.Data = append(populations.Data, suppression.count(n))
+		}
+	}
+	arrays = append(arrays, populations)
+	return arrays, meta, nil
+}
+
+// exportCommand writes derived data for use outside of this program:
+// "snapshot" writes a NumPy archive of the main derived arrays, and
+// "matrix" writes the demographic×SCC emissions (or, with -metric deaths,
+// attributable deaths) matrix as labeled JSON that can be read with
+// loadMatrix, "grid" writes the centroid, area and bounding box of each
+// grid cell, for joining gridded results to geography, and "populations"
+// writes a GeoJSON map of the census populations in each grid cell.
+func exportCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "snapshot" && args[0] != "matrix" && args[0] != "grid" && args[0] != "populations" && args[0] != "crosswalk") {
+		fmt.Fprintf(os.Stderr, "usage: %s export snapshot|matrix|grid|populations|crosswalk [flags]\n", os.Args[0])
+		return errorf(kindUsage, "export requires a type of export, snapshot, matrix, grid, populations or crosswalk")
+	}
+	fs := flag.NewFlagSet("export "+args[0], flag.ExitOnError)
+	year := yearFlag(fs, "year", defaultYear(), "analysis year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	demKeys := fs.String("demographics", "decile,ethnicity", "comma-separated demograph keys or groups (matrix only)")
+	metric := fs.String("metric", "emissions", "matrix values: emissions or deaths (matrix only)")
+	hr := fs.String("hr", "NasariACS", "hazard ratio function for deaths (matrix only)")
+	pops := fs.String("populations", "", "comma-separated census populations to map (populations only; default all)")
+	out := fs.String("o", "", "output file (default snapshot.npz, dem_scc.json, dem_scc_deaths.json, grid.csv, populations.geojson or naics_crosswalk.csv)")
+	memoryFlag(fs)
+	sccFilterFlags(fs)
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	ctx := context.Background()
+	if args[0] == "grid" {
+		if *out == "" {
+			*out = "grid.csv"
+		}
+		n, err := writeGrid(s, *aqm, *out)
+		if err != nil {
+			return err
+		}
+		if err := describeOutput(*out, "grid.csv"); err != nil {
+			return err
+		}
+		log.Printf("Wrote %d %s grid cells to %s", n, *aqm, *out)
+		return nil
+	}
+	if args[0] == "populations" {
+		if *out == "" {
+			*out = "populations.geojson"
+		}
+		var names []string
+		for _, pop := range strings.Split(*pops, ",") {
+			if pop = strings.TrimSpace(pop); pop != "" {
+				names = append(names, pop)
+			}
+		}
+		n, err := writePopulationMap(ctx, s, *aqm, names, *out)
+		if err != nil {
+			return err
+		}
+		if err := describeOutput(*out, "populations.geojson"); err != nil {
+			return err
+		}
+		log.Printf("Wrote population map of %d %s grid cells to %s", n, *aqm, *out)
+		return nil
+	}
+	if args[0] == "crosswalk" {
+		if *out == "" {
+			*out = "naics_crosswalk.csv"
+		}
+		n, err := writeNAICSCrosswalk(ctx, s, *out)
+		if err != nil {
+			return err
+		}
+		if err := describeOutput(*out, "naics_crosswalk.csv"); err != nil {
+			return err
+		}
+		log.Printf("Wrote NAICS codes of %d of %d SCCs to %s", n, len(s.SCCs), *out)
+		return nil
+	}
+	if args[0] == "matrix" {
+		if *metric != "emissions" && *metric != "deaths" {
+			return errorf(kindUsage, "invalid matrix metric %q; valid metrics are emissions and deaths", *metric)
+		}
+		if *out == "" {
+			*out = "dem_scc.json"
+			if *metric == "deaths" {
+				*out = "dem_scc_deaths.json"
+			}
+		}
+		var dems []*eieiorpc.Demograph
+		for _, key := range strings.Split(*demKeys, ",") {
+			d, err := parseDemographs(strings.TrimSpace(key))
+			if err != nil {
+				return err
+			}
+			dems = append(dems, d...)
+		}
+		var m *labeledMatrix
+		if *metric == "deaths" {
+			m, err = demSCCDeathsMatrix(ctx, s, dems, int32(*year), *hr, *aqm)
+		} else {
+			m, err = demSCCMatrix(ctx, s, dems, int32(*year), *aqm)
+		}
+		if err != nil {
+			return err
+		}
+		if err := saveMatrix(*out, m); err != nil {
+			return errors.Wrap(err, "error writing matrix")
+		}
+		name := "dem_scc.json"
+		if *metric == "deaths" {
+			name = "dem_scc_deaths.json"
+		}
+		if err := describeOutput(*out, name); err != nil {
+			return err
+		}
+		log.Printf("Wrote %d×%d demographic×SCC %s matrix to %s", len(m.RowLabels), len(m.ColLabels), *metric, *out)
+		return nil
+	}
+
+	if *out == "" {
+		*out = "snapshot.npz"
+	}
+	arrays, meta, err := buildSnapshot(ctx, s, int32(*year), *aqm)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(*out, arrays, meta); err != nil {
+		return errors.Wrap(err, "error writing snapshot")
+	}
+	if err := describeOutput(*out, "snapshot.npz"); err != nil {
+		return err
+	}
+	log.Printf("Wrote snapshot to %s", *out)
+	return nil
+}
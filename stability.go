@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+	"log"
+	"os"
+	"strings"
+)
+
+// shareStability summarizes how one sector's share of a demographic's
+// emissions varies across years.
+type shareStability struct {
+	Mean, StdDev float64
+
+	// CV is the coefficient of variation, StdDev / Mean.
+	CV float64
+}
+
+// getContributionShares returns, for each year, each demographic's share
+// of its PM2.5 emissions from each SCC, as a demographic-by-SCC matrix.
+func getContributionShares(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, years []int32, aqm string) ([]*mat.Dense, error) {
+	ctx, span := startSpan(ctx, "getContributionShares")
+	defer span.End()
+	shares := make([]*mat.Dense, len(years))
+	for i, year := range years {
+		emis, _, err := demAndEmissions(ctx, s, dems, year, LOC, aqm, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "year %d", year)
+		}
+		for d := range dems {
+			row := emis.RawRowView(d)
+			total := mat.Sum(mat.NewVecDense(len(row), row))
+			for j := range row {
+				if total != 0 {
+					row[j] /= total
+				}
+			}
+		}
+		shares[i] = emis
+	}
+	return shares, nil
+}
+
+// contributionStability calculates the stability of each demographic's
+// share of emissions from each SCC across the years in shares, as
+// returned by getContributionShares.
+func contributionStability(shares []*mat.Dense) [][]shareStability {
+	nDems, nSCC := shares[0].Dims()
+	result := make([][]shareStability, nDems)
+	x := make([]float64, len(shares))
+	for d := 0; d < nDems; d++ {
+		result[d] = make([]shareStability, nSCC)
+		for j := 0; j < nSCC; j++ {
+			for y, sh := range shares {
+				x[y] = sh.At(d, j)
+			}
+			st := &result[d][j]
+			st.Mean, st.StdDev = stat.MeanStdDev(x, nil)
+			if st.Mean != 0 {
+				st.CV = st.StdDev / st.Mean
+			}
+		}
+	}
+	return result
+}
+
+// stabilityCommand reports which sectors' shares of each demographic's
+// emissions are stable or volatile across years.
+func stabilityCommand(args []string) error {
+	fs := flag.NewFlagSet("stability", flag.ExitOnError)
+	demKeys := fs.String("demographics", "ethnicity", "comma-separated demograph keys or groups; CES income deciles are only available for 2014-2015")
+	from := fs.Int("from", 2003, "first year")
+	to := fs.Int("to", 2015, "last year")
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	cvThreshold := fs.Float64("cv", 0.25, "coefficient of variation above which a sector is reported as volatile")
+	minShare := fs.Float64("min-share", 0.001, "omit sectors whose mean share is below this")
+	out := fs.String("o", "stability.csv", "output CSV file")
+	sccFilterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s stability [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *to <= *from {
+		return errorf(kindUsage, "stability requires at least two years, got %d-%d", *from, *to)
+	}
+
+	var dems []*eieiorpc.Demograph
+	for _, key := range strings.Split(*demKeys, ",") {
+		d, err := parseDemographs(strings.TrimSpace(key))
+		if err != nil {
+			return err
+		}
+		dems = append(dems, d...)
+	}
+	var years []int32
+	for y := *from; y <= *to; y++ {
+		if _, err := parseYear(y); err != nil {
+			return err
+		}
+		years = append(years, int32(y))
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	shares, err := getContributionShares(context.Background(), s, dems, years, *aqm)
+	if err != nil {
+		return err
+	}
+	stability := contributionStability(shares)
+
+	var rows [][]string
+	for d, dem := range dems {
+		for j, st := range stability[d] {
+			if st.Mean < *minShare {
+				continue
+			}
+			class := "stable"
+			if st.CV > *cvThreshold {
+				class = "volatile"
+			}
+			rows = append(rows, []string{demographKey(dem), labels.demograph(dem), string(s.SCCs[j]),
+				formatFloat(st.Mean), formatFloat(st.StdDev), formatFloat(st.CV), class})
+		}
+	}
+	if err := writeCSV(*out, []string{"Demographic", "Label", "SCC", "MeanShare", "StdDev", "CV", "Stability"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "stability.csv"); err != nil {
+		return err
+	}
+	log.Printf("Wrote contribution stability for %d demographics over %d-%d to %s", len(dems), *from, *to, *out)
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// stageStat summarizes the finished runs of one pipeline stage or EIEIO
+// call.
+type stageStat struct {
+	Name  string
+	Done  int
+	Total time.Duration
+}
+
+// activeStage is a stage in progress.
+type activeStage struct {
+	desc  string
+	start time.Time
+}
+
+// stageProgress is the progress reported for a stage; see Progress.
+type stageProgress struct {
+	first, last     Progress
+	firstAt, lastAt time.Time
+}
+
+// runStatus tracks the stages of a run as they start and finish, so that
+// a long run can report where it is on request (see watchStatus).
+type runStatus struct {
+	mx       sync.Mutex
+	start    time.Time
+	stages   map[string]*stageStat
+	active   map[int]activeStage
+	nextID   int
+	progress map[string]*stageProgress
+	expected map[string]int
+	expectAt map[string]time.Time
+}
+
+// status tracks this run.
+var status = &runStatus{
+	start:    time.Now(),
+	stages:   make(map[string]*stageStat),
+	active:   make(map[int]activeStage),
+	progress: make(map[string]*stageProgress),
+	expected: make(map[string]int),
+	expectAt: make(map[string]time.Time),
+}
+
+// statusSpan is a span whose start and end are recorded in status.
+type statusSpan struct {
+	trace.Span
+	id    int
+	name  string
+	start time.Time
+}
+
+// End ends the span and records that its stage finished.
+func (s *statusSpan) End(options ...trace.SpanOption) {
+	s.Span.End(options...)
+	status.end(s)
+}
+
+// begin records that the stage name, described by attrs, started, and
+// returns span wrapped to record when it ends.
+func (r *runStatus) begin(span trace.Span, name string, attrs []attribute.KeyValue) trace.Span {
+	desc := name
+	if len(attrs) > 0 {
+		var parts []string
+		for _, a := range attrs {
+			parts = append(parts, fmt.Sprintf("%s=%s", a.Key, a.Value.Emit()))
+		}
+		desc += " (" + strings.Join(parts, ", ") + ")"
+	}
+	s := &statusSpan{Span: span, name: name, start: time.Now()}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s.id = r.nextID
+	r.nextID++
+	r.active[s.id] = activeStage{desc: desc, start: s.start}
+	return s
+}
+
+func (r *runStatus) end(s *statusSpan) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if _, ok := r.active[s.id]; !ok {
+		return // ended twice
+	}
+	delete(r.active, s.id)
+	st, ok := r.stages[s.name]
+	if !ok {
+		st = &stageStat{Name: s.name}
+		r.stages[s.name] = st
+	}
+	st.Done++
+	st.Total += time.Since(s.start)
+}
+
+// expect records that n runs of the stage name, such as batch scenarios,
+// are to finish, for estimating the time remaining.
+func (r *runStatus) expect(name string, n int) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.expected[name] = n
+	r.expectAt[name] = time.Now()
+	if st, ok := r.stages[name]; ok {
+		// Count only the runs from now on.
+		st.Done, st.Total = 0, 0
+	}
+}
+
+// recordProgress records a progress event. A stage whose percentage
+// falls, such as when it starts on the next year, is timed afresh.
+func (r *runStatus) recordProgress(p Progress) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	now := time.Now()
+	sp, ok := r.progress[p.Stage]
+	if !ok || p.Percent < sp.last.Percent {
+		r.progress[p.Stage] = &stageProgress{first: p, last: p, firstAt: now, lastAt: now}
+		return
+	}
+	sp.last, sp.lastAt = p, now
+}
+
+// remaining estimates the time left for the stage with progress sp, from
+// its rate of progress, or returns false if it can't be estimated yet.
+func (sp *stageProgress) remaining() (time.Duration, bool) {
+	done := sp.last.Percent - sp.first.Percent
+	if done <= 0 || sp.last.Percent >= 100 {
+		return 0, false
+	}
+	rate := done / sp.lastAt.Sub(sp.firstAt).Seconds()
+	return time.Duration((100 - sp.last.Percent) / rate * float64(time.Second)), true
+}
+
+// report writes the stages in progress, the progress of each unfinished
+// stage and of expected work with an estimate of the time remaining, and
+// the number and total time of the finished runs of each stage.
+func (r *runStatus) report(w io.Writer) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	now := time.Now()
+	fmt.Fprintf(w, "Status after %s:\n", now.Sub(r.start).Round(time.Millisecond))
+
+	active := make([]activeStage, 0, len(r.active))
+	for _, a := range r.active {
+		active = append(active, a)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].start.Before(active[j].start) })
+	if len(active) == 0 {
+		fmt.Fprintf(w, "No stages in progress\n")
+	} else {
+		fmt.Fprintf(w, "In progress:\n")
+	}
+	for _, a := range active {
+		fmt.Fprintf(w, "  %s for %s\n", a.desc, now.Sub(a.start).Round(time.Millisecond))
+	}
+
+	var names []string
+	for name := range r.expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var done int
+		if st, ok := r.stages[name]; ok {
+			done = st.Done
+		}
+		n := r.expected[name]
+		fmt.Fprintf(w, "%s: %d of %d finished", name, done, n)
+		if done > 0 && done < n {
+			perItem := now.Sub(r.expectAt[name]) / time.Duration(done)
+			fmt.Fprintf(w, ", about %s remaining", (perItem * time.Duration(n-done)).Round(time.Second))
+		}
+		fmt.Fprintln(w)
+	}
+
+	names = names[:0]
+	for name, sp := range r.progress {
+		if sp.last.Percent < 100 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sp := r.progress[name]
+		fmt.Fprintf(w, "%s", name)
+		if sp.last.Year != 0 {
+			fmt.Fprintf(w, " %d", sp.last.Year)
+		}
+		fmt.Fprintf(w, ": %.0f%%", sp.last.Percent)
+		if d, ok := sp.remaining(); ok {
+			fmt.Fprintf(w, ", about %s remaining", d.Round(time.Second))
+		}
+		fmt.Fprintln(w)
+	}
+
+	stats := make([]stageStat, 0, len(r.stages))
+	for _, st := range r.stages {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Total > stats[j].Total })
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Stage\tFinished\tTotal\tMean\t\n")
+	for _, st := range stats {
+		if st.Done == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t\n", st.Name, st.Done, st.Total.Round(time.Millisecond),
+			(st.Total / time.Duration(st.Done)).Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// watchStatus writes the status report to standard error whenever the
+// process receives a status signal (SIGUSR1), without interrupting the
+// run.
+func watchStatus() {
+	if statusSignal == nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, statusSignal)
+	go func() {
+		for range c {
+			if err := status.report(os.Stderr); err != nil {
+				log.Printf("error writing status: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignal is the signal that makes a run report its status.
+var statusSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// statusSignal is nil, as Windows has no signal for requesting status.
+var statusSignal os.Signal
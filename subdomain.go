@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"sync"
+)
+
+// subdomain is a subset of the air quality model grid, such as the cells
+// in one state, used to iterate quickly on a small area before running an
+// analysis for the whole domain. Gridded results for a subdomain are
+// indexed by position in Cells rather than by model grid cell.
+//
+// Emissions and concentrations are still calculated by the model for the
+// whole domain, so exposure in a subdomain includes pollution from sources
+// outside of it.
+type subdomain struct {
+	// Cells holds the model grid index of each subdomain cell, in order.
+	Cells []int
+
+	// nGrid is the number of cells in the model grid.
+	nGrid int
+}
+
+// newSubdomain returns the subdomain of the aqm grid whose cell centroids
+// are within the region specified by cfg.
+func newSubdomain(s *eieio.Server, cfg regionConfig, aqm string) (*subdomain, error) {
+	mask, err := regionMask(s, cfg, aqm)
+	if err != nil {
+		return nil, err
+	}
+	d := &subdomain{nGrid: len(mask)}
+	for i, in := range mask {
+		if in {
+			d.Cells = append(d.Cells, i)
+		}
+	}
+	if len(d.Cells) == 0 {
+		return nil, fmt.Errorf("subdomain %s contains no %s grid cells", cfg.File, aqm)
+	}
+	return d, nil
+}
+
+// restrict returns the values of full, a value for each model grid cell,
+// for the cells in d. If d is nil, full is returned unchanged.
+func (d *subdomain) restrict(full []float64) ([]float64, error) {
+	if d == nil {
+		return full, nil
+	}
+	if len(full) != d.nGrid {
+		return nil, errorf(kindNumeric, "expected a value for each of %d grid cells, got %d", d.nGrid, len(full))
+	}
+	sub := make([]float64, len(d.Cells))
+	for i, c := range d.Cells {
+		sub[i] = full[c]
+	}
+	return sub, nil
+}
+
+// restrictMask is like restrict for a mask such as receptors. A nil mask
+// is returned unchanged.
+func (d *subdomain) restrictMask(full []bool) ([]bool, error) {
+	if d == nil || full == nil {
+		return full, nil
+	}
+	if len(full) != d.nGrid {
+		return nil, errorf(kindNumeric, "expected a value for each of %d grid cells, got %d", d.nGrid, len(full))
+	}
+	sub := make([]bool, len(d.Cells))
+	for i, c := range d.Cells {
+		sub[i] = full[c]
+	}
+	return sub, nil
+}
+
+var (
+	// subdomainConfig is the Subdomain setting in the [Sandbox] config table.
+	subdomainConfig regionConfig
+
+	subdomainsMx sync.Mutex
+	subdomains   = make(map[string]*subdomain)
+)
+
+// getSubdomain returns the configured subdomain of the aqm grid, or nil if
+// none is configured. Subdomains are cached by aqm.
+func getSubdomain(s *eieio.Server, aqm string) (*subdomain, error) {
+	if subdomainConfig.File == "" {
+		return nil, nil
+	}
+	subdomainsMx.Lock()
+	defer subdomainsMx.Unlock()
+	if d, ok := subdomains[aqm]; ok {
+		return d, nil
+	}
+	d, err := newSubdomain(s, subdomainConfig, aqm)
+	if err != nil {
+		return nil, err
+	}
+	subdomains[aqm] = d
+	return d, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"math"
+)
+
+// Ways a change in final demand is split between domestic production and
+// imports; see scenario.ImportSubstitution.
+const (
+	substituteFixed    = "fixed"
+	substituteDomestic = "domestic"
+	substituteImport   = "import"
+)
+
+// checkImportSubstitution returns an error if mode is not a valid
+// ImportSubstitution.
+func checkImportSubstitution(mode string) error {
+	switch mode {
+	case "", substituteFixed, substituteDomestic, substituteImport:
+		return nil
+	}
+	return errorf(kindConfig, "invalid import substitution %q; valid options are %s, %s and %s", mode, substituteFixed, substituteDomestic, substituteImport)
+}
+
+// substitute returns the demand for domestic production of a commodity
+// whose baseline demand for domestic production is d0 and total (domestic
+// and imported) demand is t, after a demand change that gives a demand for
+// domestic production of d1 if the import share is fixed. The change in
+// total demand falls on domestic production or on imports according to
+// mode; a decrease larger than the baseline demand for one falls on the
+// other.
+func substitute(mode string, d0, t, d1 float64) float64 {
+	change := d1 - d0
+	if d0 > 0 {
+		change *= t / d0
+	}
+	switch mode {
+	case substituteDomestic:
+		return math.Max(0, d0+change)
+	case substituteImport:
+		return d0 + math.Min(0, change+math.Max(0, t-d0))
+	}
+	return d1
+}
+
+// substituteImports changes demand, the demand for domestic production of
+// each commodity after a change from base at fixed import shares, to split
+// the change between domestic production and imports according to mode.
+// It returns multipliers, which scale each commodity's demand, adjusted in
+// the same way. total is the total demand for each commodity.
+func substituteImports(mode string, demand *eieiorpc.Vector, base, total, multipliers []float64) ([]float64, error) {
+	if len(base) != len(demand.Data) || len(total) != len(demand.Data) {
+		return nil, errorf(kindNumeric, "expected domestic and total demand for %d commodities, got %d and %d", len(demand.Data), len(base), len(total))
+	}
+	for i, d := range demand.Data {
+		demand.Data[i] = substitute(mode, base[i], total[i], d)
+	}
+	if multipliers == nil {
+		return nil, nil
+	}
+	adjusted := make([]float64, len(multipliers))
+	for i, m := range multipliers {
+		adjusted[i] = m
+		if base[i] > 0 {
+			adjusted[i] = substitute(mode, base[i], total[i], m*base[i]) / base[i]
+		}
+	}
+	return adjusted, nil
+}
+
+// totalDemand returns the model's total (domestic and imported) final
+// demand of type fdt in year.
+func totalDemand(ctx context.Context, s *eieio.Server, fdt string, year int32) (*eieiorpc.Vector, error) {
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType(eieiorpc.FinalDemandType_value[fdt]),
+		Year:            year,
+		Location:        eieiorpc.Location_Total,
+	})
+	done(&err)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting total final demand")
+	}
+	return demand, nil
+}
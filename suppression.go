@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// Ways of protecting small population counts; see suppressionConfig.
+const (
+	suppressCells = "suppress"
+	roundCells    = "round"
+)
+
+// suppressionConfig specifies small-cell suppression of outputs that
+// combine demographics with fine geography, so that they can be shared
+// under data-use agreements: the population counts of each grid cell in
+// population maps and snapshots, and exposure totals restricted to a
+// receptor region or subdomain.
+type suppressionConfig struct {
+	// MinPopulation is the population below which a count is protected.
+	// Zero, the default, disables suppression.
+	MinPopulation float64
+
+	// Method is "suppress" (the default), which reports protected counts
+	// as missing (NaN, or null in GeoJSON), or "round", which rounds them
+	// to 0 or MinPopulation, whichever is nearer. Exposure totals are
+	// suppressed, or scaled to the rounded population, with the total
+	// population of the demographic in the region.
+	Method string
+}
+
+// suppression is the Suppression setting in the [Sandbox] config table.
+var suppression suppressionConfig
+
+// check returns an error if c is invalid.
+func (c suppressionConfig) check() error {
+	if c.MinPopulation < 0 || math.IsNaN(c.MinPopulation) || math.IsInf(c.MinPopulation, 0) {
+		return errorf(kindConfig, "invalid Suppression MinPopulation %g", c.MinPopulation)
+	}
+	switch c.Method {
+	case "", suppressCells, roundCells:
+		return nil
+	}
+	return errorf(kindConfig, "invalid Suppression Method %q; must be %s or %s", c.Method, suppressCells, roundCells)
+}
+
+// String describes c, for recording in results.
+func (c suppressionConfig) String() string {
+	if c.MinPopulation == 0 {
+		return "none"
+	}
+	method := c.Method
+	if method == "" {
+		method = suppressCells
+	}
+	return method + " below " + strconv.FormatFloat(c.MinPopulation, 'g', -1, 64)
+}
+
+// count returns population count n as it may be reported: n itself if it
+// isn't below MinPopulation, and otherwise NaN or n rounded, according
+// to Method.
+func (c suppressionConfig) count(n float64) float64 {
+	if n >= c.MinPopulation || n == 0 {
+		return n
+	}
+	if c.Method == roundCells {
+		if n < c.MinPopulation/2 {
+			return 0
+		}
+		return c.MinPopulation
+	}
+	return math.NaN()
+}
+
+// total returns v, a total such as exposure over a population of n
+// people, as it may be reported: suppressed if n is, and otherwise scaled
+// to the reported count.
+func (c suppressionConfig) total(v, n float64) float64 {
+	r := c.count(n)
+	if r == n {
+		return v
+	}
+	if math.IsNaN(r) {
+		return r
+	}
+	return v * r / n
+}
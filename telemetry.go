@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// rpcStat summarizes the calls to one EIEIO method.
+type rpcStat struct {
+	Name       string
+	Calls      int
+	Total, Max time.Duration
+}
+
+// traceEvent is a complete event in the Chrome trace event format, which
+// can be viewed at chrome://tracing or https://ui.perfetto.dev.
+type traceEvent struct {
+	Name  string `json:"name"`
+	Phase string `json:"ph"`
+	TS    int64  `json:"ts"`  // μs since start
+	Dur   int64  `json:"dur"` // μs
+	PID   int    `json:"pid"`
+	TID   int    `json:"tid"`
+}
+
+// rpcTimings records how long calls to the EIEIO server take, to find the
+// bottlenecks in an analysis.
+type rpcTimings struct {
+	mx     sync.Mutex
+	start  time.Time
+	stats  map[string]*rpcStat
+	events []traceEvent
+
+	// traceFile, if set, is where finish writes a trace of every call.
+	// It is set from the TraceFile setting in the [Sandbox] config table.
+	traceFile string
+}
+
+// timings records the calls made during this run.
+var timings = &rpcTimings{start: time.Now(), stats: make(map[string]*rpcStat)}
+
+// timeRPC starts timing a call to the named EIEIO method, and a tracing
+// span for it, returning a function to be called when the call returns:
+//
+//	done := timeRPC(ctx, "FinalDemand")
+//	demand, err := s.FinalDemand(ctx, ...)
+//	done(&err)
+//
+// A non-nil error is recorded in the span and classified as kindRPC,
+// unless it is already classified.
+func timeRPC(ctx context.Context, name string) func(err *error) {
+	start := time.Now()
+	_, span := startSpan(ctx, name)
+	return func(err *error) {
+		endSpan(span, *err)
+		*err = withKind(kindRPC, *err)
+		timings.add(name, start, time.Since(start))
+	}
+}
+
+func (t *rpcTimings) add(name string, start time.Time, d time.Duration) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	st, ok := t.stats[name]
+	if !ok {
+		st = &rpcStat{Name: name}
+		t.stats[name] = st
+	}
+	st.Calls++
+	st.Total += d
+	if d > st.Max {
+		st.Max = d
+	}
+	if t.traceFile != "" {
+		t.events = append(t.events, traceEvent{Name: name, Phase: "X", PID: 1, TID: 1,
+			TS: start.Sub(t.start).Microseconds(), Dur: d.Microseconds()})
+	}
+}
+
+// sorted returns the statistics for each method, slowest in total first.
+func (t *rpcTimings) sorted() []rpcStat {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	stats := make([]rpcStat, 0, len(t.stats))
+	for _, st := range t.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Total > stats[j].Total })
+	return stats
+}
+
+// report writes a table of the time spent in each method, slowest first,
+// with its share of the run's wall time.
+func (t *rpcTimings) report(w io.Writer) error {
+	elapsed := time.Since(t.start)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Method\tCalls\tTotal\tMean\tMax\t%% of run\t\n")
+	for _, st := range t.sorted() {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%.1f\t\n", st.Name, st.Calls, st.Total.Round(time.Millisecond),
+			(st.Total / time.Duration(st.Calls)).Round(time.Millisecond), st.Max.Round(time.Millisecond),
+			100*st.Total.Seconds()/elapsed.Seconds())
+	}
+	fmt.Fprintf(tw, "Run\t\t%s\t\t\t\t\n", elapsed.Round(time.Millisecond))
+	return tw.Flush()
+}
+
+// finish logs the bottleneck report and writes the trace file, if
+// configured. Calls made concurrently overlap, so totals can exceed the
+// wall time of the run.
+func (t *rpcTimings) finish() {
+	if len(t.sorted()) == 0 {
+		return
+	}
+	log.Printf("Time spent in EIEIO calls:")
+	t.report(os.Stderr)
+	if t.traceFile == "" {
+		return
+	}
+	f, err := os.Create(t.traceFile)
+	if err != nil {
+		log.Printf("error writing trace: %v", err)
+		return
+	}
+	defer f.Close()
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if err := json.NewEncoder(f).Encode(map[string]interface{}{"traceEvents": t.events}); err != nil {
+		log.Printf("error writing trace: %v", err)
+		return
+	}
+	log.Printf("Wrote trace of %d calls to %s", len(t.events), t.traceFile)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// temporalConfig specifies monthly emission profiles, which allow
+// exposure to be calculated by month or season. The SR matrix is an
+// annual average, so the concentrations of a period are those of the
+// annual SR matrix applied to the emission rates of that period: they
+// capture seasonal emissions, such as from heating or agriculture, but not
+// seasonal meteorology.
+type temporalConfig struct {
+	// File is the path to a CSV file with columns SCC,Pollutant followed
+	// by the fraction of annual emissions in each month, Jan to Dec. SCC
+	// and Pollutant are as in an emission factor override file (see
+	// emissionFactorConfig), and the most specific entry applies. Each
+	// entry's fractions are normalized to sum to 1. Emissions of SCCs
+	// without an entry are spread evenly over the year.
+	File string
+}
+
+// String describes c, for recording in results.
+func (c temporalConfig) String() string {
+	if c.File == "" {
+		return "none"
+	}
+	return filepath.Base(c.File)
+}
+
+// temporalProfile is an entry in a monthly emission profile file.
+type temporalProfile struct {
+	control
+	fractions [12]float64
+}
+
+// readTemporalProfiles reads a monthly emission profile file.
+func readTemporalProfiles(path string) ([]temporalProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 14
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	var profiles []temporalProfile
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range rec {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+		p := temporalProfile{control: control{scc: strings.TrimLeft(rec[0], "0"), state: "*"}}
+		if p.scc == "" {
+			return nil, fmt.Errorf("emission profile %v must specify an SCC, or \"*\"", rec)
+		}
+		if rec[1] == "*" {
+			p.anyPol = true
+		} else {
+			var ok bool
+			if p.pol, ok = neiPollutants[strings.ToUpper(rec[1])]; !ok {
+				return nil, fmt.Errorf("invalid pollutant %q in emission profile %v", rec[1], rec)
+			}
+		}
+		var sum float64
+		for m := range p.fractions {
+			v, err := strconv.ParseFloat(rec[2+m], 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("invalid fraction %q for %s in emission profile %v", rec[2+m], time.Month(m+1), rec)
+			}
+			p.fractions[m] = v
+			sum += v
+		}
+		if sum == 0 {
+			return nil, fmt.Errorf("emission profile %v has no emissions in any month", rec)
+		}
+		for m := range p.fractions {
+			p.fractions[m] /= sum
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// temporalPeriod is part of a year, such as a month or season.
+type temporalPeriod struct {
+	Name   string
+	Months []time.Month
+}
+
+// temporalPeriods returns the periods of a resolution: "month" for each
+// month, or "season" for winter (December to February), spring, summer
+// and fall.
+func temporalPeriods(resolution string) ([]temporalPeriod, error) {
+	switch resolution {
+	case "month":
+		periods := make([]temporalPeriod, 12)
+		for m := range periods {
+			month := time.Month(m + 1)
+			periods[m] = temporalPeriod{Name: month.String(), Months: []time.Month{month}}
+		}
+		return periods, nil
+	case "season":
+		return []temporalPeriod{
+			{"Winter", []time.Month{time.December, time.January, time.February}},
+			{"Spring", []time.Month{time.March, time.April, time.May}},
+			{"Summer", []time.Month{time.June, time.July, time.August}},
+			{"Fall", []time.Month{time.September, time.October, time.November}},
+		}, nil
+	}
+	return nil, errorf(kindConfig, "invalid temporal resolution %q; valid resolutions are month and season", resolution)
+}
+
+// multiplier returns the ratio of the emission rate of profile fractions
+// during p to its annual average.
+func (p temporalPeriod) multiplier(fractions [12]float64) float64 {
+	var share float64
+	for _, m := range p.Months {
+		share += fractions[m-1]
+	}
+	return share * 12 / float64(len(p.Months))
+}
+
+var (
+	// temporalSetting is the Temporal setting in the [Sandbox] config
+	// table.
+	temporalSetting temporalConfig
+
+	temporalMx          sync.Mutex
+	temporalMultipliers = make(map[string][]float64)
+)
+
+type periodKey struct{}
+
+// withPeriod returns a context in which concentrations are those caused
+// by the emission rates during p.
+func withPeriod(ctx context.Context, p temporalPeriod) context.Context {
+	return context.WithValue(ctx, periodKey{}, &p)
+}
+
+// periodFor returns the period of ctx, or nil for annual concentrations.
+func periodFor(ctx context.Context) *temporalPeriod {
+	p, _ := ctx.Value(periodKey{}).(*temporalPeriod)
+	return p
+}
+
+// applyPeriod returns m, multipliers of the emissions of pol from each
+// SCC (indexed as s.SCCs; nil for none), multiplied by the ratio of the
+// SCC's emission rate during the period of ctx to its annual average. m is
+// returned unchanged if ctx has no period.
+func applyPeriod(ctx context.Context, s *eieio.Server, m []float64, pol eieiorpc.Emission) ([]float64, error) {
+	p := periodFor(ctx)
+	if p == nil {
+		return m, nil
+	}
+	if temporalSetting.File == "" {
+		return nil, errorf(kindConfig, "calculating %s concentrations requires monthly emission profiles in [Sandbox.Temporal]", p.Name)
+	}
+	key := fmt.Sprintf("%s|%v|%s", temporalSetting.File, pol, p.Name)
+	temporalMx.Lock()
+	pm, ok := temporalMultipliers[key]
+	temporalMx.Unlock()
+	if !ok {
+		profiles, err := readTemporalProfiles(temporalSetting.File)
+		if err != nil {
+			return nil, withKind(kindConfig, errors.Wrap(err, "reading monthly emission profiles"))
+		}
+		pm = make([]float64, len(s.SCCs))
+		for j, scc := range s.SCCs {
+			pm[j] = 1
+			best := -1
+			for _, pr := range profiles {
+				if n := pr.matches(string(scc), "", pol); n > best {
+					pm[j], best = p.multiplier(pr.fractions), n
+				}
+			}
+		}
+		temporalMx.Lock()
+		temporalMultipliers[key] = pm
+		temporalMx.Unlock()
+	}
+	out := make([]float64, len(pm))
+	for j, f := range pm {
+		out[j] = f
+		if m != nil {
+			out[j] *= m[j]
+		}
+	}
+	return out, nil
+}
+
+var periodExposureHeader = []string{"Period", "Population", "Label", "Exposure", "RatioToAnnual"}
+
+// periodExposureRows calculates the population-weighted exposure of each
+// population to the PM2.5 caused by demand during each period of
+// resolution, with its ratio to the population's annual exposure. The
+// exposure of a period is at its average rate, so that of each month is
+// comparable with the annual exposure.
+func periodExposureRows(ctx context.Context, s *eieio.Server, year int32, aqm string, demand *eieiorpc.Vector, resolution string, annual map[string]float64) ([][]string, error) {
+	periods, err := temporalPeriods(resolution)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, p := range periods {
+		exposure, err := getExposureByPopulation(withPeriod(ctx, p), s, year, LOC, aqm, demand, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s exposure", p.Name)
+		}
+		for _, pop := range sortedKeys(*exposure) {
+			e := (*exposure)[pop]
+			rows = append(rows, []string{p.Name, pop, labels.get(pop), formatFloat(e), formatFloat(e / annual[pop])})
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	goshp "github.com/jonas-p/go-shp"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// testGridSR is the spatial reference of the generated grid, which matches
+// the OutputSR of the example configs.
+const testGridSR = "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1"
+
+// testGridPrj is testGridSR in the format of a shapefile .prj file.
+const testGridPrj = `PROJCS["Lambert_Conformal_Conic_2SP",GEOGCS["GCS_unnamed ellipse",DATUM["D_unknown",SPHEROID["Unknown",6370997,0]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]],PROJECTION["Lambert_Conformal_Conic_2SP"],PARAMETER["standard_parallel_1",33],PARAMETER["standard_parallel_2",45],PARAMETER["latitude_of_origin",40],PARAMETER["central_meridian",-97],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["Meter",1]]`
+
+// testSRPollutants are the SR matrix variables, with the concentration
+// (μg/m³) caused in the same cell by 1 μg/s of emissions.
+var testSRPollutants = []struct {
+	Name string
+	Base float64
+}{
+	{"PrimaryPM25", 2e-6},
+	{"SOA", 1e-8},
+	{"pNH4", 1e-9},
+	{"pNO3", 5e-10},
+	{"pSO4", 5e-11},
+}
+
+// testGrid is a square grid of square cells centered on the origin of
+// testGridSR.
+type testGrid struct {
+	N  int     // cells along each side
+	Dx float64 // cell width, m
+}
+
+// cell returns the bounds of cell i, numbered west to east then south to
+// north.
+func (g testGrid) cell(i int) *geom.Bounds {
+	x := (float64(i%g.N) - float64(g.N)/2) * g.Dx
+	y := (float64(i/g.N) - float64(g.N)/2) * g.Dx
+	return &geom.Bounds{Min: geom.Point{X: x, Y: y}, Max: geom.Point{X: x + g.Dx, Y: y + g.Dx}}
+}
+
+func (g testGrid) polygon(i int) geom.Polygon {
+	b := g.cell(i)
+	return geom.Polygon{{b.Min, {X: b.Max.X, Y: b.Min.Y}, b.Max, {X: b.Min.X, Y: b.Max.Y}, b.Min}}
+}
+
+// genTestdataCommand writes a tiny, internally consistent dataset to a
+// directory: an SR matrix, census and mortality rate shapefiles and an
+// emissions inventory on the same grid, and a copy of CONFIG using them.
+// The inventory has emissions for the same SCCs as the one in CONFIG. IO
+// tables, CES shares and the SCC-IO mapping are not generated because the
+// config already points to small copies of them shipped with INMAP.
+func genTestdataCommand(args []string) error {
+	fs := flag.NewFlagSet("gen-testdata", flag.ExitOnError)
+	out := fs.String("o", "testdata", "output directory")
+	n := fs.Int("n", 4, "number of grid cells along each side of the domain")
+	dx := fs.Float64("dx", 1000, "grid cell width in meters")
+	seed := fs.Int64("seed", 1, "random seed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s gen-testdata [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if CONFIG == "" {
+		return fmt.Errorf("gen-testdata copies the config file, but %s is empty", configEnv)
+	}
+	if *n < 1 || *dx <= 0 {
+		return errorf(kindUsage, "invalid grid size %d×%g m", *n, *dx)
+	}
+
+	dir, err := filepath.Abs(*out)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "data"), 0755); err != nil {
+		return err
+	}
+	g := testGrid{N: *n, Dx: *dx}
+	rnd := rand.New(rand.NewSource(*seed))
+
+	files := map[string]string{
+		"sr":         filepath.Join(dir, "testSR.ncf"),
+		"population": filepath.Join(dir, "testPopulation.shp"),
+		"mortality":  filepath.Join(dir, "testMortalityRate.shp"),
+		"emissions":  filepath.Join(dir, "testemis.csv"),
+	}
+	if err := writeTestSR(files["sr"], g, rnd); err != nil {
+		return errors.Wrap(err, "writing SR matrix")
+	}
+	err = writeTestShapefile(files["population"], g, []string{"TotalPop", "WhiteNoLat", "Black", "Native", "Asian", "Latino"},
+		func(int) []float64 {
+			pop := make([]float64, 6)
+			for j := 1; j < len(pop); j++ {
+				pop[j] = math.Round(rnd.Float64() * 1000)
+				pop[0] += pop[j]
+			}
+			return pop
+		})
+	if err != nil {
+		return errors.Wrap(err, "writing census shapefile")
+	}
+	// Mortality rates are in deaths per year per 100,000 people.
+	err = writeTestShapefile(files["mortality"], g, []string{"AllCause", "WhNoLMort", "BlackMort", "AsianMort", "NativeMort", "LatinoMort"},
+		func(int) []float64 {
+			rates := make([]float64, 6)
+			for j := range rates {
+				rates[j] = 600 + 400*rnd.Float64()
+			}
+			return rates
+		})
+	if err != nil {
+		return errors.Wrap(err, "writing mortality rate shapefile")
+	}
+	sccs, err := configuredSCCs()
+	if err != nil {
+		return errors.Wrap(err, "reading SCCs from configured inventory")
+	}
+	if err := writeTestEmissions(files["emissions"], sccs, g, rnd); err != nil {
+		return errors.Wrap(err, "writing emissions")
+	}
+	cfgFile := filepath.Join(dir, "data", "my_config.toml")
+	if err := writeTestConfig(cfgFile, files); err != nil {
+		return errors.Wrap(err, "writing config")
+	}
+	fmt.Printf("Wrote a %d×%d cell test dataset to %s.\nTo use it, run:\n\tINMAP_SANDBOX_ROOT=%s go run .\n", g.N, g.N, dir, dir)
+	return nil
+}
+
+// writeTestSR writes a single-layer SR matrix for g in which concentrations
+// decay with distance from the source.
+func writeTestSR(filename string, g testGrid, rnd *rand.Rand) error {
+	nCells := g.N * g.N
+	h := cdf.NewHeader([]string{"layer", "source", "receptor", "allcells", "layers"},
+		[]int{1, nCells, nCells, nCells, 1})
+	h.AddVariable("layers", []string{"layers"}, []int32{0})
+	for _, p := range testSRPollutants {
+		h.AddVariable(p.Name, []string{"layer", "source", "receptor"}, []float32{0})
+		h.AddAttribute(p.Name, "units", "μg m-3 concentration at receptor location per μg s-1 emissions at source location")
+	}
+	cellVars := []string{"N", "S", "E", "W", "Layer", "LayerHeight", "Dx", "Dy", "Dz", "WindSpeed"}
+	for _, v := range cellVars {
+		h.AddVariable(v, []string{"allcells"}, []float64{0})
+	}
+	h.Define()
+	for _, err := range h.Check() {
+		return err
+	}
+
+	ff, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer ff.Close()
+	f, err := cdf.Create(ff, h)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Writer("layers", []int{0}, []int{1}).Write([]int32{0}); err != nil {
+		return err
+	}
+
+	data := make(map[string][]float64)
+	for _, v := range cellVars {
+		data[v] = make([]float64, nCells)
+	}
+	for i := 0; i < nCells; i++ {
+		b := g.cell(i)
+		data["N"][i], data["S"][i], data["E"][i], data["W"][i] = b.Max.Y, b.Min.Y, b.Max.X, b.Min.X
+		data["Dx"][i], data["Dy"][i] = g.Dx, g.Dx
+		data["Dz"][i] = 1000
+		data["WindSpeed"][i] = 2 + rnd.Float64()
+	}
+	for _, v := range cellVars {
+		if _, err := f.Writer(v, []int{0}, []int{nCells}).Write(data[v]); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range testSRPollutants {
+		for src := 0; src < nCells; src++ {
+			cs := g.cell(src).Centroid()
+			row := make([]float32, nCells)
+			for rec := range row {
+				cr := g.cell(rec).Centroid()
+				d := math.Hypot(cs.X-cr.X, cs.Y-cr.Y)
+				row[rec] = float32(p.Base * math.Exp(-d/(2*g.Dx)) * (0.9 + 0.2*rnd.Float64()))
+			}
+			if _, err := f.Writer(p.Name, []int{0, src, 0}, []int{1, src + 1, nCells}).Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return cdf.UpdateNumRecs(ff)
+}
+
+// writeTestShapefile writes a polygon shapefile with a record for each cell
+// of g, with the named fields set to values(cell).
+func writeTestShapefile(filename string, g testGrid, fields []string, values func(i int) []float64) error {
+	shpFields := make([]goshp.Field, len(fields))
+	for i, f := range fields {
+		shpFields[i] = goshp.FloatField(f, 20, 4)
+	}
+	e, err := shp.NewEncoderFromFields(filename, goshp.POLYGON, shpFields...)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < g.N*g.N; i++ {
+		// Values are written as space-padded strings because INMAP can't
+		// parse the NUL-padded numbers written for float64 values.
+		vals := values(i)
+		padded := make([]interface{}, len(vals))
+		for j, v := range vals {
+			padded[j] = fmt.Sprintf("%20.4f", v)
+		}
+		if err := e.EncodeFields(g.polygon(i), padded...); err != nil {
+			e.Close()
+			return err
+		}
+	}
+	e.Close()
+	return ioutil.WriteFile(strings.TrimSuffix(filename, ".shp")+".prj", []byte(testGridPrj), 0644)
+}
+
+// testEmissionsRecord is a ground-level ORL point source record in which
+// the SCC, longitude, latitude, pollutant and annual emissions (tons) are
+// filled in.
+const testEmissionsRecord = `18043,"36061","%03d","1","1","TEST-FACILITY-%d","%s","02","01",0,0,0,0,0,"4911","1808-1","221112","L",%.9f,%.9f,-9,"%s",%g,,,,,,"NEI31676","1008","2","Y","E-E","11111"," ","2005","000",,,"47150",,,,"01",,"Y",,,"NA","20050101","20051231",,,,,,,,,,,,,,,,,,,`
+
+// configuredSCCs returns the SCCs in the NEIFiles of the inventory in
+// CONFIG. EIEIO requires emissions for every SCC in its SCC-IO mapping,
+// which is consistent with the configured inventory.
+func configuredSCCs() ([]string, error) {
+	var cfg struct {
+		SpatialEIO struct {
+			InventoryConfig struct {
+				NEIFiles map[string][]string
+			}
+		}
+	}
+	if _, err := toml.DecodeFile(CONFIG, &cfg); err != nil {
+		return nil, err
+	}
+	var sccs []string
+	seen := make(map[string]bool)
+	for _, files := range cfg.SpatialEIO.InventoryConfig.NEIFiles {
+		for _, file := range files {
+			f, err := os.Open(os.ExpandEnv(file))
+			if err != nil {
+				return nil, err
+			}
+			r := csv.NewReader(f)
+			r.Comment = '#'
+			r.FieldsPerRecord = -1
+			recs, err := r.ReadAll()
+			f.Close()
+			if err != nil {
+				return nil, errors.Wrap(err, file)
+			}
+			for _, rec := range recs {
+				if len(rec) > 6 && !seen[rec[6]] {
+					seen[rec[6]] = true
+					sccs = append(sccs, rec[6])
+				}
+			}
+		}
+	}
+	sort.Strings(sccs)
+	return sccs, nil
+}
+
+// writeTestEmissions writes an ORL point source inventory with emissions
+// of each pollutant from each of sccs in a random cell of g.
+func writeTestEmissions(filename string, sccs []string, g testGrid, rnd *rand.Rand) error {
+	src, err := proj.Parse(testGridSR)
+	if err != nil {
+		return err
+	}
+	dst, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return err
+	}
+	ct, err := src.NewTransform(dst)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "#ORL     POINT")
+	fmt.Fprintln(w, "#TYPE    Point Source Inventory for CAPS")
+	fmt.Fprintln(w, "#COUNTRY US")
+	fmt.Fprintln(w, "#YEAR    2005")
+	for i, scc := range sccs {
+		p, err := g.cell(rnd.Intn(g.N * g.N)).Centroid().Transform(ct)
+		if err != nil {
+			return err
+		}
+		ll := p.(geom.Point)
+		for _, pol := range []string{"PM2_5", "NOX", "SO2", "NH3", "VOC"} {
+			fmt.Fprintf(w, testEmissionsRecord+"\n", i, i, scc, ll.X, ll.Y, pol, math.Round(rnd.Float64()*100)/10)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// testConfigTables are the tables of CONFIG whose file paths are replaced by
+// writeTestConfig, and the file that replaces them.
+var testConfigTables = map[string]string{
+	"SpatialEIO.SRFiles":                            "sr",
+	"SpatialEIO.CensusFile":                         "population",
+	"SpatialEIO.MortalityRateFile":                  "mortality",
+	"SpatialEIO.InventoryConfig.NEIFiles":           "emissions",
+	"SpatialEIO.EvaluationInventoryConfig.NEIFiles": "emissions",
+}
+
+var (
+	tomlTableRE  = regexp.MustCompile(`^\s*\[([^\[\]]+)\]`)
+	tomlStringRE = regexp.MustCompile(`"[^"]*"`)
+
+	// tomlArrayItemRE matches a line holding only one string in an array.
+	tomlArrayItemRE = regexp.MustCompile(`^\s*"[^"]*"\s*,?\s*$`)
+)
+
+// writeTestConfig writes a copy of CONFIG in which the SR matrix, census,
+// mortality rate and emissions files are replaced by the generated files.
+func writeTestConfig(filename string, files map[string]string) error {
+	b, err := ioutil.ReadFile(CONFIG)
+	if err != nil {
+		return err
+	}
+	var out []string
+	var table string
+	var replaced bool
+	for _, line := range strings.Split(string(b), "\n") {
+		if m := tomlTableRE.FindStringSubmatch(line); m != nil {
+			table = strings.TrimSpace(m[1])
+			replaced = false
+			out = append(out, line)
+			continue
+		}
+		key, ok := testConfigTables[table]
+		if !ok || strings.HasPrefix(strings.TrimSpace(line), "#") || !tomlStringRE.MatchString(line) {
+			out = append(out, line)
+			continue
+		}
+		if replaced && tomlArrayItemRE.MatchString(line) {
+			continue // only keep the first file of an array
+		}
+		out = append(out, tomlStringRE.ReplaceAllString(line, fmt.Sprintf("%q", files[key])))
+		replaced = true
+	}
+	return ioutil.WriteFile(filename, []byte(strings.Join(out, "\n")), 0644)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Concentrations to which populations are exposed away from home; see
+// timeActivityConfig.
+const (
+	awayMean = "mean"
+	awayNone = "none"
+)
+
+// timeActivityConfig weights the residential exposure of census
+// populations by the fraction of their time spent at home, from time-
+// activity surveys.
+type timeActivityConfig struct {
+	// HomeFraction is the fraction of time each census population, such as
+	// "WhiteNoLat" or "IncomeDec0", spends at home. Populations not listed
+	// are assumed to be at home all the time.
+	HomeFraction map[string]float64
+
+	// Away is the concentration populations are exposed to for the rest
+	// of their time: "mean" (the default), the population-weighted mean
+	// concentration of the cells included in the exposure calculation, or
+	// "none", counting only exposure at home.
+	Away string
+}
+
+// timeActivity is the TimeActivity setting in the [Sandbox] config table.
+var timeActivity timeActivityConfig
+
+// check returns an error if c is invalid.
+func (c timeActivityConfig) check() error {
+	for pop, f := range c.HomeFraction {
+		if f < 0 || f > 1 {
+			return errorf(kindConfig, "invalid TimeActivity HomeFraction %g for %s; must be between 0 and 1", f, pop)
+		}
+	}
+	switch c.Away {
+	case "", awayMean, awayNone:
+		return nil
+	}
+	return errorf(kindConfig, "invalid TimeActivity Away %q; must be %s or %s", c.Away, awayMean, awayNone)
+}
+
+// String describes c, for recording in results.
+func (c timeActivityConfig) String() string {
+	if len(c.HomeFraction) == 0 {
+		return "none"
+	}
+	var parts []string
+	for _, pop := range sortedKeys(c.HomeFraction) {
+		parts = append(parts, pop+"="+strconv.FormatFloat(c.HomeFraction[pop], 'g', -1, 64))
+	}
+	away := c.Away
+	if away == "" {
+		away = awayMean
+	}
+	return strings.Join(parts, " ") + ", away " + away
+}
+
+// checkPopulations returns an error if c has a home fraction for a
+// population not in popNames.
+func (c timeActivityConfig) checkPopulations(popNames []string) error {
+	valid := make(map[string]bool, len(popNames))
+	for _, pop := range popNames {
+		valid[pop] = true
+	}
+	for pop := range c.HomeFraction {
+		if !valid[pop] {
+			sort.Strings(popNames)
+			return errorf(kindConfig, "invalid TimeActivity population %q; valid populations are %s", pop, strings.Join(popNames, ", "))
+		}
+	}
+	return nil
+}
+
+// adjust returns exposure, the residential exposure of a population of
+// n people, weighted by the population's time at home, with the rest of
+// its time spent at concentration away if Away is "mean".
+func (c timeActivityConfig) adjust(pop string, exposure, n, away float64) float64 {
+	h, ok := c.HomeFraction[pop]
+	if !ok {
+		return exposure
+	}
+	if c.Away == awayNone {
+		return h * exposure
+	}
+	return h*exposure + (1-h)*n*away
+}
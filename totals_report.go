@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// emissionUnits converts the units of published emission totals to kg.
+var emissionUnits = map[string]float64{
+	"":                1,
+	"kg":              1,
+	"tonnes":          1e3,
+	"Mg":              1e3,
+	"tons":            907.18474, // short tons
+	"thousand tons":   907184.74,
+	"thousand tonnes": 1e6,
+}
+
+// nationalTotal is a published national emission total.
+type nationalTotal struct {
+	Emission eieiorpc.Emission
+	Year     int32
+	Total    float64 // kg/year
+}
+
+// readNationalTotals reads published national emission totals from a CSV
+// file with columns Emission (e.g. PM25), Year, Total and Units (a key of
+// emissionUnits; empty for kg).
+func readNationalTotals(path string) ([]nationalTotal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 4
+	if _, err := r.Read(); err != nil { // header
+		return nil, err
+	}
+	var totals []nationalTotal
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range rec {
+			rec[i] = strings.TrimSpace(rec[i])
+		}
+		pol, ok := eieiorpc.Emission_value[rec[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid emission %q in national total %v", rec[0], rec)
+		}
+		year, err := strconv.ParseInt(rec[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid year %q in national total %v", rec[1], rec)
+		}
+		v, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid total %q in national total %v", rec[2], rec)
+		}
+		scale, ok := emissionUnits[rec[3]]
+		if !ok {
+			units := make([]string, 0, len(emissionUnits))
+			for u := range emissionUnits {
+				if u != "" {
+					units = append(units, u)
+				}
+			}
+			sort.Strings(units)
+			return nil, fmt.Errorf("invalid units %q in national total %v; valid units are %s", rec[3], rec, strings.Join(units, ", "))
+		}
+		totals = append(totals, nationalTotal{Emission: eieiorpc.Emission(pol), Year: int32(year), Total: v * scale})
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Year != totals[j].Year {
+			return totals[i].Year < totals[j].Year
+		}
+		return totals[i].Emission < totals[j].Emission
+	})
+	return totals, nil
+}
+
+// unitMistakes are ratios between model and national totals that suggest
+// a unit or scaling mistake rather than a modeling difference.
+var unitMistakes = []struct {
+	ratio float64
+	note  string
+}{
+	{1e3, "kg vs. tonnes"},
+	{907.18474, "kg vs. short tons"},
+	{1e6, "kg vs. thousand tonnes, or dollars vs. millions of dollars"},
+	{1.10231131, "tonnes vs. short tons"},
+}
+
+// unitNote returns a likely unit mistake explaining ratio, or "".
+func unitNote(ratio float64) string {
+	for _, m := range unitMistakes {
+		for _, r := range []float64{m.ratio, 1 / m.ratio} {
+			if math.Abs(ratio/r-1) < 0.05 {
+				return fmt.Sprintf("ratio ≈ %.4g (%s?)", r, m.note)
+			}
+		}
+	}
+	return ""
+}
+
+// modelEmissionTotals returns the model-wide emissions (kg/year) of each
+// pollutant caused by total final demand in year.
+func modelEmissionTotals(ctx context.Context, s *eieio.Server, year int32, aqm string) (map[eieiorpc.Emission]float64, error) {
+	done := timeRPC(ctx, "FinalDemand")
+	demand, err := s.FinalDemand(ctx, &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            year,
+		Location:        LOC,
+	})
+	done(&err)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting final demand")
+	}
+	totals := make(map[eieiorpc.Emission]float64)
+	for val := 0; val < len(eieiorpc.Emission_name); val++ {
+		pol := eieiorpc.Emission(val)
+		emis, err := getEmissionsBySCC(ctx, demand, s, pol, year, LOC, aqm)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error calculating %s emissions by sector", pol)
+		}
+		for _, v := range emis.RawVector().Data {
+			totals[pol] += v
+		}
+	}
+	return totals, nil
+}
+
+// totalsReportCommand compares the model-wide emission totals of each
+// pollutant and year with published national totals, to catch unit and
+// scaling mistakes.
+func totalsReportCommand(args []string) error {
+	fs := flag.NewFlagSet("totals-report", flag.ExitOnError)
+	aqm := fs.String("aqm", "isrm", "air quality model")
+	threshold := fs.Float64("threshold", 0.5, "flag totals whose ratio to the national total differs from 1 by more than this")
+	out := fs.String("o", "emission_totals.csv", "output CSV file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s totals-report [flags] national_totals.csv\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "totals-report requires a CSV file of national totals")
+	}
+	national, err := readNationalTotals(fs.Arg(0))
+	if err != nil {
+		return withKind(kindConfig, errors.Wrapf(err, "reading national totals from %s", fs.Arg(0)))
+	}
+
+	s, _, err := getEIOServer()
+	if err != nil {
+		return errors.Wrap(err, "error creating EIO server")
+	}
+	ctx := context.Background()
+	model := make(map[int32]map[eieiorpc.Emission]float64)
+	for _, n := range national {
+		if model[n.Year] != nil {
+			continue
+		}
+		if err := Year(n.Year).validate(ctx, s); err != nil {
+			return err
+		}
+		if model[n.Year], err = modelEmissionTotals(ctx, s, n.Year, *aqm); err != nil {
+			return errors.Wrapf(err, "year %d", n.Year)
+		}
+	}
+
+	var rows [][]string
+	var flagged int
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Year\tEmission\tModel (kg)\tNational (kg)\tRatio\t\n")
+	for _, n := range national {
+		m := model[n.Year][n.Emission]
+		ratio := math.NaN()
+		if n.Total != 0 {
+			ratio = m / n.Total
+		}
+		bad := (math.IsNaN(ratio) && m != 0) || math.Abs(ratio-1) > *threshold
+		var note string
+		if bad {
+			flagged++
+			note = unitNote(ratio)
+		}
+		rows = append(rows, []string{strconv.Itoa(int(n.Year)), n.Emission.String(), formatFloat(m), formatFloat(n.Total),
+			formatFloat(ratio), fmt.Sprint(bad), note})
+		mark := ""
+		if bad {
+			mark = "FLAGGED " + note
+		}
+		fmt.Fprintf(w, "%d\t%s\t%.4g\t%.4g\t%.3f\t%s\n", n.Year, n.Emission, m, n.Total, ratio, mark)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := writeCSV(*out, []string{"Year", "Emission", "Model", "National", "Ratio", "Flagged", "Note"}, rows); err != nil {
+		return err
+	}
+	if err := describeOutput(*out, "emission_totals.csv"); err != nil {
+		return err
+	}
+	log.Printf("Compared %d national totals; %d flagged. Report written to %s", len(rows), flagged, *out)
+	if flagged > 0 {
+		return errorf(kindNumeric, "%d emission totals differ from the national totals by more than %g", flagged, *threshold)
+	}
+	return nil
+}
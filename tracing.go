@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/trace/jaeger"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"sync"
+	"time"
+)
+
+// tracingConfig specifies where to export OpenTelemetry traces of the
+// analysis pipeline. Traces are exported to Jaeger, either to a collector
+// (Endpoint, e.g. "http://localhost:14268/api/traces") or to an agent
+// (AgentHost and AgentPort, e.g. "localhost" and "6831"). OTLP export is
+// not available because the Go OTLP exporter requires a newer gRPC than
+// the EIEIO dependencies build against; a Jaeger or OpenTelemetry
+// collector can forward traces to OTLP backends.
+type tracingConfig struct {
+	Endpoint             string
+	AgentHost, AgentPort string
+}
+
+var (
+	tracerProvider *sdktrace.TracerProvider
+	tracingOnce    sync.Once
+)
+
+// initTracing starts exporting traces as specified by cfg, if anything is
+// configured. Only the first call has an effect.
+func initTracing(cfg tracingConfig) error {
+	var err error
+	tracingOnce.Do(func() {
+		var endpoint jaeger.EndpointOption
+		switch {
+		case cfg.Endpoint != "":
+			endpoint = jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(cfg.Endpoint))
+		case cfg.AgentHost != "" || cfg.AgentPort != "":
+			var opts []jaeger.AgentEndpointOption
+			if cfg.AgentHost != "" {
+				opts = append(opts, jaeger.WithAgentHost(cfg.AgentHost))
+			}
+			if cfg.AgentPort != "" {
+				opts = append(opts, jaeger.WithAgentPort(cfg.AgentPort))
+			}
+			endpoint = jaeger.WithAgentEndpoint(opts...)
+		default:
+			return
+		}
+		var exporter *jaeger.Exporter
+		exporter, err = jaeger.NewRawExporter(endpoint)
+		if err != nil {
+			return
+		}
+		tracerProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String("inmap_sandbox"))),
+		)
+		otel.SetTracerProvider(tracerProvider)
+	})
+	return err
+}
+
+// shutdownTracing exports any remaining spans.
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("error exporting traces: %v", err)
+	}
+}
+
+// startSpan starts a span for a pipeline stage or RPC. If tracing is not
+// configured, the span does nothing.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer("inmap_sandbox").Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, status.begin(span, name, attrs)
+}
+
+// endSpan ends span, recording err if it is not nil. It is intended to be
+// deferred with a named error result:
+//
+//	ctx, span := startSpan(ctx, "stage")
+//	defer func() { endSpan(span, err) }()
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
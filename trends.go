@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/stat"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// yearExposure is population-weighted exposure and the population count
+// by census population in one year.
+type yearExposure struct {
+	Year     int
+	Exposure map[string]float64
+	People   map[string]float64
+}
+
+// batchYear is a completed scenario of a batch output directory.
+type batchYear struct {
+	Year int
+	Name string
+
+	// Dir is the directory of the scenario's results.
+	Dir string
+}
+
+// completedYears returns the completed scenarios in the index.csv of a
+// batch output directory, sorted by year. If names is non-empty, only the
+// named scenarios are returned. Scenarios must have distinct years.
+func completedYears(dir string, names []string) ([]batchYear, error) {
+	header, rows, err := readCSV(filepath.Join(dir, "index.csv"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading batch index")
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[h] = i
+	}
+	var years []batchYear
+	seen := make(map[int]string)
+	for _, r := range rows {
+		name := r[col["Name"]]
+		if r[col["Status"]] != string(jobDone) || (len(names) > 0 && !stringList(names).contains(name)) {
+			continue
+		}
+		year, err := strconv.Atoi(r[col["Year"]])
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: invalid year: %v", name, err)
+		}
+		if other, ok := seen[year]; ok {
+			return nil, fmt.Errorf("scenarios %s and %s both have year %d", other, name, year)
+		}
+		seen[year] = name
+		years = append(years, batchYear{Year: year, Name: name, Dir: filepath.Join(dir, r[col["Directory"]])})
+	}
+	sort.Slice(years, func(i, j int) bool { return years[i].Year < years[j].Year })
+	return years, nil
+}
+
+// loadBatchExposure reads exposure.csv for each completed scenario in the
+// index.csv of a batch output directory. If names is non-empty, only the
+// named scenarios are read. Scenarios must have distinct years.
+func loadBatchExposure(dir string, names []string) ([]yearExposure, error) {
+	scenarios, err := completedYears(dir, names)
+	if err != nil {
+		return nil, err
+	}
+	var years []yearExposure
+	for _, sc := range scenarios {
+		header, expRows, err := readCSV(filepath.Join(sc.Dir, "exposure.csv"))
+		if err != nil {
+			return nil, err
+		}
+		if len(header) < 4 || header[3] != "People" {
+			return nil, errorf(kindDataMissing, "scenario %s: exposure.csv has no People column; re-run the scenario", sc.Name)
+		}
+		ye := yearExposure{Year: sc.Year, Exposure: make(map[string]float64), People: make(map[string]float64)}
+		for _, er := range expRows {
+			v, err := strconv.ParseFloat(er[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("scenario %s: invalid exposure for %s: %v", sc.Name, er[0], err)
+			}
+			n, err := strconv.ParseFloat(er[3], 64)
+			if err != nil {
+				return nil, fmt.Errorf("scenario %s: invalid population count for %s: %v", sc.Name, er[0], err)
+			}
+			ye.Exposure[er[0]], ye.People[er[0]] = v, n
+		}
+		years = append(years, ye)
+	}
+	return years, nil
+}
+
+// exposureTrend summarizes how a population's exposure changes over time.
+type exposureTrend struct {
+	// Slope is the least-squares linear trend in exposure per year.
+	Slope float64
+
+	// PercentChange is the change in exposure from the first to the last
+	// year, as a percentage of the first year.
+	PercentChange float64
+
+	// MaxDisparityYear is the year in which the population's mean
+	// exposure (exposure per person) differs most from that of the total
+	// population, relative to the total population.
+	MaxDisparityYear int
+}
+
+// exposureTrends calculates the trend of each population in years, which
+// must be sorted by year.
+func exposureTrends(years []yearExposure, totalPop string) map[string]exposureTrend {
+	trends := make(map[string]exposureTrend)
+	if len(years) < 2 {
+		return trends
+	}
+	for pop := range years[0].Exposure {
+		var x, y []float64
+		var t exposureTrend
+		maxDisparity := -1.0
+		for _, ye := range years {
+			v, ok := ye.Exposure[pop]
+			if !ok {
+				continue
+			}
+			x = append(x, float64(ye.Year))
+			y = append(y, v)
+			// Exposure is summed over the population's members, so it
+			// is compared per person.
+			total, mean := ye.Exposure[totalPop]/ye.People[totalPop], v/ye.People[pop]
+			if total != 0 && allFinite([]float64{total, mean}) {
+				if d := math.Abs(mean/total - 1); d > maxDisparity {
+					maxDisparity = d
+					t.MaxDisparityYear = ye.Year
+				}
+			}
+		}
+		if len(x) < 2 {
+			continue
+		}
+		_, t.Slope = stat.LinearRegression(x, y, nil, false)
+		if y[0] != 0 {
+			t.PercentChange = (y[len(y)-1] - y[0]) / y[0] * 100
+		} else {
+			t.PercentChange = math.NaN()
+		}
+		trends[pop] = t
+	}
+	return trends
+}
+
+// writeTrends writes trends.csv to a batch output directory.
+func writeTrends(dir string, names []string, totalPop string) error {
+	years, err := loadBatchExposure(dir, names)
+	if err != nil {
+		return err
+	}
+	if len(years) < 2 {
+		return fmt.Errorf("trends require completed scenarios for at least 2 years, got %d", len(years))
+	}
+	trends := exposureTrends(years, totalPop)
+	pops := make([]string, 0, len(trends))
+	for pop := range trends {
+		pops = append(pops, pop)
+	}
+	sort.Strings(pops)
+	var rows [][]string
+	for _, pop := range pops {
+		t := trends[pop]
+		rows = append(rows, []string{pop, labels.get(pop), strconv.Itoa(years[0].Year), strconv.Itoa(years[len(years)-1].Year),
+			formatFloat(t.Slope), formatFloat(t.PercentChange), strconv.Itoa(t.MaxDisparityYear)})
+	}
+	path := filepath.Join(dir, "trends.csv")
+	if err := writeCSV(path, []string{"Population", "Label", "FirstYear", "LastYear", "Slope", "PercentChange", "MaxDisparityYear"}, rows); err != nil {
+		return err
+	}
+	return describeOutput(path, "trends.csv")
+}
+
+// trendsCommand writes exposure trends across the years of a completed batch.
+func trendsCommand(args []string) error {
+	fs := flag.NewFlagSet("trends", flag.ExitOnError)
+	totalPop := fs.String("total", "TotalPop", "census population that disparities are measured against")
+	var names stringList
+	fs.Var(&names, "scenario", "include only the named scenario (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s trends [-total TotalPop] [-scenario name]... batch_output_dir\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errorf(kindUsage, "trends requires exactly one batch output directory")
+	}
+	if err := writeTrends(fs.Arg(0), names, *totalPop); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", filepath.Join(fs.Arg(0), "trends.csv"))
+	return nil
+}
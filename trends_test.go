@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestExposureTrendsDisparity checks that disparities compare exposure
+// per person: a small population whose members are highly exposed differs
+// most from the total population in the year of its highest mean
+// exposure, even though its summed exposure is smaller than the total's
+// in every year.
+func TestExposureTrendsDisparity(t *testing.T) {
+	years := []yearExposure{
+		{
+			Year:     2014,
+			Exposure: map[string]float64{"TotalPop": 2000, "Small": 100},
+			People:   map[string]float64{"TotalPop": 1000, "Small": 10},
+		},
+		{
+			Year:     2015,
+			Exposure: map[string]float64{"TotalPop": 2000, "Small": 20},
+			People:   map[string]float64{"TotalPop": 1000, "Small": 10},
+		},
+	}
+	trends := exposureTrends(years, "TotalPop")
+	small := trends["Small"]
+	if small.MaxDisparityYear != 2014 {
+		t.Errorf("got maximum disparity in %d, want 2014, when the group's mean exposure was 5 times the total's", small.MaxDisparityYear)
+	}
+	if small.Slope != -80 || math.Abs(small.PercentChange+80) > 1e-9 {
+		t.Errorf("got slope %g and change %g%%, want -80 and -80%%", small.Slope, small.PercentChange)
+	}
+}
+
+func TestExposureTrendsNoPeople(t *testing.T) {
+	// A population without people in a year has no mean exposure, and
+	// that year is skipped.
+	years := []yearExposure{
+		{Year: 2014, Exposure: map[string]float64{"TotalPop": 10, "A": 0}, People: map[string]float64{"TotalPop": 10, "A": 0}},
+		{Year: 2015, Exposure: map[string]float64{"TotalPop": 10, "A": 4}, People: map[string]float64{"TotalPop": 10, "A": 2}},
+	}
+	if y := exposureTrends(years, "TotalPop")["A"].MaxDisparityYear; y != 2015 {
+		t.Errorf("got maximum disparity in %d, want 2015", y)
+	}
+}
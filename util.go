@@ -1,31 +1,285 @@
 package main
 
 import (
+	"context"
 	"github.com/BurntSushi/toml"
 	"github.com/evookelj/inmap/emissions/slca/eieio"
 	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
-	"github.com/evookelj/inmap/epi"
+	"github.com/pkg/errors"
 	"gonum.org/v1/gonum/mat"
+	"log"
 	"os"
+	"strings"
 )
 
-var CONFIG = os.ExpandEnv("${INMAP_SANDBOX_ROOT}/data/my_config.toml")
+// CONFIG is the path of the config file; see configFile.
+var CONFIG = configFile()
 
-func getEIOServer() (*eieio.Server, error) {
-	f, err := os.Open(CONFIG)
+// sandboxConfig holds settings specific to this sandbox, read from the
+// [Sandbox] table of CONFIG.
+type sandboxConfig struct {
+	// Labels overrides the human-readable names of demographics and
+	// census populations, keyed by demograph key (e.g. "decile:LowestTen")
+	// or population column (e.g. "WhiteNoLat").
+	Labels map[string]string
+
+	// Year is the analysis year of commands and scenarios that don't give
+	// one. It must be one of the Years in the [Config] table, and defaults
+	// to the latest of them.
+	Year int32
+
+	// DemandStates restricts the final demand of every scenario to the
+	// portion consumed in the listed states (postal abbreviations, e.g.
+	// "CA"). Leave empty to use national demand.
+	DemandStates []string
+
+	// DemandStateSharesFile is the path to a CSV file with columns
+	// State,Commodity,Share giving each state's share of national final
+	// demand. A Commodity of "*" applies the share to all commodities
+	// without a more specific entry. Required if DemandStates is set.
+	DemandStateSharesFile string
+
+	// ReceptorRegion, if File is set, also reports each scenario's exposure
+	// in the grid cells whose centroids are within the given region, rather
+	// than the whole domain, in receptor_exposure.csv.
+	ReceptorRegion regionConfig
+
+	// Nonattainment, if File is set, holds the polygons of the NAAQS
+	// nonattainment areas, and each scenario's exposure is also reported
+	// separately for the grid cells within them and the rest of the domain.
+	Nonattainment regionConfig
+
+	// EmitterRegions, if File is set, attributes each scenario's exposure
+	// to the regions (named by Field) where the responsible emissions
+	// occur, in exposure_by_emitter_region.csv.
+	EmitterRegions regionConfig
+
+	// Inventory, if File is set, is an emissions inventory such as the
+	// NEI, whose exposure scenarios with Inventory set calculate for
+	// comparison with that of EIO-derived emissions.
+	Inventory inventoryConfig
+
+	// ExposureWeights, if set, also calculates a composite exposure index
+	// for scenarios without ExposureWeights of their own: the weighted sum
+	// of the concentrations of the given pollutants (PNH4, PNO3, PSO4, SOA,
+	// PrimaryPM25 or TotalPM25), e.g. to apply toxicity weights to PM2.5
+	// species.
+	ExposureWeights map[string]float64
+
+	// MissingCES is what to do when CES data is unavailable for a
+	// demographic and year: "fail" (the default) stops with an error,
+	// "skip" warns and reports NaN results for the demographic, and
+	// "nearest" uses the nearest year with data.
+	MissingCES string
+
+	// TraceFile, if set, is where to write a trace of every EIEIO call in
+	// the Chrome trace event format, for viewing at chrome://tracing.
+	TraceFile string
+
+	// ExposureFunction is the exposure function used to weight
+	// concentrations, such as "loglinear" or "threshold:2.4"; see
+	// exposureFunction. The default is linear.
+	ExposureFunction string
+
+	// Background, if set, is a background PM2.5 concentration subtracted
+	// from modeled concentrations before calculating exposure and health
+	// impacts.
+	Background backgroundConfig
+
+	// Subdomain, if File is set, restricts exposure and gridded outputs to
+	// the grid cells within a region, such as one state, for quick runs
+	// before analyzing the whole domain. Gridded outputs are indexed by
+	// subdomain cell; see subdomain.
+	Subdomain regionConfig
+
+	// AgeMortality, if File is set, also calculates health impacts by age
+	// group, using baseline mortality by age, along with life-years lost.
+	AgeMortality ageMortalityConfig
+
+	// HRIntervals gives the confidence intervals of hazard ratio
+	// functions, by name, for reporting health impacts with uncertainty
+	// ranges.
+	HRIntervals map[string]hrIntervalConfig
+
+	// EmissionFactors, if File is set, overrides the emission factors of
+	// SCCs, scaling their emissions and the concentrations they cause;
+	// see emissionFactorConfig.
+	EmissionFactors emissionFactorConfig
+
+	// CESWeights, if File is set, weights the CES population counts and
+	// consumption of demographics by survey sample weights; see
+	// cesWeightConfig.
+	CESWeights cesWeightConfig
+
+	// Temporal, if File is set, gives monthly emission profiles for
+	// calculating exposure by month or season; see temporalConfig.
+	Temporal temporalConfig
+
+	// TimeActivity, if HomeFraction is set, weights the residential
+	// exposure of census populations by their time at home; see
+	// timeActivityConfig.
+	TimeActivity timeActivityConfig
+
+	// Populations defines population groups, by name, as expressions over
+	// census populations, e.g. "Poverty & Under18", which are included in
+	// exposure analyses along with the census populations; see
+	// derivedPopulation.
+	Populations map[string]string
+
+	// Suppression, if MinPopulation is set, suppresses or rounds small
+	// population counts in outputs combining demographics with fine
+	// geography; see suppressionConfig.
+	Suppression suppressionConfig
+
+	// Server holds settings of the server commands that are applied
+	// without restarting when the config changes; see serverConfig.
+	Server serverConfig
+
+	// Tracing, if configured, exports OpenTelemetry traces of each pipeline
+	// stage and EIEIO call to Jaeger.
+	Tracing tracingConfig
+
+	// Profiles are named analysis presets, run with `batch -profile NAME`.
+	Profiles map[string]profileConfig
+
+	// APIKeys, if any are set, are the keys that requests to the server
+	// commands must carry, by the name of their holder; see apiKeyConfig.
+	APIKeys map[string]apiKeyConfig
+
+	// Deflator is the price index that expresses consumption in constant
+	// dollars of its BaseYear; see deflatorConfig. Defaults to the
+	// built-in CPI-U.
+	Deflator deflatorConfig
+
+	// NonFinite is what to do when a pipeline stage produces NaN or
+	// infinite values: "fail" (the default) stops with an error naming the
+	// stage and entries, and "zero" replaces them with zero and warns.
+	NonFinite string
+}
+
+type config struct {
+	eieio.ServerConfig
+	Sandbox sandboxConfig
+}
+
+// readConfig reads CONFIG, if set, and applies any settings from the
+// environment, whose names are returned.
+func readConfig() (*config, []string, error) {
+	var cfg config
+	if CONFIG != "" {
+		f, err := os.Open(CONFIG)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		if _, err = toml.DecodeReader(f, &cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+	envVars, err := applyEnv(&cfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer f.Close()
+	return &cfg, envVars, nil
+}
 
-	var cfg eieio.ServerConfig
-	_, err = toml.DecodeReader(f, &cfg)
+func getEIOServer() (*eieio.Server, *sandboxConfig, error) {
+	cfg, envVars, err := readConfig()
 	if err != nil {
-		return nil, err
+		return nil, nil, withKind(kindConfig, err)
+	}
+	if len(envVars) > 0 {
+		log.Printf("Config settings from the environment: %s", strings.Join(envVars, ", "))
+	}
+	if len(cfg.Config.Years) == 0 {
+		for _, y := range defaultYears {
+			cfg.Config.Years = append(cfg.Config.Years, eieio.Year(y))
+		}
+	}
+	if y := cfg.Sandbox.Year; y != 0 {
+		configured := false
+		for _, cy := range cfg.Config.Years {
+			configured = configured || int32(cy) == y
+		}
+		if !configured {
+			return nil, nil, errorf(kindConfig, "the Year %d in [Sandbox] is not one of the Years in [Config]", y)
+		}
+	}
+	labels.override(cfg.Sandbox.Labels)
+	if err := setMissingCES(cfg.Sandbox.MissingCES); err != nil {
+		return nil, nil, err
+	}
+	cfg.Sandbox.CESWeights.File = os.ExpandEnv(cfg.Sandbox.CESWeights.File)
+	if err := setCESWeights(cfg.Sandbox.CESWeights); err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.Sandbox.Suppression.check(); err != nil {
+		return nil, nil, err
+	}
+	suppression = cfg.Sandbox.Suppression
+	if err := cfg.Sandbox.TimeActivity.check(); err != nil {
+		return nil, nil, err
+	}
+	timeActivity = cfg.Sandbox.TimeActivity
+	if err := setNonFinitePolicy(cfg.Sandbox.NonFinite); err != nil {
+		return nil, nil, err
+	}
+	cfg.Sandbox.Deflator.File = os.ExpandEnv(cfg.Sandbox.Deflator.File)
+	if err := setDeflator(cfg.Sandbox.Deflator); err != nil {
+		return nil, nil, err
+	}
+	censusPops := append(append([]string{}, cfg.SpatialEIO.CSTConfig.CensusPopColumns...), cfg.SpatialEIO.CSTConfig.CensusIncomeDecileNames...)
+	if err := setDerivedPopulations(cfg.Sandbox.Populations, censusPops); err != nil {
+		return nil, nil, err
+	}
+	demandStates = cfg.Sandbox.DemandStates
+	demandStateSharesFile = os.ExpandEnv(cfg.Sandbox.DemandStateSharesFile)
+	cfg.Sandbox.ReceptorRegion.File = os.ExpandEnv(cfg.Sandbox.ReceptorRegion.File)
+	receptorRegion = cfg.Sandbox.ReceptorRegion
+	cfg.Sandbox.EmitterRegions.File = os.ExpandEnv(cfg.Sandbox.EmitterRegions.File)
+	emitterRegions = cfg.Sandbox.EmitterRegions
+	cfg.Sandbox.Nonattainment.File = os.ExpandEnv(cfg.Sandbox.Nonattainment.File)
+	nonattainmentConfig = cfg.Sandbox.Nonattainment
+	cfg.Sandbox.Inventory.File = os.ExpandEnv(cfg.Sandbox.Inventory.File)
+	inventorySetting = cfg.Sandbox.Inventory
+	exposureWeightsSetting = cfg.Sandbox.ExposureWeights
+	cfg.Sandbox.Subdomain.File = os.ExpandEnv(cfg.Sandbox.Subdomain.File)
+	subdomainConfig = cfg.Sandbox.Subdomain
+	backgroundSetting = cfg.Sandbox.Background
+	backgroundSetting.File = os.ExpandEnv(backgroundSetting.File)
+	emissionFactorSetting = cfg.Sandbox.EmissionFactors
+	emissionFactorSetting.File = os.ExpandEnv(emissionFactorSetting.File)
+	temporalSetting = cfg.Sandbox.Temporal
+	temporalSetting.File = os.ExpandEnv(temporalSetting.File)
+	cesDataDir = os.ExpandEnv(cfg.CESDataDir)
+	useDetailFile = os.ExpandEnv(cfg.Config.UseDetail)
+	ageMortality = cfg.Sandbox.AgeMortality
+	ageMortality.File = os.ExpandEnv(ageMortality.File)
+	timings.traceFile = os.ExpandEnv(cfg.Sandbox.TraceFile)
+	if err := initTracing(cfg.Sandbox.Tracing); err != nil {
+		return nil, nil, withKind(kindConfig, errors.Wrap(err, "error starting tracing"))
 	}
-	cfg.Config.Years = []eieio.Year{2003, 2004, 2005, 2006, 2007, 2008, 2009, 2010, 2011, 2012, 2013, 2014, 2015}
 
-	return eieio.NewServer(&cfg, "", epi.NasariACS)
+	if err := registerHRIntervals(cfg.Sandbox.HRIntervals); err != nil {
+		return nil, nil, err
+	}
+	if defaultExposureFunction, err = parseExposureFunction(cfg.Sandbox.ExposureFunction); err != nil {
+		return nil, nil, err
+	}
+	if configFingerprint, err = configSpec(envVars); err != nil {
+		return nil, nil, err
+	}
+	_, span := startSpan(context.Background(), "NewServer")
+	s, err := eieio.NewServer(&cfg.ServerConfig, "", hazardRatios...)
+	span.End()
+	if err != nil {
+		// Missing input files are classified by kindOf.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		return nil, nil, withKind(kindConfig, err)
+	}
+	return s, &cfg.Sandbox, nil
 }
 
 func array2vec(d []float64) *mat.VecDense {
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"path/filepath"
+	"strconv"
+)
+
+// valuationConfig specifies how attributable deaths are valued in dollars.
+type valuationConfig struct {
+	// VSL is the value of a statistical life in dollars in BaseYear.
+	// If zero, damages are not calculated.
+	VSL float64
+
+	// BaseYear is the year VSL is expressed in. Defaults to
+	// defaultYear.
+	BaseYear int32
+
+	// Growth is the annual fractional growth in VSL, e.g. from real
+	// income growth, used to adjust VSL to other years.
+	Growth float64
+
+	// Morbidity is the cost of illness, as a fraction of mortality costs,
+	// added to the value of each attributable death.
+	Morbidity float64
+}
+
+// value returns the dollar damages per attributable death in year,
+// including morbidity costs.
+func (v valuationConfig) value(year int32) float64 {
+	base := v.BaseYear
+	if base == 0 {
+		base = int32(defaultYear())
+	}
+	vsl := v.VSL * math.Pow(1+v.Growth, float64(year-base))
+	return vsl * (1 + v.Morbidity)
+}
+
+// pm25Species are the PM2.5 species that make up TotalPM25.
+var pm25Species = []eieiorpc.Pollutant{
+	eieiorpc.Pollutant_PNH4,
+	eieiorpc.Pollutant_PNO3,
+	eieiorpc.Pollutant_PSO4,
+	eieiorpc.Pollutant_SOA,
+	eieiorpc.Pollutant_PrimaryPM25,
+}
+
+// totalHealth returns the total attributable deaths of pop caused by demand,
+// counting only PM2.5 above the background concentration of ctx.
+func totalHealth(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, pol eieiorpc.Pollutant, pop string, year int32, hr, aqm string) (float64, error) {
+	ctx, span := startSpan(ctx, "totalHealth")
+	defer span.End()
+	emitters, err := emitterMask(s, nil)
+	if err != nil {
+		return 0, err
+	}
+	done := timeRPC(ctx, "Health")
+	deaths, err := s.SpatialEIO.Health(ctx, &eieiorpc.HealthInput{
+		Demand:      demand,
+		EmitterMask: emitters,
+		Pollutant:   pol,
+		Population:  pop,
+		Year:        year,
+		Location:    LOC,
+		HR:          hr,
+		AQM:         aqm,
+	})
+	done(&err)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error calculating %s health impacts for %s", pol, pop)
+	}
+	weights, err := backgroundWeights(ctx, s, demand, year, aqm)
+	if err != nil {
+		return 0, err
+	}
+	cellDeaths, err := scaleByCell(deaths.Data, weights)
+	if err != nil {
+		return 0, err
+	}
+	if allFinite(demand.Data) {
+		if err := checkFinite(ctx, fmt.Sprintf("%s deaths of %s", pol, pop), cellDeaths, indexLabel("cell")); err != nil {
+			return 0, err
+		}
+	}
+	var total float64
+	for _, v := range cellDeaths {
+		total += v
+	}
+	return total, nil
+}
+
+// deathsBySCC returns the deaths of the total population attributable to
+// the PM2.5 caused by demand, by emitting SCC, counting only PM2.5 above
+// the background concentration of ctx.
+func deathsBySCC(ctx context.Context, s *eieio.Server, demand *eieiorpc.Vector, year int32, hr, aqm string) ([]float64, error) {
+	health, err := healthMatrix(ctx, s, &eieiorpc.HealthMatrixInput{
+		Demand:     demand,
+		Pollutant:  eieiorpc.Pollutant_TotalPM25,
+		Population: s.CSTConfig.CensusTotalPopColumn,
+		Year:       year,
+		Location:   LOC,
+		HR:         hr,
+		AQM:        aqm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := filterSCCColumns(s, health); err != nil {
+		return nil, err
+	}
+	weights, err := backgroundWeights(ctx, s, demand, year, aqm)
+	if err != nil {
+		return nil, err
+	}
+	if r, _ := health.Dims(); weights != nil && r != len(weights) {
+		return nil, errorf(kindNumeric, "expected health impacts in %d grid cells, got %d", len(weights), r)
+	}
+	deaths := make([]float64, len(s.SCCs))
+	for j := range deaths {
+		for i, col := 0, health.ColView(j); i < col.Len(); i++ {
+			if weights != nil {
+				deaths[j] += col.AtVec(i) * weights[i]
+			} else {
+				deaths[j] += col.AtVec(i)
+			}
+		}
+	}
+	if allFinite(demand.Data) {
+		if err := checkFinite(ctx, "deaths by SCC", deaths, sccLabel(s)); err != nil {
+			return nil, err
+		}
+	}
+	return deaths, nil
+}
+
+// demAndDeaths returns a matrix of the deaths of the total population
+// attributable to each demographic's consumption (rows, in the order of
+// dems) by emitting SCC (columns, as s.SCCs): the deaths analogue of
+// demAndEmissions. Deaths are not population-adjusted, so each row sums
+// to the demographic's total attributable deaths. multipliers optionally
+// scales each commodity's demand; see getDemographicDemand.
+func demAndDeaths(ctx context.Context, s *eieio.Server, dems []*eieiorpc.Demograph, year int32, hr, aqm string, multipliers []float64) (*mat.Dense, error) {
+	ctx, span := startSpan(ctx, "demAndDeaths")
+	defer span.End()
+	deaths := mat.NewDense(len(dems), len(s.SCCs), nil)
+	for demIdx, dem := range dems {
+		params := []interface{}{year, hr, aqm, hashFloats(multipliers), backgroundFor(ctx)}
+		bySCC, err := cachedDemographic(ctx, "deaths", dem, params, func(ctx context.Context) ([]float64, error) {
+			demand, err := getDemographicDemand(ctx, s, dem, year, multipliers)
+			if err != nil {
+				return nil, errors.Wrap(err, "error getting consumption")
+			}
+			bySCC, err := deathsBySCC(ctx, s, demand, year, hr, aqm)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error calculating health impacts of %s", labels.demograph(dem))
+			}
+			return bySCC, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(bySCC) != len(s.SCCs) {
+			return nil, errorf(kindNumeric, "expected deaths for %d SCCs, got %d", len(s.SCCs), len(bySCC))
+		}
+		deaths.SetRow(demIdx, bySCC)
+		reportProgress(ctx, Progress{
+			Stage:       "deaths by demographic",
+			Year:        year,
+			Demographic: demographKey(dem),
+			Percent:     100 * float64(demIdx+1) / float64(len(dems)),
+		})
+	}
+	return deaths, nil
+}
+
+// writeDamages values the health impacts of sc in dollars and writes them
+// to dir: by population and pollutant, total PM2.5 and each of its
+// species (damages.csv), by emitting sector
+// (damages_by_sector.csv) and, if dems is non-empty, by consuming
+// demographic (damages_by_demographic.csv). It returns total PM2.5
+// damages by population.
+func writeDamages(ctx context.Context, s *eieio.Server, sc *scenario, demand *eieiorpc.Vector, dems []*eieiorpc.Demograph, multipliers []float64, dir string) (map[string]float64, error) {
+	ctx, span := startSpan(ctx, "writeDamages")
+	defer span.End()
+	value := sc.Valuation.value(sc.Year)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, errorf(kindConfig, "the value of a statistical life in %d is %g; check [Scenario.Valuation]", sc.Year, value)
+	}
+	vslYear := strconv.Itoa(int(sc.Year))
+
+	// Total damages are those of the deaths from total PM2.5, as in
+	// health.csv. As hazard ratios are nonlinear, the deaths from each
+	// species are only a breakdown, and needn't sum to the total.
+	damages := make(map[string]float64)
+	var rows [][]string
+	for _, popName := range s.CSTConfig.CensusPopColumns {
+		for _, pol := range append([]eieiorpc.Pollutant{eieiorpc.Pollutant_TotalPM25}, pm25Species...) {
+			deaths, err := totalHealthInterval(ctx, s, demand, pol, popName, sc.Year, sc.HR, sc.AQM)
+			if err != nil {
+				return nil, err
+			}
+			if pol == eieiorpc.Pollutant_TotalPM25 {
+				damages[popName] = deaths[0] * value
+			}
+			row := append([]string{popName, labels.get(popName), pol.String(), vslYear}, formatFloats(deaths, 1)...)
+			rows = append(rows, append(row, formatFloats(deaths, value)...))
+		}
+	}
+	header := append([]string{"Population", "Label", "Pollutant", "Year"}, intervalHeader(sc.HR, "Deaths", "Damages")...)
+	if err := writeCSV(filepath.Join(dir, "damages.csv"), header, rows); err != nil {
+		return nil, err
+	}
+
+	totalPop := s.CSTConfig.CensusTotalPopColumn
+	bySCC, err := deathsBySCC(ctx, s, demand, sc.Year, sc.HR, sc.AQM)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calculating health impacts by sector")
+	}
+	rows = rows[:0]
+	for j, deaths := range bySCC {
+		if deaths == 0 {
+			continue
+		}
+		rows = append(rows, []string{string(s.SCCs[j]), vslYear, formatFloat(deaths), formatFloat(deaths * value)})
+	}
+	if err := writeCSV(filepath.Join(dir, "damages_by_sector.csv"), []string{"SCC", "Year", "Deaths", "Damages"}, rows); err != nil {
+		return nil, err
+	}
+
+	if len(dems) > 0 {
+		rows = rows[:0]
+		for _, dem := range dems {
+			params := []interface{}{sc.Year, sc.HR, sc.AQM, hashFloats(multipliers), backgroundFor(ctx)}
+			deaths, err := cachedDemographic(ctx, "damages", dem, params, func(ctx context.Context) ([]float64, error) {
+				demDemand, err := getDemographicDemand(ctx, s, dem, sc.Year, multipliers)
+				if err != nil {
+					return nil, err
+				}
+				return totalHealthInterval(ctx, s, demDemand, eieiorpc.Pollutant_TotalPM25, totalPop, sc.Year, sc.HR, sc.AQM)
+			})
+			if err != nil {
+				return nil, err
+			}
+			row := append([]string{demographKey(dem), labels.demograph(dem), vslYear}, formatFloats(deaths, 1)...)
+			rows = append(rows, append(row, formatFloats(deaths, value)...))
+		}
+		header := append([]string{"Demographic", "Label", "Year"}, intervalHeader(sc.HR, "Deaths", "Damages")...)
+		if err := writeCSV(filepath.Join(dir, "damages_by_demographic.csv"), header, rows); err != nil {
+			return nil, err
+		}
+	}
+	return damages, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/evookelj/inmap/emissions/slca/eieio/eieiorpc"
+	"github.com/pkg/errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// standardDemographics are the demographics whose results are warmed by
+// default: the CES income deciles and ethnicities.
+const standardDemographics = "decile,ethnicity"
+
+// warmTarget is a year and, unless it is nil for total final demand, a
+// demographic whose concentrations are warmed.
+type warmTarget struct {
+	year int32
+	dem  *eieiorpc.Demograph
+}
+
+// String describes t, for logging.
+func (t warmTarget) String() string {
+	if t.dem == nil {
+		return Year(t.year).String() + " total demand"
+	}
+	return Year(t.year).String() + " " + demographKey(t.dem)
+}
+
+// warmTargets returns the total final demand and each of the demographics
+// of keys, a comma-separated list of demograph keys or groups, for each
+// year configured in s.
+func warmTargets(ctx context.Context, s *eieio.Server, keys string) ([]warmTarget, error) {
+	var dems []*eieiorpc.Demograph
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		d, err := parseDemographs(key)
+		if err != nil {
+			return nil, err
+		}
+		dems = append(dems, d...)
+	}
+	years, err := s.Years(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var targets []warmTarget
+	for _, year := range years.Years {
+		targets = append(targets, warmTarget{year: year})
+		for _, dem := range dems {
+			targets = append(targets, warmTarget{year: year, dem: dem})
+		}
+	}
+	return targets, nil
+}
+
+// warmCache calculates the total PM2.5 concentrations caused by each of
+// targets with the air quality model aqm, so that the EIEIO caches hold
+// the concentration factors of each year, the slowest part of a first
+// request, and the concentrations of the most common requests. Each target
+// is calculated as a request of pool, so that warming shares its
+// parallelism with the requests being answered. Targets that fail, such as
+// demographics without CES data for a year, are logged and skipped. It
+// returns early if ctx is cancelled.
+func warmCache(ctx context.Context, pool *serverPool, targets []warmTarget, aqm string) {
+	ctx, span := startSpan(ctx, "warmCache")
+	defer span.End()
+	start := time.Now()
+	var warmed int
+	for i, t := range targets {
+		if ctx.Err() != nil {
+			log.Printf("Warm: cancelled after %d of %d", i, len(targets))
+			return
+		}
+		err := pool.do(ctx, func(ctx context.Context, s *eieio.Server) error {
+			return warmTargetCache(ctx, s, t, aqm)
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Warm: skipping %s: %v", t, err)
+			}
+			continue
+		}
+		warmed++
+		log.Printf("Warm: cached %s (%d of %d)", t, i+1, len(targets))
+	}
+	log.Printf("Warm: cached %d of %d year and demographic concentrations in %s", warmed, len(targets), time.Since(start).Round(time.Second))
+}
+
+// warmTargetCache calculates the total PM2.5 concentrations caused by t.
+func warmTargetCache(ctx context.Context, s *eieio.Server, t warmTarget, aqm string) error {
+	var demand *eieiorpc.Vector
+	var err error
+	if t.dem == nil {
+		demand, _, err = modelDemand(ctx, s, eieiorpc.FinalDemandType_AllDemand.String(), t.year)
+	} else {
+		demand, err = getDemographicDemand(ctx, s, t.dem, t.year, nil)
+	}
+	if err != nil {
+		return errors.Wrap(err, "calculating final demand")
+	}
+	if !allFinite(demand.Data) {
+		return errorf(kindDataMissing, "no CES data")
+	}
+	_, err = getConcentrations(ctx, s, &eieiorpc.ConcentrationInput{
+		Demand:    demand,
+		Pollutant: eieiorpc.Pollutant_TotalPM25,
+		Year:      t.year,
+		Location:  LOC,
+		AQM:       aqm,
+	})
+	return err
+}
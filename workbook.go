@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/tealeg/xlsx"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// table is a result table with a header row, as written by writeCSV.
+type table struct {
+	Name   string
+	Header []string
+	Rows   [][]string
+}
+
+// writeWorkbook writes each table to its own sheet of an Excel workbook at
+// path. Header rows are bold and frozen, and numeric values are written as
+// numbers.
+func writeWorkbook(path string, tables []table) error {
+	headerStyle := xlsx.NewStyle()
+	headerStyle.Font.Bold = true
+	headerStyle.ApplyFont = true
+
+	f := xlsx.NewFile()
+	for _, t := range tables {
+		sheet, err := f.AddSheet(t.Name)
+		if err != nil {
+			return fmt.Errorf("adding sheet %s: %v", t.Name, err)
+		}
+		sheet.SheetViews = []xlsx.SheetView{{Pane: &xlsx.Pane{
+			YSplit:      1,
+			TopLeftCell: "A2",
+			ActivePane:  "bottomLeft",
+			State:       "frozen",
+		}}}
+		row := sheet.AddRow()
+		for _, h := range t.Header {
+			c := row.AddCell()
+			c.SetString(h)
+			c.SetStyle(headerStyle)
+		}
+		for _, r := range t.Rows {
+			row := sheet.AddRow()
+			for _, v := range r {
+				c := row.AddCell()
+				if num, err := strconv.ParseFloat(v, 64); err == nil {
+					c.SetFloat(num)
+				} else {
+					c.SetString(v)
+				}
+			}
+		}
+		if len(t.Header) > 0 {
+			sheet.SetColWidth(0, len(t.Header)-1, 20)
+		}
+	}
+	return f.Save(path)
+}
+
+// topSectorsCount is the number of sectors listed in the workbook.
+const topSectorsCount = 25
+
+// sectorShare is the emissions of an SCC and their share of the total.
+type sectorShare struct {
+	SCC       string
+	Emissions float64
+	Share     float64
+}
+
+// topSectors returns the n SCCs of s with the greatest emissions emis,
+// in decreasing order, leaving out those with none.
+func topSectors(s *eieio.Server, emis []float64, n int) []sectorShare {
+	order := make([]int, len(emis))
+	var total float64
+	for i, v := range emis {
+		order[i] = i
+		total += v
+	}
+	sort.Slice(order, func(i, j int) bool { return emis[order[i]] > emis[order[j]] })
+	var sectors []sectorShare
+	for _, i := range order {
+		if len(sectors) == n || emis[i] <= 0 {
+			break
+		}
+		sectors = append(sectors, sectorShare{SCC: string(s.SCCs[i]), Emissions: emis[i], Share: emis[i] / total})
+	}
+	return sectors
+}
+
+// scenarioWorkbookTables returns the tables of the results workbook for a
+// scenario: a summary, exposure by population, the sectors with the
+// greatest emissions, exposure disparities and run metadata.
+func scenarioWorkbookTables(s *eieio.Server, sc *scenario, demandEmis []float64, r *scenarioResult) []table {
+	totalPop := s.CSTConfig.CensusTotalPopColumn
+
+	summary := table{Name: "Summary", Header: []string{"Metric", "Value"}}
+	for name, v := range summaryMetrics(r, totalPop) {
+		summary.Rows = append(summary.Rows, []string{name, formatFloat(v)})
+	}
+	sort.Slice(summary.Rows, func(i, j int) bool { return summary.Rows[i][0] < summary.Rows[j][0] })
+
+	exposure := table{Name: "Exposure", Header: []string{"Population", "Label", "Exposure"}}
+	disparity := table{Name: "Disparity", Header: []string{"Population", "Label", "Exposure", "RatioToTotal", "DifferenceFromTotal"}}
+	for _, popName := range sortedKeys(r.Exposure) {
+		v := r.Exposure[popName]
+		exposure.Rows = append(exposure.Rows, []string{popName, labels.get(popName), formatFloat(v)})
+		if total, ok := r.Exposure[totalPop]; ok && popName != totalPop && total != 0 {
+			disparity.Rows = append(disparity.Rows, []string{popName, labels.get(popName), formatFloat(v), formatFloat(v / total), formatFloat(v - total)})
+		}
+	}
+
+	sectors := table{Name: "Top sectors", Header: []string{"Rank", "SCC", "Emissions"}}
+	for rank, sector := range topSectors(s, demandEmis, topSectorsCount) {
+		sectors.Rows = append(sectors.Rows, []string{strconv.Itoa(rank + 1), sector.SCC, formatFloat(sector.Emissions)})
+	}
+
+	metadata := table{Name: "Metadata", Header: []string{"Field", "Value"}, Rows: [][]string{
+		{"Scenario", sc.Name},
+		{"Year", strconv.Itoa(int(sc.Year))},
+		{"FinalDemandType", sc.FinalDemandType},
+		{"AQM", sc.AQM},
+		{"HR", sc.HR},
+		{"Location", LOC.String()},
+		{"MissingCES", string(missingCES)},
+		{"Generated", time.Now().Format(time.RFC3339)},
+	}}
+	for _, note := range r.MissingCES {
+		metadata.Rows = append(metadata.Rows, []string{"CESNote", note})
+	}
+
+	tables := []table{summary, exposure}
+	if len(r.Contribution) > 0 {
+		contribution := table{Name: "Contribution", Header: []string{"Demographic", "Label", "Emissions"}}
+		for _, key := range sortedKeys(r.Contribution) {
+			contribution.Rows = append(contribution.Rows, []string{key, labels.get(key), formatFloat(r.Contribution[key])})
+		}
+		tables = append(tables, contribution)
+	}
+	return append(tables, sectors, disparity, metadata)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
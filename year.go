@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/evookelj/inmap/emissions/slca/eieio"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Year is an analysis year. Results for years without EIO or CES data are
+// silently wrong rather than errors in the upstream model, so years
+// supplied by users should be checked with validate or parsed with
+// parseYear.
+type Year int32
+
+// defaultYears are the analysis years used if the Years setting in the
+// [Config] table of CONFIG is empty: those covered by the IO tables and CES
+// data shipped with INMAP.
+var defaultYears = []Year{2003, 2004, 2005, 2006, 2007, 2008, 2009, 2010, 2011, 2012, 2013, 2014, 2015}
+
+var (
+	configuredYearsOnce sync.Once
+	configuredYearsList []Year
+	configuredYearsErr  error
+
+	// configuredYearSetting is the Year setting in the [Sandbox] table of
+	// CONFIG, read with configuredYearsList.
+	configuredYearSetting int32
+)
+
+// configuredYears returns the analysis years loaded by getEIOServer: the
+// Years setting in the [Config] table of CONFIG, or defaultYears. The
+// config is only read once, so that years can be checked while parsing
+// flags, before the EIEIO server is created.
+func configuredYears() ([]Year, error) {
+	configuredYearsOnce.Do(func() {
+		cfg, _, err := readConfig()
+		if err != nil {
+			configuredYearsErr = errors.Wrap(err, "reading configured years")
+			return
+		}
+		for _, y := range cfg.Config.Years {
+			configuredYearsList = append(configuredYearsList, Year(y))
+		}
+		if len(configuredYearsList) == 0 {
+			configuredYearsList = defaultYears
+		}
+		configuredYearSetting = cfg.Sandbox.Year
+	})
+	return configuredYearsList, configuredYearsErr
+}
+
+// defaultYear returns the analysis year of commands and scenarios that
+// don't give one: the Year setting in the [Sandbox] table of CONFIG or,
+// if it isn't set, the latest of configuredYears. Unlike parseYear, it
+// never fails, so it can give flag defaults: a config that can't be read
+// or a Year that isn't configured is reported by getEIOServer.
+func defaultYear() Year {
+	years, err := configuredYears()
+	if err != nil {
+		years = defaultYears
+	}
+	return pickDefaultYear(years, configuredYearSetting)
+}
+
+// pickDefaultYear returns setting if it is one of years, or else the
+// latest of years.
+func pickDefaultYear(years []Year, setting int32) Year {
+	var latest Year
+	for _, y := range years {
+		if int32(y) == setting {
+			return y
+		}
+		if y > latest {
+			latest = y
+		}
+	}
+	return latest
+}
+
+// parseYear returns y as a Year if it is one of configuredYears.
+func parseYear(y int) (Year, error) {
+	years, err := configuredYears()
+	if err != nil {
+		return 0, err
+	}
+	valid := make([]string, len(years))
+	for i, cy := range years {
+		if int(cy) == y {
+			return cy, nil
+		}
+		valid[i] = cy.String()
+	}
+	return 0, errorf(kindConfig, "year %d is not configured; valid years are %s (set Years in the [Config] table of the config file)", y, strings.Join(valid, ", "))
+}
+
+// validate returns an error if y is not one of the years configured in s.
+func (y Year) validate(ctx context.Context, s *eieio.Server) error {
+	years, err := s.Years(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, sy := range years.Years {
+		if sy == int32(y) {
+			return nil
+		}
+	}
+	return errorf(kindConfig, "year %d is not configured in the EIO server", y)
+}
+
+// String implements fmt.Stringer and flag.Value.
+func (y Year) String() string { return strconv.Itoa(int(y)) }
+
+// Set implements flag.Value.
+func (y *Year) Set(v string) error {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return errorf(kindConfig, "invalid year %q", v)
+	}
+	*y, err = parseYear(i)
+	return err
+}
+
+// yearFlag defines a Year flag in fs, which is checked against
+// configuredYears when parsed.
+func yearFlag(fs *flag.FlagSet, name string, value Year, usage string) *Year {
+	y := value
+	fs.Var(&y, name, usage)
+	return &y
+}
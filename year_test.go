@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPickDefaultYear(t *testing.T) {
+	years := []Year{2014, 2016, 2015}
+	for _, test := range []struct {
+		setting int32
+		want    Year
+	}{
+		{0, 2016},
+		{2014, 2014},
+		{2017, 2016},
+	} {
+		if y := pickDefaultYear(years, test.setting); y != test.want {
+			t.Errorf("Year %d: got %d, want %d", test.setting, y, test.want)
+		}
+	}
+}